@@ -0,0 +1,495 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// External programs (players, viewers, --run programs and hook
+// programs) are given as command lines, e.g.
+//
+//     mpv --start={{.Position}} --title={{.Title}} -- {{.URL}}
+//
+// A command line is a text/template that's executed with a
+// commandData and then split into words the way a shell would,
+// respecting quotes and backslashes. Nothing is run by a shell,
+// so there's no globbing or variable expansion. Commands that
+// don't use templates keep working as before: the URL that
+// they act on, if any, is added as the last argument.
+//
+// Like html/template, command templates escape every value
+// they insert, according to whether it's in single quotes,
+// double quotes or neither. A value can't add words to the
+// command, however it's quoted, so titles and GUIDs taken from
+// feeds can't inject arguments. The shellquote function is for
+// values that are passed on to a shell, e.g. by sh -c.
+//
+// URLs are only opened if they're http, https or file URLs,
+// which also means that they can't be mistaken for options.
+
+// commandData is what command templates can refer to. Fields
+// that don't apply, e.g. item fields in a feed command, are
+// left empty.
+type commandData struct {
+	// URL is the URL that the command acts on.
+	URL string
+	// Title is the item's title, or the feed's title for
+	// commands that act on feeds.
+	Title    string
+	ID       int64
+	GUID     string
+	Pubdate  time.Time
+	Duration int64
+	// Position is where playback starts, in seconds.
+	Position  int64
+	FeedID    int64
+	FeedTitle string
+	FeedURL   string
+	// Event, ItemCount and Error are set for hooks.
+	Event     string
+	ItemCount int
+	Error     string
+}
+
+func newItemCommandData(item itemView, position int64) *commandData {
+	return &commandData{
+		URL:       item.url,
+		Title:     item.Title,
+		ID:        item.ID,
+		GUID:      item.guid,
+		Pubdate:   item.Pubdate,
+		Duration:  item.Duration,
+		Position:  position,
+		FeedID:    item.feedID,
+		FeedTitle: item.FeedTitle,
+	}
+}
+
+// loadFeedCommandData returns the data for a command that
+// opens u, one of the URLs of the given feed.
+func loadFeedCommandData(db *sql.DB, id int64, u string) (*commandData, error) {
+
+	data := &commandData{
+		URL:    u,
+		FeedID: id,
+	}
+
+	err := db.QueryRow("SELECT title, url FROM feeds WHERE id = ?", id).Scan(&data.FeedTitle, &data.FeedURL)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errNoFeedFound
+		}
+		return nil, err
+	}
+
+	data.Title = data.FeedTitle
+	return data, nil
+}
+
+// isCommandTemplate reports whether a command line uses
+// templates.
+func isCommandTemplate(command string) bool {
+	return strings.Contains(command, "{{")
+}
+
+// parseCommand creates a command from a command line and the
+// data that it acts on, which may be nil, e.g. to check that a
+// command is valid before there's anything to run it on. Any
+// args are added after the command line's own arguments.
+func parseCommand(command string, data *commandData, args ...string) (*exec.Cmd, error) {
+
+	d := commandData{}
+	if data != nil {
+		d = *data
+	}
+
+	if d.URL != "" {
+		u, err := commandURL(d.URL)
+		if err != nil {
+			return nil, err
+		}
+		d.URL = u
+	}
+	d.FeedURL = commandURLReplacer.Replace(d.FeedURL)
+
+	text, err := expandCommand(command, &d)
+	if err != nil {
+		return nil, err
+	}
+
+	words, err := splitWords(text)
+	if err != nil {
+		return nil, errors.New("bad command: " + err.Error())
+	}
+
+	if len(words) < 1 || words[0] == "" {
+		return nil, errors.New("no command given")
+	}
+
+	exe, err := exec.LookPath(words[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return exec.Command(exe, append(words[1:], args...)...), nil
+}
+
+// parseURLCommand is parseCommand for commands that open
+// data.URL. Unless the command line is a template, the URL is
+// added as the last argument.
+func parseURLCommand(command string, data *commandData) (*exec.Cmd, error) {
+
+	if isCommandTemplate(command) {
+		return parseCommand(command, data)
+	}
+
+	return parseCommand(command, data, data.URL)
+}
+
+// expandCommand executes a command line's template.
+func expandCommand(command string, data *commandData) (string, error) {
+
+	if !isCommandTemplate(command) {
+		return command, nil
+	}
+
+	tmpl, err := template.New("command").Funcs(template.FuncMap{
+		"shellquote":       shellquote,
+		escapeUnquoted:     escapeCommandValue(shellquote),
+		escapeSingleQuoted: escapeCommandValue(singleQuoteEscaper.Replace),
+		escapeDoubleQuoted: escapeCommandValue(doubleQuoteEscaper.Replace),
+	}).Parse(command)
+	if err != nil {
+		return "", errors.New("bad command: " + err.Error())
+	}
+
+	if err := escapeCommandTemplate(tmpl); err != nil {
+		return "", errors.New("bad command: " + err.Error())
+	}
+
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", errors.New("bad command: " + err.Error())
+	}
+
+	return buf.String(), nil
+}
+
+// The functions that escapeCommandTemplate adds to actions,
+// one for each kind of quoting.
+const (
+	escapeUnquoted     = "_kibner_escape_unquoted"
+	escapeSingleQuoted = "_kibner_escape_single_quoted"
+	escapeDoubleQuoted = "_kibner_escape_double_quoted"
+)
+
+var (
+	// A single quote can't be escaped inside single quotes, so
+	// it's written as: end quote, escaped quote, start quote.
+	singleQuoteEscaper = strings.NewReplacer("'", `'\''`)
+	doubleQuoteEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+func escapeCommandValue(escape func(string) string) func(interface{}) string {
+	return func(v interface{}) string {
+		return escape(fmt.Sprint(v))
+	}
+}
+
+// escapeCommandTemplate adds an escaping function to the end
+// of every action in a command template that outputs a value.
+// Which function depends on the quotes that the action is in.
+// In unquoted text, values that are already shellquoted are
+// left alone.
+func escapeCommandTemplate(tmpl *template.Template) error {
+
+	if len(tmpl.Templates()) > 1 {
+		return errors.New("templates can't define other templates")
+	}
+
+	_, err := escapeCommandList(tmpl.Tree.Root, 0)
+	return err
+}
+
+// escapeCommandList escapes the actions in a list of template
+// nodes, given the quote (if any) that the list starts in. It
+// returns the quote that the list ends in.
+func escapeCommandList(list *parse.ListNode, quote rune) (rune, error) {
+
+	if list == nil {
+		return quote, nil
+	}
+
+	for _, node := range list.Nodes {
+
+		var err error
+
+		switch node := node.(type) {
+		case *parse.TextNode:
+			var escaped bool
+			quote, escaped = commandQuoteState(quote, string(node.Text))
+			if escaped {
+				err = errors.New("templates can't follow a backslash")
+			}
+		case *parse.ActionNode:
+			escapeCommandPipe(node.Pipe, quote)
+		case *parse.IfNode:
+			quote, err = escapeCommandBranch("if", &node.BranchNode, quote)
+		case *parse.RangeNode:
+			quote, err = escapeCommandBranch("range", &node.BranchNode, quote)
+		case *parse.WithNode:
+			quote, err = escapeCommandBranch("with", &node.BranchNode, quote)
+		case *parse.TemplateNode:
+			err = errors.New("templates can't include other templates")
+		}
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return quote, nil
+}
+
+// escapeCommandBranch escapes both parts of an if, range or
+// with action. They have to leave the quotes in the same state
+// so that what follows can be escaped properly.
+func escapeCommandBranch(name string, branch *parse.BranchNode, quote rune) (rune, error) {
+
+	q1, err := escapeCommandList(branch.List, quote)
+	if err != nil {
+		return 0, err
+	}
+
+	q2, err := escapeCommandList(branch.ElseList, quote)
+	if err != nil {
+		return 0, err
+	}
+
+	if q1 != q2 || (name == "range" && q1 != quote) {
+		return 0, errors.New("unbalanced quotes in {{" + name + "}}")
+	}
+
+	return q1, nil
+}
+
+func escapeCommandPipe(pipe *parse.PipeNode, quote rune) {
+
+	// Variable declarations don't output anything.
+	if len(pipe.Decl) > 0 {
+		return
+	}
+
+	name := escapeUnquoted
+	switch quote {
+	case '\'':
+		name = escapeSingleQuoted
+	case '"':
+		name = escapeDoubleQuoted
+	default:
+		if last := pipe.Cmds[len(pipe.Cmds)-1]; len(last.Args) > 0 {
+			if id, ok := last.Args[0].(*parse.IdentifierNode); ok && id.Ident == "shellquote" {
+				return
+			}
+		}
+	}
+
+	cmd := &parse.CommandNode{NodeType: parse.NodeCommand}
+	cmd.Args = []parse.Node{parse.NewIdentifier(name).SetTree(nil).SetPos(pipe.Position())}
+	pipe.Cmds = append(pipe.Cmds, cmd)
+}
+
+// commandQuoteState returns the quote (if any) that a command
+// line is in at the end of text, given the quote it started
+// in, and whether text ends in an unused backslash. It follows
+// the same rules as splitWords.
+func commandQuoteState(quote rune, text string) (rune, bool) {
+
+	escaped := false
+
+	for _, r := range text {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			}
+		case r == '\\':
+			escaped = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		}
+	}
+
+	return quote, escaped
+}
+
+// commandURL checks that a URL is safe to pass to a program.
+// Characters that would split the URL into several words are
+// percent-encoded so that templates don't have to quote URLs.
+// Programs given the URL as a separate argument get the
+// original.
+func commandURL(s string) (string, error) {
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", errors.New("invalid URL " + strconv.Quote(s))
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "file":
+	default:
+		return "", errors.New("refusing to open " + strconv.Quote(s) + " (only http, https and file URLs are allowed)")
+	}
+
+	return commandURLReplacer.Replace(s), nil
+}
+
+var commandURLReplacer = strings.NewReplacer(
+	" ", "%20",
+	"\t", "%09",
+	"\n", "%0A",
+	"\r", "%0D",
+	`"`, "%22",
+	"'", "%27",
+	`\`, "%5C",
+)
+
+// shellquote quotes s so that it's a single word, both for
+// kibner's command lines and for POSIX shells.
+func shellquote(s string) string {
+
+	if s == "" {
+		return "''"
+	}
+
+	safe := true
+	for _, r := range s {
+		if !isShellSafe(r) {
+			safe = false
+			break
+		}
+	}
+
+	if safe {
+		return s
+	}
+
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func isShellSafe(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	default:
+		return strings.ContainsRune("@%+=:,./_-", r)
+	}
+}
+
+// splitWords splits a command line into words. Words are
+// separated by whitespace, except in single or double quotes
+// or after a backslash. In double quotes, a backslash only
+// escapes a double quote or another backslash.
+func splitWords(s string) ([]string, error) {
+
+	var words []string
+	var word strings.Builder
+
+	inWord := false
+	var quote rune
+	escaped := false
+
+	for _, r := range s {
+
+		switch {
+		case escaped:
+			if quote == '"' && r != '"' && r != '\\' {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(r)
+			escaped = false
+
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				word.WriteRune(r)
+			}
+
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+
+		case r == '\\':
+			escaped = true
+			inWord = true
+
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	switch {
+	case escaped:
+		return nil, errors.New("trailing backslash")
+	case quote != 0:
+		return nil, errors.New("unterminated " + string(quote) + " quote")
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
+
+// joinCommand joins the words of a command line that were
+// given as separate arguments, quoting any that need it.
+// Words that contain templates are left alone because they
+// can't be quoted until they've been expanded.
+func joinCommand(words []string) string {
+
+	quoted := make([]string, len(words))
+
+	for i, w := range words {
+		if isCommandTemplate(w) {
+			quoted[i] = w
+		} else {
+			quoted[i] = shellquote(w)
+		}
+	}
+
+	return strings.Join(quoted, " ")
+}
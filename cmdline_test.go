@@ -0,0 +1,356 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitWords(t *testing.T) {
+
+	tests := []struct {
+		Input string
+		Exp   []string
+		Err   string
+	}{
+		{
+			Input: "",
+		},
+		{
+			Input: "  mpv\t--no-video  ",
+			Exp:   []string{"mpv", "--no-video"},
+		},
+		{
+			Input: `vlc --meta-title='The "Best" Episode' "it's" a\ b`,
+			Exp:   []string{"vlc", `--meta-title=The "Best" Episode`, "it's", "a b"},
+		},
+		{
+			Input: `echo "a \"b\" \c \\" '\n' ''`,
+			Exp:   []string{"echo", `a "b" \c \`, `\n`, ""},
+		},
+		{
+			Input: `echo 'it'\''s'`,
+			Exp:   []string{"echo", "it's"},
+		},
+		{
+			Input: `echo "oops`,
+			Err:   `unterminated " quote`,
+		},
+		{
+			Input: `echo 'oops`,
+			Err:   `unterminated ' quote`,
+		},
+		{
+			Input: `echo oops\`,
+			Err:   "trailing backslash",
+		},
+	}
+
+	for _, test := range tests {
+
+		got, err := splitWords(test.Input)
+
+		if errString(err) != test.Err {
+			t.Errorf("%q: expected error %q, got %v", test.Input, test.Err, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, test.Exp) {
+			t.Errorf("%q: expected splitWords to return %q, got %q", test.Input, test.Exp, got)
+		}
+	}
+}
+
+func TestShellquote(t *testing.T) {
+
+	tests := map[string]string{
+		"":                  "''",
+		"simple":            "simple",
+		"--start=90":        "--start=90",
+		"Ear Hustle":        "'Ear Hustle'",
+		"Don't Panic":       `'Don'\''t Panic'`,
+		`"$HOME" && rm -rf`: `'"$HOME" && rm -rf'`,
+	}
+
+	for s, exp := range tests {
+
+		got := shellquote(s)
+		if got != exp {
+			t.Errorf("expected shellquote(%q) to return %q, got %q", s, exp, got)
+		}
+
+		// Quoted strings are a single word.
+		if words, err := splitWords(got); err != nil || len(words) != 1 || words[0] != s {
+			t.Errorf("expected %s to split into %q, got %q (error %v)", got, s, words, err)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+
+	item := &commandData{
+		URL:       "https://example.com/episodes/it's here.mp3?a=1&b=2",
+		Title:     "Don't Panic",
+		ID:        7,
+		Pubdate:   time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Duration:  3600,
+		Position:  90,
+		FeedTitle: "Serial",
+	}
+
+	tests := []struct {
+		Name    string
+		Command string
+		Data    *commandData
+		URL     bool
+		Exp     []string
+		Err     string
+	}{
+		{
+			Name:    "No data",
+			Command: "sh -c 'exit 0'",
+			Exp:     []string{sh, "-c", "exit 0"},
+		},
+		{
+			Name:    "Plain command",
+			Command: "sh -x",
+			Data:    item,
+			URL:     true,
+			Exp:     []string{sh, "-x", item.URL},
+		},
+		{
+			Name:    "Template",
+			Command: "sh --start={{.Position}} --title={{.Title | shellquote}} -- {{.URL}}",
+			Data:    item,
+			URL:     true,
+			Exp:     []string{sh, "--start=90", "--title=Don't Panic", "--", "https://example.com/episodes/it%27s%20here.mp3?a=1&b=2"},
+		},
+		{
+			Name:    "Quoted template",
+			Command: `sh "{{.FeedTitle}}: {{.Pubdate.Format "2006-01-02"}}" '{{.Duration}}s'`,
+			Data:    item,
+			Exp:     []string{sh, "Serial: 2020-01-02", "3600s"},
+		},
+		{
+			Name:    "Shell script",
+			Command: `sh -c "notify-send {{.Title | shellquote}}"`,
+			Data:    item,
+			Exp:     []string{sh, "-c", `notify-send 'Don'\''t Panic'`},
+		},
+		{
+			Name:    "Option-like URL",
+			Command: "sh",
+			Data:    &commandData{URL: "-rf"},
+			URL:     true,
+			Err:     `refusing to open "-rf" (only http, https and file URLs are allowed)`,
+		},
+		{
+			Name:    "Unsupported scheme",
+			Command: "sh {{.URL}}",
+			Data:    &commandData{URL: "javascript:alert(1)"},
+			Err:     `refusing to open "javascript:alert(1)" (only http, https and file URLs are allowed)`,
+		},
+		{
+			Name:    "File URL",
+			Command: "sh",
+			Data:    &commandData{URL: "file:///tmp/episode.mp3"},
+			URL:     true,
+			Exp:     []string{sh, "file:///tmp/episode.mp3"},
+		},
+		{
+			Name:    "Empty values",
+			Command: "sh --guid={{.GUID}} {{.GUID}}",
+			Data:    item,
+			Exp:     []string{sh, "--guid=", ""},
+		},
+		{
+			Name:    "Conditional",
+			Command: `sh {{if .Title}}"--title={{.Title}}"{{end}} {{with .GUID}}--guid={{.}}{{else}}--no-guid{{end}}`,
+			Data:    item,
+			Exp:     []string{sh, "--title=Don't Panic", "--no-guid"},
+		},
+		{
+			Name:    "Unbalanced quotes",
+			Command: `sh {{if .Title}}'{{end}}x'`,
+			Err:     "bad command: unbalanced quotes in {{if}}",
+		},
+		{
+			Name:    "Escaped template",
+			Command: `sh a\{{.Title}}`,
+			Err:     "bad command: templates can't follow a backslash",
+		},
+		{
+			Name:    "Defined template",
+			Command: `{{define "x"}}--evil{{end}}sh {{template "x"}}`,
+			Err:     "bad command: templates can't define other templates",
+		},
+		{
+			Name:    "Unknown function",
+			Command: "sh {{.Title | upper}}",
+			Err:     `bad command: template: command:1: function "upper" not defined`,
+		},
+		{
+			Name:    "Bad quotes",
+			Command: `sh "{{.Title}}`,
+			Err:     `bad command: unterminated " quote`,
+		},
+		{
+			Name:    "Empty command",
+			Command: " {{.Title}} ",
+			Err:     "no command given",
+		},
+	}
+
+	for _, test := range tests {
+
+		var cmd *exec.Cmd
+		var err error
+
+		if test.URL {
+			cmd, err = parseURLCommand(test.Command, test.Data)
+		} else {
+			cmd, err = parseCommand(test.Command, test.Data)
+		}
+
+		if errString(err) != test.Err {
+			t.Errorf("%s: expected error %q, got %v", test.Name, test.Err, err)
+			continue
+		}
+
+		if err == nil && !reflect.DeepEqual(cmd.Args, test.Exp) {
+			t.Errorf("%s: expected args %q, got %q", test.Name, test.Exp, cmd.Args)
+		}
+	}
+}
+
+func TestCommandTemplateInjection(t *testing.T) {
+
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+
+	values := []string{
+		"x --script=/tmp/evil.lua",
+		`x' --script=/tmp/evil.lua '`,
+		`x" --script=/tmp/evil.lua "`,
+		`x\" --script=/tmp/evil.lua \"`,
+		`x\`,
+		"x\n--script=/tmp/evil.lua",
+	}
+
+	tests := []struct {
+		Command string
+		Exp     func(string) []string
+	}{
+		{
+			Command: "sh {{.Title}} {{.FeedTitle}} {{.GUID}}",
+			Exp: func(v string) []string {
+				return []string{sh, v, v, v}
+			},
+		},
+		{
+			Command: "sh --title={{.Title}}",
+			Exp: func(v string) []string {
+				return []string{sh, "--title=" + v}
+			},
+		},
+		{
+			Command: `sh "--title={{.Title}}" "{{.FeedTitle}}: {{.GUID}}"`,
+			Exp: func(v string) []string {
+				return []string{sh, "--title=" + v, v + ": " + v}
+			},
+		},
+		{
+			Command: "sh '--title={{.Title}}' '{{.FeedTitle}}: {{.GUID}}'",
+			Exp: func(v string) []string {
+				return []string{sh, "--title=" + v, v + ": " + v}
+			},
+		},
+		{
+			Command: "sh --title={{.Title | shellquote}}",
+			Exp: func(v string) []string {
+				return []string{sh, "--title=" + v}
+			},
+		},
+		{
+			// Values passed on to a shell need quoting for
+			// that shell too.
+			Command: `sh -c "echo {{.Title | shellquote}}"`,
+			Exp: func(v string) []string {
+				return []string{sh, "-c", "echo " + shellquote(v)}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		for _, v := range values {
+
+			data := &commandData{Title: v, FeedTitle: v, GUID: v}
+
+			cmd, err := parseCommand(test.Command, data)
+			if err != nil {
+				t.Errorf("%s with %q: parseCommand returned error %q", test.Command, v, err)
+				continue
+			}
+
+			if exp := test.Exp(v); !reflect.DeepEqual(cmd.Args, exp) {
+				t.Errorf("%s with %q: expected args %q, got %q", test.Command, v, exp, cmd.Args)
+			}
+		}
+	}
+}
+
+func TestJoinCommand(t *testing.T) {
+
+	got := joinCommand([]string{"notify-send", "New episodes", "{{.FeedTitle | shellquote}}"})
+	exp := "notify-send 'New episodes' {{.FeedTitle | shellquote}}"
+
+	if got != exp {
+		t.Errorf("expected joinCommand to return %q, got %q", exp, got)
+	}
+}
+
+func TestHookCommandTemplate(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "kibner-hooks")
+	if err != nil {
+		t.Fatalf("TempDir returned error %q", err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	save := hookScript(t, dir, "save.sh", `printf '%s\n' "$@" > "`+out+`"`)
+
+	payload := &hookPayload{
+		Event: hookItemPlayed,
+		Feed:  hookFeed{ID: 1, Title: "Serial", URL: "http://example.com/serial.xml"},
+		Items: []hookItem{
+			{ID: 5, Title: "S01 Episode 01: The Alibi", URL: "http://example.com/1.mp3"},
+		},
+	}
+
+	if err := runHookCommand(save+" {{.Event}} {{.FeedTitle | shellquote}} {{.Title | shellquote}} {{.URL}} {{.ItemCount}}", nil, payload); err != nil {
+		t.Fatalf("runHookCommand returned error %q", err)
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("hook script did not run: %s", err)
+	}
+
+	exp := "item-played\nSerial\nS01 Episode 01: The Alibi\nhttp://example.com/1.mp3\n1\n"
+
+	if got := string(data); got != exp {
+		t.Errorf("expected hook arguments %q, got %q", exp, got)
+	}
+}
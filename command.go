@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"reflect"
+	"strings"
 
 	flag "github.com/ogier/pflag"
 )
@@ -14,11 +17,63 @@ var (
 	ErrBadArgs = errors.New("bad args")
 )
 
+// Env is the environment a command runs in. Commands read input
+// from Stdin and write output to Stdout and Stderr so that they
+// can be driven by something other than a terminal.
 type Env struct {
-	Stdin  io.Writer
+	Stdin  io.Reader
 	Stdout io.Writer
 	Stderr io.Writer
 	LogTo  io.Writer
+	// NoInput means that commands must not prompt for input.
+	// It's set by the global --no-input option.
+	NoInput bool
+	// Verbose and Debug are set by the global --verbose and
+	// --debug options. They determine what Log writes.
+	Verbose bool
+	Debug   bool
+	// Log writes diagnostic messages to LogTo. It's set up
+	// by RunWithEnv.
+	Log *Logger
+	// Hooks runs hooks for the command, logging to Log. It's
+	// set up by RunWithEnv.
+	Hooks *hookRunner
+
+	in *bufio.Reader
+}
+
+// StdEnv returns an Env that uses the standard input and output.
+func StdEnv() *Env {
+	return &Env{
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		LogTo:  os.Stderr,
+	}
+}
+
+// ReadLine reads a line of input from Stdin, without the line
+// ending. The final line of input doesn't need a line ending.
+func (env *Env) ReadLine() (string, error) {
+
+	if env.in == nil {
+		env.in = bufio.NewReader(env.Stdin)
+	}
+
+	line, err := env.in.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// attach connects a command to the environment's input and output.
+func (env *Env) attach(cmd *exec.Cmd) {
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = env.Stdin, env.Stdout, env.Stderr
 }
 
 type CommandSet struct {
@@ -34,26 +89,55 @@ func NewCommandSet(name string, commands ...*Command) *CommandSet {
 }
 
 func (cs *CommandSet) Run(name string, args []string) error {
-	return cs.RunWithEnv(name, args, &Env{
-		Stdin:  os.Stdin,
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
-	})
+	return cs.RunWithEnv(name, args, StdEnv())
+}
+
+// RunArgs runs the command named by the first argument. Global
+// options can go before the command name as well as after it,
+// e.g. "kibner --no-input sync".
+func (cs *CommandSet) RunArgs(args []string, env *Env) error {
+
+	fs := flag.NewFlagSet(cs.Name, flag.ContinueOnError)
+	fs.SetOutput(env.Stderr)
+	fs.SetInterspersed(false)
+	fs.Usage = func() {
+		cs.Usage(env.Stdout)
+	}
+	addGlobalFlags(fs, env)
+
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		cs.Usage(env.Stdout)
+		return errors.New("no command given")
+	}
+
+	return cs.RunWithEnv(fs.Arg(0), fs.Args()[1:], env)
 }
 
 func (cs *CommandSet) RunWithEnv(name string, args []string, env *Env) error {
 
 	c := cs.findByName(name)
 	if c == nil {
-		cs.Usage()
+		cs.Usage(env.Stdout)
 		return errors.New("no such command " + name)
 	}
 
 	var help bool
 
 	fs := flag.NewFlagSet(name, flag.ContinueOnError)
-	fs.Usage = c.usage
+	fs.SetOutput(env.Stderr)
+	fs.Usage = func() {
+		c.usage(env.Stdout)
+	}
 	fs.BoolVarP(&help, "help", "h", false, "Show this help page")
+	addGlobalFlags(fs, env)
 	c.opts.addToFlagSet(fs)
 
 	err := fs.Parse(args)
@@ -61,15 +145,27 @@ func (cs *CommandSet) RunWithEnv(name string, args []string, env *Env) error {
 		return err
 	}
 
+	level := logLevelWarn
+	switch {
+	case env.Debug:
+		level = logLevelDebug
+	case env.Verbose:
+		level = logLevelInfo
+	}
+	env.Log = NewLogger(env.LogTo, level)
+	env.Hooks = newHookRunner(env.Log)
+	// Let hooks finish before the program exits.
+	defer env.Hooks.wait()
+
 	if help {
-		c.usage()
+		c.usage(env.Stdout)
 		return nil
 	}
 
 	err = c.run(c.opts, fs.Args(), env)
 	if err != nil {
 		if err == ErrBadArgs {
-			c.usage()
+			c.usage(env.Stdout)
 		}
 		return err
 	}
@@ -77,7 +173,16 @@ func (cs *CommandSet) RunWithEnv(name string, args []string, env *Env) error {
 	return nil
 }
 
-func (cs *CommandSet) Usage() {
+// addGlobalFlags adds the options that every command accepts.
+// Their defaults come from env so that options given before the
+// command name carry over.
+func addGlobalFlags(fs *flag.FlagSet, env *Env) {
+	fs.BoolVar(&env.NoInput, "no-input", env.NoInput, "Never prompt for input")
+	fs.BoolVarP(&env.Verbose, "verbose", "v", env.Verbose, "Show more information, e.g. feed warnings")
+	fs.BoolVar(&env.Debug, "debug", env.Debug, "Show debugging information")
+}
+
+func (cs *CommandSet) Usage(w io.Writer) {
 
 	width := 0
 	marginLeft := 2
@@ -89,14 +194,19 @@ func (cs *CommandSet) Usage() {
 		}
 	}
 
-	fmt.Println("Usage:", cs.Name, "[command] [...]")
-	fmt.Println()
-	fmt.Println("Available Commands:")
+	fmt.Fprintln(w, "Usage:", cs.Name, "[command] [...]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Available Commands:")
 	for _, c := range cs.commands {
-		fmt.Printf("%*s%-*s %s\n", marginLeft, "", width+marginRight, c.name, c.desc)
+		fmt.Fprintf(w, "%*s%-*s %s\n", marginLeft, "", width+marginRight, c.name, c.desc)
 	}
-	fmt.Println()
-	fmt.Printf("Use \"%s <command> --help\" for help with individual commands.\n", cs.Name)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Global Options:")
+	fmt.Fprintf(w, "%*s%-*s %s\n", marginLeft, "", width+marginRight, "--no-input", "Never prompt for input")
+	fmt.Fprintf(w, "%*s%-*s %s\n", marginLeft, "", width+marginRight, "-v, --verbose", "Show more information, e.g. feed warnings")
+	fmt.Fprintf(w, "%*s%-*s %s\n", marginLeft, "", width+marginRight, "--debug", "Show debugging information")
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Use \"%s <command> --help\" for help with individual commands.\n", cs.Name)
 }
 
 func (cs *CommandSet) findByName(name string) *Command {
@@ -167,14 +277,14 @@ func WithOptionAlias(name string, alias string, usage string, value interface{})
 	}
 }
 
-func (c *Command) usage() {
+func (c *Command) usage(w io.Writer) {
 
-	fmt.Println("Usage:", c.syntax)
-	fmt.Println(c.desc + ".")
+	fmt.Fprintln(w, "Usage:", c.syntax)
+	fmt.Fprintln(w, c.desc+".")
 
 	if len(c.opts) > 0 {
-		fmt.Println("\nOptions:")
-		c.opts.print()
+		fmt.Fprintln(w, "\nOptions:")
+		c.opts.print(w)
 	}
 }
 
@@ -198,9 +308,10 @@ func (opts Options) addToFlagSet(fs *flag.FlagSet) {
 	}
 }
 
-func (opts Options) print() {
+func (opts Options) print(w io.Writer) {
 
 	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(w)
 	for _, o := range opts {
 		o.addToFlagSet(fs)
 	}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+// testWithHome runs fn with $HOME set to an empty temporary
+// directory, so that commands get a database of their own.
+func testWithHome(t *testing.T, fn func(t *testing.T)) {
+
+	home, err := ioutil.TempDir("", "kibner-home")
+	if err != nil {
+		t.Fatalf("TempDir returned error %q", err)
+	}
+	defer os.RemoveAll(home)
+
+	oldHome := os.Getenv("HOME")
+	defer os.Setenv("HOME", oldHome)
+	os.Setenv("HOME", home)
+
+	oldCache := homedir.DisableCache
+	defer func() { homedir.DisableCache = oldCache }()
+	homedir.DisableCache = true
+
+	fn(t)
+}
+
+func TestDBAtPathConcurrentWrites(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "kibner-db")
+	if err != nil {
+		t.Fatalf("TempDir returned error %q", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "kibner.db")
+
+	// Separate connections stand in for separate processes.
+	var dbs [2]*sql.DB
+	for i := range dbs {
+		db, err := dbAtPath(path)
+		if err != nil {
+			t.Fatalf("dbAtPath returned error %q", err)
+		}
+		defer db.Close()
+		dbs[i] = db
+	}
+
+	var mode string
+	if err := dbs[1].QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatalf("Error querying journal mode: %s", err)
+	}
+	if mode != "wal" {
+		t.Errorf("Expected journal mode %q, got %q", "wal", mode)
+	}
+
+	var timeout int64
+	if err := dbs[1].QueryRow("PRAGMA busy_timeout").Scan(&timeout); err != nil {
+		t.Fatalf("Error querying busy timeout: %s", err)
+	}
+	if exp := int64(defaults.BusyTimeout / time.Millisecond); timeout != exp {
+		t.Errorf("Expected busy timeout %d, got %d", exp, timeout)
+	}
+
+	tx, err := dbs[0].Begin()
+	if err != nil {
+		t.Fatalf("Begin returned error %q", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM feeds"); err != nil {
+		tx.Rollback()
+		t.Fatalf("Exec returned error %q", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		done <- tx.Commit()
+	}()
+
+	// This write has to wait for the transaction above.
+	if _, err := dbs[1].Exec("DELETE FROM feeds"); err != nil {
+		t.Errorf("Expected concurrent write to succeed, got %q", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("Commit returned error %q", err)
+	}
+}
+
+// runCLI runs a kibner command with the given input and returns
+// its output.
+func runCLI(args []string, input string) (string, error) {
+
+	var out bytes.Buffer
+
+	env := &Env{
+		Stdin:  strings.NewReader(input),
+		Stdout: &out,
+		Stderr: &out,
+		LogTo:  &out,
+	}
+
+	// Commands remember their options so every run needs a
+	// fresh set of them.
+	cs := NewCommandSet("kibner", getCommands()...)
+	err := cs.RunArgs(args, env)
+
+	return out.String(), err
+}
+
+func TestCLI(t *testing.T) {
+	testWithHome(t, testCLI)
+}
+
+func testCLI(t *testing.T) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	serial := serverURL(ts, "serial.xml")
+	rework := serverURL(ts, "rework.xml")
+	columbo := serverURL(ts, "columbo.xml")
+
+	tests := []struct {
+		Args     []string
+		Input    string
+		Err      error
+		Contains []string
+		Excludes []string
+	}{
+		{
+			Args:     []string{"version"},
+			Contains: []string{"Kibner v" + version + "\n"},
+		},
+		{
+			Args:     []string{"nosuchcommand"},
+			Err:      errorString("no such command nosuchcommand"),
+			Contains: []string{"Usage: kibner [command]", "Available Commands:"},
+		},
+		{
+			Args:     []string{"list", "--help"},
+			Contains: []string{"Usage: kibner list", "Options:", "--sortby"},
+		},
+		{
+			Args:     []string{"version", "extra"},
+			Err:      ErrBadArgs,
+			Contains: []string{"Usage: kibner version"},
+		},
+		{
+			Args:     []string{"add", serial},
+			Contains: []string{"Added Serial - "},
+		},
+		{
+			Args:     []string{"add", rework},
+			Contains: []string{"Added REWORK - "},
+		},
+		{
+			Args:     []string{"feeds"},
+			Contains: []string{"Serial", "REWORK"},
+		},
+		{
+			Args:     []string{"add", columbo},
+			Contains: []string{"Added Columbo - 10 items, 3 warnings (use -v to list them)\n"},
+			Excludes: []string{"Warnings for"},
+		},
+		{
+			Args: []string{"sync", "--exact", "columbo", "-v", "--debug"},
+			Contains: []string{
+				"No new items, 3 warnings\n",
+				"\nWarnings for Columbo:\n",
+				`  "Dead Weight": no release date` + "\n",
+				"debug: synced " + columbo + ": 0 new items, 3 warnings\n",
+			},
+		},
+		{
+			Args: []string{"remove", "--exact", "columbo", "--yes", "--no-input"},
+		},
+		{
+			Args:     []string{"validate", serverURL(ts, "uncivil.xml")},
+			Contains: []string{"Uncivil (", "3 items, no problems found\n"},
+		},
+		{
+			Args:     []string{"validate", "--exact", "serial"},
+			Err:      errorString("12 problems found"),
+			Contains: []string{`"S01 Episode 01: The Alibi": no file size (enclosure length is "0")`},
+		},
+		{
+			Args: []string{"remove", "e", "--no-input"},
+			Err: errorString(`"e" matches 2 feeds:
+     2  REWORK
+     1  Serial
+Use --id or --exact to choose one, or --all-matches to choose them all`),
+		},
+		{
+			Args: []string{"--no-input", "remove", "e"},
+			Err: errorString(`"e" matches 2 feeds:
+     2  REWORK
+     1  Serial
+Use --id or --exact to choose one, or --all-matches to choose them all`),
+		},
+		{
+			Args:     []string{"--no-input"},
+			Err:      errorString("no command given"),
+			Contains: []string{"Usage: kibner [command]"},
+		},
+		{
+			Args: []string{"remove", "Serial", "--id", "1"},
+			Err:  errorString("--id can't be used with a feed name"),
+		},
+		{
+			Args: []string{"list", "Serial", "--unmark", "--select", "1, 2", "--no-input"},
+		},
+		{
+			Args:     []string{"list", "--unplayed", "--exact", "serial"},
+			Contains: []string{"Showing 2 items"},
+		},
+		{
+			Args: []string{"list", "--unplayed", "--mark", "--no-input"},
+			Err:  errorString("no items selected (use --select or --yes with --no-input)"),
+		},
+		{
+			Args: []string{"list", "--unplayed", "--mark", "--yes", "--no-input"},
+		},
+		{
+			Args:     []string{"list", "--unplayed"},
+			Contains: []string{"No items found"},
+		},
+		{
+			Args: []string{"unmark", "1", "2"},
+		},
+		{
+			Args:     []string{"list", "--unplayed"},
+			Contains: []string{"Showing 2 items", "| ID: 1\n", "| ID: 2\n"},
+		},
+		{
+			Args: []string{"mark", "2", "1"},
+		},
+		{
+			Args:     []string{"list", "--unplayed"},
+			Contains: []string{"No items found"},
+		},
+		{
+			Args: []string{"mark", "1", "x"},
+			Err:  errorString("invalid item ID x"),
+		},
+		{
+			Args:     []string{"mark"},
+			Err:      ErrBadArgs,
+			Contains: []string{"Usage: kibner mark"},
+		},
+		{
+			Args:     []string{"show", "1"},
+			Contains: []string{"From Serial\n", "ID:       1\n", "Played:   Yes\n"},
+		},
+		{
+			Args: []string{"show", "999"},
+			Err:  errorString("no item with ID 999"),
+		},
+		{
+			Args: []string{"update", "--id", "2", "--author", "Jason Fried", "--yes", "--no-input"},
+		},
+		{
+			Args:     []string{"feeds"},
+			Contains: []string{"Jason Fried"},
+		},
+		{
+			// Both feeds contain an "e". Skip the first one
+			// (REWORK) and remove the second (Serial).
+			Args:     []string{"remove", "e"},
+			Input:    "n\nyes\n",
+			Contains: []string{"[1/2] Remove REWORK? Yes, No, Quit: ", "[2/2] Remove Serial? Yes, No, Quit: "},
+		},
+		{
+			Args:     []string{"feeds"},
+			Contains: []string{"REWORK"},
+			Excludes: []string{"Serial"},
+		},
+		{
+			// Invalid responses are asked again.
+			Args:     []string{"remove", "Rework"},
+			Input:    "x\n\nq\n",
+			Err:      errNoFeedChosen,
+			Contains: []string{strings.Repeat("[1/1] Remove REWORK? Yes, No, Quit: ", 3)},
+		},
+		{
+			Args:  []string{"remove", "Rework"},
+			Input: "",
+			Err:   io.EOF,
+		},
+		{
+			Args:     []string{"sync"},
+			Contains: []string{"No new items\n"},
+		},
+		{
+			Args: []string{"tag", "--id", "2", "business", " news / tech "},
+		},
+		{
+			Args:     []string{"tag", "rework"},
+			Err:      ErrBadArgs,
+			Contains: []string{"Usage: kibner tag"},
+		},
+		{
+			Args:     []string{"feeds", "--tag", "news"},
+			Contains: []string{"REWORK", "Tags: business, news/tech\n"},
+		},
+		{
+			Args:     []string{"feeds", "--sortby", "tag"},
+			Contains: []string{"\nbusiness:\n"},
+		},
+		{
+			Args:     []string{"sync", "--tag", "news"},
+			Contains: []string{"No new items\n"},
+		},
+		{
+			Args: []string{"sync", "--tag", "sport"},
+			Err:  errorString("no feeds tagged sport"),
+		},
+		{
+			Args: []string{"sync", "rework", "--tag", "news"},
+			Err:  errorString("--tag can't be used with a feed name"),
+		},
+		{
+			Args:     []string{"list", "--tag", "sport"},
+			Contains: []string{"No items found"},
+		},
+		{
+			Args: []string{"untag", "--exact", "rework", "news/tech"},
+		},
+		{
+			Args:     []string{"feeds", "--tag", "news"},
+			Contains: []string{"No feeds found"},
+		},
+		{
+			Args:     []string{"export", "-"},
+			Contains: []string{rework + "\n"},
+		},
+		{
+			Args:     []string{"export", "--format", "json", "-"},
+			Contains: []string{`"Title": "REWORK",`, `"URL": "` + rework + `",`, `"business"`},
+		},
+		{
+			Args:     []string{"import", "--dry-run", "-"},
+			Input:    serial + "\n" + rework + "\n",
+			Contains: []string{"Dry run: would add 1 of 2 feeds, 1 errors\n", "Would add Serial (" + serial + ") with ", rework + ": already subscribed\n"},
+		},
+		{
+			Args:     []string{"feeds"},
+			Excludes: []string{"Serial"},
+		},
+		{
+			Args:     []string{"import", "-"},
+			Input:    "# Feeds\n" + serial + "\n",
+			Contains: []string{"Added 1 of 1 feeds, 0 errors"},
+		},
+		{
+			Args:     []string{"sync", "--dry-run"},
+			Contains: []string{"Dry run: No new items\n"},
+		},
+		{
+			Args: []string{"sync", "--dry-run", "--probe"},
+			Err:  errorString("--probe can't be used with --dry-run"),
+		},
+		{
+			Args:     []string{"remove", "--exact", "serial", "--dry-run"},
+			Contains: []string{"Would remove Serial and its "},
+		},
+		{
+			Args:     []string{"feeds"},
+			Contains: []string{"Serial"},
+		},
+		{
+			Args: []string{"import", serverURL(ts, "feeds.opml")},
+			Err:  errorString("bad status: 404 Not Found"),
+		},
+		{
+			Args: []string{"hook", "new-episodes", "echo"},
+			Err:  errorString(`invalid event "new-episodes" (valid events are feed-added, feed-removed, item-played, new-items, sync-failed)`),
+		},
+		{
+			Args:     []string{"hook", "new-items", "echo", "new items"},
+			Contains: []string{"Added new-items hook 1\n"},
+		},
+		{
+			Args:     []string{"hooks"},
+			Contains: []string{"new-items: when a sync finds new items in a feed\n     1  echo 'new items'\n", "sync-failed: when a feed can't be synced\n        No hooks\n"},
+		},
+		{
+			Args: []string{"unhook", "1"},
+		},
+		{
+			Args: []string{"unhook", "1"},
+			Err:  errorString("no hook with ID 1"),
+		},
+		{
+			Args: []string{"daemon", "status"},
+			Err:  errorString("the daemon isn't running"),
+		},
+		{
+			Args:     []string{"daemon", "stop"},
+			Err:      ErrBadArgs,
+			Contains: []string{"Usage: kibner daemon [status]"},
+		},
+		{
+			Args:     []string{"reset"},
+			Input:    "N\n",
+			Contains: []string{"Reset Kibner"},
+		},
+		{
+			Args:     []string{"feeds"},
+			Contains: []string{"REWORK"},
+		},
+		{
+			Args:  []string{"reset"},
+			Input: "y",
+		},
+		{
+			Args:     []string{"feeds"},
+			Excludes: []string{"REWORK"},
+		},
+		{
+			Args:     []string{"stats"},
+			Contains: []string{"All time\n", "Listened: 0s (0 items played)\n"},
+		},
+		{
+			Args:     []string{"stats", "--format", "json"},
+			Contains: []string{`"listened_seconds": 0,`},
+		},
+		{
+			Args:     []string{"probe"},
+			Contains: []string{"No items to probe\n"},
+		},
+	}
+
+	for _, test := range tests {
+
+		name := strings.Join(test.Args, " ")
+
+		out, err := runCLI(test.Args, test.Input)
+
+		if errString(err) != errString(test.Err) {
+			t.Errorf("%s: expected error %q, got %q", name, test.Err, err)
+		}
+
+		for _, s := range test.Contains {
+			if !strings.Contains(out, s) {
+				t.Errorf("%s: expected output to contain %q, got %q", name, s, out)
+			}
+		}
+
+		for _, s := range test.Excludes {
+			if strings.Contains(out, s) {
+				t.Errorf("%s: expected output not to contain %q, got %q", name, s, out)
+			}
+		}
+	}
+}
+
+func TestEnvReadLine(t *testing.T) {
+
+	env := &Env{
+		Stdin: strings.NewReader("one\r\ntwo\n\nthree"),
+	}
+
+	for _, exp := range []string{"one", "two", "", "three"} {
+		line, err := env.ReadLine()
+		if err != nil {
+			t.Fatalf("ReadLine returned error %q", err)
+		}
+		if line != exp {
+			t.Errorf("expected ReadLine to return %q, got %q", exp, line)
+		}
+	}
+
+	if _, err := env.ReadLine(); err != io.EOF {
+		t.Errorf("expected ReadLine to return %q, got %q", io.EOF, err)
+	}
+}
+
+type errorString string
+
+func (e errorString) Error() string {
+	return string(e)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	kibner "github.com/deepilla/kibner/internal/types"
+)
+
+// The daemon syncs feeds in the background, each one when it's
+// due (see schedule.go). Schedules are saved in the database so
+// they survive restarts. While it runs, the daemon listens on a
+// Unix socket and writes its status as JSON to anyone who
+// connects, which is how "kibner daemon status" works.
+
+// clock abstracts the passage of time so that tests can run the
+// daemon on a fake clock.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type daemon struct {
+	db      *sql.DB
+	hooks   *hookRunner
+	clock   clock
+	rand    *rand.Rand
+	log     *Logger
+	started time.Time
+
+	mu        sync.Mutex
+	schedules []feedSchedule
+}
+
+func newDaemon(db *sql.DB, hooks *hookRunner, clk clock, log *Logger) *daemon {
+
+	now := clk.Now()
+
+	return &daemon{
+		db:      db,
+		hooks:   hooks,
+		clock:   clk,
+		rand:    rand.New(rand.NewSource(now.UnixNano())),
+		log:     log,
+		started: now,
+	}
+}
+
+// run syncs feeds as they fall due until stop is closed. Errors
+// are logged rather than returned so that a bad moment, e.g. a
+// locked database, doesn't stop the daemon.
+func (d *daemon) run(stop <-chan struct{}) error {
+
+	for {
+
+		next, err := d.syncDue()
+		if err != nil {
+			d.log.Warnf("could not sync: %s", err)
+		}
+
+		// Wake up at least every DaemonPoll to pick up feeds
+		// that were added in the meantime.
+		wait := defaults.DaemonPoll
+		if !next.IsZero() {
+			if untilNext := next.Sub(d.clock.Now()); untilNext < wait {
+				wait = untilNext
+			}
+		}
+		if wait < 0 {
+			wait = 0
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-d.clock.After(wait):
+		}
+	}
+}
+
+// syncDue syncs the feeds that are due and reschedules them. It
+// returns the time at which the next feed is due, which is zero
+// if there are no feeds.
+func (d *daemon) syncDue() (time.Time, error) {
+
+	now := d.clock.Now()
+
+	schedules, err := loadFeedSchedules(d.db)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	due := make(map[int64]*feedSchedule)
+	for i := range schedules {
+		if !schedules[i].Next.After(now) {
+			due[schedules[i].ID] = &schedules[i]
+		}
+	}
+
+	if len(due) > 0 {
+
+		infos, err := loadSyncInfo(d.db, 0)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		var dueInfos []syncInfo
+		for _, info := range infos {
+			if due[info.ID] != nil {
+				dueInfos = append(dueInfos, info)
+			}
+		}
+
+		d.log.Infof("syncing %d of %d feeds", len(dueInfos), len(schedules))
+
+		results := syncMultiple(d.db, d.hooks, dueInfos, nil)
+		logSyncResults(d.log, results)
+
+		for _, res := range results {
+
+			s := due[res.ID]
+			d.reschedule(s, res, now)
+
+			if err := saveFeedSchedule(d.db, s); err != nil {
+				d.log.Warnf("could not save schedule for %s: %s", s.Title, err)
+			}
+		}
+	}
+
+	d.mu.Lock()
+	d.schedules = schedules
+	d.mu.Unlock()
+
+	var next time.Time
+	for _, s := range schedules {
+		if next.IsZero() || s.Next.Before(next) {
+			next = s.Next
+		}
+	}
+
+	return next, nil
+}
+
+// reschedule updates a feed's schedule after a sync.
+func (d *daemon) reschedule(s *feedSchedule, res *syncResult, now time.Time) {
+
+	var hints kibner.Schedule
+
+	if res.Err != nil {
+		s.Failures++
+		s.Error = res.Err.Error()
+		d.log.Warnf("could not sync %s: %s", s.Title, res.Err)
+	} else {
+		s.Failures = 0
+		s.Error = ""
+		if res.Schedule != nil {
+			hints = *res.Schedule
+		}
+		if res.Items > 0 {
+			d.log.Infof("%s: %d new items", s.Title, res.Items)
+		}
+	}
+
+	pubdates, err := loadPubdates(d.db, s.ID)
+	if err != nil {
+		d.log.Warnf("could not load items for %s: %s", s.Title, err)
+	}
+
+	interval := syncInterval(hints, pubdates, s.Failures)
+
+	s.Synced = now
+	s.Interval = int64(interval / time.Second)
+	// Schedules are saved to the nearest second.
+	s.Next = nextSync(now, interval, hints, d.rand).Truncate(time.Second)
+
+	d.log.Debugf("next sync of %s at %s", s.Title, s.Next.Format(time.RFC3339))
+}
+
+type daemonStatus struct {
+	PID     int            `json:"pid"`
+	Started time.Time      `json:"started"`
+	Feeds   []feedSchedule `json:"feeds"`
+}
+
+func (d *daemon) status() *daemonStatus {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	feeds := make([]feedSchedule, len(d.schedules))
+	copy(feeds, d.schedules)
+
+	return &daemonStatus{
+		PID:     os.Getpid(),
+		Started: d.started,
+		Feeds:   feeds,
+	}
+}
+
+// serveStatus writes the daemon's status to every connection
+// on l until l is closed.
+func (d *daemon) serveStatus(l net.Listener) {
+
+	for {
+
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			if err := json.NewEncoder(conn).Encode(d.status()); err != nil {
+				d.log.Debugf("could not write status: %s", err)
+			}
+		}()
+	}
+}
+
+// listenStatus listens on the status socket at path. A socket
+// left behind by a daemon that didn't exit cleanly is removed,
+// but only if no daemon answers on it.
+func listenStatus(path string) (net.Listener, error) {
+
+	if _, err := os.Stat(path); err == nil {
+
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, errors.New("the daemon is already running")
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// readDaemonStatus asks the daemon listening on the status
+// socket at path for its status.
+func readDaemonStatus(path string) (*daemonStatus, error) {
+
+	conn, err := net.DialTimeout("unix", path, defaults.Timeout)
+	if err != nil {
+		return nil, errors.New("the daemon isn't running")
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(defaults.Timeout))
+
+	var status daemonStatus
+	if err := json.NewDecoder(conn).Decode(&status); err != nil {
+		return nil, errors.New("bad status: " + err.Error())
+	}
+
+	return &status, nil
+}
+
+func printDaemonStatus(w io.Writer, status *daemonStatus, now time.Time) {
+
+	const layout = "Jan 2 15:04"
+
+	fmt.Fprintf(w, "Running since %s (pid %d)\n", status.Started.Local().Format(layout), status.PID)
+
+	if len(status.Feeds) == 0 {
+		fmt.Fprintln(w, "\nNo feeds")
+		return
+	}
+
+	fmt.Fprintln(w)
+
+	for _, s := range status.Feeds {
+
+		fmt.Fprintf(w, "%6d  %s\n", s.ID, s.Title)
+
+		if s.Synced.IsZero() {
+			fmt.Fprintln(w, "        Not synced yet")
+			continue
+		}
+
+		next := s.Next.Local().Format(layout)
+		if !s.Next.After(now) {
+			next = "due now"
+		}
+
+		fmt.Fprintf(w, "        Synced %s, next %s (every %s)\n", s.Synced.Local().Format(layout), next, formatSeconds(s.Interval))
+
+		switch {
+		case s.Failures == 1:
+			fmt.Fprintf(w, "        Last sync failed: %s\n", s.Error)
+		case s.Failures > 1:
+			fmt.Fprintf(w, "        Last %d syncs failed: %s\n", s.Failures, s.Error)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	kibner "github.com/deepilla/kibner/internal/types"
+)
+
+// fakeClock is a clock that only moves when it's told to.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []fakeTimer
+	waiting chan time.Duration
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{
+		now:     now,
+		waiting: make(chan time.Duration, 10),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the time once the clock
+// has been advanced by d. It also sends d to c.waiting so that
+// tests know when something is waiting.
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+
+	c.mu.Lock()
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), ch: ch})
+	c.mu.Unlock()
+
+	c.waiting <- d
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+
+	var timers []fakeTimer
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			timers = append(timers, t)
+			continue
+		}
+		t.ch <- c.now
+	}
+
+	c.timers = timers
+}
+
+func TestDaemonSyncDue(t *testing.T) {
+	testWithInitDB(t, testDaemonSyncDue)
+}
+
+func testDaemonSyncDue(t *testing.T, db *sql.DB) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	serial, err := addFeed(db, nil, serverURL(ts, "serial.xml"))
+	if err != nil {
+		t.Fatalf("addFeed returned error %q", err)
+	}
+
+	rework, err := addFeed(db, nil, serverURL(ts, "rework.xml"))
+	if err != nil {
+		t.Fatalf("addFeed returned error %q", err)
+	}
+
+	// Break the second feed.
+	if err := updateFeed(db, rework.ID, map[string]interface{}{"url": serverURL(ts, "not-found.xml")}); err != nil {
+		t.Fatalf("updateFeed returned error %q", err)
+	}
+
+	t0 := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+	clk := newFakeClock(t0)
+
+	d := newDaemon(db, nil, clk, nil)
+	d.rand = rand.New(rand.NewSource(1))
+
+	// Feeds that haven't been synced are due straight away.
+	next, err := d.syncDue()
+	if err != nil {
+		t.Fatalf("syncDue returned error %q", err)
+	}
+
+	schedules := getFeedSchedules(t, db)
+
+	s1, s2 := schedules[serial.ID], schedules[rework.ID]
+
+	for _, s := range []feedSchedule{s1, s2} {
+		if !s.Synced.Equal(t0) {
+			t.Errorf("expected %s to be synced at %s, got %s", s.Title, t0, s.Synced)
+		}
+		interval := time.Duration(s.Interval) * time.Second
+		if d := s.Next.Sub(t0); d < interval*9/10 || d > interval*11/10 {
+			t.Errorf("expected %s to be due in %s give or take 10%%, got %s", s.Title, interval, d)
+		}
+	}
+
+	if s1.Failures != 0 || s1.Error != "" {
+		t.Errorf("expected %s to sync, got %d failures (%q)", s1.Title, s1.Failures, s1.Error)
+	}
+
+	if s2.Failures != 1 || s2.Error != "bad status: 404 Not Found" {
+		t.Errorf("expected %s to fail, got %d failures (%q)", s2.Title, s2.Failures, s2.Error)
+	}
+
+	pubdates, err := loadPubdates(db, rework.ID)
+	if err != nil {
+		t.Fatalf("loadPubdates returned error %q", err)
+	}
+
+	if got, exp := time.Duration(s2.Interval)*time.Second, syncInterval(kibner.Schedule{}, pubdates, 1); got != exp {
+		t.Errorf("expected failing feed to back off to %s, got %s", exp, got)
+	}
+
+	exp := s1.Next
+	if s2.Next.Before(exp) {
+		exp = s2.Next
+	}
+
+	if !next.Equal(exp) {
+		t.Errorf("expected syncDue to return %s, got %s", exp, next)
+	}
+
+	// Nothing is due yet.
+	clk.Advance(time.Minute)
+
+	if _, err := d.syncDue(); err != nil {
+		t.Fatalf("syncDue returned error %q", err)
+	}
+
+	if got := getFeedSchedules(t, db); !reflect.DeepEqual(got, schedules) {
+		t.Errorf("expected schedules to be unchanged, got %s", jsonify(got))
+	}
+
+	// Sync the failing feed again. Push the other feed back so
+	// that it isn't due at the same time.
+	s1.Next = s2.Next.Add(time.Hour)
+	if err := saveFeedSchedule(db, &s1); err != nil {
+		t.Fatalf("saveFeedSchedule returned error %q", err)
+	}
+
+	clk.Advance(s2.Next.Sub(clk.Now()))
+
+	if _, err := d.syncDue(); err != nil {
+		t.Fatalf("syncDue returned error %q", err)
+	}
+
+	schedules = getFeedSchedules(t, db)
+
+	s := schedules[rework.ID]
+
+	if got, exp := time.Duration(s.Interval)*time.Second, syncInterval(kibner.Schedule{}, pubdates, 2); s.Failures != 2 || got != exp {
+		t.Errorf("expected %s to fail twice and back off to %s, got %d failures and %s", s.Title, exp, s.Failures, got)
+	}
+
+	if s := schedules[serial.ID]; !s.Synced.Equal(t0) {
+		t.Errorf("expected %s not to be synced again, got %s", s.Title, jsonify(s))
+	}
+
+	// Removing a feed removes its schedule.
+	if err := removeFeed(db, nil, rework.ID); err != nil {
+		t.Fatalf("removeFeed returned error %q", err)
+	}
+
+	verifyTables(t, db, map[string]int{
+		"feeds":           1,
+		"items":           len(allTestCases["Serial"].NewFeed().Items),
+		"feed_schedules":  1,
+		"sqlite_sequence": 2,
+	})
+
+	status := d.status()
+
+	if status.PID != os.Getpid() || !status.Started.Equal(t0) || len(status.Feeds) != 2 {
+		t.Errorf("unexpected status %s", jsonify(status))
+	}
+}
+
+func getFeedSchedules(t *testing.T, db *sql.DB) map[int64]feedSchedule {
+
+	schedules, err := loadFeedSchedules(db)
+	if err != nil {
+		t.Fatalf("loadFeedSchedules returned error %q", err)
+	}
+
+	m := make(map[int64]feedSchedule, len(schedules))
+	for _, s := range schedules {
+		m[s.ID] = s
+	}
+
+	return m
+}
+
+func TestDaemonRun(t *testing.T) {
+	testWithInitDB(t, testDaemonRun)
+}
+
+func testDaemonRun(t *testing.T, db *sql.DB) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	clk := newFakeClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local))
+	d := newDaemon(db, nil, clk, nil)
+
+	stop := make(chan struct{})
+	done := make(chan error)
+
+	go func() {
+		done <- d.run(stop)
+	}()
+
+	// With no feeds, the daemon polls for new ones.
+	if wait := <-clk.waiting; wait != defaults.DaemonPoll {
+		t.Errorf("expected daemon to wait %s, got %s", defaults.DaemonPoll, wait)
+	}
+
+	res, err := addFeed(db, nil, serverURL(ts, "serial.xml"))
+	if err != nil {
+		t.Fatalf("addFeed returned error %q", err)
+	}
+
+	clk.Advance(defaults.DaemonPoll)
+
+	// Serial is weekly so it won't be due for longer than a
+	// poll interval.
+	if wait := <-clk.waiting; wait != defaults.DaemonPoll {
+		t.Errorf("expected daemon to wait %s, got %s", defaults.DaemonPoll, wait)
+	}
+
+	if s := getFeedSchedules(t, db)[res.ID]; s.Synced.IsZero() {
+		t.Errorf("expected daemon to sync new feed")
+	}
+
+	close(stop)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run returned error %q", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected daemon to stop")
+	}
+}
+
+func TestDaemonStatus(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "kibner-daemon")
+	if err != nil {
+		t.Fatalf("TempDir returned error %q", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "daemon.sock")
+
+	if _, err := readDaemonStatus(path); errString(err) != "the daemon isn't running" {
+		t.Errorf("expected readDaemonStatus to fail, got %q", err)
+	}
+
+	// Stale sockets are replaced.
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatalf("WriteFile returned error %q", err)
+	}
+
+	l, err := listenStatus(path)
+	if err != nil {
+		t.Fatalf("listenStatus returned error %q", err)
+	}
+	defer l.Close()
+
+	if _, err := listenStatus(path); errString(err) != "the daemon is already running" {
+		t.Errorf("expected listenStatus to fail, got %q", err)
+	}
+
+	t0 := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+
+	d := newDaemon(nil, nil, newFakeClock(t0), nil)
+	d.schedules = []feedSchedule{
+		{
+			ID:       1,
+			Title:    "Serial",
+			Synced:   t0,
+			Next:     t0.Add(time.Hour),
+			Interval: 3600,
+		},
+	}
+
+	go d.serveStatus(l)
+
+	status, err := readDaemonStatus(path)
+	if err != nil {
+		t.Fatalf("readDaemonStatus returned error %q", err)
+	}
+
+	if jsonify(status.Feeds) != jsonify(d.schedules) || !status.Started.Equal(t0) {
+		t.Errorf("expected status %s, got %s", jsonify(d.status()), jsonify(status))
+	}
+}
+
+func TestPrintDaemonStatus(t *testing.T) {
+
+	t0 := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+
+	status := &daemonStatus{
+		PID:     123,
+		Started: t0,
+		Feeds: []feedSchedule{
+			{
+				ID:    3,
+				Title: "Columbo",
+			},
+			{
+				ID:       2,
+				Title:    "REWORK",
+				Synced:   t0.Add(time.Hour),
+				Next:     t0.Add(5 * time.Hour),
+				Interval: 4 * 3600,
+				Failures: 2,
+				Error:    "bad status: 404 Not Found",
+			},
+			{
+				ID:       1,
+				Title:    "Serial",
+				Synced:   t0,
+				Next:     t0.Add(90 * time.Minute),
+				Interval: 5400,
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	printDaemonStatus(&buf, status, t0.Add(2*time.Hour))
+
+	exp := `Running since Jan 1 12:00 (pid 123)
+
+     3  Columbo
+        Not synced yet
+     2  REWORK
+        Synced Jan 1 13:00, next Jan 1 17:00 (every 4h)
+        Last 2 syncs failed: bad status: 404 Not Found
+     1  Serial
+        Synced Jan 1 12:00, next due now (every 1h30m)
+`
+
+	if got := buf.String(); got != exp {
+		t.Errorf("expected output %q, got %q", exp, got)
+	}
+}
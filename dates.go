@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	kibner "github.com/deepilla/kibner/internal/types"
+)
+
+// Month names and abbreviations, including common typos and
+// the more widely used non-English names, mapped to the
+// abbreviations that time.Parse understands.
+var monthNames = map[string]string{
+
+	// English
+	"january": "Jan", "jan": "Jan",
+	"february": "Feb", "feb": "Feb",
+	"march": "Mar", "mar": "Mar",
+	"april": "Apr", "apr": "Apr",
+	"may":  "May",
+	"june": "Jun", "jun": "Jun",
+	"july": "Jul", "jul": "Jul",
+	"august": "Aug", "aug": "Aug",
+	"september": "Sep", "sept": "Sep", "sep": "Sep",
+	"october": "Oct", "oct": "Oct",
+	"november": "Nov", "nov": "Nov",
+	"december": "Dec", "dec": "Dec",
+
+	// French
+	"janvier": "Jan", "janv": "Jan",
+	"février": "Feb", "févr": "Feb", "fevrier": "Feb", "fevr": "Feb", "fév": "Feb",
+	"mars":  "Mar",
+	"avril": "Apr", "avr": "Apr",
+	"mai":     "May",
+	"juin":    "Jun",
+	"juillet": "Jul", "juil": "Jul",
+	"août": "Aug", "aout": "Aug",
+	"septembre": "Sep",
+	"octobre":   "Oct",
+	"novembre":  "Nov",
+	"décembre":  "Dec", "decembre": "Dec", "déc": "Dec",
+
+	// German
+	"januar": "Jan", "jän": "Jan",
+	"februar": "Feb",
+	"märz":    "Mar", "mär": "Mar", "maerz": "Mar",
+	"juni":    "Jun",
+	"juli":    "Jul",
+	"oktober": "Oct", "okt": "Oct",
+	"dezember": "Dec", "dez": "Dec",
+
+	// Spanish
+	"enero": "Jan", "ene": "Jan",
+	"febrero": "Feb",
+	"marzo":   "Mar",
+	"abril":   "Apr", "abr": "Apr",
+	"mayo":   "May",
+	"junio":  "Jun",
+	"julio":  "Jul",
+	"agosto": "Aug", "ago": "Aug",
+	"septiembre": "Sep", "setiembre": "Sep", "set": "Sep",
+	"octubre":   "Oct",
+	"noviembre": "Nov",
+	"diciembre": "Dec", "dic": "Dec",
+
+	// Italian
+	"gennaio": "Jan", "gen": "Jan",
+	"febbraio": "Feb",
+	"aprile":   "Apr",
+	"maggio":   "May", "mag": "May",
+	"giugno": "Jun", "giu": "Jun",
+	"luglio": "Jul", "lug": "Jul",
+	"settembre": "Sep",
+	"ottobre":   "Oct", "ott": "Oct",
+
+	// Dutch
+	"januari":  "Jan",
+	"februari": "Feb",
+	"maart":    "Mar", "mrt": "Mar",
+	"mei":      "May",
+	"augustus": "Aug",
+
+	// Portuguese
+	"janeiro":   "Jan",
+	"fevereiro": "Feb", "fev": "Feb",
+	"março":    "Mar",
+	"maio":     "May",
+	"junho":    "Jun",
+	"julho":    "Jul",
+	"setembro": "Sep",
+	"outubro":  "Oct", "out": "Oct",
+	"novembro": "Nov",
+	"dezembro": "Dec",
+}
+
+// Time zone abbreviations that feeds use. time.Parse only knows
+// the offsets of abbreviations used by the local time zone, and
+// treats anything else as UTC.
+var zoneOffsets = map[string]string{
+	"UT":   "+0000",
+	"UTC":  "+0000",
+	"GMT":  "+0000",
+	"Z":    "+0000",
+	"EST":  "-0500",
+	"EDT":  "-0400",
+	"CST":  "-0600",
+	"CDT":  "-0500",
+	"MST":  "-0700",
+	"MDT":  "-0600",
+	"PST":  "-0800",
+	"PDT":  "-0700",
+	"BST":  "+0100",
+	"CET":  "+0100",
+	"CEST": "+0200",
+	"AEST": "+1000",
+	"AEDT": "+1100",
+}
+
+// ISO 8601 layouts, which some RSS feeds use instead of RFC 822.
+var isoDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// Layouts for dates that have been normalised by parsePubdate,
+// i.e. without day names or commas, with English month names
+// and with numeric time zones.
+var pubdateLayouts = []string{
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04 -0700",
+	"2 Jan 2006 15:04:05",
+	"2 Jan 2006 15:04",
+	"2 Jan 2006",
+	"2 Jan 06 15:04:05 -0700",
+	"2 Jan 06 15:04 -0700",
+	"2 Jan 06 15:04:05",
+	"2 Jan 06",
+	"Jan 2 2006 15:04:05 -0700",
+	"Jan 2 2006 15:04 -0700",
+	"Jan 2 2006 15:04:05",
+	"Jan 2 2006 15:04",
+	"Jan 2 2006",
+	"Jan 2 06",
+	"2006 Jan 2 15:04:05 -0700",
+	"2006 Jan 2",
+}
+
+// Ordinal day numbers, e.g. 1st, 22nd, 17th.
+var rxOrdinal = regexp.MustCompile(`^(\d{1,2})(st|nd|rd|th)$`)
+
+// Numeric time zones with a colon, e.g. -05:00.
+var rxColonOffset = regexp.MustCompile(`^([+-]\d{2}):(\d{2})$`)
+
+var errBadPubdate = errors.New("unrecognised date format")
+
+// parsePubdate parses the dates that feeds actually contain, as
+// opposed to the RFC 822 dates they're supposed to contain. It
+// copes with things like non-standard abbreviations (Tues, Thur,
+// Sept), missing or misspelled day names, ordinal days, two-digit
+// years, non-English month names and ISO 8601 dates.
+func parsePubdate(s string) (time.Time, error) {
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, errBadPubdate
+	}
+
+	for _, layout := range isoDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+
+	s = normalisePubdate(s)
+
+	for _, layout := range pubdateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, errBadPubdate
+}
+
+// normalisePubdate rewrites a date in the form expected by
+// pubdateLayouts.
+func normalisePubdate(s string) string {
+
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || r == ','
+	})
+
+	// Day names are abbreviated in the same way as months, and
+	// some clash, e.g. "mar" is Tuesday in Spanish and March in
+	// English. So a leading word is taken to be the day if it's
+	// followed by a comma or if the month comes later.
+	if len(fields) > 1 && isLetters(fields[0]) {
+		rest := s[strings.Index(s, fields[0])+len(fields[0]):]
+		if strings.HasPrefix(strings.TrimSpace(rest), ",") || hasMonthName(fields[1:]) {
+			fields = fields[1:]
+		}
+	}
+
+	var parts []string
+
+	for _, f := range fields {
+
+		word := strings.ToLower(strings.TrimSuffix(f, "."))
+
+		if month, ok := monthNames[word]; ok {
+			parts = append(parts, month)
+			continue
+		}
+
+		if m := rxOrdinal.FindStringSubmatch(word); m != nil {
+			parts = append(parts, m[1])
+			continue
+		}
+
+		if offset, ok := zoneOffsets[strings.ToUpper(f)]; ok {
+			parts = append(parts, offset)
+			continue
+		}
+
+		if m := rxColonOffset.FindStringSubmatch(f); m != nil {
+			parts = append(parts, m[1]+m[2])
+			continue
+		}
+
+		// Anything else that's made up of letters is assumed
+		// to be a day name (in whatever language) and dropped.
+		if isLetters(word) {
+			continue
+		}
+
+		// The time may be followed by a zone with no space,
+		// e.g. 20:30:00Z.
+		f = strings.TrimSuffix(f, "Z")
+
+		parts = append(parts, f)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func hasMonthName(fields []string) bool {
+	for _, f := range fields {
+		if _, ok := monthNames[strings.ToLower(strings.TrimSuffix(f, "."))]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isLetters(s string) bool {
+	for _, r := range s {
+		if !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// lookupLastModified returns the Last-Modified time of the
+// file at the given URL. It's a variable so that tests can
+// avoid making network requests.
+var lookupLastModified = headLastModified
+
+func headLastModified(url string) (time.Time, error) {
+
+	req, err := newRequestMethod(http.MethodHead, url, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	resp, err := defaultClient.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, errors.New("bad status: " + resp.Status)
+	}
+
+	return http.ParseTime(resp.Header.Get("Last-Modified"))
+}
+
+// lookupMissingPubdates gives items that have no release date
+// the time their file was last modified on the server, which is
+// the best guess at when they were released.
+//
+// Feeds without dates tend to have lots of items, so the files
+// are looked up in parallel, with the same limits as feed
+// downloads, and only the first defaults.MaxPubdateLookups
+// items without dates are looked up. Feeds list their newest
+// items first, so older items miss out.
+func lookupMissingPubdates(items []*kibner.Item) {
+
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, defaults.MaxWorkers)
+	hosts := newHostLimiter(httpSettings.MaxPerHost)
+	lookups := 0
+
+	for _, item := range items {
+
+		if !item.Pubdate.IsZero() {
+			continue
+		}
+
+		if lookups == defaults.MaxPubdateLookups {
+			break
+		}
+		lookups++
+
+		wg.Add(1)
+		go func(item *kibner.Item) {
+			defer wg.Done()
+
+			release := hosts.acquire(item.URL)
+			workers <- struct{}{}
+			t, err := lookupLastModified(item.URL)
+			<-workers
+			release()
+
+			if err == nil && !t.IsZero() {
+				item.Pubdate = t
+			}
+		}(item)
+	}
+
+	wg.Wait()
+}
+
+// fillMissingPubdates gives items that still have no release
+// date the time Kibner first saw them.
+func fillMissingPubdates(items []*kibner.Item, firstSeen time.Time) {
+
+	// Pubdates are stored to the nearest second.
+	firstSeen = firstSeen.UTC().Truncate(time.Second)
+
+	for _, item := range items {
+		if item.Pubdate.IsZero() {
+			item.Pubdate = firstSeen
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	kibner "github.com/deepilla/kibner/internal/types"
+)
+
+func TestParsePubdate(t *testing.T) {
+
+	est := time.FixedZone("", -5*60*60)
+
+	tests := []struct {
+		Input string
+		Time  time.Time
+		Error bool
+	}{
+		{
+			// Standard RFC 822
+			Input: "Mon, 18 Sep 1972 01:30:00 +0000",
+			Time:  time.Date(1972, time.September, 18, 1, 30, 0, 0, time.UTC),
+		},
+		{
+			// Non-standard day and month abbreviations
+			Input: "Tues, 12 Sept 2017 09:00:00 -0500",
+			Time:  time.Date(2017, time.September, 12, 9, 0, 0, 0, est),
+		},
+		{
+			Input: "Thur, 14 Sept 2017 09:00:00 EST",
+			Time:  time.Date(2017, time.September, 14, 9, 0, 0, 0, est),
+		},
+		{
+			// Full day and month names
+			Input: "Thursday, 14 September 2017 09:00:00 GMT",
+			Time:  time.Date(2017, time.September, 14, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			// Wrong day name
+			Input: "Fri, 14 Sep 2017 09:00:00 GMT",
+			Time:  time.Date(2017, time.September, 14, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			// Missing day name
+			Input: "14 Sep 2017 09:00:00 +0000",
+			Time:  time.Date(2017, time.September, 14, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			// Ordinal day
+			Input: "17th Nov 1971 20:30:00 -0500",
+			Time:  time.Date(1971, time.November, 17, 20, 30, 0, 0, est),
+		},
+		{
+			// Two-digit year
+			Input: "Wed, 13 Sep 17 09:00 +0000",
+			Time:  time.Date(2017, time.September, 13, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			// Month first
+			Input: "September 13, 2017",
+			Time:  time.Date(2017, time.September, 13, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// Offset with a colon
+			Input: "Wed, 13 Sep 2017 09:00:00 -05:00",
+			Time:  time.Date(2017, time.September, 13, 9, 0, 0, 0, est),
+		},
+		{
+			// French
+			Input: "mer., 13 sept. 2017 09:00:00 +0000",
+			Time:  time.Date(2017, time.September, 13, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			// German
+			Input: "Mi, 13 Dez 2017 09:00:00 +0000",
+			Time:  time.Date(2017, time.December, 13, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			// Spanish
+			Input: "miércoles, 13 enero 2017 09:00:00 GMT",
+			Time:  time.Date(2017, time.January, 13, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			// Spanish day name that's also a month abbreviation
+			Input: "mar, 05 mar 2019 10:00:00 +0000",
+			Time:  time.Date(2019, time.March, 5, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			Input: "mar 05 mar 2019",
+			Time:  time.Date(2019, time.March, 5, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Input: "Mar 5, 2019",
+			Time:  time.Date(2019, time.March, 5, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// ISO 8601
+			Input: "2017-09-13T09:00:00Z",
+			Time:  time.Date(2017, time.September, 13, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			Input: "2017-09-13T09:00:00-05:00",
+			Time:  time.Date(2017, time.September, 13, 9, 0, 0, 0, est),
+		},
+		{
+			Input: "2017-09-13",
+			Time:  time.Date(2017, time.September, 13, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Input: "",
+			Error: true,
+		},
+		{
+			Input: "Last Tuesday",
+			Error: true,
+		},
+		{
+			Input: "13 Smarch 2017",
+			Error: true,
+		},
+	}
+
+	for _, test := range tests {
+
+		got, err := parsePubdate(test.Input)
+
+		if test.Error {
+			if err == nil {
+				t.Errorf("%q: expected parsePubdate to return an error, got %v", test.Input, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: parsePubdate returned error %q", test.Input, err)
+			continue
+		}
+
+		if !got.Equal(test.Time) {
+			t.Errorf("%q: expected parsePubdate to return %v, got %v", test.Input, test.Time, got)
+		}
+	}
+}
+
+func TestLookupMissingPubdates(t *testing.T) {
+
+	lastModified := time.Date(2017, time.September, 13, 9, 0, 0, 0, time.UTC)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/modified.mp3" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	}))
+	defer ts.Close()
+
+	saved := lookupLastModified
+	lookupLastModified = headLastModified
+	defer func() {
+		lookupLastModified = saved
+	}()
+
+	pubdate := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		Item    *kibner.Item
+		Pubdate time.Time
+	}{
+		{
+			// Items with a pubdate are left alone.
+			Item: &kibner.Item{
+				URL:     ts.URL + "/modified.mp3",
+				Pubdate: pubdate,
+			},
+			Pubdate: pubdate,
+		},
+		{
+			Item: &kibner.Item{
+				URL: ts.URL + "/modified.mp3",
+			},
+			Pubdate: lastModified,
+		},
+		{
+			Item: &kibner.Item{
+				URL: ts.URL + "/missing.mp3",
+			},
+		},
+	}
+
+	for i, test := range tests {
+
+		lookupMissingPubdates([]*kibner.Item{test.Item})
+
+		if got := test.Item.Pubdate; !got.Equal(test.Pubdate) {
+			t.Errorf("Test %d: expected lookupMissingPubdates to set Pubdate %v, got %v", i+1, test.Pubdate, got)
+		}
+	}
+}
+
+func TestLookupMissingPubdatesLimit(t *testing.T) {
+
+	defer func(n int) { defaults.MaxPubdateLookups = n }(defaults.MaxPubdateLookups)
+	defaults.MaxPubdateLookups = 2
+
+	lastModified := time.Date(2017, time.September, 13, 9, 0, 0, 0, time.UTC)
+	pubdate := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	saved := lookupLastModified
+	lookupLastModified = func(string) (time.Time, error) {
+		return lastModified, nil
+	}
+	defer func() {
+		lookupLastModified = saved
+	}()
+
+	items := []*kibner.Item{
+		{URL: "http://example.com/1.mp3"},
+		{URL: "http://example.com/2.mp3", Pubdate: pubdate},
+		{URL: "http://example.com/3.mp3"},
+		{URL: "http://example.com/4.mp3"},
+	}
+
+	lookupMissingPubdates(items)
+
+	// Items with dates don't count towards the limit.
+	for i, exp := range []time.Time{lastModified, pubdate, lastModified, {}} {
+		if got := items[i].Pubdate; !got.Equal(exp) {
+			t.Errorf("Item %d: expected Pubdate %v, got %v", i+1, exp, got)
+		}
+	}
+}
+
+func TestFillMissingPubdates(t *testing.T) {
+
+	pubdate := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	firstSeen := time.Date(2017, time.October, 1, 12, 0, 0, 500, time.UTC)
+
+	items := []*kibner.Item{
+		{URL: "http://example.com/1.mp3", Pubdate: pubdate},
+		{URL: "http://example.com/2.mp3"},
+	}
+
+	fillMissingPubdates(items, firstSeen)
+
+	for i, exp := range []time.Time{pubdate, firstSeen.Truncate(time.Second)} {
+		if got := items[i].Pubdate; !got.Equal(exp) {
+			t.Errorf("Item %d: expected Pubdate %v, got %v", i+1, exp, got)
+		}
+	}
+}
+
+func TestLookupMissingPubdatesInParallel(t *testing.T) {
+
+	defer func(n int) { defaults.MaxWorkers = n }(defaults.MaxWorkers)
+	defaults.MaxWorkers = 3
+
+	lastModified := time.Date(2017, time.September, 13, 9, 0, 0, 0, time.UTC)
+	started := make(chan struct{}, 10)
+	proceed := make(chan struct{})
+
+	saved := lookupLastModified
+	lookupLastModified = func(url string) (time.Time, error) {
+		started <- struct{}{}
+		<-proceed
+		return lastModified, nil
+	}
+	defer func() {
+		lookupLastModified = saved
+	}()
+
+	var items []*kibner.Item
+	for i := 0; i < 6; i++ {
+		items = append(items, &kibner.Item{URL: fmt.Sprintf("http://host%d.example.com/%d.mp3", i%3, i)})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		lookupMissingPubdates(items)
+		close(done)
+	}()
+
+	// All the workers should be busy at once.
+	for i := 0; i < defaults.MaxWorkers; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %d lookups at once, got %d", defaults.MaxWorkers, i)
+		}
+	}
+
+	close(proceed)
+	<-done
+
+	if n := len(started); n != len(items)-defaults.MaxWorkers {
+		t.Errorf("expected %d more lookups, got %d", len(items)-defaults.MaxWorkers, n)
+	}
+
+	for i, item := range items {
+		if !item.Pubdate.Equal(lastModified) {
+			t.Errorf("Item %d: expected Pubdate %v, got %v", i+1, lastModified, item.Pubdate)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Units that feeds use in durations like "45 min" or
+// "1 hr 5 mins" instead of hh:mm:ss.
+var durationUnits = map[string]time.Duration{
+	"ms":           time.Millisecond,
+	"msec":         time.Millisecond,
+	"msecs":        time.Millisecond,
+	"millisecond":  time.Millisecond,
+	"milliseconds": time.Millisecond,
+	"s":            time.Second,
+	"sec":          time.Second,
+	"secs":         time.Second,
+	"second":       time.Second,
+	"seconds":      time.Second,
+	"m":            time.Minute,
+	"min":          time.Minute,
+	"mins":         time.Minute,
+	"minute":       time.Minute,
+	"minutes":      time.Minute,
+	"h":            time.Hour,
+	"hr":           time.Hour,
+	"hrs":          time.Hour,
+	"hour":         time.Hour,
+	"hours":        time.Hour,
+}
+
+// A number followed by a unit, e.g. 45min or 1.5 hours.
+var rxDurationPart = regexp.MustCompile(`(\d+(?:\.\d+)?)\s*([a-z]+)\.?`)
+
+// maxDurationSeconds is the longest duration we expect to see
+// written as a plain number of seconds. Anything bigger is
+// assumed to be in milliseconds, which some feeds use.
+const maxDurationSeconds = 24 * 60 * 60
+
+// parseDuration parses an itunes:duration value. The spec
+// allows hh:mm:ss, mm:ss or a number of seconds, but feeds also
+// use fractional seconds (1:02:03.5), units (45 min, 1h 2m 3s)
+// and milliseconds. Durations are rounded to the nearest second.
+func parseDuration(s string) (time.Duration, error) {
+
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	var d time.Duration
+	var err error
+
+	if strings.IndexFunc(s, unicode.IsLetter) >= 0 {
+		d, err = parseDurationUnits(s)
+	} else {
+		d, err = parseDurationClock(s)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return d.Round(time.Second), nil
+}
+
+func parseDurationClock(hhmmss string) (time.Duration, error) {
+
+	var units []time.Duration
+	var duration time.Duration
+
+	parts := strings.Split(hhmmss, ":")
+
+	switch len(parts) {
+	case 1:
+		units = []time.Duration{time.Second}
+	case 2:
+		units = []time.Duration{time.Minute, time.Second}
+	case 3:
+		units = []time.Duration{time.Hour, time.Minute, time.Second}
+	default:
+		return 0, errors.New("invalid duration format: " + hhmmss)
+	}
+
+	for i := range parts {
+
+		// Only the seconds can have a fractional part.
+		var n float64
+		var err error
+		if i == len(parts)-1 {
+			n, err = strconv.ParseFloat(parts[i], 64)
+		} else {
+			var m int
+			m, err = strconv.Atoi(parts[i])
+			n = float64(m)
+		}
+
+		if err != nil {
+			return 0, errors.New("could not parse duration " + hhmmss + ": " + err.Error())
+		}
+		if n < 0 {
+			return 0, errors.New("invalid duration format: " + hhmmss)
+		}
+
+		duration += time.Duration(n * float64(units[i]))
+	}
+
+	if len(parts) == 1 && duration > maxDurationSeconds*time.Second {
+		duration /= time.Second / time.Millisecond
+	}
+
+	return duration, nil
+}
+
+func parseDurationUnits(s string) (time.Duration, error) {
+
+	var duration time.Duration
+
+	// Every part of the string has to be a number and a unit
+	// (apart from separators), otherwise we're just guessing.
+	rest := rxDurationPart.ReplaceAllStringFunc(s, func(part string) string {
+		m := rxDurationPart.FindStringSubmatch(part)
+		unit, ok := durationUnits[m[2]]
+		if !ok {
+			return part
+		}
+		n, _ := strconv.ParseFloat(m[1], 64)
+		duration += time.Duration(n * float64(unit))
+		return ""
+	})
+
+	if rest == s {
+		return 0, errors.New("invalid duration format: " + s)
+	}
+
+	words := strings.FieldsFunc(rest, func(r rune) bool {
+		return unicode.IsSpace(r) || r == ','
+	})
+
+	for _, w := range words {
+		if w != "and" {
+			return 0, errors.New("invalid duration format: " + s)
+		}
+	}
+
+	return duration, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+
+	tests := []struct {
+		Input    string
+		Duration time.Duration
+		Error    bool
+	}{
+		{
+			Input:    "1:02:03",
+			Duration: time.Hour + 2*time.Minute + 3*time.Second,
+		},
+		{
+			Input:    "62:03",
+			Duration: 62*time.Minute + 3*time.Second,
+		},
+		{
+			Input:    "3723",
+			Duration: 3723 * time.Second,
+		},
+		{
+			Input:    " 01:02:03 ",
+			Duration: time.Hour + 2*time.Minute + 3*time.Second,
+		},
+		{
+			// Fractional seconds
+			Input:    "1:02:03.5",
+			Duration: time.Hour + 2*time.Minute + 4*time.Second,
+		},
+		{
+			Input:    "3723.2",
+			Duration: 3723 * time.Second,
+		},
+		{
+			// Milliseconds
+			Input:    "3723000",
+			Duration: 3723 * time.Second,
+		},
+		{
+			Input:    "3723000ms",
+			Duration: 3723 * time.Second,
+		},
+		{
+			// Units
+			Input:    "45 min",
+			Duration: 45 * time.Minute,
+		},
+		{
+			Input:    "45 Mins.",
+			Duration: 45 * time.Minute,
+		},
+		{
+			Input:    "1h2m3s",
+			Duration: time.Hour + 2*time.Minute + 3*time.Second,
+		},
+		{
+			Input:    "1 hr, 5 minutes",
+			Duration: time.Hour + 5*time.Minute,
+		},
+		{
+			Input:    "1 hour and 30 seconds",
+			Duration: time.Hour + 30*time.Second,
+		},
+		{
+			Input:    "1.5 hours",
+			Duration: 90 * time.Minute,
+		},
+		{
+			Input: "",
+			Error: true,
+		},
+		{
+			Input: "xxx",
+			Error: true,
+		},
+		{
+			Input: "1:2:3:4",
+			Error: true,
+		},
+		{
+			Input: "1:-2:03",
+			Error: true,
+		},
+		{
+			Input: "1.5:00",
+			Error: true,
+		},
+		{
+			Input: "45 fortnights",
+			Error: true,
+		},
+		{
+			Input: "about 45 min",
+			Error: true,
+		},
+	}
+
+	for _, test := range tests {
+
+		got, err := parseDuration(test.Input)
+
+		if test.Error {
+			if err == nil {
+				t.Errorf("%q: expected parseDuration to return an error, got %s", test.Input, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: parseDuration returned error %q", test.Input, err)
+			continue
+		}
+
+		if got != test.Duration {
+			t.Errorf("%q: expected parseDuration to return %s, got %s", test.Input, test.Duration, got)
+		}
+	}
+}
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// gpodderClient talks to a server that implements the
+// gpodder.net API (version 2). Only the subscription and
+// episode action endpoints are supported.
+type gpodderClient struct {
+	Server   string
+	Username string
+	Password string
+	Device   string
+	client   *http.Client
+}
+
+func newGpodderClient(server, username, password, device string) *gpodderClient {
+	return &gpodderClient{
+		Server:   strings.TrimRight(server, "/"),
+		Username: username,
+		Password: password,
+		Device:   device,
+		client:   defaultClient,
+	}
+}
+
+// account returns a key that identifies the server, user
+// and device combination in the database.
+func (c *gpodderClient) account() string {
+	return c.Server + "/" + c.Username + "/" + c.Device
+}
+
+type gpodderSubscriptionChanges struct {
+	Add       []string `json:"add"`
+	Remove    []string `json:"remove"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+type gpodderUpdateResult struct {
+	Timestamp  int64       `json:"timestamp"`
+	UpdateURLs [][2]string `json:"update_urls"`
+}
+
+const (
+	gpodderActionNew      = "new"
+	gpodderActionPlay     = "play"
+	gpodderActionDownload = "download"
+	gpodderActionDelete   = "delete"
+)
+
+type gpodderEpisodeAction struct {
+	Podcast   string      `json:"podcast"`
+	Episode   string      `json:"episode"`
+	GUID      string      `json:"guid,omitempty"`
+	Device    string      `json:"device,omitempty"`
+	Action    string      `json:"action"`
+	Timestamp gpodderTime `json:"timestamp"`
+	Started   *int64      `json:"started,omitempty"`
+	Position  *int64      `json:"position,omitempty"`
+	Total     *int64      `json:"total,omitempty"`
+}
+
+type gpodderEpisodeActions struct {
+	Actions   []*gpodderEpisodeAction `json:"actions"`
+	Timestamp int64                   `json:"timestamp"`
+}
+
+// gpodderTime is a timestamp in the format used by the
+// gpodder.net API, e.g. "2009-12-12T09:00:00". Times are
+// always in UTC.
+type gpodderTime time.Time
+
+const gpodderTimeLayout = "2006-01-02T15:04:05"
+
+func (gt gpodderTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Time(gt).UTC().Format(gpodderTimeLayout))
+}
+
+func (gt *gpodderTime) UnmarshalJSON(data []byte) error {
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	t, err := time.Parse(gpodderTimeLayout, s)
+	if err != nil {
+		// Some servers include a timezone.
+		if t, err = time.Parse(time.RFC3339, s); err != nil {
+			return errors.New("unsupported date format: " + s)
+		}
+	}
+
+	*gt = gpodderTime(t)
+	return nil
+}
+
+func (c *gpodderClient) subscriptionsURL() string {
+	return fmt.Sprintf("%s/api/2/subscriptions/%s/%s.json", c.Server, url.PathEscape(c.Username), url.PathEscape(c.Device))
+}
+
+func (c *gpodderClient) episodesURL() string {
+	return fmt.Sprintf("%s/api/2/episodes/%s.json", c.Server, url.PathEscape(c.Username))
+}
+
+func (c *gpodderClient) getSubscriptions(since int64) (*gpodderSubscriptionChanges, error) {
+
+	var changes gpodderSubscriptionChanges
+
+	u := fmt.Sprintf("%s?since=%d", c.subscriptionsURL(), since)
+	if err := c.do(http.MethodGet, u, nil, &changes); err != nil {
+		return nil, err
+	}
+
+	return &changes, nil
+}
+
+func (c *gpodderClient) uploadSubscriptions(add, remove []string) (*gpodderUpdateResult, error) {
+
+	// The API expects empty arrays rather than nulls.
+	if add == nil {
+		add = []string{}
+	}
+	if remove == nil {
+		remove = []string{}
+	}
+
+	data := map[string][]string{
+		"add":    add,
+		"remove": remove,
+	}
+
+	var res gpodderUpdateResult
+	if err := c.do(http.MethodPost, c.subscriptionsURL(), data, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (c *gpodderClient) getEpisodeActions(since int64) (*gpodderEpisodeActions, error) {
+
+	var actions gpodderEpisodeActions
+
+	u := fmt.Sprintf("%s?since=%d", c.episodesURL(), since)
+	if err := c.do(http.MethodGet, u, nil, &actions); err != nil {
+		return nil, err
+	}
+
+	return &actions, nil
+}
+
+func (c *gpodderClient) uploadEpisodeActions(actions []*gpodderEpisodeAction) (*gpodderUpdateResult, error) {
+
+	if actions == nil {
+		actions = []*gpodderEpisodeAction{}
+	}
+
+	var res gpodderUpdateResult
+	if err := c.do(http.MethodPost, c.episodesURL(), actions, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (c *gpodderClient) do(method string, url string, data interface{}, result interface{}) error {
+
+	var body io.Reader
+
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := newRequestMethod(method, url, body)
+	if err != nil {
+		return errors.New("bad request: " + err.Error())
+	}
+
+	req.SetBasicAuth(c.Username, c.Password)
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.New("fetch error: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("bad status: " + resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return errors.New("parse error: " + err.Error())
+	}
+
+	return nil
+}
+
+type gpodderResult struct {
+	LocalAdds      []*syncResult
+	LocalRemoves   int
+	RemoteAdds     int
+	RemoteRemoves  int
+	ActionsSent    int
+	ActionsApplied int
+	ActionsSkipped int
+}
+
+// gpodderSync synchronises subscriptions and episode actions
+// with a gpodder.net-compatible server. Remote subscription
+// changes are applied before local ones are uploaded. Episode
+// actions are matched to items by GUID or enclosure URL, and
+// conflicts are resolved in favour of the most recent change.
+func gpodderSync(db *sql.DB, hooks *hookRunner, c *gpodderClient) (*gpodderResult, error) {
+
+	state, err := loadGpodderState(db, c.account())
+	if err != nil {
+		return nil, err
+	}
+
+	res := &gpodderResult{}
+
+	if err := gpodderSyncSubscriptions(db, hooks, c, state, res); err != nil {
+		return nil, errors.New("could not sync subscriptions: " + err.Error())
+	}
+
+	if err := gpodderSyncActions(db, c, state, res); err != nil {
+		return nil, errors.New("could not sync episode actions: " + err.Error())
+	}
+
+	return res, nil
+}
+
+type gpodderState struct {
+	Account       string
+	Subscriptions int64
+	Actions       int64
+	Uploaded      time.Time
+	urls          map[string]bool
+}
+
+func loadGpodderState(db *sql.DB, account string) (*gpodderState, error) {
+
+	state := &gpodderState{
+		Account: account,
+	}
+
+	q := "SELECT subscriptions, actions, uploaded FROM gpodder_state WHERE account = ?"
+
+	err := db.QueryRow(q, account).Scan(&state.Subscriptions, &state.Actions, &state.Uploaded)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	urls, err := queryStrings(db, "SELECT url FROM gpodder_subscriptions WHERE account = ?", account)
+	if err != nil {
+		return nil, err
+	}
+
+	state.urls = make(map[string]bool, len(urls))
+	for _, u := range urls {
+		state.urls[u] = true
+	}
+
+	return state, nil
+}
+
+func saveGpodderState(db *sql.DB, state *gpodderState) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	q := "INSERT OR REPLACE INTO gpodder_state(account, subscriptions, actions, uploaded) VALUES(?, ?, ?, ?)"
+
+	_, err = tx.Exec(q, state.Account, state.Subscriptions, state.Actions, state.Uploaded.Unix())
+	if err != nil {
+		return rollback(tx, err)
+	}
+
+	_, err = tx.Exec("DELETE FROM gpodder_subscriptions WHERE account = ?", state.Account)
+	if err != nil {
+		return rollback(tx, err)
+	}
+
+	for u := range state.urls {
+		_, err = tx.Exec("INSERT INTO gpodder_subscriptions(account, url) VALUES(?, ?)", state.Account, u)
+		if err != nil {
+			return rollback(tx, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func gpodderSyncSubscriptions(db *sql.DB, hooks *hookRunner, c *gpodderClient, state *gpodderState, res *gpodderResult) error {
+
+	remote, err := c.getSubscriptions(state.Subscriptions)
+	if err != nil {
+		return err
+	}
+
+	local, err := loadFeedIDsByURL(db)
+	if err != nil {
+		return err
+	}
+
+	// Apply remote changes. Remote adds for feeds that have
+	// been removed locally since the last sync are ignored
+	// (the removal is uploaded below). Likewise, remote
+	// removals for feeds added locally since the last sync.
+
+	var adds []string
+	var failed bool
+
+	for _, u := range remote.Add {
+		if _, ok := local[u]; ok || state.urls[u] {
+			continue
+		}
+		adds = append(adds, u)
+	}
+
+	if len(adds) > 0 {
+		for _, r := range addFeedMultiple(db, hooks, adds, nil) {
+			res.LocalAdds = append(res.LocalAdds, r)
+			if r.Err != nil {
+				failed = true
+				continue
+			}
+			// Feeds can redirect, in which case r.URL is not
+			// the URL that the server sent us. Either way, it
+			// doesn't need uploading.
+			local[r.URL] = r.ID
+			state.urls[r.URL] = true
+		}
+	}
+
+	for _, u := range remote.Remove {
+		id, ok := local[u]
+		if !ok || !state.urls[u] {
+			continue
+		}
+		if err := removeFeed(db, hooks, id); err != nil {
+			return err
+		}
+		delete(local, u)
+		delete(state.urls, u)
+		res.LocalRemoves++
+	}
+
+	// Upload local changes.
+
+	var add, remove []string
+
+	for u := range local {
+		if !state.urls[u] {
+			add = append(add, u)
+		}
+	}
+
+	for u := range state.urls {
+		if _, ok := local[u]; !ok {
+			remove = append(remove, u)
+		}
+	}
+
+	timestamp := remote.Timestamp
+
+	if len(add) > 0 || len(remove) > 0 {
+
+		upd, err := c.uploadSubscriptions(add, remove)
+		if err != nil {
+			return err
+		}
+
+		timestamp = upd.Timestamp
+		res.RemoteAdds = len(add)
+		res.RemoteRemoves = len(remove)
+
+		// The server may rewrite URLs that it considers
+		// invalid. Use the rewritten URLs locally so that
+		// the two sides stay in step.
+		for _, u := range upd.UpdateURLs {
+
+			oldURL, newURL := u[0], u[1]
+
+			id, ok := local[oldURL]
+			if !ok || newURL == "" || newURL == oldURL {
+				continue
+			}
+			if _, exists := local[newURL]; exists {
+				continue
+			}
+
+			if err := updateFeed(db, id, map[string]interface{}{"url": newURL}); err != nil {
+				return err
+			}
+
+			delete(local, oldURL)
+			local[newURL] = id
+		}
+	}
+
+	state.urls = make(map[string]bool, len(local))
+	for u := range local {
+		state.urls[u] = true
+	}
+
+	// If a remote add failed, keep the old timestamp so that
+	// the server sends the add again next time. Everything
+	// else it resends has already been applied and is skipped.
+	if !failed {
+		state.Subscriptions = timestamp
+	}
+
+	return saveGpodderState(db, state)
+}
+
+func loadFeedIDsByURL(db *sql.DB) (map[string]int64, error) {
+
+	var rows []struct {
+		ID  int64
+		URL string
+	}
+
+	if err := queryRows(&rows, db, "SELECT id, url FROM feeds"); err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]int64, len(rows))
+	for _, r := range rows {
+		ids[r.URL] = r.ID
+	}
+
+	return ids, nil
+}
+
+// gpodderPlayedMargin is how close to the end of an episode
+// a remote play action has to be for kibner to consider the
+// episode played.
+const gpodderPlayedMargin = 60 * time.Second
+
+func gpodderSyncActions(db *sql.DB, c *gpodderClient, state *gpodderState, res *gpodderResult) error {
+
+	now := time.Now()
+
+	local, err := loadGpodderActions(db, c.Device, state.Uploaded)
+	if err != nil {
+		return err
+	}
+
+	if len(local) > 0 {
+		if _, err := c.uploadEpisodeActions(local); err != nil {
+			return err
+		}
+		res.ActionsSent = len(local)
+	}
+
+	remote, err := c.getEpisodeActions(state.Actions)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range remote.Actions {
+
+		if a.Device == c.Device {
+			// Our own actions, echoed back to us.
+			continue
+		}
+
+		ok, err := applyGpodderAction(db, a)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			res.ActionsApplied++
+		} else {
+			res.ActionsSkipped++
+		}
+	}
+
+	state.Actions = remote.Timestamp
+	state.Uploaded = now
+
+	return saveGpodderState(db, state)
+}
+
+// loadGpodderActions converts local changes to played status
+// and playback position into episode actions. Kibner doesn't
+// download files itself so it only ever reports play and new
+// actions; download and delete actions from other devices are
+// skipped by applyGpodderAction. Played items are sent with a total equal to their
+// position, even if their duration is unknown, because a play
+// action without a total is only a position update.
+//
+// Timestamps are stored to the nearest second, so changes made
+// in the same second as the last upload are sent again. That's
+// harmless because the server keeps the most recent action for
+// each episode.
+func loadGpodderActions(db *sql.DB, device string, since time.Time) ([]*gpodderEpisodeAction, error) {
+
+	q :=
+		`SELECT
+			f.url,
+			i.url,
+			i.guid,
+			i.unplayed,
+			i.position,
+			i.duration,
+			i.updated
+		FROM
+			items i
+		INNER JOIN
+			feeds f ON f.id = i.feedid
+		WHERE
+			i.updated > 0 AND i.updated >= ?
+		ORDER BY
+			i.updated`
+
+	var rows []struct {
+		FeedURL  string
+		URL      string
+		GUID     string
+		Unplayed bool
+		Position int64
+		Duration int64
+		Updated  time.Time
+	}
+
+	if err := queryRows(&rows, db, q, since.Unix()); err != nil {
+		return nil, err
+	}
+
+	actions := make([]*gpodderEpisodeAction, len(rows))
+
+	for i, r := range rows {
+
+		a := &gpodderEpisodeAction{
+			Podcast:   r.FeedURL,
+			Episode:   r.URL,
+			GUID:      r.GUID,
+			Device:    device,
+			Action:    gpodderActionNew,
+			Timestamp: gpodderTime(r.Updated),
+		}
+
+		if !r.Unplayed || r.Position > 0 {
+
+			position, total := r.Position, r.Duration
+			if !r.Unplayed {
+				if total > 0 {
+					position = total
+				} else {
+					total = position
+				}
+			}
+
+			var started int64
+			a.Action = gpodderActionPlay
+			a.Started = &started
+			a.Position = &position
+			if total > 0 || !r.Unplayed {
+				a.Total = &total
+			}
+		}
+
+		actions[i] = a
+	}
+
+	return actions, nil
+}
+
+// applyGpodderAction updates the item referred to by a remote
+// episode action. It returns false if the item could not be
+// found, the action is older than the local state, or the
+// action has no meaning for kibner.
+//
+// A play action only marks an item as played if it gets to
+// (or near) the end, which needs a total. Without one, it's
+// just a position update. Download and delete actions are
+// skipped: kibner doesn't keep downloaded files, and deleting
+// a file on another device says nothing about whether the
+// episode was played.
+func applyGpodderAction(db *sql.DB, a *gpodderEpisodeAction) (bool, error) {
+
+	unplayed := true
+
+	switch a.Action {
+	case gpodderActionNew, gpodderActionPlay:
+	default:
+		return false, nil
+	}
+
+	q :=
+		`SELECT
+			i.ROWID,
+			i.updated
+		FROM
+			items i
+		INNER JOIN
+			feeds f ON f.id = i.feedid
+		WHERE
+			f.url = ? AND (i.guid = ? OR i.url = ?)
+		ORDER BY
+			i.guid = ? DESC
+		LIMIT 1`
+
+	guid := a.GUID
+	if guid == "" {
+		guid = a.Episode
+	}
+
+	var id int64
+	var updated time.Time
+
+	err := db.QueryRow(q, a.Podcast, guid, a.Episode, guid).Scan(&id, &updated)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := time.Time(a.Timestamp)
+	if !timestamp.After(updated) {
+		return false, nil
+	}
+
+	var position int64
+	if a.Position != nil {
+		position = *a.Position
+	}
+
+	if a.Action == gpodderActionPlay && a.Total != nil {
+		remaining := time.Duration(*a.Total-position) * time.Second
+		unplayed = position < *a.Total && remaining > gpodderPlayedMargin
+	}
+
+	if a.Action == gpodderActionPlay && !unplayed {
+		position = 0
+	}
+
+	q = "UPDATE items SET unplayed = ?, position = ?, updated = ? WHERE ROWID = ?"
+
+	if _, err := db.Exec(q, unplayed, position, timestamp.Unix(), id); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
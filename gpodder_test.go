@@ -0,0 +1,710 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGpodder is an in-memory implementation of the
+// gpodder.net subscription and episode action APIs.
+type fakeGpodder struct {
+	sync.Mutex
+	Username string
+	Password string
+	clock    int64
+	subs     []fakeGpodderSub
+	actions  []fakeGpodderAction
+}
+
+type fakeGpodderSub struct {
+	URL       string
+	Add       bool
+	Timestamp int64
+}
+
+type fakeGpodderAction struct {
+	*gpodderEpisodeAction
+	Timestamp int64
+}
+
+func newFakeGpodder(username, password string) *fakeGpodder {
+	return &fakeGpodder{
+		Username: username,
+		Password: password,
+	}
+}
+
+func (s *fakeGpodder) tick() int64 {
+	s.clock++
+	return s.clock
+}
+
+func (s *fakeGpodder) Subscribe(add bool, urls ...string) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	ts := s.tick()
+	for _, u := range urls {
+		s.subs = append(s.subs, fakeGpodderSub{u, add, ts})
+	}
+}
+
+func (s *fakeGpodder) AddActions(actions ...*gpodderEpisodeAction) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	ts := s.tick()
+	for _, a := range actions {
+		s.actions = append(s.actions, fakeGpodderAction{a, ts})
+	}
+}
+
+// Subscriptions returns the server's current subscriptions.
+func (s *fakeGpodder) Subscriptions() []string {
+
+	s.Lock()
+	defer s.Unlock()
+
+	add, _ := s.changesSince(0)
+	sort.Strings(add)
+	return add
+}
+
+// Actions returns the actions uploaded by the given device.
+func (s *fakeGpodder) Actions(device string) []*gpodderEpisodeAction {
+
+	s.Lock()
+	defer s.Unlock()
+
+	var actions []*gpodderEpisodeAction
+	for _, a := range s.actions {
+		if a.Device == device {
+			actions = append(actions, a.gpodderEpisodeAction)
+		}
+	}
+
+	return actions
+}
+
+func (s *fakeGpodder) changesSince(since int64) ([]string, []string) {
+
+	state := map[string]bool{}
+	for _, sub := range s.subs {
+		if sub.Timestamp > since {
+			state[sub.URL] = sub.Add
+		}
+	}
+
+	var add, remove []string
+	for u, ok := range state {
+		if ok {
+			add = append(add, u)
+		} else if since > 0 {
+			remove = append(remove, u)
+		}
+	}
+
+	return add, remove
+}
+
+func (s *fakeGpodder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if user, password, ok := r.BasicAuth(); !ok || user != s.Username || password != s.Password {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	var result interface{}
+
+	switch {
+
+	case strings.HasPrefix(r.URL.Path, "/api/2/subscriptions/"+s.Username+"/"):
+
+		if r.Method == http.MethodGet {
+			add, remove := s.changesSince(since)
+			result = map[string]interface{}{
+				"add":       add,
+				"remove":    remove,
+				"timestamp": s.clock,
+			}
+			break
+		}
+
+		var data struct {
+			Add    []string `json:"add"`
+			Remove []string `json:"remove"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		ts := s.tick()
+		for _, u := range data.Add {
+			s.subs = append(s.subs, fakeGpodderSub{u, true, ts})
+		}
+		for _, u := range data.Remove {
+			s.subs = append(s.subs, fakeGpodderSub{u, false, ts})
+		}
+
+		result = map[string]interface{}{
+			"timestamp":   ts,
+			"update_urls": [][2]string{},
+		}
+
+	case r.URL.Path == "/api/2/episodes/"+s.Username+".json":
+
+		if r.Method == http.MethodGet {
+			actions := []*gpodderEpisodeAction{}
+			for _, a := range s.actions {
+				if a.Timestamp > since {
+					actions = append(actions, a.gpodderEpisodeAction)
+				}
+			}
+			result = map[string]interface{}{
+				"actions":   actions,
+				"timestamp": s.clock,
+			}
+			break
+		}
+
+		var data []*gpodderEpisodeAction
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		ts := s.tick()
+		for _, a := range data {
+			s.actions = append(s.actions, fakeGpodderAction{a, ts})
+		}
+
+		result = map[string]interface{}{
+			"timestamp":   ts,
+			"update_urls": [][2]string{},
+		}
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
+
+func TestGpodderSync(t *testing.T) {
+	testWithInitDB(t, testGpodderSync)
+}
+
+func testGpodderSync(t *testing.T, db *sql.DB) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	server := newFakeGpodder("alice", "secret")
+	gs := httptest.NewServer(server)
+	defer gs.Close()
+
+	urls := map[string]string{}
+	for _, name := range []string{"Serial", "S-Town", "Rabbits", "Mogul"} {
+		urls[name] = serverURL(ts, allTestCases[name].Filename)
+	}
+
+	serial := allTestCases["Serial"].NewFeed()
+	stown := allTestCases["S-Town"].NewFeed()
+
+	ids := map[string]int64{}
+	for _, name := range []string{"Serial", "S-Town"} {
+		res, err := addFeed(db, nil, urls[name])
+		if err != nil {
+			t.Fatalf("%s: addFeed returned error %q", name, err)
+		}
+		ids[name] = res.ID
+	}
+
+	// Subscriptions and episode actions from another device.
+
+	server.Subscribe(true, urls["Rabbits"], urls["Mogul"])
+
+	position, total := int64(100), int64(3000)
+	earlier := gpodderTime(time.Now().Add(-time.Hour))
+
+	server.AddActions(
+		&gpodderEpisodeAction{
+			Podcast:   urls["Serial"],
+			Episode:   serial.Items[0].URL,
+			GUID:      serial.Items[0].GUID,
+			Device:    "phone",
+			Action:    gpodderActionNew,
+			Timestamp: earlier,
+		},
+		&gpodderEpisodeAction{
+			Podcast:   urls["S-Town"],
+			Episode:   stown.Items[1].URL,
+			Device:    "phone",
+			Action:    gpodderActionPlay,
+			Timestamp: earlier,
+			Position:  &position,
+			Total:     &total,
+		},
+		&gpodderEpisodeAction{
+			Podcast:   urls["S-Town"],
+			Episode:   "http://example.com/no-such-episode.mp3",
+			Device:    "phone",
+			Action:    gpodderActionPlay,
+			Timestamp: earlier,
+		},
+	)
+
+	c := newGpodderClient(gs.URL, "alice", "secret", "kibner")
+
+	res, err := gpodderSync(db, nil, c)
+	if err != nil {
+		t.Fatalf("gpodderSync returned error %q", err)
+	}
+
+	exp := &gpodderResult{
+		LocalAdds:      res.LocalAdds,
+		RemoteAdds:     2,
+		ActionsApplied: 2,
+		ActionsSkipped: 1,
+	}
+	verifyGpodderResult(t, res, exp, 2)
+
+	verifyTables(t, db, map[string]int{
+		"feeds":                 4,
+		"items":                 len(serial.Items) + len(stown.Items) + len(allTestCases["Rabbits"].NewFeed().Items) + len(allTestCases["Mogul"].NewFeed().Items),
+		"sqlite_sequence":       2,
+		"gpodder_state":         1,
+		"gpodder_subscriptions": 4,
+	})
+
+	verifyUnplayedItemCount(t, db, ids["Serial"], 1)
+	verifyUnplayedItemCount(t, db, ids["S-Town"], 1)
+	verifyItemPosition(t, db, ids["S-Town"], stown.Items[1].GUID, position)
+
+	if got, exp := server.Subscriptions(), sortedValues(urls); !equalStringSlices(got, exp) {
+		t.Errorf("Expected server subscriptions %q, got %q", exp, got)
+	}
+
+	// Local changes, plus a removal from another device.
+
+	if err := updatePlayedStatus(db, nil, false, itemIDByURL(t, db, stown.Items[0].URL)); err != nil {
+		t.Fatalf("updatePlayedStatus returned error %q", err)
+	}
+
+	mogulID := res.LocalAdds[0].ID
+	if res.LocalAdds[0].URL != urls["Mogul"] {
+		mogulID = res.LocalAdds[1].ID
+	}
+	if err := removeFeed(db, nil, mogulID); err != nil {
+		t.Fatalf("removeFeed returned error %q", err)
+	}
+
+	server.Subscribe(false, urls["Rabbits"])
+
+	res, err = gpodderSync(db, nil, c)
+	if err != nil {
+		t.Fatalf("gpodderSync returned error %q", err)
+	}
+
+	exp = &gpodderResult{
+		LocalRemoves:  1,
+		RemoteRemoves: 1,
+		ActionsSent:   1,
+	}
+	verifyGpodderResult(t, res, exp, 0)
+
+	verifyTables(t, db, map[string]int{
+		"feeds":                 2,
+		"items":                 len(serial.Items) + len(stown.Items),
+		"sqlite_sequence":       2,
+		"gpodder_state":         1,
+		"gpodder_subscriptions": 2,
+	})
+
+	delete(urls, "Rabbits")
+	delete(urls, "Mogul")
+
+	if got, exp := server.Subscriptions(), sortedValues(urls); !equalStringSlices(got, exp) {
+		t.Errorf("Expected server subscriptions %q, got %q", exp, got)
+	}
+
+	actions := server.Actions("kibner")
+	if len(actions) != 1 {
+		t.Fatalf("Expected 1 uploaded action, got %d", len(actions))
+	}
+
+	if a := actions[0]; a.Action != gpodderActionNew || a.Episode != stown.Items[0].URL || a.GUID != stown.Items[0].GUID || a.Podcast != urls["S-Town"] {
+		t.Errorf("Unexpected episode action %s", jsonify(a))
+	}
+}
+
+func TestGpodderSyncFailedAdd(t *testing.T) {
+	testWithInitDB(t, testGpodderSyncFailedAdd)
+}
+
+func testGpodderSyncFailedAdd(t *testing.T, db *sql.DB) {
+
+	var mu sync.Mutex
+	broken := true
+
+	files := http.FileServer(http.Dir("internal/testdata/rss"))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if broken {
+			http.NotFound(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	server := newFakeGpodder("alice", "secret")
+	gs := httptest.NewServer(server)
+	defer gs.Close()
+
+	feedURL := serverURL(ts, allTestCases["Serial"].Filename)
+	server.Subscribe(true, feedURL)
+
+	c := newGpodderClient(gs.URL, "alice", "secret", "kibner")
+
+	res, err := gpodderSync(db, nil, c)
+	if err != nil {
+		t.Fatalf("gpodderSync returned error %q", err)
+	}
+
+	if len(res.LocalAdds) != 1 || res.LocalAdds[0].Err == nil {
+		t.Fatalf("Expected 1 failed local add, got %s", jsonify(res.LocalAdds))
+	}
+
+	verifyTables(t, db, map[string]int{
+		"feeds":                 0,
+		"items":                 0,
+		"sqlite_sequence":       1,
+		"gpodder_state":         1,
+		"gpodder_subscriptions": 0,
+	})
+
+	// The add should be retried once the feed is back.
+
+	mu.Lock()
+	broken = false
+	mu.Unlock()
+
+	res, err = gpodderSync(db, nil, c)
+	if err != nil {
+		t.Fatalf("gpodderSync returned error %q", err)
+	}
+
+	verifyGpodderResult(t, res, &gpodderResult{}, 1)
+
+	verifyTables(t, db, map[string]int{
+		"feeds":                 1,
+		"items":                 len(allTestCases["Serial"].NewFeed().Items),
+		"sqlite_sequence":       2,
+		"gpodder_state":         1,
+		"gpodder_subscriptions": 1,
+	})
+
+	if got, exp := server.Subscriptions(), []string{feedURL}; !equalStringSlices(got, exp) {
+		t.Errorf("Expected server subscriptions %q, got %q", exp, got)
+	}
+}
+
+func TestApplyGpodderAction(t *testing.T) {
+	testWithInitDB(t, testApplyGpodderAction)
+}
+
+func testApplyGpodderAction(t *testing.T, db *sql.DB) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	feedURL := serverURL(ts, allTestCases["Serial"].Filename)
+
+	res, err := addFeed(db, nil, feedURL)
+	if err != nil {
+		t.Fatalf("addFeed returned error %q", err)
+	}
+
+	item := allTestCases["Serial"].NewFeed().Items[0]
+
+	int64p := func(n int64) *int64 { return &n }
+
+	tests := []struct {
+		Name     string
+		Action   string
+		Position *int64
+		Total    *int64
+		Applied  bool
+		Unplayed bool
+		ExpPos   int64
+	}{
+		{
+			Name:     "Play without a total",
+			Action:   gpodderActionPlay,
+			Position: int64p(600),
+			Applied:  true,
+			Unplayed: true,
+			ExpPos:   600,
+		},
+		{
+			Name:     "Play part of the way",
+			Action:   gpodderActionPlay,
+			Position: int64p(700),
+			Total:    int64p(3000),
+			Applied:  true,
+			Unplayed: true,
+			ExpPos:   700,
+		},
+		{
+			Name:     "Play to near the end",
+			Action:   gpodderActionPlay,
+			Position: int64p(2990),
+			Total:    int64p(3000),
+			Applied:  true,
+		},
+		{
+			Name:     "New",
+			Action:   gpodderActionNew,
+			Applied:  true,
+			Unplayed: true,
+		},
+		{
+			Name:     "Play to the end of an unknown duration",
+			Action:   gpodderActionPlay,
+			Position: int64p(0),
+			Total:    int64p(0),
+			Applied:  true,
+		},
+		{
+			Name:   "Download",
+			Action: gpodderActionDownload,
+		},
+		{
+			Name:   "Delete",
+			Action: gpodderActionDelete,
+		},
+	}
+
+	timestamp := time.Now().Add(time.Hour)
+
+	for _, test := range tests {
+
+		// Each action needs to be newer than the last.
+		timestamp = timestamp.Add(time.Minute)
+
+		applied, err := applyGpodderAction(db, &gpodderEpisodeAction{
+			Podcast:   feedURL,
+			Episode:   item.URL,
+			GUID:      item.GUID,
+			Action:    test.Action,
+			Timestamp: gpodderTime(timestamp),
+			Position:  test.Position,
+			Total:     test.Total,
+		})
+		if err != nil {
+			t.Fatalf("%s: applyGpodderAction returned error %q", test.Name, err)
+		}
+
+		if applied != test.Applied {
+			t.Errorf("%s: expected applyGpodderAction to return %t, got %t", test.Name, test.Applied, applied)
+		}
+
+		if !test.Applied {
+			continue
+		}
+
+		var unplayed bool
+		if err := db.QueryRow("SELECT unplayed FROM items WHERE feedid = ? AND guid = ?", res.ID, item.GUID).Scan(&unplayed); err != nil {
+			t.Fatalf("%s: Error querying item: %s", test.Name, err)
+		}
+
+		if unplayed != test.Unplayed {
+			t.Errorf("%s: expected unplayed to be %t, got %t", test.Name, test.Unplayed, unplayed)
+		}
+
+		verifyItemPosition(t, db, res.ID, item.GUID, test.ExpPos)
+	}
+}
+
+func TestLoadGpodderActionsPlayed(t *testing.T) {
+	testWithInitDB(t, testLoadGpodderActionsPlayed)
+}
+
+func testLoadGpodderActionsPlayed(t *testing.T, db *sql.DB) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	if _, err := addFeed(db, nil, serverURL(ts, allTestCases["Serial"].Filename)); err != nil {
+		t.Fatalf("addFeed returned error %q", err)
+	}
+
+	item := allTestCases["Serial"].NewFeed().Items[0]
+	id := itemIDByURL(t, db, item.URL)
+
+	// Played items with no known duration still count as
+	// played on other devices.
+	if _, err := db.Exec("UPDATE items SET duration = 0 WHERE id = ?", id); err != nil {
+		t.Fatalf("Exec returned error %q", err)
+	}
+
+	since := time.Now().Add(-time.Minute)
+
+	if err := updatePlayedStatus(db, nil, false, id); err != nil {
+		t.Fatalf("updatePlayedStatus returned error %q", err)
+	}
+
+	if err := updatePlayedStatus(db, nil, true, id); err != nil {
+		t.Fatalf("updatePlayedStatus returned error %q", err)
+	}
+
+	actions, err := loadGpodderActions(db, "kibner", since)
+	if err != nil {
+		t.Fatalf("loadGpodderActions returned error %q", err)
+	}
+
+	if len(actions) != 1 {
+		t.Fatalf("expected 1 action, got %s", jsonify(actions))
+	}
+
+	a := actions[0]
+	if a.Action != gpodderActionPlay || a.Position == nil || a.Total == nil || *a.Position < *a.Total {
+		t.Errorf("expected a play action to the end, got %s", jsonify(a))
+	}
+}
+
+func TestGpodderSyncUnauthorized(t *testing.T) {
+	testWithInitDB(t, testGpodderSyncUnauthorized)
+}
+
+func testGpodderSyncUnauthorized(t *testing.T, db *sql.DB) {
+
+	gs := httptest.NewServer(newFakeGpodder("alice", "secret"))
+	defer gs.Close()
+
+	c := newGpodderClient(gs.URL, "alice", "wrong", "kibner")
+	exp := "could not sync subscriptions: bad status: 401 Unauthorized"
+
+	if _, err := gpodderSync(db, nil, c); err == nil || err.Error() != exp {
+		t.Errorf("Expected gpodderSync to return error %q, got %v", exp, err)
+	}
+}
+
+func TestGpodderTime(t *testing.T) {
+
+	tests := []struct {
+		JSON string
+		Time time.Time
+	}{
+		{
+			JSON: `"2009-12-12T09:00:00"`,
+			Time: time.Date(2009, time.December, 12, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			JSON: `"2009-12-12T09:00:00+01:00"`,
+			Time: time.Date(2009, time.December, 12, 8, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, test := range tests {
+
+		var gt gpodderTime
+		if err := json.Unmarshal([]byte(test.JSON), &gt); err != nil {
+			t.Fatalf("%s: Unmarshal returned error %q", test.JSON, err)
+		}
+
+		if got := time.Time(gt); !got.Equal(test.Time) {
+			t.Errorf("%s: expected %s, got %s", test.JSON, test.Time, got)
+		}
+
+		b, err := json.Marshal(gt)
+		if err != nil {
+			t.Fatalf("%s: Marshal returned error %q", test.JSON, err)
+		}
+
+		if got, exp := string(b), `"`+test.Time.Format(gpodderTimeLayout)+`"`; got != exp {
+			t.Errorf("%s: expected Marshal to return %s, got %s", test.JSON, exp, got)
+		}
+	}
+}
+
+func verifyGpodderResult(t *testing.T, got, exp *gpodderResult, adds int) {
+
+	if len(got.LocalAdds) != adds {
+		t.Errorf("Expected %d local adds, got %d", adds, len(got.LocalAdds))
+	}
+
+	for _, r := range got.LocalAdds {
+		if r.Err != nil {
+			t.Errorf("%s: expected no error, got %q", r.URL, r.Err)
+		}
+	}
+
+	if got.LocalRemoves != exp.LocalRemoves {
+		t.Errorf("Expected %d local removes, got %d", exp.LocalRemoves, got.LocalRemoves)
+	}
+
+	if got.RemoteAdds != exp.RemoteAdds {
+		t.Errorf("Expected %d remote adds, got %d", exp.RemoteAdds, got.RemoteAdds)
+	}
+
+	if got.RemoteRemoves != exp.RemoteRemoves {
+		t.Errorf("Expected %d remote removes, got %d", exp.RemoteRemoves, got.RemoteRemoves)
+	}
+
+	if got.ActionsSent != exp.ActionsSent {
+		t.Errorf("Expected %d actions sent, got %d", exp.ActionsSent, got.ActionsSent)
+	}
+
+	if got.ActionsApplied != exp.ActionsApplied {
+		t.Errorf("Expected %d actions applied, got %d", exp.ActionsApplied, got.ActionsApplied)
+	}
+
+	if got.ActionsSkipped != exp.ActionsSkipped {
+		t.Errorf("Expected %d actions skipped, got %d", exp.ActionsSkipped, got.ActionsSkipped)
+	}
+}
+
+func verifyItemPosition(t *testing.T, db *sql.DB, feedID int64, guid string, position int64) {
+
+	var got int64
+
+	err := db.QueryRow("SELECT position FROM items WHERE feedid = ? AND guid = ?", feedID, guid).Scan(&got)
+	if err != nil {
+		t.Fatalf("Error querying item position: %s", err)
+	}
+
+	if got != position {
+		t.Errorf("Expected item %q to have position %d, got %d", guid, position, got)
+	}
+}
+
+func sortedValues(m map[string]string) []string {
+
+	vals := make([]string, 0, len(m))
+	for _, v := range m {
+		vals = append(vals, v)
+	}
+
+	sort.Strings(vals)
+	return vals
+}
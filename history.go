@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyEntry is the played state of an item in another app.
+type historyEntry struct {
+	FeedURL string
+	GUID    string
+	// URL is the item's enclosure URL.
+	URL      string
+	Played   bool
+	Position int64
+	// Updated is when the item's state last changed, if known.
+	Updated time.Time
+}
+
+func (e historyEntry) String() string {
+
+	id := e.GUID
+	if id == "" {
+		id = e.URL
+	}
+
+	return fmt.Sprintf("%q from %s", id, e.FeedURL)
+}
+
+// readHistoryFile reads the listening history in the given
+// file. If format is historyFormatAuto, the format is worked
+// out from the file's contents.
+func readHistoryFile(path string, format historyFormat) ([]historyEntry, error) {
+
+	if format == historyFormatAuto {
+		var err error
+		format, err = detectHistoryFormat(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch format {
+	case historyFormatAntennaPod:
+		return readHistoryDB(path, readHistoryAntennaPod)
+	case historyFormatGPodder:
+		return readHistoryDB(path, readHistoryGPodder)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch format {
+	case historyFormatOPML:
+		return readHistoryOPML(f)
+	case historyFormatCSV:
+		return readHistoryCSV(f)
+	default:
+		return nil, errors.New("unsupported history format")
+	}
+}
+
+const sqliteHeader = "SQLite format 3\x00"
+
+// detectHistoryFormat works out the format of a history file.
+// Databases are recognised by their tables, XML files are
+// assumed to be OPML and anything else is assumed to be CSV.
+func detectHistoryFormat(path string) (historyFormat, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	f.Close()
+
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, err
+	}
+	head = head[:n]
+
+	if !bytes.HasPrefix(head, []byte(sqliteHeader)) {
+		head = bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+		if bytes.HasPrefix(bytes.TrimSpace(head), []byte("<")) {
+			return historyFormatOPML, nil
+		}
+		return historyFormatCSV, nil
+	}
+
+	var format historyFormat
+
+	_, err = readHistoryDB(path, func(db *sql.DB) ([]historyEntry, error) {
+
+		tables, err := queryStrings(db, "SELECT name FROM sqlite_master WHERE type = 'table'")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range tables {
+			switch name {
+			case "FeedItems":
+				format = historyFormatAntennaPod
+			case "episode":
+				format = historyFormatGPodder
+			}
+		}
+
+		return nil, nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	if format == historyFormatAuto {
+		return 0, errors.New("unrecognised database: " + path)
+	}
+
+	return format, nil
+}
+
+// readHistoryDB opens another app's database, read-only, and
+// reads its history with fn.
+func readHistoryDB(path string, fn func(*sql.DB) ([]historyEntry, error)) ([]historyEntry, error) {
+
+	// Check that the file exists. Otherwise SQLite will
+	// happily create an empty database.
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	db, err := connect(path, map[string]string{
+		"mode": "ro",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return fn(db)
+}
+
+// readHistoryAntennaPod reads the history from an AntennaPod
+// database backup. Items are played if their read column is
+// 1 (it's 0 for unplayed items and -1 for new ones). Positions
+// and play times are in milliseconds.
+func readHistoryAntennaPod(db *sql.DB) ([]historyEntry, error) {
+
+	q :=
+		`SELECT
+			f.download_url,
+			IFNULL(i.item_identifier, ''),
+			IFNULL(m.download_url, ''),
+			i.read = 1,
+			IFNULL(m.position, 0),
+			IFNULL(m.last_played_time, 0)
+		FROM
+			FeedItems i
+		INNER JOIN
+			Feeds f ON f.id = i.feed
+		LEFT OUTER JOIN
+			FeedMedia m ON m.feeditem = i.id`
+
+	var rows []struct {
+		FeedURL      string
+		GUID         string
+		URL          string
+		Played       bool
+		PositionMS   int64
+		LastPlayedMS int64
+	}
+
+	if err := queryRows(&rows, db, q); err != nil {
+		return nil, errors.New("could not read AntennaPod database: " + err.Error())
+	}
+
+	entries := make([]historyEntry, len(rows))
+
+	for i, r := range rows {
+		entries[i] = historyEntry{
+			FeedURL:  r.FeedURL,
+			GUID:     r.GUID,
+			URL:      r.URL,
+			Played:   r.Played,
+			Position: r.PositionMS / 1000,
+		}
+		if r.LastPlayedMS > 0 {
+			entries[i].Updated = time.Unix(r.LastPlayedMS/1000, 0)
+		}
+	}
+
+	return entries, nil
+}
+
+// readHistoryGPodder reads the history from a gPodder database.
+// gPodder doesn't have a played status as such. Episodes that
+// are no longer new have been played (or marked as old, which
+// amounts to the same thing).
+func readHistoryGPodder(db *sql.DB) ([]historyEntry, error) {
+
+	q :=
+		`SELECT
+			p.url,
+			IFNULL(e.guid, ''),
+			IFNULL(e.url, ''),
+			e.is_new = 0,
+			IFNULL(e.current_position, 0),
+			IFNULL(e.last_playback, 0)
+		FROM
+			episode e
+		INNER JOIN
+			podcast p ON p.id = e.podcast_id`
+
+	var rows []struct {
+		FeedURL      string
+		GUID         string
+		URL          string
+		Played       bool
+		Position     int64
+		LastPlayback int64
+	}
+
+	if err := queryRows(&rows, db, q); err != nil {
+		return nil, errors.New("could not read gPodder database: " + err.Error())
+	}
+
+	entries := make([]historyEntry, len(rows))
+
+	for i, r := range rows {
+		entries[i] = historyEntry{
+			FeedURL:  r.FeedURL,
+			GUID:     r.GUID,
+			URL:      r.URL,
+			Played:   r.Played,
+			Position: r.Position,
+		}
+		if r.LastPlayback > 0 {
+			entries[i].Updated = time.Unix(r.LastPlayback, 0)
+		}
+	}
+
+	return entries, nil
+}
+
+// historyOutline is an OPML outline with the extensions that
+// apps like Overcast use to export episodes. Episodes are
+// outlines inside their feed's outline.
+type historyOutline struct {
+	URL       string            `xml:"xmlUrl,attr"`
+	Enclosure string            `xml:"enclosureUrl,attr"`
+	GUID      string            `xml:"guid,attr"`
+	Played    string            `xml:"played,attr"`
+	Progress  string            `xml:"progress,attr"`
+	Updated   string            `xml:"userUpdatedDate,attr"`
+	Outlines  []*historyOutline `xml:"outline"`
+}
+
+// readHistoryOPML reads the history from an OPML file.
+func readHistoryOPML(r io.Reader) ([]historyEntry, error) {
+
+	var data struct {
+		Outlines []*historyOutline `xml:"body>outline"`
+	}
+
+	if err := xml.NewDecoder(r).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	var entries []historyEntry
+
+	var walk func(outlines []*historyOutline, feedURL string)
+
+	walk = func(outlines []*historyOutline, feedURL string) {
+
+		for _, o := range outlines {
+
+			if u := strings.TrimSpace(o.URL); u != "" {
+				walk(o.Outlines, u)
+				continue
+			}
+
+			if feedURL == "" || (o.Enclosure == "" && o.GUID == "") {
+				walk(o.Outlines, feedURL)
+				continue
+			}
+
+			e := historyEntry{
+				FeedURL: feedURL,
+				GUID:    strings.TrimSpace(o.GUID),
+				URL:     strings.TrimSpace(o.Enclosure),
+				Played:  o.Played == "1" || strings.EqualFold(o.Played, "true"),
+			}
+
+			if d, err := parseDuration(o.Progress); err == nil {
+				e.Position = int64(d / time.Second)
+			}
+
+			if t, err := parsePubdate(o.Updated); err == nil {
+				e.Updated = t
+			}
+
+			entries = append(entries, e)
+		}
+	}
+
+	walk(data.Outlines, "")
+
+	return entries, nil
+}
+
+// readHistoryCSV reads the history from a CSV file with the
+// columns feed URL, item GUID or URL, played and position. The
+// played column is true/false, yes/no or 1/0. Positions are in
+// seconds or hh:mm:ss. A header row is skipped.
+func readHistoryCSV(r io.Reader) ([]historyEntry, error) {
+
+	cr := csv.NewReader(bufio.NewReader(r))
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	var entries []historyEntry
+
+	for line := 1; ; line++ {
+
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Skip blank lines and the header.
+		if len(rec) == 1 && strings.TrimSpace(rec[0]) == "" {
+			continue
+		}
+		if line == 1 && !strings.Contains(rec[0], "://") {
+			continue
+		}
+
+		if len(rec) < 3 {
+			return nil, fmt.Errorf("line %d: expected at least 3 columns, got %d", line, len(rec))
+		}
+
+		played, err := parsePlayed(rec[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+
+		e := historyEntry{
+			FeedURL: strings.TrimSpace(rec[0]),
+			GUID:    strings.TrimSpace(rec[1]),
+			URL:     strings.TrimSpace(rec[1]),
+			Played:  played,
+		}
+
+		if len(rec) > 3 && strings.TrimSpace(rec[3]) != "" {
+			d, err := parseDuration(rec[3])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+			e.Position = int64(d / time.Second)
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+func parsePlayed(s string) (bool, error) {
+
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "true", "yes", "y", "played":
+		return true, nil
+	case "", "0", "false", "no", "n", "unplayed":
+		return false, nil
+	}
+
+	if n, err := strconv.Atoi(s); err == nil {
+		return n > 0, nil
+	}
+
+	return false, errors.New("invalid played value " + strconv.Quote(s))
+}
+
+// historyResult describes the outcome of importing history.
+type historyResult struct {
+	// Added lists the feeds that had to be subscribed to.
+	Added   []*syncResult
+	Entries int
+	Matched int
+	Updated int
+	// Unmatched lists the entries that didn't match an item,
+	// either because the item isn't in the feed (any more)
+	// or because the feed couldn't be added.
+	Unmatched []string
+}
+
+// importHistory applies listening history from another app.
+// Feeds that aren't already subscribed to are added. Items are
+// matched on their GUID, or failing that, their enclosure URL.
+// Entries don't overwrite local changes made after them (or
+// any local changes at all, if the entry's time isn't known).
+// Progress messages are written to progress, which may be nil.
+func importHistory(db *sql.DB, hooks *hookRunner, entries []historyEntry, progress io.Writer) (*historyResult, error) {
+
+	ids, err := loadFeedIDsByURL(db)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &historyResult{
+		Entries: len(entries),
+	}
+
+	var urls []string
+	seen := map[string]bool{}
+
+	for _, e := range entries {
+		if _, ok := ids[e.FeedURL]; !ok && !seen[e.FeedURL] {
+			seen[e.FeedURL] = true
+			urls = append(urls, e.FeedURL)
+		}
+	}
+
+	if len(urls) > 0 {
+		added := addFeedMultiple(db, hooks, urls, progress)
+		for _, r := range added {
+			if r.Err == nil {
+				ids[r.Source] = r.ID
+				ids[r.URL] = r.ID
+			}
+		}
+
+		// A feed URL that redirects to a feed that's already
+		// subscribed to can't be added, but its entries still
+		// belong to that feed.
+		for _, r := range added {
+			if r.Err != nil && ids[r.URL] != 0 {
+				ids[r.Source] = ids[r.URL]
+				continue
+			}
+			res.Added = append(res.Added, r)
+		}
+	}
+
+	items, err := loadHistoryItems(db)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := tx.Prepare("UPDATE items SET unplayed = ?, position = ?, updated = ? WHERE id = ?")
+	if err != nil {
+		return nil, rollback(tx, err)
+	}
+	defer stmt.Close()
+
+	for _, e := range entries {
+
+		item := items.match(ids[e.FeedURL], e)
+		if item == nil {
+			res.Unmatched = append(res.Unmatched, e.String())
+			continue
+		}
+
+		res.Matched++
+
+		updated := time.Unix(item.Updated, 0)
+		if item.Updated > 0 && !e.Updated.After(updated) {
+			continue
+		}
+
+		position := e.Position
+		if e.Played {
+			position = 0
+		}
+
+		if item.Unplayed == !e.Played && item.Position == position {
+			continue
+		}
+
+		timestamp := item.Updated
+		if !e.Updated.IsZero() {
+			timestamp = e.Updated.Unix()
+		}
+
+		if _, err := stmt.Exec(!e.Played, position, timestamp, item.ID); err != nil {
+			return nil, rollback(tx, err)
+		}
+
+		res.Updated++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+type historyItem struct {
+	ID       int64
+	FeedID   int64
+	GUID     string
+	URL      string
+	Unplayed bool
+	Position int64
+	Updated  int64
+}
+
+// historyItems indexes items by feed and by GUID and URL.
+type historyItems struct {
+	byGUID map[int64]map[string]*historyItem
+	byURL  map[int64]map[string]*historyItem
+}
+
+func loadHistoryItems(db *sql.DB) (*historyItems, error) {
+
+	q := "SELECT id, feedid, guid, url, unplayed, position, CAST(updated AS INTEGER) FROM items"
+
+	var rows []historyItem
+	if err := queryRows(&rows, db, q); err != nil {
+		return nil, err
+	}
+
+	items := &historyItems{
+		byGUID: map[int64]map[string]*historyItem{},
+		byURL:  map[int64]map[string]*historyItem{},
+	}
+
+	for i := range rows {
+
+		r := &rows[i]
+
+		if items.byGUID[r.FeedID] == nil {
+			items.byGUID[r.FeedID] = map[string]*historyItem{}
+			items.byURL[r.FeedID] = map[string]*historyItem{}
+		}
+
+		items.byGUID[r.FeedID][r.GUID] = r
+		items.byURL[r.FeedID][r.URL] = r
+	}
+
+	return items, nil
+}
+
+func (items *historyItems) match(feedID int64, e historyEntry) *historyItem {
+
+	if e.GUID != "" {
+		if item := items.byGUID[feedID][e.GUID]; item != nil {
+			return item
+		}
+	}
+
+	if e.URL != "" {
+		if item := items.byURL[feedID][e.URL]; item != nil {
+			return item
+		}
+	}
+
+	return nil
+}
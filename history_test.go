@@ -0,0 +1,381 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadHistoryCSV(t *testing.T) {
+
+	tests := []struct {
+		Name    string
+		Input   string
+		Entries []historyEntry
+		Error   bool
+	}{
+		{
+			Name: "With header",
+			Input: `feed,episode,played,position
+http://example.com/feed.xml,guid-1,true,
+http://example.com/feed.xml,http://example.com/2.mp3,no,1:02:03
+`,
+			Entries: []historyEntry{
+				{
+					FeedURL: "http://example.com/feed.xml",
+					GUID:    "guid-1",
+					URL:     "guid-1",
+					Played:  true,
+				},
+				{
+					FeedURL:  "http://example.com/feed.xml",
+					GUID:     "http://example.com/2.mp3",
+					URL:      "http://example.com/2.mp3",
+					Position: 3723,
+				},
+			},
+		},
+		{
+			Name:  "Without header",
+			Input: "http://example.com/feed.xml, guid-1, 0, 90\n\n",
+			Entries: []historyEntry{
+				{
+					FeedURL:  "http://example.com/feed.xml",
+					GUID:     "guid-1",
+					URL:      "guid-1",
+					Position: 90,
+				},
+			},
+		},
+		{
+			Name:  "Bad played value",
+			Input: "http://example.com/feed.xml,guid-1,maybe\n",
+			Error: true,
+		},
+		{
+			Name:  "Too few columns",
+			Input: "http://example.com/feed.xml,guid-1\n",
+			Error: true,
+		},
+	}
+
+	for _, test := range tests {
+
+		entries, err := readHistoryCSV(strings.NewReader(test.Input))
+
+		if test.Error {
+			if err == nil {
+				t.Errorf("%s: expected readHistoryCSV to return an error", test.Name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: readHistoryCSV returned error %q", test.Name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(entries, test.Entries) {
+			t.Errorf("%s: expected readHistoryCSV to return %s, got %s", test.Name, jsonify(test.Entries), jsonify(entries))
+		}
+	}
+}
+
+func TestReadHistoryOPML(t *testing.T) {
+
+	f, err := os.Open(filepath.Join("internal", "testdata", "opml", "overcast.opml"))
+	if err != nil {
+		t.Fatalf("Open returned error %q", err)
+	}
+	defer f.Close()
+
+	entries, err := readHistoryOPML(f)
+	if err != nil {
+		t.Fatalf("readHistoryOPML returned error %q", err)
+	}
+
+	exp := []historyEntry{
+		{
+			FeedURL: "http://feeds.serialpodcast.org/serialpodcast",
+			URL:     "http://dts.podtrac.com/redirect.mp3/files.serialpodcast.org/sites/default/files/podcast/1445350094/serial-s01-e01.mp3",
+			Played:  true,
+			Updated: time.Date(2017, 10, 2, 0, 15, 0, 0, time.UTC),
+		},
+	}
+
+	if len(entries) != len(exp) {
+		t.Fatalf("expected readHistoryOPML to return %d entries, got %d", len(exp), len(entries))
+	}
+
+	for i := range exp {
+		if !exp[i].Updated.Equal(entries[i].Updated) {
+			t.Errorf("expected entry %d to have time %s, got %s", i, exp[i].Updated, entries[i].Updated)
+		}
+		exp[i].Updated, entries[i].Updated = time.Time{}, time.Time{}
+	}
+
+	if !reflect.DeepEqual(entries, exp) {
+		t.Errorf("expected readHistoryOPML to return %s, got %s", jsonify(exp), jsonify(entries))
+	}
+}
+
+func TestReadHistoryDB(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "kibner-history")
+	if err != nil {
+		t.Fatalf("TempDir returned error %q", err)
+	}
+	defer os.RemoveAll(dir)
+
+	played := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		Name   string
+		Format historyFormat
+		Schema []string
+	}{
+		{
+			Name:   "AntennaPod",
+			Format: historyFormatAntennaPod,
+			Schema: []string{
+				`CREATE TABLE Feeds (id INTEGER PRIMARY KEY, download_url TEXT)`,
+				`CREATE TABLE FeedItems (id INTEGER PRIMARY KEY, feed INTEGER, item_identifier TEXT, read INTEGER)`,
+				`CREATE TABLE FeedMedia (id INTEGER PRIMARY KEY, feeditem INTEGER, download_url TEXT, position INTEGER, last_played_time INTEGER)`,
+				`INSERT INTO Feeds VALUES (1, 'http://example.com/feed.xml')`,
+				`INSERT INTO FeedItems VALUES (1, 1, 'guid-1', 1), (2, 1, 'guid-2', -1), (3, 1, NULL, 0)`,
+				`INSERT INTO FeedMedia VALUES (1, 1, 'http://example.com/1.mp3', 0, 1588334400000), (3, 3, 'http://example.com/3.mp3', 90500, NULL)`,
+			},
+		},
+		{
+			Name:   "gPodder",
+			Format: historyFormatGPodder,
+			Schema: []string{
+				`CREATE TABLE podcast (id INTEGER PRIMARY KEY, url TEXT)`,
+				`CREATE TABLE episode (id INTEGER PRIMARY KEY, podcast_id INTEGER, guid TEXT, url TEXT, is_new INTEGER, current_position INTEGER, last_playback INTEGER)`,
+				`INSERT INTO podcast VALUES (1, 'http://example.com/feed.xml')`,
+				`INSERT INTO episode VALUES (1, 1, 'guid-1', 'http://example.com/1.mp3', 0, 0, 1588334400), (2, 1, 'guid-2', NULL, 1, 0, 0), (3, 1, '', 'http://example.com/3.mp3', 1, 90, NULL)`,
+			},
+		},
+	}
+
+	exp := []historyEntry{
+		{
+			FeedURL: "http://example.com/feed.xml",
+			GUID:    "guid-1",
+			URL:     "http://example.com/1.mp3",
+			Played:  true,
+			Updated: played,
+		},
+		{
+			FeedURL: "http://example.com/feed.xml",
+			GUID:    "guid-2",
+		},
+		{
+			FeedURL:  "http://example.com/feed.xml",
+			URL:      "http://example.com/3.mp3",
+			Position: 90,
+		},
+	}
+
+	for _, test := range tests {
+
+		path := filepath.Join(dir, test.Name+".db")
+
+		db, err := connect(path, nil)
+		if err != nil {
+			t.Fatalf("%s: connect returned error %q", test.Name, err)
+		}
+
+		for _, q := range test.Schema {
+			if _, err := db.Exec(q); err != nil {
+				t.Fatalf("%s: Exec returned error %q", test.Name, err)
+			}
+		}
+		db.Close()
+
+		format, err := detectHistoryFormat(path)
+		if err != nil {
+			t.Errorf("%s: detectHistoryFormat returned error %q", test.Name, err)
+		} else if format != test.Format {
+			t.Errorf("%s: expected detectHistoryFormat to return %v, got %v", test.Name, test.Format, format)
+		}
+
+		entries, err := readHistoryFile(path, historyFormatAuto)
+		if err != nil {
+			t.Errorf("%s: readHistoryFile returned error %q", test.Name, err)
+			continue
+		}
+
+		for i := range entries {
+			if !entries[i].Updated.IsZero() {
+				entries[i].Updated = entries[i].Updated.UTC()
+			}
+		}
+
+		if !reflect.DeepEqual(entries, exp) {
+			t.Errorf("%s: expected readHistoryFile to return %s, got %s", test.Name, jsonify(exp), jsonify(entries))
+		}
+	}
+}
+
+func TestImportHistory(t *testing.T) {
+	testWithInitDB(t, testImportHistory)
+}
+
+func testImportHistory(t *testing.T, db *sql.DB) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	serial := allTestCases["Serial"].NewFeed()
+	rework := allTestCases["Rework"].NewFeed()
+
+	id, err := saveFeed(db, serial, time.Now())
+	if err != nil {
+		t.Fatalf("saveFeed returned error %q", err)
+	}
+
+	// The second item was marked as unplayed locally, after
+	// the other app last changed it.
+	local := time.Now().Add(-time.Hour)
+	_, err = db.Exec("UPDATE items SET unplayed = 1, updated = ? WHERE feedid = ? AND guid = ?", local.Unix(), id, serial.Items[1].GUID)
+	if err != nil {
+		t.Fatalf("Exec returned error %q", err)
+	}
+
+	entries := []historyEntry{
+		{
+			// Matched by URL. Already played.
+			FeedURL: serial.URL,
+			URL:     serial.Items[0].URL,
+			Played:  true,
+		},
+		{
+			// Older than the local change.
+			FeedURL: serial.URL,
+			GUID:    serial.Items[1].GUID,
+			Played:  true,
+			Updated: local.Add(-time.Minute),
+		},
+		{
+			// In a new feed. Items in new feeds start off
+			// as played.
+			FeedURL:  serverURL(ts, "rework.xml"),
+			GUID:     rework.Items[0].GUID,
+			Position: 60,
+		},
+		{
+			FeedURL: serverURL(ts, "rework.xml"),
+			GUID:    "not-a-real-guid",
+		},
+		{
+			FeedURL: serverURL(ts, "not-found.xml"),
+			GUID:    "guid-1",
+		},
+	}
+
+	res, err := importHistory(db, nil, entries, nil)
+	if err != nil {
+		t.Fatalf("importHistory returned error %q", err)
+	}
+
+	if len(res.Added) != 2 || res.Added[0].Err != nil || res.Added[1].Err == nil {
+		t.Errorf("expected importHistory to add rework.xml and fail to add not-found.xml, got %s", jsonify(res.Added))
+	}
+
+	if res.Entries != 5 || res.Matched != 3 || res.Updated != 1 {
+		t.Errorf("expected 5 entries, 3 matched and 1 updated, got %d, %d and %d", res.Entries, res.Matched, res.Updated)
+	}
+
+	expUnmatched := []string{
+		entries[3].String(),
+		entries[4].String(),
+	}
+
+	if !reflect.DeepEqual(res.Unmatched, expUnmatched) {
+		t.Errorf("expected unmatched entries %q, got %q", expUnmatched, res.Unmatched)
+	}
+
+	var got []struct {
+		GUID     string
+		Unplayed bool
+		Position int64
+	}
+
+	q := "SELECT guid, unplayed, position FROM items WHERE guid IN(?, ?) ORDER BY guid"
+	if err := queryRows(&got, db, q, serial.Items[1].GUID, rework.Items[0].GUID); err != nil {
+		t.Fatalf("queryRows returned error %q", err)
+	}
+
+	for _, item := range got {
+		switch item.GUID {
+		case serial.Items[1].GUID:
+			if !item.Unplayed {
+				t.Errorf("expected local change to %q to be kept", item.GUID)
+			}
+		case rework.Items[0].GUID:
+			if !item.Unplayed || item.Position != 60 {
+				t.Errorf("expected %q to be unplayed at position 60, got %+v", item.GUID, item)
+			}
+		}
+	}
+}
+
+func TestImportHistoryRedirects(t *testing.T) {
+	testWithInitDB(t, testImportHistoryRedirects)
+}
+
+func testImportHistoryRedirects(t *testing.T, db *sql.DB) {
+
+	ts := newRedirectServer(map[string]string{
+		"/old-rework.xml": "/rework.xml",
+		"/old-serial.xml": "/serial.xml",
+	})
+	defer ts.Close()
+
+	serial := allTestCases["Serial"].NewFeed()
+	rework := allTestCases["Rework"].NewFeed()
+
+	existing, err := addFeed(db, nil, serverURL(ts, "rework.xml"))
+	if err != nil {
+		t.Fatalf("addFeed returned error %q", err)
+	}
+
+	entries := []historyEntry{
+		{
+			// Redirects to a feed that's already subscribed to.
+			FeedURL:  serverURL(ts, "old-rework.xml"),
+			GUID:     rework.Items[0].GUID,
+			Position: 60,
+		},
+		{
+			// These two end up at the same new feed.
+			FeedURL: serverURL(ts, "old-serial.xml"),
+			GUID:    serial.Items[0].GUID,
+		},
+		{
+			FeedURL: serverURL(ts, "serial.xml"),
+			GUID:    serial.Items[1].GUID,
+		},
+	}
+
+	res, err := importHistory(db, nil, entries, nil)
+	if err != nil {
+		t.Fatalf("importHistory returned error %q", err)
+	}
+
+	if len(res.Added) != 1 || res.Added[0].Err != nil || res.Added[0].URL != serverURL(ts, "serial.xml") {
+		t.Errorf("expected importHistory to add serial.xml, got %s", jsonify(res.Added))
+	}
+
+	if res.Matched != 3 || len(res.Unmatched) != 0 {
+		t.Errorf("expected 3 matched entries, got %d (unmatched %q)", res.Matched, res.Unmatched)
+	}
+
+	verifyItemPosition(t, db, existing.ID, rework.Items[0].GUID, 60)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kibner "github.com/deepilla/kibner/internal/types"
+)
+
+// Hooks are programs and webhook URLs that are notified when
+// something happens, e.g. when a sync finds new items. Every
+// hook is registered for one event. Programs are run with the
+// event's data as JSON on stdin and a summary of it in KIBNER_*
+// environment variables. Webhooks are sent the same JSON in a
+// POST request. Hooks run in the background. Hooks that fail
+// or time out are logged but don't affect whatever triggered
+// them.
+
+type hookEvent string
+
+const (
+	hookNewItems    hookEvent = "new-items"
+	hookFeedAdded   hookEvent = "feed-added"
+	hookFeedRemoved hookEvent = "feed-removed"
+	hookItemPlayed  hookEvent = "item-played"
+	hookSyncFailed  hookEvent = "sync-failed"
+)
+
+var hookEvents = map[hookEvent]string{
+	hookNewItems:    "a sync finds new items in a feed",
+	hookFeedAdded:   "a feed is added",
+	hookFeedRemoved: "a feed is removed",
+	hookItemPlayed:  "items are marked as played",
+	hookSyncFailed:  "a feed can't be synced",
+}
+
+// hookRunner runs hooks in the background, so that a slow hook
+// doesn't hold up whatever triggered it, e.g. an import of
+// hundreds of feeds. At most MaxWorkers hooks run at once.
+// Failures are written to the runner's logger. RunWithEnv
+// creates a runner for each command and waits for it before
+// returning. A nil hookRunner doesn't run hooks.
+type hookRunner struct {
+	log   *Logger
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newHookRunner(log *Logger) *hookRunner {
+	return &hookRunner{
+		log:   log,
+		slots: make(chan struct{}, defaults.MaxWorkers),
+	}
+}
+
+// wait waits for any running hooks to finish.
+func (r *hookRunner) wait() {
+	if r != nil {
+		r.wg.Wait()
+	}
+}
+
+type hookFeed struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+type hookItem struct {
+	ID       int64     `json:"id,omitempty"`
+	GUID     string    `json:"guid"`
+	Title    string    `json:"title"`
+	URL      string    `json:"url"`
+	Pubdate  time.Time `json:"pubdate"`
+	Duration int64     `json:"duration_seconds"`
+}
+
+// hookPayload is the data sent to hooks. Every event relates
+// to a single feed. Items are only included for the new-items
+// and item-played events, Error for sync-failed.
+type hookPayload struct {
+	Event hookEvent  `json:"event"`
+	Time  time.Time  `json:"time"`
+	Feed  hookFeed   `json:"feed"`
+	Items []hookItem `json:"items,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+// env returns the environment variables for hook programs.
+func (p *hookPayload) env() []string {
+	return []string{
+		"KIBNER_EVENT=" + string(p.Event),
+		"KIBNER_FEED_ID=" + strconv.FormatInt(p.Feed.ID, 10),
+		"KIBNER_FEED_TITLE=" + p.Feed.Title,
+		"KIBNER_FEED_URL=" + p.Feed.URL,
+		"KIBNER_ITEM_COUNT=" + strconv.Itoa(len(p.Items)),
+		"KIBNER_ERROR=" + p.Error,
+	}
+}
+
+// commandData returns the data for hook command templates.
+// Commands for events with a single item can refer to it too.
+func (p *hookPayload) commandData() *commandData {
+
+	data := &commandData{
+		Title:     p.Feed.Title,
+		FeedID:    p.Feed.ID,
+		FeedTitle: p.Feed.Title,
+		FeedURL:   p.Feed.URL,
+		Event:     string(p.Event),
+		ItemCount: len(p.Items),
+		Error:     p.Error,
+	}
+
+	if len(p.Items) == 1 {
+		item := p.Items[0]
+		data.URL = item.URL
+		data.Title = item.Title
+		data.ID = item.ID
+		data.GUID = item.GUID
+		data.Pubdate = item.Pubdate
+		data.Duration = item.Duration
+	}
+
+	return data
+}
+
+func newHookItems(items []*kibner.Item) []hookItem {
+
+	hitems := make([]hookItem, len(items))
+
+	for i, item := range items {
+		hitems[i] = hookItem{
+			GUID:     item.GUID,
+			Title:    item.Title,
+			URL:      item.URL,
+			Pubdate:  item.Pubdate,
+			Duration: int64(item.Duration / time.Second),
+		}
+	}
+
+	return hitems
+}
+
+type hook struct {
+	ID     int64
+	Event  hookEvent
+	Target string
+}
+
+// isWebhook reports whether the hook's target is a URL rather
+// than a program.
+func (h hook) isWebhook() bool {
+	return strings.HasPrefix(h.Target, "http://") || strings.HasPrefix(h.Target, "https://")
+}
+
+func parseHookEvent(s string) (hookEvent, error) {
+
+	event := hookEvent(strings.ToLower(strings.TrimSpace(s)))
+
+	if _, ok := hookEvents[event]; !ok {
+		return "", fmt.Errorf("invalid event %q (valid events are %s)", s, strings.Join(hookEventNames(), ", "))
+	}
+
+	return event, nil
+}
+
+func hookEventNames() []string {
+
+	names := make([]string, 0, len(hookEvents))
+	for event := range hookEvents {
+		names = append(names, string(event))
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func addHook(db *sql.DB, event hookEvent, target string) (int64, error) {
+
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return 0, errors.New("no hook command or URL given")
+	}
+
+	res, err := db.Exec("INSERT INTO hooks(event, target) VALUES(?, ?)", event, target)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+func removeHook(db *sql.DB, id int64) error {
+
+	res, err := db.Exec("DELETE FROM hooks WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("no hook with ID %d", id)
+	}
+
+	return nil
+}
+
+// loadHooks returns the hooks for the given event, or every
+// hook if event is empty.
+func loadHooks(db *sql.DB, event hookEvent) ([]hook, error) {
+
+	var hooks []hook
+	var params []interface{}
+
+	q := "SELECT id, event, target FROM hooks"
+
+	if event != "" {
+		q += " WHERE event = ?"
+		params = append(params, event)
+	}
+
+	q += " ORDER BY event, id"
+
+	if err := queryRows(&hooks, db, q, params...); err != nil {
+		return nil, err
+	}
+
+	return hooks, nil
+}
+
+// fireHooks starts the hooks for the payload's event. Failures
+// are logged, not returned, so that hooks can't break whatever
+// triggered them.
+func fireHooks(db *sql.DB, runner *hookRunner, payload *hookPayload) {
+
+	if runner == nil {
+		return
+	}
+
+	hooks, err := loadHooks(db, payload.Event)
+	if err != nil {
+		runner.log.Warnf("could not load %s hooks: %s", payload.Event, err)
+		return
+	}
+
+	if len(hooks) == 0 {
+		return
+	}
+
+	if payload.Time.IsZero() {
+		payload.Time = time.Now()
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		runner.log.Warnf("could not encode %s hook data: %s", payload.Event, err)
+		return
+	}
+
+	for _, h := range hooks {
+		runner.wg.Add(1)
+		go runner.run(h, data, payload)
+	}
+}
+
+func (r *hookRunner) run(h hook, data []byte, payload *hookPayload) {
+
+	defer r.wg.Done()
+
+	r.slots <- struct{}{}
+	defer func() { <-r.slots }()
+
+	var err error
+	if h.isWebhook() {
+		err = postWebhook(h.Target, data)
+	} else {
+		err = runHookCommand(h.Target, data, payload)
+	}
+
+	if err != nil {
+		r.log.Warnf("%s hook %d (%s) failed: %s", payload.Event, h.ID, h.Target, err)
+		return
+	}
+
+	r.log.Debugf("ran %s hook %d (%s) for %s", payload.Event, h.ID, h.Target, payload.Feed.Title)
+}
+
+func runHookCommand(command string, data []byte, payload *hookPayload) error {
+
+	cmd, err := parseCommand(command, payload.commandData())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaults.HookTimeout)
+	defer cancel()
+
+	cmd = exec.CommandContext(ctx, cmd.Path, cmd.Args[1:]...)
+	cmd.Env = append(os.Environ(), payload.env()...)
+	cmd.Stdin = bytes.NewReader(data)
+
+	out, err := cmd.CombinedOutput()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.New("timed out after " + defaults.HookTimeout.String())
+	}
+
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return errors.New(err.Error() + ": " + msg)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func postWebhook(u string, data []byte) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaults.HookTimeout)
+	defer cancel()
+
+	req, err := newRequestMethod(http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return errors.New("bad request: " + err.Error())
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := defaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.New("post error: " + err.Error())
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("bad status: " + resp.Status)
+	}
+
+	return nil
+}
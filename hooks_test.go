@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseHookEvent(t *testing.T) {
+
+	for _, s := range []string{"new-items", " Feed-Added ", "sync-failed"} {
+		if _, err := parseHookEvent(s); err != nil {
+			t.Errorf("%q: parseHookEvent returned error %q", s, err)
+		}
+	}
+
+	for _, s := range []string{"", "new-item", "played"} {
+		if _, err := parseHookEvent(s); err == nil {
+			t.Errorf("%q: expected parseHookEvent to return an error", s)
+		}
+	}
+}
+
+func TestHooks(t *testing.T) {
+	testWithInitDB(t, testHooks)
+}
+
+func testHooks(t *testing.T, db *sql.DB) {
+
+	id1, err := addHook(db, hookNewItems, " notify-send ")
+	if err != nil {
+		t.Fatalf("addHook returned error %q", err)
+	}
+
+	id2, err := addHook(db, hookFeedAdded, "http://example.com/hook")
+	if err != nil {
+		t.Fatalf("addHook returned error %q", err)
+	}
+
+	if _, err := addHook(db, hookNewItems, "notify-send"); err == nil {
+		t.Errorf("expected addHook to reject a duplicate hook")
+	}
+
+	if _, err := addHook(db, hookNewItems, " "); err == nil {
+		t.Errorf("expected addHook to reject an empty target")
+	}
+
+	hooks, err := loadHooks(db, "")
+	if err != nil {
+		t.Fatalf("loadHooks returned error %q", err)
+	}
+
+	exp := []hook{
+		{ID: id2, Event: hookFeedAdded, Target: "http://example.com/hook"},
+		{ID: id1, Event: hookNewItems, Target: "notify-send"},
+	}
+
+	if !reflect.DeepEqual(hooks, exp) {
+		t.Errorf("expected loadHooks to return %+v, got %+v", exp, hooks)
+	}
+
+	if !hooks[0].isWebhook() || hooks[1].isWebhook() {
+		t.Errorf("expected only the first hook to be a webhook")
+	}
+
+	if err := removeHook(db, id1); err != nil {
+		t.Fatalf("removeHook returned error %q", err)
+	}
+
+	if err := removeHook(db, id1); err == nil {
+		t.Errorf("expected removeHook to return an error for a missing hook")
+	}
+
+	verifyTables(t, db, map[string]int{
+		"feeds":           0,
+		"items":           0,
+		"hooks":           1,
+		"sqlite_sequence": 1,
+	})
+}
+
+// hookScript writes a shell script that saves its input and
+// environment to files in dir, and returns its path.
+func hookScript(t *testing.T, dir string, name string, body string) string {
+
+	path := filepath.Join(dir, name)
+
+	script := "#!/bin/sh\n" + body + "\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("WriteFile returned error %q", err)
+	}
+
+	return path
+}
+
+// webhookRecorder is a test server that records the JSON
+// posted to it.
+type webhookRecorder struct {
+	*httptest.Server
+	mu       sync.Mutex
+	payloads []hookPayload
+}
+
+func newWebhookRecorder(status int) *webhookRecorder {
+
+	rec := &webhookRecorder{}
+
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		var payload hookPayload
+
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		rec.mu.Lock()
+		rec.payloads = append(rec.payloads, payload)
+		rec.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+
+	return rec
+}
+
+func TestFireHooks(t *testing.T) {
+	testWithInitDB(t, testFireHooks)
+}
+
+func testFireHooks(t *testing.T, db *sql.DB) {
+
+	dir, err := ioutil.TempDir("", "kibner-hooks")
+	if err != nil {
+		t.Fatalf("TempDir returned error %q", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var logs bytes.Buffer
+	runner := newHookRunner(NewLogger(&logs, logLevelWarn))
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	rec := newWebhookRecorder(http.StatusOK)
+	defer rec.Close()
+
+	failing := newWebhookRecorder(http.StatusInternalServerError)
+	defer failing.Close()
+
+	out := filepath.Join(dir, "out")
+	save := hookScript(t, dir, "save.sh", `cat > "`+out+`.json"; echo "$KIBNER_EVENT $KIBNER_FEED_TITLE $KIBNER_ITEM_COUNT" > "`+out+`.env"`)
+	fail := hookScript(t, dir, "fail.sh", "echo oops; exit 3")
+
+	// The log messages below depend on the order in which the
+	// hooks are added.
+	for _, h := range []hook{
+		{Event: hookFeedAdded, Target: save},
+		{Event: hookFeedAdded, Target: fail},
+		{Event: hookFeedAdded, Target: failing.URL},
+		{Event: hookNewItems, Target: rec.URL},
+		{Event: hookItemPlayed, Target: rec.URL},
+	} {
+		if _, err := addHook(db, h.Event, h.Target); err != nil {
+			t.Fatalf("addHook returned error %q", err)
+		}
+	}
+
+	// Failing hooks don't stop the feed from being added.
+	res, err := addFeed(db, runner, serverURL(ts, "serial.xml"))
+	if err != nil {
+		t.Fatalf("addFeed returned error %q", err)
+	}
+
+	runner.wait()
+
+	data, err := ioutil.ReadFile(out + ".json")
+	if err != nil {
+		t.Fatalf("hook script did not run: %s", err)
+	}
+
+	var payload hookPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		t.Fatalf("Unmarshal returned error %q", err)
+	}
+
+	expFeed := hookFeed{ID: res.ID, Title: "Serial", URL: serverURL(ts, "serial.xml")}
+
+	if payload.Event != hookFeedAdded || payload.Feed != expFeed {
+		t.Errorf("expected %s payload for %+v, got %s", hookFeedAdded, expFeed, data)
+	}
+
+	env, err := ioutil.ReadFile(out + ".env")
+	if err != nil {
+		t.Fatalf("ReadFile returned error %q", err)
+	}
+
+	if got, exp := string(env), "feed-added Serial 0\n"; got != exp {
+		t.Errorf("expected hook environment %q, got %q", exp, got)
+	}
+
+	for _, s := range []string{
+		"warning: feed-added hook 2 (" + fail + ") failed: exit status 3: oops\n",
+		"warning: feed-added hook 3 (" + failing.URL + ") failed: bad status: 500 Internal Server Error\n",
+	} {
+		if !strings.Contains(logs.String(), s) {
+			t.Errorf("expected hook log to contain %q, got %q", s, logs.String())
+		}
+	}
+
+	// Forget the two most recent items so that a sync finds
+	// them again.
+	_, err = db.Exec("DELETE FROM items WHERE id IN(SELECT id FROM items WHERE feedid = ? ORDER BY pubdate DESC LIMIT 2)", res.ID)
+	if err != nil {
+		t.Fatalf("Exec returned error %q", err)
+	}
+
+	if _, err := syncOne(db, runner, res.ID); err != nil {
+		t.Fatalf("syncOne returned error %q", err)
+	}
+
+	runner.wait()
+
+	var ids []int64
+	if err := queryRows(&ids, db, "SELECT id FROM items ORDER BY id LIMIT 2"); err != nil {
+		t.Fatalf("queryRows returned error %q", err)
+	}
+
+	if err := updatePlayedStatus(db, runner, true, ids...); err != nil {
+		t.Fatalf("updatePlayedStatus returned error %q", err)
+	}
+
+	// Unplaying items doesn't trigger anything.
+	if err := updatePlayedStatus(db, runner, false, ids...); err != nil {
+		t.Fatalf("updatePlayedStatus returned error %q", err)
+	}
+
+	runner.wait()
+
+	if len(rec.payloads) != 2 {
+		t.Fatalf("expected 2 webhook calls, got %d", len(rec.payloads))
+	}
+
+	for i, exp := range []struct {
+		Event hookEvent
+		Items int
+	}{
+		{hookNewItems, 2},
+		{hookItemPlayed, 2},
+	} {
+		got := rec.payloads[i]
+		if got.Event != exp.Event || got.Feed.ID != res.ID || len(got.Items) != exp.Items {
+			t.Errorf("expected %s webhook with %d items, got %s", exp.Event, exp.Items, jsonify(got))
+		}
+	}
+
+	if items := rec.payloads[1].Items; items[0].ID != ids[0] || items[1].ID != ids[1] {
+		t.Errorf("expected played items %v, got %s", ids, jsonify(items))
+	}
+}
+
+func TestFireHooksTimeout(t *testing.T) {
+	testWithInitDB(t, testFireHooksTimeout)
+}
+
+func testFireHooksTimeout(t *testing.T, db *sql.DB) {
+
+	dir, err := ioutil.TempDir("", "kibner-hooks")
+	if err != nil {
+		t.Fatalf("TempDir returned error %q", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var logs bytes.Buffer
+	runner := newHookRunner(NewLogger(&logs, logLevelWarn))
+
+	defer func(d time.Duration) { defaults.HookTimeout = d }(defaults.HookTimeout)
+	defaults.HookTimeout = 100 * time.Millisecond
+
+	slow := hookScript(t, dir, "slow.sh", "exec sleep 5")
+
+	if _, err := addHook(db, hookSyncFailed, slow); err != nil {
+		t.Fatalf("addHook returned error %q", err)
+	}
+
+	start := time.Now()
+
+	fireHooks(db, runner, &hookPayload{
+		Event: hookSyncFailed,
+		Feed:  hookFeed{ID: 1, Title: "Serial"},
+		Error: "bad status: 404 Not Found",
+	})
+	runner.wait()
+
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("expected hook to time out, took %s", d)
+	}
+
+	if exp := "failed: timed out after 100ms\n"; !strings.Contains(logs.String(), exp) {
+		t.Errorf("expected hook log to contain %q, got %q", exp, logs.String())
+	}
+}
+
+func TestHooksDontStallBatches(t *testing.T) {
+	testWithInitDB(t, testHooksDontStallBatches)
+}
+
+func testHooksDontStallBatches(t *testing.T, db *sql.DB) {
+
+	dir, err := ioutil.TempDir("", "kibner-hooks")
+	if err != nil {
+		t.Fatalf("TempDir returned error %q", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(d time.Duration) { defaults.HookTimeout = d }(defaults.HookTimeout)
+	defaults.HookTimeout = 500 * time.Millisecond
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	var logs bytes.Buffer
+	runner := newHookRunner(NewLogger(&logs, logLevelWarn))
+
+	slow := hookScript(t, dir, "slow.sh", "exec sleep 5")
+
+	if _, err := addHook(db, hookFeedAdded, slow); err != nil {
+		t.Fatalf("addHook returned error %q", err)
+	}
+
+	urls := []string{
+		serverURL(ts, "serial.xml"),
+		serverURL(ts, "rework.xml"),
+		serverURL(ts, "s-town.xml"),
+	}
+
+	start := time.Now()
+
+	for _, res := range addFeedMultiple(db, runner, urls, nil) {
+		if res.Err != nil {
+			t.Fatalf("addFeedMultiple returned error %q for %s", res.Err, res.Source)
+		}
+	}
+
+	// Run one after another, the hooks would take 1.5s.
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected feeds to be added without waiting for hooks, took %s", d)
+	}
+
+	runner.wait()
+
+	if d := time.Since(start); d > 1400*time.Millisecond {
+		t.Errorf("expected hooks to run in parallel, took %s", d)
+	}
+
+	if n := strings.Count(logs.String(), "timed out"); n != len(urls) {
+		t.Errorf("expected %d hooks to time out, got %d (%q)", len(urls), n, logs.String())
+	}
+}
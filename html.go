@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Elements that start a new block of text.
+var htmlBlockElements = map[string]bool{
+	"address":    true,
+	"article":    true,
+	"blockquote": true,
+	"dd":         true,
+	"div":        true,
+	"dl":         true,
+	"dt":         true,
+	"figure":     true,
+	"footer":     true,
+	"h1":         true,
+	"h2":         true,
+	"h3":         true,
+	"h4":         true,
+	"h5":         true,
+	"h6":         true,
+	"header":     true,
+	"hr":         true,
+	"p":          true,
+	"pre":        true,
+	"section":    true,
+	"table":      true,
+	"tr":         true,
+}
+
+// Elements whose content is never displayed.
+var htmlHiddenElements = map[string]bool{
+	"head":   true,
+	"script": true,
+	"style":  true,
+	"title":  true,
+}
+
+// htmlList is an ordered or unordered list that's being
+// rendered.
+type htmlList struct {
+	ordered bool
+	items   int
+	indent  int
+}
+
+// htmlRenderer accumulates the plain text version of an HTML
+// fragment.
+type htmlRenderer struct {
+	linelen int
+	lines   []string
+	text    []string
+	gap     bool
+	hidden  int
+	hrefs   []string
+	links   []string
+	lists   []htmlList
+	marker  string
+}
+
+// renderHTML converts an HTML fragment into lines of plain
+// text no longer than linelen characters. Blocks such as
+// paragraphs are separated by blank lines and line breaks are
+// preserved, and list items are bulleted or numbered. Links are
+// numbered in the text and their URLs are listed as footnotes at
+// the end.
+//
+// Plain text (which is what a lot of feeds use) is simply
+// wrapped, as is anything that can't be parsed as HTML.
+func renderHTML(linelen int, s string) []string {
+
+	r := &htmlRenderer{
+		linelen: linelen,
+	}
+
+	if err := r.render(s); err != nil {
+		return formatLines(linelen, normaliseText(s))
+	}
+
+	return r.lines
+}
+
+func (r *htmlRenderer) render(s string) error {
+
+	// The decoder needs a single root element.
+	d := xml.NewDecoder(strings.NewReader("<html>" + s + "</html>"))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			r.start(strings.ToLower(t.Name.Local), t.Attr)
+		case xml.EndElement:
+			r.end(strings.ToLower(t.Name.Local))
+		case xml.CharData:
+			if r.hidden == 0 {
+				r.text = append(r.text, string(t))
+			}
+		}
+	}
+
+	r.flush()
+
+	if len(r.links) > 0 {
+		r.lines = append(r.lines, "")
+		for i, link := range r.links {
+			r.lines = append(r.lines, fmt.Sprintf("[%d] %s", i+1, link))
+		}
+	}
+
+	return nil
+}
+
+func (r *htmlRenderer) start(name string, attrs []xml.Attr) {
+
+	switch {
+	case htmlHiddenElements[name]:
+		r.hidden++
+	case htmlBlockElements[name]:
+		r.flush()
+		r.gap = true
+	case name == "br":
+		r.flush()
+	case name == "ul", name == "ol":
+		r.flush()
+		if len(r.lists) == 0 {
+			r.gap = true
+		}
+		r.lists = append(r.lists, htmlList{
+			ordered: name == "ol",
+		})
+	case name == "li":
+		r.flush()
+		if len(r.lists) == 0 {
+			// A list item without a list.
+			r.lists = append(r.lists, htmlList{})
+		}
+		r.startItem()
+	case name == "a":
+		r.hrefs = append(r.hrefs, attrValue(attrs, "href"))
+		// Remember where the link text starts so that we
+		// can tell whether the link is just a bare URL.
+		r.text = append(r.text, "")
+	}
+}
+
+func (r *htmlRenderer) end(name string) {
+
+	switch {
+	case htmlHiddenElements[name]:
+		if r.hidden > 0 {
+			r.hidden--
+		}
+	case htmlBlockElements[name]:
+		r.flush()
+		r.gap = true
+	case name == "ul", name == "ol":
+		r.flush()
+		// An empty item's marker mustn't end up on the text
+		// after the list.
+		r.marker = ""
+		if len(r.lists) > 0 {
+			r.lists = r.lists[:len(r.lists)-1]
+		}
+		if len(r.lists) == 0 {
+			r.gap = true
+		}
+	case name == "li":
+		r.flush()
+		r.marker = ""
+	case name == "a":
+		if len(r.hrefs) == 0 {
+			return
+		}
+		href := r.hrefs[len(r.hrefs)-1]
+		r.hrefs = r.hrefs[:len(r.hrefs)-1]
+		r.link(href)
+	}
+}
+
+// startItem sets the bullet or number for a new list item.
+// Nested lists are indented by two spaces per level and any
+// text that wraps is lined up with the start of the item.
+func (r *htmlRenderer) startItem() {
+
+	l := &r.lists[len(r.lists)-1]
+	l.items++
+
+	r.marker = "•"
+	if l.ordered {
+		r.marker = fmt.Sprintf("%d.", l.items)
+	}
+
+	l.indent = 2*(len(r.lists)-1) + utf8.RuneCountInString(r.marker) + 1
+}
+
+// link adds a footnote reference for the link that has just
+// been closed, unless the link text is the URL itself.
+func (r *htmlRenderer) link(href string) {
+
+	href = strings.TrimSpace(href)
+	if href == "" || strings.HasPrefix(href, "#") {
+		return
+	}
+
+	// Find the link text, i.e. everything since the empty
+	// marker added by start.
+	start := len(r.text)
+	for i := len(r.text) - 1; i >= 0; i-- {
+		if r.text[i] == "" {
+			start = i
+			break
+		}
+	}
+
+	text := strings.Join(r.text[start:], "")
+	if strings.TrimSpace(text) == href {
+		return
+	}
+
+	n := 0
+	for i, link := range r.links {
+		if link == href {
+			n = i + 1
+			break
+		}
+	}
+
+	if n == 0 {
+		r.links = append(r.links, href)
+		n = len(r.links)
+	}
+
+	// Put the reference straight after the link text, even
+	// if the text ends in whitespace.
+	trimmed := strings.TrimRightFunc(text, unicode.IsSpace)
+	ref := fmt.Sprintf("%s [%d]%s", trimmed, n, text[len(trimmed):])
+
+	r.text = append(r.text[:start], ref)
+}
+
+// flush wraps the pending text and adds it to the output.
+func (r *htmlRenderer) flush() {
+
+	text := replaceWhitespace(strings.Join(r.text, ""), " ")
+	r.text = nil
+
+	if text == "" {
+		return
+	}
+
+	if r.gap && len(r.lines) > 0 {
+		r.lines = append(r.lines, "")
+	}
+	r.gap = false
+
+	indent := 0
+	if len(r.lists) > 0 {
+		indent = r.lists[len(r.lists)-1].indent
+	}
+
+	// Don't let deeply nested lists squeeze the text into
+	// nothing.
+	linelen := r.linelen - indent
+	if linelen < r.linelen/2 {
+		linelen = r.linelen / 2
+	}
+
+	prefix := strings.Repeat(" ", indent)
+	marker := r.marker
+	r.marker = ""
+
+	for i, line := range formatLines(linelen, text) {
+		if i == 0 && marker != "" && indent > utf8.RuneCountInString(marker) {
+			line = prefix[:indent-utf8.RuneCountInString(marker)-1] + marker + " " + line
+		} else {
+			line = prefix + line
+		}
+		r.lines = append(r.lines, line)
+	}
+}
+
+func attrValue(attrs []xml.Attr, name string) string {
+	for _, attr := range attrs {
+		if strings.EqualFold(attr.Name.Local, name) {
+			return attr.Value
+		}
+	}
+	return ""
+}
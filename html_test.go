@@ -0,0 +1,235 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestRenderHTML(t *testing.T) {
+
+	tests := []struct {
+		Name  string
+		HTML  string
+		Lines []string
+	}{
+		{
+			Name: "Empty",
+		},
+		{
+			Name:  "Plain text",
+			HTML:  "  Just some\n  plain text.  ",
+			Lines: []string{"Just some plain", "text."},
+		},
+		{
+			Name: "Wrapped",
+			HTML: "<p>The quick brown fox jumps over the lazy dog.</p>",
+			Lines: []string{
+				"The quick brown fox",
+				"jumps over the lazy",
+				"dog.",
+			},
+		},
+		{
+			Name: "Paragraphs and line breaks",
+			HTML: "<p>One</p><p>Two<br>Three<br/></p><div>Four</div>",
+			Lines: []string{
+				"One",
+				"",
+				"Two",
+				"Three",
+				"",
+				"Four",
+			},
+		},
+		{
+			Name:  "Entities",
+			HTML:  "Tom &amp; Jerry&nbsp;&mdash; &#8220;Cat&#8221;",
+			Lines: []string{"Tom & Jerry — “Cat”"},
+		},
+		{
+			Name: "Links",
+			HTML: `<a href="http://one.com">One</a>, <a href="http://two.com">Two</a> and <a href="http://one.com">One</a> again`,
+			Lines: []string{
+				"One [1], Two [2] and",
+				"One [1] again",
+				"",
+				"[1] http://one.com",
+				"[2] http://two.com",
+			},
+		},
+		{
+			Name:  "Bare links and anchors",
+			HTML:  `See <a href="http://one.com">http://one.com</a> or <a href="#top">the top</a>`,
+			Lines: []string{"See http://one.com", "or the top"},
+		},
+		{
+			Name: "Link text with trailing space",
+			HTML: `Visit <a href="http://one.com">One, </a>or not`,
+			Lines: []string{
+				"Visit One, [1] or",
+				"not",
+				"",
+				"[1] http://one.com",
+			},
+		},
+		{
+			Name: "Lists",
+			HTML: "<p>Notes:</p><ul><li>First item wraps onto a new line</li><li>Second<ol><li>Nested</li><li>Also nested</li></ol></li></ul><p>After</p>",
+			Lines: []string{
+				"Notes:",
+				"",
+				"• First item wraps",
+				"  onto a new line",
+				"• Second",
+				"  1. Nested",
+				"  2. Also nested",
+				"",
+				"After",
+			},
+		},
+		{
+			Name:  "Empty list item",
+			HTML:  "<ul><li></li></ul>text",
+			Lines: []string{"text"},
+		},
+		{
+			Name:  "Empty nested list item",
+			HTML:  "<ol><li><ul><li></li></ul></li></ol>after",
+			Lines: []string{"after"},
+		},
+		{
+			Name:  "Item text in a block",
+			HTML:  "<ul><li><p>First</p></li><li></li><li>Third</li></ul>",
+			Lines: []string{"• First", "", "• Third"},
+		},
+		{
+			Name:  "Hidden elements",
+			HTML:  "<style>p { color: red; }</style><p>Visible</p><script>alert(1)</script>",
+			Lines: []string{"Visible"},
+		},
+		{
+			Name:  "Unclosed tags",
+			HTML:  "<p>One<p>Two <b>bold",
+			Lines: []string{"One", "", "Two bold"},
+		},
+	}
+
+	for _, test := range tests {
+		got := renderHTML(20, test.HTML)
+		if !reflect.DeepEqual(got, test.Lines) {
+			t.Errorf("%s: expected renderHTML to return %q, got %q", test.Name, test.Lines, got)
+		}
+	}
+}
+
+func TestRenderHTMLTestdata(t *testing.T) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	rxRef := regexp.MustCompile(`\[(\d+)\]`)
+
+	for name, test := range allTestCases {
+
+		feed, err := fetchAndParse(serverURL(ts, test.Filename))
+		if err != nil {
+			t.Fatalf("%s: fetchAndParse returned error %q", name, err)
+		}
+
+		for i, item := range feed.Items {
+
+			lines := renderHTML(70, item.RawDesc)
+			text := strings.Join(lines, "\n")
+
+			if item.RawDesc != "" && len(lines) == 0 {
+				t.Errorf("%s item %d: expected renderHTML to return some text", name, i+1)
+			}
+
+			if s := replaceTags(text, ""); s != text {
+				t.Errorf("%s item %d: expected renderHTML to remove HTML tags, got %q", name, i+1, text)
+			}
+
+			for _, entity := range []string{"&amp;", "&nbsp;", "&#"} {
+				if strings.Contains(text, entity) {
+					t.Errorf("%s item %d: expected renderHTML to decode %s, got %q", name, i+1, entity, text)
+				}
+			}
+
+			footnotes := map[string]bool{}
+
+			for _, line := range lines {
+				if m := rxRef.FindStringSubmatch(line); m != nil && strings.HasPrefix(line, m[0]+" ") {
+					footnotes[m[1]] = true
+					continue
+				}
+				if n := utf8.RuneCountInString(line); n > 70 && strings.Contains(line, " ") {
+					t.Errorf("%s item %d: expected lines of at most 70 characters, got %d in %q", name, i+1, n, line)
+				}
+			}
+
+			for _, m := range rxRef.FindAllStringSubmatch(text, -1) {
+				if !footnotes[m[1]] {
+					t.Errorf("%s item %d: expected a footnote for link %s in %q", name, i+1, m[0], text)
+				}
+			}
+		}
+	}
+
+	feed, err := fetchAndParse(serverURL(ts, allTestCases["Ear Hustle"].Filename))
+	if err != nil {
+		t.Fatalf("fetchAndParse returned error %q", err)
+	}
+
+	exp := []string{
+		"Special thanks to Richie Morris, Dwight Krizman & Charles Spencer of",
+		`Quentin Blue for performing "Trying to Carry On."`,
+		"",
+		"Ear Hustle is produced by Nigel Poor, Antwan Williams and Earlonne",
+		"Woods with consulting editor Curtis Fox, outside production advisor",
+		"Pat Mesiti-Miller and executive producer Julie Shapiro. Sound design",
+		"in this episode is by Earlonne Woods, with contributing beats from",
+		"Antwan Williams, JB Burton and David Jassy.",
+		"",
+		"Find out more about the show at earhustlesq.com, [1] including how to",
+		"send us a question (by postcard) that might get answered in a future",
+		"episode. Ear Hustle is a proud member of Radiotopia [2], from PRX.",
+		"",
+		"Lastly! Yet more thanks to Mail Chimp [3] and Squarespace [4] for",
+		"supporting the show.",
+		"",
+		"[1] https://www.earhustlesq.com/",
+		"[2] https://www.radiotopia.fm/",
+		"[3] https://mailchimp.com/",
+		"[4] https://www.squarespace.com/",
+	}
+
+	lines := renderHTML(70, feed.Items[0].RawDesc)
+	if len(lines) < len(exp) {
+		t.Fatalf("expected renderHTML to return at least %d lines, got %q", len(exp), lines)
+	}
+
+	if got := lines[len(lines)-len(exp):]; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected renderHTML to end with %q, got %q", exp, got)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+
+	tests := map[int64]string{
+		0:             "0 bytes",
+		999:           "999 bytes",
+		1000:          "1.0 KB",
+		82644860:      "82.6 MB",
+		1500000000:    "1.5 GB",
+		2500000000000: "2500.0 GB",
+	}
+
+	for n, exp := range tests {
+		if got := formatBytes(n); got != exp {
+			t.Errorf("expected formatBytes(%d) to return %q, got %q", n, exp, got)
+		}
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Kibner makes all of its HTTP requests with defaultClient.
+// Its transport has separate timeouts for connecting, waiting
+// for a response and reading the response body, so that large
+// feeds on slow servers don't time out as long as data keeps
+// arriving. GET and HEAD requests that fail with a network
+// error or a status that suggests a temporary problem (429 and
+// most 5xx) are retried with exponential backoff, or after the
+// wait given in a Retry-After header. Responses are requested
+// with gzip or brotli compression and decompressed on the fly.
+// The settings can be changed with KIBNER_* environment
+// variables (see httpConfig.loadEnv).
+
+// httpConfig holds the settings for the HTTP client.
+type httpConfig struct {
+	// ConnectTimeout limits the time taken to connect to a
+	// server, including the TLS handshake.
+	ConnectTimeout time.Duration
+	// HeaderTimeout limits the time between sending a
+	// request and receiving the response headers.
+	HeaderTimeout time.Duration
+	// BodyTimeout limits the time spent waiting for more of
+	// the response body. The body as a whole can take longer.
+	BodyTimeout time.Duration
+	// MaxRetries is the number of times a failed request is
+	// retried. RetryWait is the wait before the first retry,
+	// which doubles each time up to MaxRetryWait. Requests
+	// that ask for longer waits aren't retried.
+	MaxRetries   int
+	RetryWait    time.Duration
+	MaxRetryWait time.Duration
+	// MaxPerHost limits the number of feeds fetched at the
+	// same time from a single host.
+	MaxPerHost int
+	// Proxy is the URL of an HTTP, HTTPS or SOCKS5 proxy. If
+	// it's nil, the standard HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY environment variables are used.
+	Proxy     *url.URL
+	UserAgent string
+}
+
+func defaultHTTPConfig() httpConfig {
+	return httpConfig{
+		ConnectTimeout: defaults.ConnectTimeout,
+		HeaderTimeout:  defaults.HeaderTimeout,
+		BodyTimeout:    defaults.BodyTimeout,
+		MaxRetries:     defaults.MaxRetries,
+		RetryWait:      defaults.RetryWait,
+		MaxRetryWait:   defaults.MaxRetryWait,
+		MaxPerHost:     defaults.MaxPerHost,
+		UserAgent:      "kibner/" + version,
+	}
+}
+
+// loadEnv overrides the settings with any that are set in the
+// environment. getenv is usually os.Getenv.
+func (cfg *httpConfig) loadEnv(getenv func(string) string) error {
+
+	durations := map[string]*time.Duration{
+		"KIBNER_CONNECT_TIMEOUT": &cfg.ConnectTimeout,
+		"KIBNER_HEADER_TIMEOUT":  &cfg.HeaderTimeout,
+		"KIBNER_BODY_TIMEOUT":    &cfg.BodyTimeout,
+	}
+
+	for name, p := range durations {
+		if val := getenv(name); val != "" {
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 {
+				return errors.New("invalid " + name + " " + strconv.Quote(val) + " (use e.g. 30s or 2m)")
+			}
+			*p = d
+		}
+	}
+
+	if val := getenv("KIBNER_RETRIES"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return errors.New("invalid KIBNER_RETRIES " + strconv.Quote(val))
+		}
+		cfg.MaxRetries = n
+	}
+
+	if val := getenv("KIBNER_MAX_PER_HOST"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 {
+			return errors.New("invalid KIBNER_MAX_PER_HOST " + strconv.Quote(val))
+		}
+		cfg.MaxPerHost = n
+	}
+
+	if val := getenv("KIBNER_PROXY"); val != "" {
+		u, err := parseProxy(val)
+		if err != nil {
+			return err
+		}
+		cfg.Proxy = u
+	}
+
+	if val := getenv("KIBNER_USER_AGENT"); val != "" {
+		cfg.UserAgent = val
+	}
+
+	return nil
+}
+
+func parseProxy(s string) (*url.URL, error) {
+
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("invalid proxy " + strconv.Quote(s))
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return u, nil
+	default:
+		return nil, errors.New("invalid proxy " + strconv.Quote(s) + " (the scheme must be http, https or socks5)")
+	}
+}
+
+// httpSettings are the settings that defaultClient was created
+// with. Call configureHTTP to change them.
+var httpSettings = defaultHTTPConfig()
+
+var defaultClient = newHTTPClient(httpSettings)
+
+// configureHTTP replaces defaultClient with one that uses the
+// given settings.
+func configureHTTP(cfg httpConfig) {
+	httpSettings = cfg
+	defaultClient = newHTTPClient(cfg)
+}
+
+func newHTTPClient(cfg httpConfig) *http.Client {
+
+	base := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   cfg.ConnectTimeout,
+		ResponseHeaderTimeout: cfg.HeaderTimeout,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		// Compression is handled by retryTransport, which
+		// also understands brotli.
+		DisableCompression: true,
+	}
+
+	if cfg.Proxy != nil {
+		base.Proxy = http.ProxyURL(cfg.Proxy)
+	}
+
+	return &http.Client{
+		CheckRedirect: checkRedirect,
+		Transport: &retryTransport{
+			base:  base,
+			cfg:   cfg,
+			clock: realClock{},
+		},
+	}
+}
+
+// newRequest creates a GET request with kibner's User-Agent.
+func newRequest(url string) (*http.Request, error) {
+	return newRequestMethod(http.MethodGet, url, nil)
+}
+
+func newRequestMethod(method, url string, body io.Reader) (*http.Request, error) {
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", httpSettings.UserAgent)
+	return req, nil
+}
+
+// retryTransport wraps an http.Transport with retries, body
+// timeouts and decompression.
+type retryTransport struct {
+	base  http.RoundTripper
+	cfg   httpConfig
+	clock clock
+}
+
+// retryStatuses are the response codes that are worth trying
+// again after a wait.
+var retryStatuses = map[int]bool{
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	// RoundTrippers mustn't modify the request.
+	r := req.WithContext(req.Context())
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+
+	// Compressed byte ranges wouldn't make sense.
+	if r.Header.Get("Accept-Encoding") == "" && r.Header.Get("Range") == "" {
+		r.Header.Set("Accept-Encoding", "gzip, br")
+	}
+
+	for attempt := 0; ; attempt++ {
+
+		resp, err := t.roundTrip(r)
+
+		wait, ok := t.retryWait(r, resp, err, attempt)
+		if !ok {
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		case <-t.clock.After(wait):
+		}
+	}
+}
+
+// roundTrip makes a single attempt at a request.
+func (t *retryTransport) roundTrip(req *http.Request) (*http.Response, error) {
+
+	ctx, cancel := context.WithCancel(req.Context())
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	body := &timeoutBody{
+		ReadCloser: resp.Body,
+		cancel:     cancel,
+		timeout:    t.cfg.BodyTimeout,
+	}
+	body.timer = time.AfterFunc(body.timeout, body.expire)
+	resp.Body = body
+
+	if req.Method == http.MethodHead {
+		return resp, nil
+	}
+
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "gzip":
+		resp.Body = &decodedBody{Reader: &lazyGzipReader{r: body}, body: body}
+	case "br":
+		resp.Body = &decodedBody{Reader: brotli.NewReader(body), body: body}
+	default:
+		return resp, nil
+	}
+
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+
+	return resp, nil
+}
+
+// retryWait reports whether a request should be retried and if
+// so, how long to wait first.
+func (t *retryTransport) retryWait(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool) {
+
+	if attempt >= t.cfg.MaxRetries || req.Context().Err() != nil {
+		return 0, false
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return 0, false
+	}
+
+	if err == nil && !retryStatuses[resp.StatusCode] {
+		return 0, false
+	}
+
+	wait := t.cfg.RetryWait << uint(attempt)
+	if wait > t.cfg.MaxRetryWait || wait <= 0 {
+		wait = t.cfg.MaxRetryWait
+	}
+
+	if resp != nil {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), t.clock.Now()); ok {
+			if d > t.cfg.MaxRetryWait {
+				return 0, false
+			}
+			wait = d
+		}
+	}
+
+	return wait, true
+}
+
+// parseRetryAfter parses the value of a Retry-After header,
+// which is either a number of seconds or an HTTP date.
+func parseRetryAfter(s string, now time.Time) (time.Duration, bool) {
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(s); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+
+	t, err := http.ParseTime(s)
+	if err != nil {
+		return 0, false
+	}
+
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+
+	return 0, true
+}
+
+// timeoutBody is a response body that gives up if no data
+// arrives for the given timeout.
+type timeoutBody struct {
+	io.ReadCloser
+	cancel  context.CancelFunc
+	timeout time.Duration
+	timer   *time.Timer
+
+	mu      sync.Mutex
+	expired bool
+}
+
+func (b *timeoutBody) expire() {
+	b.mu.Lock()
+	b.expired = true
+	b.mu.Unlock()
+	b.cancel()
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	expired := b.expired
+	b.mu.Unlock()
+
+	if expired {
+		return n, errors.New("timed out reading response after " + b.timeout.String())
+	}
+
+	b.timer.Reset(b.timeout)
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	b.timer.Stop()
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// decodedBody is a decompressed response body.
+type decodedBody struct {
+	io.Reader
+	body io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	return b.body.Close()
+}
+
+// lazyGzipReader creates its gzip.Reader on the first read, so
+// that errors reading the gzip header are returned by Read.
+type lazyGzipReader struct {
+	r  io.Reader
+	zr *gzip.Reader
+}
+
+func (r *lazyGzipReader) Read(p []byte) (int, error) {
+
+	if r.zr == nil {
+		zr, err := gzip.NewReader(r.r)
+		if err != nil {
+			return 0, err
+		}
+		r.zr = zr
+	}
+
+	return r.zr.Read(p)
+}
+
+// hostLimiter limits the number of requests made to each host
+// at the same time.
+type hostLimiter struct {
+	max   int
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+func newHostLimiter(max int) *hostLimiter {
+
+	if max < 1 {
+		max = 1
+	}
+
+	return &hostLimiter{
+		max:   max,
+		hosts: make(map[string]chan struct{}),
+	}
+}
+
+// acquire waits until a request can be made to the host in
+// rawurl. Call the returned function when the request is done.
+func (l *hostLimiter) acquire(rawurl string) func() {
+
+	host := rawurl
+	if u, err := url.Parse(rawurl); err == nil && u.Host != "" {
+		host = strings.ToLower(u.Host)
+	}
+
+	l.mu.Lock()
+	slots := l.hosts[host]
+	if slots == nil {
+		slots = make(chan struct{}, l.max)
+		l.hosts[host] = slots
+	}
+	l.mu.Unlock()
+
+	slots <- struct{}{}
+
+	return func() {
+		<-slots
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestHTTPConfigLoadEnv(t *testing.T) {
+
+	tests := []struct {
+		Name  string
+		Env   map[string]string
+		Check func(cfg httpConfig) bool
+		Error string
+	}{
+		{
+			Name: "Defaults",
+			Check: func(cfg httpConfig) bool {
+				return reflect.DeepEqual(cfg, defaultHTTPConfig())
+			},
+		},
+		{
+			Name: "Overrides",
+			Env: map[string]string{
+				"KIBNER_CONNECT_TIMEOUT": "5s",
+				"KIBNER_BODY_TIMEOUT":    "2m",
+				"KIBNER_RETRIES":         "0",
+				"KIBNER_MAX_PER_HOST":    "4",
+				"KIBNER_PROXY":           "socks5://localhost:1080",
+				"KIBNER_USER_AGENT":      "MyPodcatcher/1.0",
+			},
+			Check: func(cfg httpConfig) bool {
+				return cfg.ConnectTimeout == 5*time.Second &&
+					cfg.HeaderTimeout == defaults.HeaderTimeout &&
+					cfg.BodyTimeout == 2*time.Minute &&
+					cfg.MaxRetries == 0 &&
+					cfg.MaxPerHost == 4 &&
+					cfg.Proxy.String() == "socks5://localhost:1080" &&
+					cfg.UserAgent == "MyPodcatcher/1.0"
+			},
+		},
+		{
+			Name:  "Bad timeout",
+			Env:   map[string]string{"KIBNER_HEADER_TIMEOUT": "30"},
+			Error: `invalid KIBNER_HEADER_TIMEOUT "30" (use e.g. 30s or 2m)`,
+		},
+		{
+			Name:  "Bad host limit",
+			Env:   map[string]string{"KIBNER_MAX_PER_HOST": "0"},
+			Error: `invalid KIBNER_MAX_PER_HOST "0"`,
+		},
+		{
+			Name:  "Bad proxy",
+			Env:   map[string]string{"KIBNER_PROXY": "ftp://localhost"},
+			Error: `invalid proxy "ftp://localhost" (the scheme must be http, https or socks5)`,
+		},
+	}
+
+	for _, test := range tests {
+
+		cfg := defaultHTTPConfig()
+		err := cfg.loadEnv(func(name string) string {
+			return test.Env[name]
+		})
+
+		if errString(err) != test.Error {
+			t.Errorf("%s: expected error %q, got %q", test.Name, test.Error, err)
+			continue
+		}
+
+		if test.Check != nil && !test.Check(cfg) {
+			t.Errorf("%s: unexpected settings %+v", test.Name, cfg)
+		}
+	}
+}
+
+// instantClock is a clock that never waits. It records the
+// waits it was asked for instead.
+type instantClock struct {
+	mu    sync.Mutex
+	waits []time.Duration
+}
+
+func (c *instantClock) Now() time.Time {
+	return time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+}
+
+func (c *instantClock) After(d time.Duration) <-chan time.Time {
+
+	c.mu.Lock()
+	c.waits = append(c.waits, d)
+	c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	ch <- c.Now().Add(d)
+	return ch
+}
+
+func newTestHTTPClient(cfg httpConfig) (*http.Client, *instantClock) {
+
+	clk := &instantClock{}
+
+	client := newHTTPClient(cfg)
+	client.Transport.(*retryTransport).clock = clk
+
+	return client, clk
+}
+
+func TestRetryTransport(t *testing.T) {
+
+	// The server fails with the given statuses in turn and
+	// then succeeds.
+	type response struct {
+		Status     int
+		RetryAfter string
+	}
+
+	tests := []struct {
+		Name      string
+		Method    string
+		Responses []response
+		Status    int
+		Waits     []time.Duration
+	}{
+		{
+			Name:   "Success",
+			Status: http.StatusOK,
+		},
+		{
+			Name: "Backoff",
+			Responses: []response{
+				{Status: http.StatusServiceUnavailable},
+				{Status: http.StatusBadGateway},
+			},
+			Status: http.StatusOK,
+			Waits:  []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			Name: "Retry-After",
+			Responses: []response{
+				{Status: http.StatusTooManyRequests, RetryAfter: "5"},
+				{Status: http.StatusServiceUnavailable, RetryAfter: "Wed, 01 Jan 2020 12:00:30 GMT"},
+			},
+			Status: http.StatusOK,
+			Waits:  []time.Duration{5 * time.Second, 30 * time.Second},
+		},
+		{
+			Name: "Retry-After too long",
+			Responses: []response{
+				{Status: http.StatusServiceUnavailable, RetryAfter: "3600"},
+			},
+			Status: http.StatusServiceUnavailable,
+		},
+		{
+			Name: "Too many failures",
+			Responses: []response{
+				{Status: http.StatusInternalServerError},
+				{Status: http.StatusInternalServerError},
+				{Status: http.StatusInternalServerError},
+				{Status: http.StatusGatewayTimeout},
+			},
+			Status: http.StatusGatewayTimeout,
+			Waits:  []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+		},
+		{
+			Name: "Not found",
+			Responses: []response{
+				{Status: http.StatusNotFound},
+			},
+			Status: http.StatusNotFound,
+		},
+		{
+			Name:   "POST",
+			Method: http.MethodPost,
+			Responses: []response{
+				{Status: http.StatusServiceUnavailable},
+			},
+			Status: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, test := range tests {
+
+		var mu sync.Mutex
+		responses := test.Responses
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if len(responses) == 0 {
+				w.Write([]byte("OK"))
+				return
+			}
+
+			resp := responses[0]
+			responses = responses[1:]
+
+			if resp.RetryAfter != "" {
+				w.Header().Set("Retry-After", resp.RetryAfter)
+			}
+			w.WriteHeader(resp.Status)
+		}))
+
+		client, clk := newTestHTTPClient(defaultHTTPConfig())
+
+		method := test.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+
+		req, err := newRequestMethod(method, ts.URL, nil)
+		if err != nil {
+			t.Fatalf("%s: newRequestMethod returned error %q", test.Name, err)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("%s: Do returned error %q", test.Name, err)
+			ts.Close()
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.Status {
+			t.Errorf("%s: expected status %d, got %d", test.Name, test.Status, resp.StatusCode)
+		}
+
+		if !reflect.DeepEqual(clk.waits, test.Waits) {
+			t.Errorf("%s: expected waits %v, got %v", test.Name, test.Waits, clk.waits)
+		}
+
+		ts.Close()
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		Value string
+		Wait  time.Duration
+		OK    bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{"-1", 0, false},
+		{"Wed, 01 Jan 2020 12:01:00 GMT", time.Minute, true},
+		{"Wed, 01 Jan 2020 11:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+
+	for _, test := range tests {
+		wait, ok := parseRetryAfter(test.Value, now)
+		if wait != test.Wait || ok != test.OK {
+			t.Errorf("%q: expected parseRetryAfter to return %s, %t, got %s, %t", test.Value, test.Wait, test.OK, wait, ok)
+		}
+	}
+}
+
+func TestHTTPCompression(t *testing.T) {
+
+	const body = "<rss>Compressed feed</rss>"
+
+	var gz, br bytes.Buffer
+
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(body))
+	zw.Close()
+
+	bw := brotli.NewWriter(&br)
+	bw.Write([]byte(body))
+	bw.Close()
+
+	encodings := make(chan string, 1)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		encodings <- r.Header.Get("Accept-Encoding")
+
+		switch r.URL.Path {
+		case "/gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gz.Bytes())
+		case "/br":
+			w.Header().Set("Content-Encoding", "br")
+			w.Write(br.Bytes())
+		default:
+			w.Write([]byte(body))
+		}
+	}))
+	defer ts.Close()
+
+	client, _ := newTestHTTPClient(defaultHTTPConfig())
+
+	for _, path := range []string{"gzip", "br", "plain"} {
+
+		req, err := newRequest(serverURL(ts, path))
+		if err != nil {
+			t.Fatalf("newRequest returned error %q", err)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: Do returned error %q", path, err)
+		}
+
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if err != nil {
+			t.Errorf("%s: ReadAll returned error %q", path, err)
+		}
+
+		if string(data) != body {
+			t.Errorf("%s: expected body %q, got %q", path, body, data)
+		}
+
+		if enc := <-encodings; enc != "gzip, br" {
+			t.Errorf("%s: expected Accept-Encoding %q, got %q", path, "gzip, br", enc)
+		}
+	}
+
+	// Range requests aren't compressed.
+	req, err := newRequest(serverURL(ts, "plain"))
+	if err != nil {
+		t.Fatalf("newRequest returned error %q", err)
+	}
+	req.Header.Set("Range", "bytes=0-9")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do returned error %q", err)
+	}
+	resp.Body.Close()
+
+	if enc := <-encodings; enc != "" {
+		t.Errorf("expected range request not to set Accept-Encoding, got %q", enc)
+	}
+}
+
+func TestHTTPBodyTimeout(t *testing.T) {
+
+	done := make(chan struct{})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// Send a bit of the body, then stall.
+		w.Write([]byte("<rss>"))
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	cfg := defaultHTTPConfig()
+	cfg.BodyTimeout = 100 * time.Millisecond
+
+	client, _ := newTestHTTPClient(cfg)
+
+	req, err := newRequest(ts.URL)
+	if err != nil {
+		t.Fatalf("newRequest returned error %q", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do returned error %q", err)
+	}
+	defer resp.Body.Close()
+
+	start := time.Now()
+
+	data, err := ioutil.ReadAll(resp.Body)
+
+	if exp := "timed out reading response after 100ms"; errString(err) != exp {
+		t.Errorf("expected error %q, got %q", exp, err)
+	}
+
+	if string(data) != "<rss>" {
+		t.Errorf("expected partial body %q, got %q", "<rss>", data)
+	}
+
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("expected read to time out, took %s", d)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+
+	defer func(cfg httpConfig) { configureHTTP(cfg) }(httpSettings)
+
+	cfg := defaultHTTPConfig()
+	cfg.UserAgent = "MyPodcatcher/1.0"
+	configureHTTP(cfg)
+
+	agents := make(chan string, 1)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.UserAgent()
+	}))
+	defer ts.Close()
+
+	if _, err := fetchURL(ts.URL); err != nil {
+		t.Fatalf("fetchURL returned error %q", err)
+	}
+
+	if got := <-agents; got != cfg.UserAgent {
+		t.Errorf("expected User-Agent %q, got %q", cfg.UserAgent, got)
+	}
+}
+
+func TestFetchAndParseMultipleHostLimit(t *testing.T) {
+
+	defer func(cfg httpConfig) { configureHTTP(cfg) }(httpSettings)
+
+	cfg := defaultHTTPConfig()
+	cfg.MaxPerHost = 2
+	configureHTTP(cfg)
+
+	var mu sync.Mutex
+	var active, maxActive int
+
+	files := http.FileServer(http.Dir("internal/testdata/rss"))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		files.ServeHTTP(w, r)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	var urls []string
+	for _, name := range []string{"serial.xml", "rework.xml", "columbo.xml", "uncivil.xml", "s-town.xml", "mogul.xml"} {
+		urls = append(urls, serverURL(ts, name))
+	}
+
+	feeds, errs := fetchAndParseMultiple(urls, 10, nil)
+
+	if len(feeds) != len(urls) || len(errs) != 0 {
+		t.Fatalf("expected %d feeds and no errors, got %d feeds and errors %v", len(urls), len(feeds), errs)
+	}
+
+	if maxActive != cfg.MaxPerHost {
+		t.Errorf("expected at most %d requests at a time, got %d", cfg.MaxPerHost, maxActive)
+	}
+}
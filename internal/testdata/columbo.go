@@ -54,6 +54,16 @@ func Columbo() *kibner.Feed {
 				Duration: 73 * time.Minute,
 				GUID:     "https://libsyn.com/columbo/s01e05.mp3",
 			},
+			{
+				// Non-standard pubdate
+				Title:    "Suitable for Framing",
+				Desc:     "Art critic Dale Kingston (Ross Martin) murders his uncle and tries to frame his aunt (Kim Hunter), to obtain what is considered to be one of the most valuable art collections in the world.",
+				Pubdate:  time.Date(1971, time.November, 18, 1, 30, 0, 0, time.UTC),
+				URL:      "https://libsyn.com/columbo/s01e04.mp3",
+				Filesize: 82644860,
+				Duration: 73 * time.Minute,
+				GUID:     "S01E04",
+			},
 			{
 				// Invalid filesize
 				Title:    "Death Lends a Hand",
@@ -99,15 +109,6 @@ func Columbo() *kibner.Feed {
 				Duration: 73 * time.Minute,
 				GUID:     "S01E03",
 			},
-			{
-				// Invalid pubdate
-				Title:    "Suitable for Framing",
-				Desc:     "Art critic Dale Kingston (Ross Martin) murders his uncle and tries to frame his aunt (Kim Hunter), to obtain what is considered to be one of the most valuable art collections in the world.",
-				URL:      "https://libsyn.com/columbo/s01e04.mp3",
-				Filesize: 82644860,
-				Duration: 73 * time.Minute,
-				GUID:     "S01E04",
-			},
 		},
 	}
 }
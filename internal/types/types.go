@@ -7,22 +7,46 @@ import "time"
 
 // Feed represents a podcast feed.
 type Feed struct {
-	Title  string
-	Author string
-	Desc   string
-	Type   string
-	URL    string
-	Link   string
-	Image  string
-	Items  []*Item
+	Title    string
+	Author   string
+	Desc     string
+	Type     string
+	URL      string
+	Link     string
+	Image    string
+	Language string
+	Items    []*Item
+	// Warnings lists problems found while parsing the feed,
+	// e.g. items that were skipped or had invalid fields.
+	Warnings []string
+	// Schedule holds the feed's hints about when it's worth
+	// fetching again, if it has any.
+	Schedule Schedule
+}
+
+// Schedule describes when a feed expects to be fetched.
+// Zero values mean that the feed gives no hint.
+type Schedule struct {
+	// TTL is how long the feed may be cached for (the RSS
+	// ttl element).
+	TTL time.Duration
+	// UpdatePeriod is how often the feed is updated (the
+	// sy:updatePeriod and sy:updateFrequency elements).
+	UpdatePeriod time.Duration
+	// SkipHours and SkipDays are the hours (0-23, in UTC)
+	// and days on which the feed shouldn't be fetched.
+	SkipHours []int
+	SkipDays  []time.Weekday
 }
 
 // Item represents an individual podcast episode.
 type Item struct {
 	Title    string
 	Desc     string
+	RawDesc  string
 	Pubdate  time.Time
 	URL      string
+	Type     string
 	Filesize int64
 	Duration time.Duration
 	GUID     string
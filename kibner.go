@@ -2,17 +2,18 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
@@ -28,6 +29,16 @@ func initDB(db *sql.DB) error {
 
 	sql := []string{
 
+		`DROP TABLE IF EXISTS feed_schedules`,
+
+		`DROP TABLE IF EXISTS hooks`,
+
+		`DROP TABLE IF EXISTS feed_tags`,
+
+		`DROP TABLE IF EXISTS gpodder_subscriptions`,
+
+		`DROP TABLE IF EXISTS gpodder_state`,
+
 		`DROP TABLE IF EXISTS items`,
 
 		`DROP TABLE IF EXISTS feeds`,
@@ -88,18 +99,235 @@ func initDB(db *sql.DB) error {
 		}
 	}
 
+	if err := upgradeSchema(tx, 0); err != nil {
+		return rollback(tx, err)
+	}
+
+	return tx.Commit()
+}
+
+// schemaUpgrades lists the changes made to the database
+// schema since the original release. Entry N upgrades a
+// database from version N to version N+1, where the version
+// is stored in SQLite's user_version pragma. initDB creates
+// the original schema and then applies every upgrade, so new
+// and upgraded databases always end up with the same tables.
+var schemaUpgrades = [][]string{
+
+	// Version 1: gpodder.net sync.
+	{
+		// Playback position in seconds, and the time at which
+		// the played status or position last changed locally.
+
+		`ALTER TABLE items ADD COLUMN position INTEGER DEFAULT 0`,
+
+		`ALTER TABLE items ADD COLUMN updated DATETIME DEFAULT 0`,
+
+		`CREATE TABLE gpodder_state (
+			account			TEXT PRIMARY KEY,
+			subscriptions	INTEGER DEFAULT 0,
+			actions			INTEGER DEFAULT 0,
+			uploaded		DATETIME DEFAULT 0
+		)`,
+
+		// The subscriptions that kibner and the server agreed
+		// on at the end of the last sync. Comparing this list
+		// with the feeds table tells us which feeds have been
+		// added or removed locally since then.
+
+		`CREATE TABLE gpodder_subscriptions (
+			account			TEXT NOT NULL,
+			url				TEXT NOT NULL
+		)`,
+
+		`CREATE UNIQUE INDEX unique_gpodder_url ON gpodder_subscriptions(account, url)`,
+	},
+
+	// Version 2: item IDs.
+	{
+		// Items were originally identified by their URL, which
+		// isn't necessarily unique. Give them an AUTOINCREMENT
+		// id for the same reasons as feeds (see initDB). SQLite
+		// can't add a primary key to an existing table so the
+		// table has to be rebuilt. Existing rows keep their
+		// ROWIDs as ids.
+
+		`CREATE TABLE items_v2 (
+			id				INTEGER PRIMARY KEY AUTOINCREMENT,
+			feedid			INTEGER NOT NULL REFERENCES feeds(id),
+			title			TEXT NOT NULL,
+			desc			TEXT,
+			pubdate			DATETIME NOT NULL,
+			url				TEXT NOT NULL,
+			filesize		INTEGER DEFAULT 0,
+			duration		INTEGER DEFAULT 0,
+			guid			TEXT NOT NULL,
+			unplayed		BOOLEAN DEFAULT 0,
+			timestamp		DATETIME NOT NULL,
+			position		INTEGER DEFAULT 0,
+			updated			DATETIME DEFAULT 0
+		)`,
+
+		`INSERT INTO items_v2 (id, feedid, title, desc, pubdate, url, filesize, duration, guid, unplayed, timestamp, position, updated)
+			SELECT ROWID, feedid, title, desc, pubdate, url, filesize, duration, guid, unplayed, timestamp, position, updated FROM items`,
+
+		`DROP TABLE items`,
+
+		`ALTER TABLE items_v2 RENAME TO items`,
+
+		`CREATE UNIQUE INDEX unique_item_guid ON items(feedid, guid)`,
+	},
+
+	// Version 3: item details.
+	{
+		// The MIME type of the item's enclosure, and the
+		// item's full description as it appeared in the feed,
+		// markup and all. The desc column holds a shorter,
+		// plain text summary.
+
+		`ALTER TABLE items ADD COLUMN type TEXT DEFAULT ''`,
+
+		`ALTER TABLE items ADD COLUMN rawdesc TEXT DEFAULT ''`,
+	},
+
+	// Version 4: duration probing.
+	{
+		// The time at which the item's media file was last
+		// probed for its duration (see probeItems), or 0 if it
+		// never has been.
+
+		`ALTER TABLE items ADD COLUMN probed DATETIME DEFAULT 0`,
+	},
+
+	// Version 5: feed tags.
+	{
+		// User-defined tags, any number per feed. Tags that
+		// contain slashes are nested folders, e.g. news/tech
+		// is the tech folder inside the news folder.
+
+		`CREATE TABLE feed_tags (
+			feedid			INTEGER NOT NULL REFERENCES feeds(id),
+			tag				TEXT NOT NULL
+		)`,
+
+		`CREATE UNIQUE INDEX unique_feed_tag ON feed_tags(feedid, tag COLLATE NOCASE)`,
+	},
+
+	// Version 6: feed language.
+	{
+		// The language code from the feed (or from an imported
+		// OPML file if the feed doesn't have one), e.g. en-us.
+
+		`ALTER TABLE feeds ADD COLUMN language TEXT DEFAULT ''`,
+	},
+
+	// Version 7: hooks.
+	{
+		// Programs and webhook URLs to notify when something
+		// happens, e.g. new items are found (see hooks.go).
+
+		`CREATE TABLE hooks (
+			id				INTEGER PRIMARY KEY,
+			event			TEXT NOT NULL,
+			target			TEXT NOT NULL
+		)`,
+
+		`CREATE UNIQUE INDEX unique_hook ON hooks(event, target)`,
+	},
+
+	// Version 8: sync schedules.
+	{
+		// When the daemon last synced each feed and when it's
+		// due to sync it again (see daemon.go). Interval is the
+		// time between the two in seconds, before any jitter,
+		// and failures counts the syncs that have failed in a
+		// row. Feeds that the daemon hasn't synced yet don't
+		// have a row.
+
+		`CREATE TABLE feed_schedules (
+			feedid			INTEGER PRIMARY KEY REFERENCES feeds(id),
+			synced			DATETIME DEFAULT 0,
+			next			DATETIME DEFAULT 0,
+			interval		INTEGER DEFAULT 0,
+			failures		INTEGER DEFAULT 0,
+			error			TEXT DEFAULT ''
+		)`,
+	},
+}
+
+func schemaVersion(tx *sql.Tx) (int, error) {
+
+	var version int
+
+	err := tx.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func upgradeSchema(tx *sql.Tx, version int) error {
+
+	if version > len(schemaUpgrades) {
+		return fmt.Errorf("unsupported database version %d", version)
+	}
+
+	if version == len(schemaUpgrades) {
+		return nil
+	}
+
+	for _, upgrade := range schemaUpgrades[version:] {
+		for _, q := range upgrade {
+			if _, err := tx.Exec(q); err != nil {
+				return err
+			}
+		}
+	}
+
+	// PRAGMA statements don't support placeholders.
+	_, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(schemaUpgrades)))
+	return err
+}
+
+func upgradeDB(db *sql.DB) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	version, err := schemaVersion(tx)
+	if err != nil {
+		return rollback(tx, err)
+	}
+
+	if err := upgradeSchema(tx, version); err != nil {
+		return rollback(tx, err)
+	}
+
 	return tx.Commit()
 }
 
 type syncResult struct {
-	ID    int64
-	URL   string
-	Title string
-	Items int
-	Err   error
+	ID  int64
+	URL string
+	// Source is the URL that the feed was requested from,
+	// which differs from URL if the request was redirected.
+	Source   string
+	Title    string
+	Items    int
+	Err      error
+	Warnings []string
+	// NewURL is set by previews if the feed would move to a
+	// new URL, e.g. after a permanent redirect.
+	NewURL string
+	// Schedule holds the feed's update hints. It's set by
+	// syncs that fetched the feed successfully.
+	Schedule *kibner.Schedule
 }
 
-func addFeed(db *sql.DB, url string) (*syncResult, error) {
+func addFeed(db *sql.DB, hooks *hookRunner, url string) (*syncResult, error) {
 
 	feed, err := fetchAndParse(url)
 	if err != nil {
@@ -111,17 +339,25 @@ func addFeed(db *sql.DB, url string) (*syncResult, error) {
 		return nil, errors.New("could not save feed: " + err.Error())
 	}
 
+	fireHooks(db, hooks, &hookPayload{
+		Event: hookFeedAdded,
+		Feed:  hookFeed{ID: id, Title: feed.Title, URL: feed.URL},
+	})
+
 	return &syncResult{
-		ID:    id,
-		URL:   feed.URL,
-		Title: feed.Title,
-		Items: len(feed.Items),
+		ID:       id,
+		URL:      feed.URL,
+		Title:    feed.Title,
+		Items:    len(feed.Items),
+		Warnings: feed.Warnings,
 	}, nil
 }
 
-func addFeedMultiple(db *sql.DB, urls []string) []*syncResult {
+// addFeedMultiple adds the feeds at the given URLs. Progress
+// messages are written to progress, which may be nil.
+func addFeedMultiple(db *sql.DB, hooks *hookRunner, urls []string, progress io.Writer) []*syncResult {
 
-	feeds, errs := fetchAndParseMultiple(urls, defaults.MaxWorkers)
+	feeds, errs := fetchAndParseMultiple(urls, defaults.MaxWorkers, progress)
 
 	i := 0
 	now := time.Now()
@@ -130,39 +366,143 @@ func addFeedMultiple(db *sql.DB, urls []string) []*syncResult {
 	for url, feed := range feeds {
 
 		i++
-		fmt.Printf("Adding %d of %d feeds\r", i, len(feeds))
+		printProgress(progress, "Adding %d of %d feeds", i, len(feeds))
 
 		id, err := saveFeed(db, feed, now)
 		if err != nil {
-			errs[url] = err
+			// Keep the feed's own URL, which may differ from
+			// the one given if it redirected to a feed that's
+			// already subscribed to.
+			results = append(results, &syncResult{
+				URL:    feed.URL,
+				Source: url,
+				Err:    err,
+			})
 			continue
 		}
 
+		fireHooks(db, hooks, &hookPayload{
+			Event: hookFeedAdded,
+			Feed:  hookFeed{ID: id, Title: feed.Title, URL: feed.URL},
+		})
+
 		results = append(results, &syncResult{
-			ID:    id,
-			URL:   feed.URL,
-			Title: feed.Title,
-			Items: len(feed.Items),
+			ID:       id,
+			URL:      feed.URL,
+			Source:   url,
+			Title:    feed.Title,
+			Items:    len(feed.Items),
+			Warnings: feed.Warnings,
 		})
 	}
 
 	for url, err := range errs {
 		results = append(results, &syncResult{
-			URL: url,
-			Err: err,
+			URL:    url,
+			Source: url,
+			Err:    err,
 		})
 	}
 
 	return results
 }
 
-func removeFeed(db *sql.DB, id int64) error {
+var errAlreadySubscribed = errors.New("already subscribed")
+
+// previewFeedMultiple fetches the feeds at the given URLs like
+// addFeedMultiple but doesn't save them. Feeds that are already
+// subscribed to, and URLs that turn out to be duplicates (e.g.
+// because they redirect to the same feed), are reported as
+// errors. Progress messages are written to progress, which may
+// be nil.
+func previewFeedMultiple(db *sql.DB, urls []string, progress io.Writer) ([]*syncResult, error) {
+
+	ids, err := loadFeedIDsByURL(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var fetch []string
+	for _, u := range urls {
+		if ids[u] == 0 {
+			fetch = append(fetch, u)
+		}
+	}
+
+	feeds, errs := fetchAndParseMultiple(fetch, defaults.MaxWorkers, progress)
+	if errs == nil {
+		errs = map[string]error{}
+	}
+
+	results := make([]*syncResult, 0, len(urls))
+	seen := map[string]string{}
+
+	for _, u := range urls {
+
+		if ids[u] != 0 {
+			errs[u] = errAlreadySubscribed
+			continue
+		}
+
+		feed, ok := feeds[u]
+		if !ok {
+			continue
+		}
+
+		switch {
+		case ids[feed.URL] != 0:
+			errs[u] = errAlreadySubscribed
+		case seen[feed.URL] != "":
+			errs[u] = errors.New("duplicate of " + seen[feed.URL])
+		default:
+			seen[feed.URL] = u
+			results = append(results, &syncResult{
+				URL:      feed.URL,
+				Source:   u,
+				Title:    feed.Title,
+				Items:    len(feed.Items),
+				Warnings: feed.Warnings,
+			})
+		}
+	}
+
+	for _, u := range urls {
+		if err := errs[u]; err != nil {
+			results = append(results, &syncResult{
+				URL:    u,
+				Source: u,
+				Err:    err,
+			})
+		}
+	}
+
+	return results, nil
+}
+
+func removeFeed(db *sql.DB, hooks *hookRunner, id int64) error {
+
+	// Remember the feed's details for the hooks.
+	removed := hookFeed{ID: id}
+	err := db.QueryRow("SELECT title, url FROM feeds WHERE id = ?", id).Scan(&removed.Title, &removed.URL)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
 
 	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
 
+	err = deleteTags(tx, id)
+	if err != nil {
+		return rollback(tx, err)
+	}
+
+	err = deleteSchedule(tx, id)
+	if err != nil {
+		return rollback(tx, err)
+	}
+
 	err = deleteItems(tx, id)
 	if err != nil {
 		return rollback(tx, err)
@@ -173,10 +513,54 @@ func removeFeed(db *sql.DB, id int64) error {
 		return rollback(tx, err)
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fireHooks(db, hooks, &hookPayload{
+		Event: hookFeedRemoved,
+		Feed:  removed,
+	})
+
+	return nil
+}
+
+// removeSummary describes what removing a feed would delete.
+type removeSummary struct {
+	Title         string
+	Items         int64
+	UnplayedItems int64
 }
 
-func syncOne(db *sql.DB, id int64) (*syncResult, error) {
+func loadRemoveSummary(db *sql.DB, id int64) (*removeSummary, error) {
+
+	q := `SELECT
+			f.title,
+			COUNT(i.id),
+			IFNULL(SUM(i.unplayed), 0)
+		FROM
+			feeds f
+		LEFT OUTER JOIN
+			items i ON i.feedid = f.id
+		WHERE
+			f.id = ?
+		GROUP BY
+			f.id`
+
+	var summary removeSummary
+
+	err := db.QueryRow(q, id).Scan(&summary.Title, &summary.Items, &summary.UnplayedItems)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, errNoFeedFound
+	case err != nil:
+		return nil, err
+	}
+
+	return &summary, nil
+}
+
+func syncOne(db *sql.DB, hooks *hookRunner, id int64) (*syncResult, error) {
 
 	infos, err := loadSyncInfo(db, id)
 	if err != nil {
@@ -193,29 +577,36 @@ func syncOne(db *sql.DB, id int64) (*syncResult, error) {
 	info := &infos[0]
 	feed, err := fetchAndParse(info.URL)
 	if err != nil {
+		fireSyncFailed(db, hooks, info, err)
 		return nil, err
 	}
 
-	items, err := syncItems(db, info, feed.Items)
+	items, err := syncItems(db, hooks, info, feed.Items)
 	if err != nil {
 		return nil, err
 	}
 
+	warnings := feed.Warnings
+
 	err = syncFeed(db, info, feed)
 	if err != nil {
-		// Swallow this error
-		log.Println(err)
+		// Not worth failing the sync for.
+		warnings = append(warnings, "could not update feed details: "+err.Error())
 	}
 
 	return &syncResult{
-		ID:    info.ID,
-		URL:   info.URL,
-		Title: info.Title,
-		Items: items,
+		ID:       info.ID,
+		URL:      info.URL,
+		Title:    info.Title,
+		Items:    items,
+		Warnings: warnings,
+		Schedule: &feed.Schedule,
 	}, nil
 }
 
-func syncAll(db *sql.DB) ([]*syncResult, error) {
+// syncAll syncs every feed in the database. Progress messages
+// are written to progress, which may be nil.
+func syncAll(db *sql.DB, hooks *hookRunner, progress io.Writer) ([]*syncResult, error) {
 
 	infos, err := loadSyncInfo(db, 0)
 	if err != nil {
@@ -226,6 +617,24 @@ func syncAll(db *sql.DB) ([]*syncResult, error) {
 		return nil, errors.New("no feeds to sync")
 	}
 
+	return syncMultiple(db, hooks, infos, progress), nil
+}
+
+// syncTagged syncs the feeds with the given tag, or with a tag
+// in a folder inside it. Progress messages are written to
+// progress, which may be nil.
+func syncTagged(db *sql.DB, hooks *hookRunner, tag string, progress io.Writer) ([]*syncResult, error) {
+
+	infos, err := loadSyncInfoTagged(db, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return syncMultiple(db, hooks, infos, progress), nil
+}
+
+func syncMultiple(db *sql.DB, hooks *hookRunner, infos []syncInfo, progress io.Writer) []*syncResult {
+
 	urls := make([]string, len(infos))
 	mURLToInfo := make(map[string]*syncInfo, len(infos))
 	results := make([]*syncResult, 0, len(infos))
@@ -235,38 +644,42 @@ func syncAll(db *sql.DB) ([]*syncResult, error) {
 		mURLToInfo[infos[i].URL] = &infos[i]
 	}
 
-	feeds, errs := fetchAndParseMultiple(urls, defaults.MaxWorkers)
+	feeds, errs := fetchAndParseMultiple(urls, defaults.MaxWorkers, progress)
 
 	i := 0
 	for url, feed := range feeds {
 
 		i++
-		fmt.Printf("Syncing %d of %d feeds\r", i, len(feeds))
+		printProgress(progress, "Syncing %d of %d feeds", i, len(feeds))
 
 		info := mURLToInfo[url]
+		warnings := feed.Warnings
 
 		if err := syncFeed(db, info, feed); err != nil {
-			// Swallow this error.
-			log.Println(err)
+			// Not worth failing the sync for.
+			warnings = append(warnings, "could not update feed details: "+err.Error())
 		}
 
-		items, err := syncItems(db, info, feed.Items)
+		items, err := syncItems(db, hooks, info, feed.Items)
 		if err != nil {
 			errs[url] = err
 			continue
 		}
 
 		results = append(results, &syncResult{
-			ID:    info.ID,
-			URL:   info.URL,
-			Title: info.Title,
-			Items: items,
+			ID:       info.ID,
+			URL:      info.URL,
+			Title:    info.Title,
+			Items:    items,
+			Warnings: warnings,
+			Schedule: &feed.Schedule,
 		})
 	}
 
 	for url, err := range errs {
 
 		info := mURLToInfo[url]
+		fireSyncFailed(db, hooks, info, err)
 
 		results = append(results, &syncResult{
 			ID:    info.ID,
@@ -276,7 +689,59 @@ func syncAll(db *sql.DB) ([]*syncResult, error) {
 		})
 	}
 
-	return results, nil
+	return results
+}
+
+// previewSyncMultiple fetches feeds like syncMultiple but
+// doesn't save anything. The results count the items that would
+// be added, and NewURL is set for feeds that would move.
+// Progress messages are written to progress, which may be nil.
+func previewSyncMultiple(infos []syncInfo, progress io.Writer) []*syncResult {
+
+	urls := make([]string, len(infos))
+	mURLToInfo := make(map[string]*syncInfo, len(infos))
+	results := make([]*syncResult, 0, len(infos))
+
+	for i := range infos {
+		urls[i] = infos[i].URL
+		mURLToInfo[infos[i].URL] = &infos[i]
+	}
+
+	feeds, errs := fetchAndParseMultiple(urls, defaults.MaxWorkers, progress)
+
+	for _, info := range infos {
+
+		if err, ok := errs[info.URL]; ok {
+			results = append(results, &syncResult{
+				ID:    info.ID,
+				URL:   info.URL,
+				Title: info.Title,
+				Err:   err,
+			})
+			continue
+		}
+
+		feed := feeds[info.URL]
+		if feed == nil {
+			continue
+		}
+
+		res := &syncResult{
+			ID:       info.ID,
+			URL:      info.URL,
+			Title:    info.Title,
+			Items:    len(newSyncItems(mURLToInfo[info.URL], feed.Items)),
+			Warnings: feed.Warnings,
+		}
+
+		if feed.URL != info.URL {
+			res.NewURL = feed.URL
+		}
+
+		results = append(results, res)
+	}
+
+	return results
 }
 
 type listFeedOptions struct {
@@ -285,7 +750,10 @@ type listFeedOptions struct {
 	Limit     uint
 	Title     string
 	Author    string
-	ShowDesc  bool
+	// Tag restricts the list to feeds with the given tag, or
+	// with a tag in a folder inside it.
+	Tag      string
+	ShowDesc bool
 }
 
 func listFeeds(db *sql.DB, w io.Writer, tmpl *template.Template, opts listFeedOptions) error {
@@ -296,18 +764,35 @@ func listFeeds(db *sql.DB, w io.Writer, tmpl *template.Template, opts listFeedOp
 	}
 
 	return tmpl.Execute(w, map[string]interface{}{
-		"Feeds":    feeds,
-		"ShowDesc": opts.ShowDesc,
+		"Feeds":      feeds,
+		"ShowDesc":   opts.ShowDesc,
+		"GroupByTag": opts.SortBy == sortFeedsByTag,
 	})
 }
 
 type feedView struct {
+	ID            int64
 	Title         string
 	Author        string
 	Desc          string
+	URL           string
+	Link          string
+	Image         string
+	Language      string
 	Items         int64
 	UnplayedItems int64
 	LastPubdate   time.Time
+	Tags          []string
+}
+
+// FirstTag returns the feed's first tag in alphabetical order,
+// which is the one it's grouped under when feeds are sorted by
+// tag, or an empty string if it has no tags.
+func (v feedView) FirstTag() string {
+	if len(v.Tags) == 0 {
+		return ""
+	}
+	return v.Tags[0]
 }
 
 func loadFeedViews(db *sql.DB, opts listFeedOptions) ([]feedView, error) {
@@ -323,7 +808,7 @@ func loadFeedViews(db *sql.DB, opts listFeedOptions) ([]feedView, error) {
 		order = "DESC"
 	case sortOrderDefault:
 		switch opts.SortBy {
-		case sortFeedsByTitle:
+		case sortFeedsByTitle, sortFeedsByTag:
 			order = "ASC"
 		default:
 			order = "DESC"
@@ -345,6 +830,9 @@ func loadFeedViews(db *sql.DB, opts listFeedOptions) ([]feedView, error) {
 		sortFields = fmt.Sprintf("unplayed_count %s, %s", order, secondaryFields)
 	case sortFeedsByTimestamp:
 		sortFields = fmt.Sprintf("f.timestamp %s, %s", order, secondaryFields)
+	case sortFeedsByTag:
+		// Untagged feeds go last, whatever the sort order.
+		sortFields = fmt.Sprintf("first_tag IS NULL, first_tag %s, %s", order, secondaryFields)
 	default:
 		return nil, errors.New("unsupported sort order")
 	}
@@ -366,6 +854,12 @@ func loadFeedViews(db *sql.DB, opts listFeedOptions) ([]feedView, error) {
 		params = append(params, "%"+author+"%")
 	}
 
+	if tag := opts.Tag; tag != "" {
+		cond, args := tagCondition("f.id", tag)
+		conditions = append(conditions, cond)
+		params = append(params, args...)
+	}
+
 	whereClause := "1=1"
 	if len(conditions) > 0 {
 		whereClause = strings.Join(conditions, " AND ")
@@ -405,17 +899,26 @@ func loadFeedViews(db *sql.DB, opts listFeedOptions) ([]feedView, error) {
 	// MAX will return NULL if a feed has zero items (hence
 	// the IFNULL).
 	//
+	// 5. first_tag is the feed's alphabetically first tag (or
+	// NULL if it doesn't have any) for sorting by tag.
+	//
 	// TODO: Can we rewrite this query so that MAX(i.pubdate)
 	// can be scanned directly into a date?
 
 	q :=
 		`SELECT
+			f.id,
 			f.title,
 			f.author,
 			f.desc,
+			f.url,
+			IFNULL(f.link, ''),
+			IFNULL(f.image, ''),
+			IFNULL(f.language, ''),
 			COUNT(i.ROWID)					AS item_count,
 			IFNULL(SUM(i.unplayed), 0)		AS unplayed_count,
-			IFNULL(MAX(i.pubdate), ?)		AS max_pubdate
+			IFNULL(MAX(i.pubdate), ?)		AS max_pubdate,
+			(SELECT t.tag FROM feed_tags t WHERE t.feedid = f.id ORDER BY t.tag COLLATE NOCASE LIMIT 1) COLLATE NOCASE AS first_tag
 		FROM
 			feeds f
 		LEFT OUTER JOIN
@@ -429,12 +932,18 @@ func loadFeedViews(db *sql.DB, opts listFeedOptions) ([]feedView, error) {
 		LIMIT ?`
 
 	var rows []struct {
+		ID              int64
 		Title           string
 		Author          string
 		Desc            string
+		URL             string
+		Link            string
+		Image           string
+		Language        string
 		Items           int64
 		UnplayedItems   int64
 		LastPubdateUnix int64
+		FirstTag        sql.NullString
 	}
 
 	err := queryRows(&rows, db, q, append(params, limit)...)
@@ -442,16 +951,27 @@ func loadFeedViews(db *sql.DB, opts listFeedOptions) ([]feedView, error) {
 		return nil, err
 	}
 
+	tags, err := loadFeedTags(db)
+	if err != nil {
+		return nil, err
+	}
+
 	feeds := make([]feedView, len(rows))
 
 	for i, r := range rows {
 		feeds[i] = feedView{
+			ID:            r.ID,
 			Title:         r.Title,
 			Author:        r.Author,
 			Desc:          r.Desc,
+			URL:           r.URL,
+			Link:          r.Link,
+			Image:         r.Image,
+			Language:      r.Language,
 			Items:         r.Items,
 			UnplayedItems: r.UnplayedItems,
 			LastPubdate:   time.Unix(r.LastPubdateUnix, 0),
+			Tags:          tags[r.ID],
 		}
 	}
 
@@ -463,12 +983,14 @@ func defaultFeedTemplate(now time.Time) *template.Template {
 	layout := `
 {{- with len .Feeds -}}
 Showing {{.}} feed{{if ne . 1}}s{{end}}:
-{{range $index, $feed := $.Feeds}}{{println -}}
+{{$group := "-"}}{{range $index, $feed := $.Feeds}}{{if $.GroupByTag}}{{if ne $feed.FirstTag $group}}{{$group = $feed.FirstTag}}
+{{with $group}}{{.}}{{else}}Untagged{{end}}:{{end}}{{end}}{{println -}}
          {{$index | plus 1 | printf "%*d" 7}}. {{$feed.Title}}
          {{$feed.Author}}
-         {{if $.ShowDesc}}{{range $feed.Desc | lines 70}}{{.}}
+         {{with $feed.Tags}}Tags: {{join . ", "}}
+         {{end}}{{if $.ShowDesc}}{{range $feed.Desc | lines 70}}{{.}}
          {{end}}{{end -}}
-         {{$feed.Items}} item{{if ne $feed.Items 1}}s{{end}}{{with $feed.UnplayedItems}}, {{.}} unplayed{{end}}{{with $feed.LastPubdate}}{{if not .IsZero}} (updated {{. | ago}}){{end}}{{end}}
+         {{$feed.Items}} item{{if ne $feed.Items 1}}s{{end}}{{with $feed.UnplayedItems}}, {{.}} unplayed{{end}}{{with $feed.LastPubdate}}{{if not .IsZero}} (updated {{. | ago}}){{end}}{{end}} | ID: {{$feed.ID}}
 {{end -}}
 {{else -}}
 No feeds found
@@ -476,6 +998,7 @@ No feeds found
 
 	funcs := template.FuncMap{
 		"lines": formatLines,
+		"join":  strings.Join,
 		"ago": func(t time.Time) string {
 			return timeRelativeTo(now, t)
 		},
@@ -507,17 +1030,42 @@ type listItemOptions struct {
 	StartDate time.Time
 	Title     string
 	FeedID    int64
-	ShowDesc  bool
-	Action    listItemAction
-	Use       string
+	// Tag restricts the list to items from feeds with the
+	// given tag, or with a tag in a folder inside it.
+	Tag string
+	// ItemIDs restricts the list to the given items.
+	ItemIDs  []int64
+	ShowDesc bool
+	Action   listItemAction
+	Use      string
+	Player   playerType
+	// Select chooses the items to act on without prompting.
+	// Items are given by their position in the list (from 1)
+	// or their GUID.
+	Select []string
+	// Yes acts on every item in the list without prompting.
+	Yes bool
 }
 
-func listItems(db *sql.DB, w io.Writer, tmpl *template.Template, opts listItemOptions) error {
+func listItems(db *sql.DB, env *Env, tmpl *template.Template, opts listItemOptions) error {
 
 	app := opts.Use
 
-	if opts.Action == actionPlay || opts.Action == actionRun {
-		_, err := parseCommand(app)
+	var backend playerBackend
+
+	switch opts.Action {
+	case actionPlay:
+		var err error
+		backend, err = newPlayerBackend(playerOptions{
+			Type:    opts.Player,
+			Program: app,
+			Env:     env,
+		})
+		if err != nil {
+			return err
+		}
+	case actionRun:
+		_, err := parseCommand(app, nil)
 		if err != nil {
 			return err
 		}
@@ -529,20 +1077,36 @@ func listItems(db *sql.DB, w io.Writer, tmpl *template.Template, opts listItemOp
 	}
 
 	t := tmpl
-	var urls []string
+	var selected []itemView
+	prompt := opts.Action != actionNone
 
-	if opts.Action != actionNone {
-		t, err = addCallbackTemplate(t, "prompt", listItemCallback(opts.Action, app, items, &urls))
+	switch {
+	case opts.Action == actionNone:
+	case len(opts.Select) > 0:
+		selected, err = selectItems(items, opts.Select)
 		if err != nil {
 			return err
 		}
+		prompt = false
+	case opts.Yes:
+		selected = items
+		prompt = false
+	case env.NoInput && len(items) > 0:
+		return errors.New("no items selected (use --select or --yes with --no-input)")
 	}
 
-	err = t.Execute(w, map[string]interface{}{
+	if prompt {
+		t, err = addCallbackTemplate(t, "prompt", listItemCallback(env, opts.Action, app, items, &selected))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = t.Execute(env.Stdout, map[string]interface{}{
 		"Items":      items,
 		"SingleFeed": opts.FeedID != 0,
 		"ShowDesc":   opts.ShowDesc,
-		"ShowPrompt": opts.Action != actionNone,
+		"ShowPrompt": prompt,
 	})
 
 	if err != nil {
@@ -555,43 +1119,110 @@ func listItems(db *sql.DB, w io.Writer, tmpl *template.Template, opts listItemOp
 		}
 	}
 
-	if opts.Action == actionNone || len(urls) == 0 {
+	if opts.Action == actionNone {
 		return nil
 	}
 
-	if opts.Action == actionMark {
-		return updatePlayedStatus(db, true, urls...)
+	return actOnItems(db, env, backend, opts.Action, app, selected)
+}
+
+// actOnItems performs a list action on the given items. The
+// backend is required to play items.
+func actOnItems(db *sql.DB, env *Env, backend playerBackend, action listItemAction, app string, items []itemView) error {
+
+	if len(items) == 0 {
+		return nil
 	}
 
-	if opts.Action == actionUnmark {
-		return updatePlayedStatus(db, false, urls...)
+	ids := make([]int64, len(items))
+	for i, item := range items {
+		ids[i] = item.ID
 	}
 
-	for _, url := range urls {
+	switch action {
+	case actionMark:
+		return updatePlayedStatus(db, env.Hooks, true, ids...)
+	case actionUnmark:
+		return updatePlayedStatus(db, env.Hooks, false, ids...)
+	}
+
+	for _, item := range items {
+
+		if action == actionPlay {
+			err := playItem(db, env.Hooks, backend, item.ID)
+			if err == errPlaybackStopped {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		pos, err := loadItemPosition(db, item.ID)
+		if err != nil {
+			return err
+		}
 
-		cmd, err := parseCommand(app, url)
+		cmd, err := parseURLCommand(app, newItemCommandData(item, pos))
 		if err != nil {
 			return err
 		}
 
+		env.attach(cmd)
+
 		if err := cmd.Run(); err != nil {
 			return err
 		}
+	}
 
-		if opts.Action == actionPlay {
-			if err := updatePlayedStatus(db, true, url); err != nil {
-				return err
+	return nil
+}
+
+// selectItems returns the selected items. Selectors are GUIDs
+// or positions in the list (starting at 1). GUIDs are checked
+// first because they can be numbers too. A position prefixed
+// with # is never treated as a GUID.
+func selectItems(items []itemView, selectors []string) ([]itemView, error) {
+
+	var selected []itemView
+
+	for _, sel := range selectors {
+
+		if !strings.HasPrefix(sel, "#") {
+			if item, ok := findItemByGUID(items, sel); ok {
+				selected = append(selected, item)
+				continue
 			}
 		}
+
+		if n, err := strconv.Atoi(strings.TrimPrefix(sel, "#")); err == nil {
+			if n < 1 || n > len(items) {
+				return nil, fmt.Errorf("no item %d in the list", n)
+			}
+			selected = append(selected, items[n-1])
+			continue
+		}
+
+		return nil, errors.New("no item with GUID " + sel + " in the list")
 	}
 
-	return nil
+	return selected, nil
+}
+
+func findItemByGUID(items []itemView, guid string) (itemView, bool) {
+	for _, item := range items {
+		if item.guid == guid {
+			return item, true
+		}
+	}
+	return itemView{}, false
 }
 
 var errListItemsDone = errors.New("__list_items_exit_loop__")
 var errListItemsAborted = errors.New("__list_items_exit_function__")
 
-func listItemCallback(action listItemAction, app string, items []itemView, urls *[]string) func(i int) error {
+func listItemCallback(env *Env, action listItemAction, app string, items []itemView, selected *[]itemView) func(i int) error {
 
 	var prompt string
 
@@ -615,18 +1246,16 @@ func listItemCallback(action listItemAction, app string, items []itemView, urls
 
 	return func(i int) error {
 
-		c, err := ask(prompt, "ynadq")
+		c, err := ask(env, prompt, "ynadq")
 		if err != nil {
 			return err
 		}
 
 		switch c {
 		case 'y':
-			*urls = append(*urls, items[i].url)
+			*selected = append(*selected, items[i])
 		case 'a':
-			for i := range items[i:] {
-				*urls = append(*urls, items[i].url)
-			}
+			*selected = append(*selected, items[i:]...)
 			return errListItemsDone
 		case 'd':
 			return errListItemsDone
@@ -662,6 +1291,7 @@ func addCallbackTemplate(t *template.Template, name string, callback func(int) e
 }
 
 type itemView struct {
+	ID         int64
 	Title      string
 	Desc       string
 	Duration   int64
@@ -670,6 +1300,21 @@ type itemView struct {
 	FeedTitle  string
 	feedID     int64
 	url        string
+	guid       string
+	filesize   int64
+	mimetype   string
+	rawDesc    string
+	timestamp  time.Time
+}
+
+// RawDesc returns the item's description as it appeared in
+// the feed. Items saved before the original was stored only
+// have the plain text version.
+func (v itemView) RawDesc() string {
+	if v.rawDesc == "" {
+		return v.Desc
+	}
+	return v.rawDesc
 }
 
 func loadItemViews(db *sql.DB, opts listItemOptions) ([]itemView, error) {
@@ -735,6 +1380,21 @@ func loadItemViews(db *sql.DB, opts listItemOptions) ([]itemView, error) {
 		params = append(params, id)
 	}
 
+	if tag := opts.Tag; tag != "" {
+		cond, args := tagCondition("i.feedid", tag)
+		conditions = append(conditions, cond)
+		params = append(params, args...)
+	}
+
+	if ids := opts.ItemIDs; len(ids) > 0 {
+		placeholders := make([]string, len(ids))
+		for i, id := range ids {
+			placeholders[i] = "?"
+			params = append(params, id)
+		}
+		conditions = append(conditions, "i.id IN("+strings.Join(placeholders, ", ")+")")
+	}
+
 	whereClause := "1=1"
 	if len(conditions) > 0 {
 		whereClause = strings.Join(conditions, " AND ")
@@ -751,12 +1411,18 @@ func loadItemViews(db *sql.DB, opts listItemOptions) ([]itemView, error) {
 
 	q :=
 		`SELECT
+			i.id,
 			i.title,
 			i.desc,
 			i.url,
+			i.guid,
+			i.filesize,
 			i.duration,
 			i.pubdate,
 			i.unplayed,
+			i.type,
+			i.rawdesc,
+			i.timestamp,
 			f.id,
 			f.title
 		FROM
@@ -770,12 +1436,18 @@ func loadItemViews(db *sql.DB, opts listItemOptions) ([]itemView, error) {
 		LIMIT ?`
 
 	var rows []struct {
+		ID        int64
 		Title     string
 		Desc      string
 		URL       string
+		GUID      string
+		Filesize  int64
 		Duration  int64
 		Pubdate   time.Time
 		Unplayed  bool
+		Type      string
+		RawDesc   string
+		Timestamp time.Time
 		FeedID    int64
 		FeedTitle string
 	}
@@ -789,6 +1461,7 @@ func loadItemViews(db *sql.DB, opts listItemOptions) ([]itemView, error) {
 
 	for i, r := range rows {
 		items[i] = itemView{
+			ID:         r.ID,
 			Title:      r.Title,
 			FeedTitle:  r.FeedTitle,
 			Desc:       r.Desc,
@@ -796,6 +1469,11 @@ func loadItemViews(db *sql.DB, opts listItemOptions) ([]itemView, error) {
 			Pubdate:    r.Pubdate,
 			IsUnplayed: r.Unplayed,
 			url:        r.URL,
+			guid:       r.GUID,
+			filesize:   r.Filesize,
+			mimetype:   r.Type,
+			rawDesc:    r.RawDesc,
+			timestamp:  r.Timestamp,
 			feedID:     r.FeedID,
 		}
 	}
@@ -803,6 +1481,39 @@ func loadItemViews(db *sql.DB, opts listItemOptions) ([]itemView, error) {
 	return items, nil
 }
 
+// loadItemsByID loads the items with the given IDs, in the
+// given order.
+func loadItemsByID(db *sql.DB, ids []int64) ([]itemView, error) {
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	views, err := loadItemViews(db, listItemOptions{
+		ItemIDs: ids,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int64]itemView, len(views))
+	for _, v := range views {
+		byID[v.ID] = v
+	}
+
+	items := make([]itemView, len(ids))
+
+	for i, id := range ids {
+		item, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("no item with ID %d", id)
+		}
+		items[i] = item
+	}
+
+	return items, nil
+}
+
 func defaultItemTemplate(now time.Time) *template.Template {
 
 	layout := `
@@ -811,9 +1522,9 @@ Showing {{.}} item{{if ne . 1}}s{{end}}:
 {{range $index, $item := $.Items}}{{println -}}
          {{if $item.IsUnplayed}}{{$index | plus 1 | printf "* %d" | printf "%*s" 7}}{{else}}{{$index | plus 1 | printf "%*d" 7}}{{end}}. {{$item.Title}}
          {{if $.SingleFeed}}Released{{else}}From {{$item.FeedTitle}},{{end}} {{if $item.Pubdate.IsZero}}Date unknown{{else}}{{$item.Pubdate.Local | ago}}{{end}}
-         {{if $.ShowDesc}}{{range $item.Desc | lines 70}}{{.}}
+         {{if $.ShowDesc}}{{range $item.RawDesc | text 70}}{{.}}
          {{end}}{{end -}}
-         Duration: {{with $item.Duration}}{{. | duration}}{{else}}Unknown{{end}}{{if $.ShowPrompt}}
+         Duration: {{with $item.Duration}}{{. | duration}}{{else}}Unknown{{end}} | ID: {{$item.ID}}{{if $.ShowPrompt}}
          {{template "prompt" $index}}{{else}}{{println}}{{end -}}
 {{end -}}
 {{else -}}
@@ -821,7 +1532,7 @@ No items found
 {{end}}`
 
 	funcs := template.FuncMap{
-		"lines": formatLines,
+		"text": renderHTML,
 		"ago": func(t time.Time) string {
 			return timeRelativeTo(now, t)
 		},
@@ -836,6 +1547,65 @@ No items found
 	)
 }
 
+func showItem(db *sql.DB, w io.Writer, tmpl *template.Template, id int64) error {
+
+	items, err := loadItemsByID(db, []int64{id})
+	if err != nil {
+		return err
+	}
+
+	item := items[0]
+
+	return tmpl.Execute(w, map[string]interface{}{
+		"Item":     item,
+		"URL":      item.url,
+		"Type":     item.mimetype,
+		"GUID":     item.guid,
+		"Filesize": item.filesize,
+		"Added":    item.timestamp,
+		"Desc":     renderHTML(70, item.RawDesc()),
+	})
+}
+
+func defaultShowTemplate(now time.Time) *template.Template {
+
+	layout := `
+{{- with .Item -}}
+{{.Title}}
+From {{.FeedTitle}}
+
+ID:       {{.ID}}
+Released: {{if .Pubdate.IsZero}}Date unknown{{else}}{{.Pubdate.Local | date}} ({{.Pubdate.Local | ago}}){{end}}
+Duration: {{with .Duration}}{{. | duration}}{{else}}Unknown{{end}}
+Played:   {{if .IsUnplayed}}No{{else}}Yes{{end}}
+{{- end}}
+Size:     {{with .Filesize}}{{. | bytes}}{{else}}Unknown{{end}}
+Added:    {{.Added.Local | date}}
+URL:      {{.URL}}
+Type:     {{with .Type}}{{.}}{{else}}Unknown{{end}}
+GUID:     {{.GUID}}
+{{with .Desc}}
+{{range .}}{{.}}
+{{end}}{{end -}}
+`
+
+	funcs := template.FuncMap{
+		"lines": formatLines,
+		"ago": func(t time.Time) string {
+			return timeRelativeTo(now, t)
+		},
+		"date": func(t time.Time) string {
+			return t.Format("Mon Jan 2, 2006 15:04")
+		},
+		"duration": formatSeconds,
+		"bytes":    formatBytes,
+	}
+
+	return template.Must(
+		template.New("show").Funcs(funcs).Parse(layout),
+	)
+}
+
 func exportList(db *sql.DB, w io.Writer) error {
 
 	q := `SELECT url FROM feeds ORDER BY url COLLATE NOCASE`
@@ -860,15 +1630,36 @@ func exportList(db *sql.DB, w io.Writer) error {
 	return nil
 }
 
+// exportOPML writes the feeds to w as an OPML file. Tagged
+// feeds are written inside folders named after their tags (and
+// appear in more than one folder if they have more than one
+// tag), as well as listing their tags as categories. Untagged
+// feeds come after the folders.
 func exportOPML(db *sql.DB, w io.Writer, timestamp time.Time) error {
 
-	q := `SELECT type, title, desc, url FROM feeds ORDER BY title COLLATE NOCASE, url COLLATE NOCASE`
+	q := `SELECT
+			id,
+			type,
+			title,
+			desc,
+			url,
+			IFNULL(link, ''),
+			IFNULL(image, ''),
+			language
+		FROM
+			feeds
+		ORDER BY
+			title COLLATE NOCASE, url COLLATE NOCASE`
 
 	var rows []struct {
-		Type  string
-		Title string
-		Desc  string
-		URL   string
+		ID       int64
+		Type     string
+		Title    string
+		Desc     string
+		URL      string
+		Link     string
+		Image    string
+		Language string
 	}
 
 	err := queryRows(&rows, db, q)
@@ -880,23 +1671,80 @@ func exportOPML(db *sql.DB, w io.Writer, timestamp time.Time) error {
 		return errors.New("no feeds to export")
 	}
 
+	tags, err := loadFeedTags(db)
+	if err != nil {
+		return err
+	}
+
 	data := newOPML("Kibner subscriptions")
 	data.Pubdate = opmltime(timestamp)
-	data.Entries = make([]*entry, len(rows))
 
-	for i, r := range rows {
-		data.Entries[i] = &entry{
-			Type:  r.Type,
-			Text:  r.Title,
-			Title: r.Title,
-			Desc:  r.Desc,
-			URL:   r.URL,
+	// Create the folders up front so that they're in
+	// alphabetical order and come before any feeds.
+
+	var allTags []string
+	for _, feedTags := range tags {
+		allTags = append(allTags, feedTags...)
+	}
+
+	sort.Slice(allTags, func(i, j int) bool {
+		return strings.ToLower(allTags[i]) < strings.ToLower(allTags[j])
+	})
+
+	folders := map[string]*entry{}
+	for _, tag := range allTags {
+		data.folder(tag, folders)
+	}
+
+	for _, r := range rows {
+
+		e := &entry{
+			Type:     r.Type,
+			Text:     r.Title,
+			Title:    r.Title,
+			Desc:     r.Desc,
+			URL:      r.URL,
+			Link:     r.Link,
+			Image:    r.Image,
+			Language: r.Language,
+		}
+		e.setCategories(tags[r.ID])
+
+		if len(tags[r.ID]) == 0 {
+			data.Entries = append(data.Entries, e)
+			continue
+		}
+
+		for _, tag := range tags[r.ID] {
+			f := data.folder(tag, folders)
+			f.Entries = append(f.Entries, e)
 		}
 	}
 
 	return data.writeTo(w)
 }
 
+// exportJSON writes the feeds to w as a JSON array of feed
+// views, i.e. everything that kibner feeds knows about them.
+// The output can be imported again.
+func exportJSON(db *sql.DB, w io.Writer) error {
+
+	feeds, err := loadFeedViews(db, listFeedOptions{
+		SortBy: sortFeedsByTitle,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(feeds) == 0 {
+		return errors.New("no feeds to export")
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(feeds)
+}
+
 var errInvalidTarget = errors.New("invalid target")
 
 func loadFeedURL(db *sql.DB, feedID int64, target target) (string, error) {
@@ -926,7 +1774,37 @@ func loadFeedURL(db *sql.DB, feedID int64, target target) (string, error) {
 	}
 }
 
-func syncItems(db *sql.DB, info *syncInfo, items []*kibner.Item) (int, error) {
+func syncItems(db *sql.DB, hooks *hookRunner, info *syncInfo, items []*kibner.Item) (int, error) {
+
+	newItems := newSyncItems(info, items)
+
+	if len(newItems) == 0 {
+		return 0, nil
+	}
+
+	if err := saveNewItems(db, info.ID, newItems); err != nil {
+		return 0, err
+	}
+
+	fireHooks(db, hooks, &hookPayload{
+		Event: hookNewItems,
+		Feed:  hookFeed{ID: info.ID, Title: info.Title, URL: info.URL},
+		Items: newHookItems(newItems),
+	})
+
+	return len(newItems), nil
+}
+
+func fireSyncFailed(db *sql.DB, hooks *hookRunner, info *syncInfo, err error) {
+	fireHooks(db, hooks, &hookPayload{
+		Event: hookSyncFailed,
+		Feed:  hookFeed{ID: info.ID, Title: info.Title, URL: info.URL},
+		Error: err.Error(),
+	})
+}
+
+// newSyncItems returns the items that aren't already saved.
+func newSyncItems(info *syncInfo, items []*kibner.Item) []*kibner.Item {
 
 	var newItems []*kibner.Item
 
@@ -936,11 +1814,7 @@ func syncItems(db *sql.DB, info *syncInfo, items []*kibner.Item) (int, error) {
 		}
 	}
 
-	if len(newItems) == 0 {
-		return 0, nil
-	}
-
-	return len(newItems), saveNewItems(db, info.ID, newItems)
+	return newItems
 }
 
 func syncFeed(db *sql.DB, info *syncInfo, feed *kibner.Feed) error {
@@ -986,6 +1860,39 @@ func loadSyncInfo(db *sql.DB, id int64) ([]syncInfo, error) {
 	return infos, nil
 }
 
+// loadSyncInfoTagged loads the sync info for the feeds with the
+// given tag, or with a tag in a folder inside it.
+func loadSyncInfoTagged(db *sql.DB, tag string) ([]syncInfo, error) {
+
+	ids, err := loadTaggedFeedIDs(db, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		return nil, errors.New("no feeds tagged " + tag)
+	}
+
+	all, err := loadSyncInfo(db, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	tagged := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		tagged[id] = true
+	}
+
+	var infos []syncInfo
+	for _, info := range all {
+		if tagged[info.ID] {
+			infos = append(infos, info)
+		}
+	}
+
+	return infos, nil
+}
+
 func loadSyncInfoFeeds(db *sql.DB, id int64) ([]syncInfo, error) {
 
 	var rows []syncInfo
@@ -1020,34 +1927,196 @@ func loadSyncInfoGUIDs(db *sql.DB, id int64) (map[int64][]string, error) {
 		params = append(params, id)
 	}
 
-	if err := queryRows(&rows, db, q, params...); err != nil {
-		return nil, err
+	if err := queryRows(&rows, db, q, params...); err != nil {
+		return nil, err
+	}
+
+	var guids map[int64][]string
+
+	for _, r := range rows {
+		if guids == nil {
+			guids = make(map[int64][]string)
+		}
+		guids[r.ID] = append(guids[r.ID], r.GUID)
+	}
+
+	return guids, nil
+}
+
+func extractURLsList(r io.Reader) ([]string, error) {
+
+	var urls []string
+
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+
+		u := strings.TrimSpace(scanner.Text())
+
+		if u == "" || u[0] == '#' || seen[u] {
+			continue
+		}
+
+		if _, err := url.Parse(u); err != nil {
+			continue
+		}
+
+		seen[u] = true
+		urls = append(urls, u)
+	}
+
+	return urls, scanner.Err()
+}
+
+// detectFileFormat works out the format of an import file from
+// its contents. Files starting with a tag are OPML, files
+// starting with an array or object are JSON and anything else
+// is a plain list of URLs.
+func detectFileFormat(data []byte) fileFormat {
+
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	data = bytes.TrimSpace(data)
+
+	switch {
+	case bytes.HasPrefix(data, []byte("<")):
+		return fileFormatOPML
+	case bytes.HasPrefix(data, []byte("[")), bytes.HasPrefix(data, []byte("{")):
+		return fileFormatJSON
+	default:
+		return fileFormatList
+	}
+}
+
+// importDetails holds the details of a feed from an import
+// file that are applied once the feed has been added.
+type importDetails struct {
+	// Title is the feed's name in the file. It's used as a
+	// local title if it differs from the feed's own title,
+	// e.g. if the feed was renamed in another app.
+	Title string
+	Tags  []string
+	// Link, Image and Language fill in any details that the
+	// feed itself doesn't provide.
+	Link     string
+	Image    string
+	Language string
+}
+
+// opmlContainers are the names of top-level folders that some
+// apps (e.g. Overcast and Pocket Casts) put every feed in. They
+// aren't used as tags.
+var opmlContainers = map[string]bool{
+	"feeds":         true,
+	"podcasts":      true,
+	"subscriptions": true,
+}
+
+// extractURLsOPML returns the feed URLs in an OPML file, along
+// with the details of each feed from the file. Feeds are tagged
+// with their categories and with the names of the folders they
+// appear in, with nested folders separated by slashes. If a URL
+// appears more than once, its first title is used and its tags
+// are combined.
+func extractURLsOPML(r io.Reader) ([]string, map[string]*importDetails, error) {
+
+	var data opml
+	if err := data.readFrom(r); err != nil {
+		return nil, nil, err
+	}
+
+	var urls []string
+	details := map[string]*importDetails{}
+
+	var walk func(entries []*entry, folder string)
+
+	walk = func(entries []*entry, folder string) {
+
+		for _, entry := range entries {
+
+			u := strings.TrimSpace(entry.URL)
+
+			if u == "" {
+				// A folder.
+				name := entry.name()
+				switch {
+				case folder != "":
+					name = folder + "/" + name
+				case opmlContainers[strings.ToLower(name)]:
+					name = ""
+				}
+				walk(entry.Entries, name)
+				continue
+			}
+
+			if _, err := url.Parse(u); err != nil {
+				continue
+			}
+
+			d := details[u]
+			if d == nil {
+				d = &importDetails{
+					Title:    entry.name(),
+					Link:     strings.TrimSpace(entry.Link),
+					Image:    strings.TrimSpace(entry.Image),
+					Language: strings.TrimSpace(entry.Language),
+				}
+				details[u] = d
+				urls = append(urls, u)
+			}
+
+			for _, tag := range append(entry.categories(), folder) {
+				if tag, err := normaliseTag(tag); err == nil && !containsFold(d.Tags, tag) {
+					d.Tags = append(d.Tags, tag)
+				}
+			}
+		}
+	}
+
+	walk(data.Entries, "")
+
+	return urls, details, nil
+}
+
+// extractURLsJSON returns the feed URLs in a JSON file created
+// by exportJSON, along with the details of each feed. A single
+// feed object is accepted as well as an array of them.
+func extractURLsJSON(r io.Reader) ([]string, map[string]*importDetails, error) {
+
+	type jsonFeed struct {
+		URL      string
+		Title    string
+		Tags     []string
+		Link     string
+		Image    string
+		Language string
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	var guids map[int64][]string
+	var feeds []jsonFeed
 
-	for _, r := range rows {
-		if guids == nil {
-			guids = make(map[int64][]string)
-		}
-		guids[r.ID] = append(guids[r.ID], r.GUID)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		feeds = make([]jsonFeed, 1)
+		err = json.Unmarshal(data, &feeds[0])
+	} else {
+		err = json.Unmarshal(data, &feeds)
 	}
 
-	return guids, nil
-}
-
-func extractURLsList(r io.Reader) ([]string, error) {
+	if err != nil {
+		return nil, nil, errors.New("invalid JSON: " + err.Error())
+	}
 
 	var urls []string
+	details := map[string]*importDetails{}
 
-	seen := map[string]bool{}
-	scanner := bufio.NewScanner(r)
-
-	for scanner.Scan() {
-
-		u := strings.TrimSpace(scanner.Text())
+	for _, f := range feeds {
 
-		if u == "" || u[0] == '#' || seen[u] {
+		u := strings.TrimSpace(f.URL)
+		if u == "" || details[u] != nil {
 			continue
 		}
 
@@ -1055,40 +2124,81 @@ func extractURLsList(r io.Reader) ([]string, error) {
 			continue
 		}
 
-		seen[u] = true
+		d := &importDetails{
+			Title:    strings.TrimSpace(f.Title),
+			Link:     strings.TrimSpace(f.Link),
+			Image:    strings.TrimSpace(f.Image),
+			Language: strings.TrimSpace(f.Language),
+		}
+
+		for _, tag := range f.Tags {
+			if tag, err := normaliseTag(tag); err == nil && !containsFold(d.Tags, tag) {
+				d.Tags = append(d.Tags, tag)
+			}
+		}
+
+		details[u] = d
 		urls = append(urls, u)
 	}
 
-	return urls, scanner.Err()
+	return urls, details, nil
 }
 
-func extractURLsOPML(r io.Reader) ([]string, error) {
+// applyImportDetails applies the details from an import file
+// to a newly added feed.
+func applyImportDetails(db *sql.DB, feedID int64, details *importDetails) error {
 
-	var data opml
-	if err := data.readFrom(r); err != nil {
-		return nil, err
+	var feed struct {
+		Title    string
+		Link     string
+		Image    string
+		Language string
 	}
 
-	seen := map[string]bool{}
-	urls := make([]string, 0, len(data.Entries))
+	q := "SELECT title, IFNULL(link, ''), IFNULL(image, ''), language FROM feeds WHERE id = ?"
+
+	err := db.QueryRow(q, feedID).Scan(&feed.Title, &feed.Link, &feed.Image, &feed.Language)
+	if err != nil {
+		return err
+	}
 
-	for _, entry := range data.Entries {
+	values := map[string]interface{}{}
 
-		u := strings.TrimSpace(entry.URL)
+	if title := normaliseText(details.Title); title != "" && title != feed.Title {
+		values["title"] = title
+	}
 
-		if u == "" || seen[u] {
-			continue
+	for field, v := range map[string][2]string{
+		"link":     {feed.Link, details.Link},
+		"image":    {feed.Image, details.Image},
+		"language": {feed.Language, details.Language},
+	} {
+		if v[0] == "" && v[1] != "" {
+			values[field] = v[1]
 		}
+	}
 
-		if _, err := url.Parse(u); err != nil {
-			continue
+	if len(values) > 0 {
+		if err := updateFeed(db, feedID, values); err != nil {
+			return err
 		}
+	}
 
-		seen[u] = true
-		urls = append(urls, u)
+	if len(details.Tags) > 0 {
+		return tagFeed(db, feedID, details.Tags)
 	}
 
-	return urls, nil
+	return nil
+}
+
+// containsFold reports whether list contains s, ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
 }
 
 func rollback(tx *sql.Tx, err error) error {
@@ -1097,60 +2207,138 @@ func rollback(tx *sql.Tx, err error) error {
 	return err
 }
 
-func newRequest(url string) (*http.Request, error) {
+func fetchAndParse(feedURL string) (*kibner.Feed, error) {
+
+	var f *gofeed.Feed
+	var finalURL string
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return nil, err
+	// Follow itunes:new-feed-url links, but not in circles
+	// and not forever.
+	seen := map[string]bool{}
+
+	for hops := 0; ; hops++ {
+
+		var err error
+		f, finalURL, err = fetchGoFeed(feedURL)
+		if err != nil {
+			return nil, err
+		}
+
+		seen[feedURL] = true
+		seen[finalURL] = true
+
+		var newFeedURL string
+		if f.ITunesExt != nil {
+			newFeedURL = f.ITunesExt.NewFeedURL
+		}
+		if newFeedURL == "" || seen[newFeedURL] {
+			break
+		}
+
+		if hops == defaults.MaxFeedHops {
+			return nil, errors.New("bad feed: stopped after " + strconv.Itoa(defaults.MaxFeedHops) + " new feed URLs")
+		}
+
+		feedURL = newFeedURL
+	}
+
+	feed := translateFeed(f)
+	if feed.Title == "" {
+		return nil, errors.New("bad feed: no title")
 	}
 
-	req.Header.Set("User-Agent", "kibner/"+version)
-	return req, nil
+	feed.URL = finalURL
+	lookupMissingPubdates(feed.Items)
+
+	return feed, nil
 }
 
-func fetchAndParse(feedURL string) (*kibner.Feed, error) {
+// fetchGoFeed fetches and parses the feed at feedURL. It also
+// returns the URL that the feed was actually fetched from,
+// which differs from feedURL if the request was redirected.
+func fetchGoFeed(feedURL string) (*gofeed.Feed, string, error) {
 
 	req, err := newRequest(feedURL)
 	if err != nil {
-		return nil, errors.New("bad request: " + err.Error())
+		return nil, "", errors.New("bad request: " + err.Error())
 	}
 
 	resp, err := defaultClient.Do(req)
 	if err != nil {
-		return nil, errors.New("fetch error: " + err.Error())
+		return nil, "", errors.New("fetch error: " + err.Error())
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("bad status: " + resp.Status)
+		return nil, "", errors.New("bad status: " + resp.Status)
+	}
+
+	if err := checkContentType(resp.Header); err != nil {
+		return nil, "", err
+	}
+
+	data, err := readFeed(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := checkFeedStructure(data); err != nil {
+		return nil, "", err
 	}
 
 	parser := gofeed.NewParser()
 	parser.RSSTranslator = NewRSSTranslator()
-	f, err := parser.Parse(resp.Body)
+	f, err := parser.Parse(bytes.NewReader(data))
 	if err != nil {
-		return nil, errors.New("parse error: " + err.Error())
+		return nil, "", errors.New("parse error: " + err.Error())
 	}
 
-	var newFeedURL string
-	if f.ITunesExt != nil {
-		newFeedURL = f.ITunesExt.NewFeedURL
+	if err := checkItemCount(len(f.Items)); err != nil {
+		return nil, "", err
 	}
-	if newFeedURL != "" && newFeedURL != feedURL {
-		return fetchAndParse(newFeedURL)
+
+	finalURL := resp.Request.URL.String()
+	if finalURL == "" {
+		finalURL = feedURL
 	}
 
-	feed := translateFeed(f)
-	if feed.Title == "" {
-		return nil, errors.New("bad feed: no title")
+	return f, finalURL, nil
+}
+
+// fetchURL fetches the document at u, e.g. an OPML file to
+// import.
+func fetchURL(u string) ([]byte, error) {
+
+	req, err := newRequest(u)
+	if err != nil {
+		return nil, errors.New("bad request: " + err.Error())
+	}
+
+	resp, err := defaultClient.Do(req)
+	if err != nil {
+		return nil, errors.New("fetch error: " + err.Error())
 	}
+	defer resp.Body.Close()
 
-	feed.URL = resp.Request.URL.String()
-	if feed.URL == "" {
-		feed.URL = feedURL
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("bad status: " + resp.Status)
 	}
 
-	return feed, nil
+	if err := checkImportContentType(resp.Header); err != nil {
+		return nil, err
+	}
+
+	// Import files get the same limits as feeds.
+	data, err := readFeed(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkFeedStructure(data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
 }
 
 func translateFeed(f *gofeed.Feed) *kibner.Feed {
@@ -1168,23 +2356,51 @@ func translateFeed(f *gofeed.Feed) *kibner.Feed {
 		image = f.Image.URL
 	}
 
+	var warn feedWarnings
+
 	return &kibner.Feed{
-		Title:  f.Title,
-		Author: author,
-		Desc:   f.Description,
-		Type:   f.FeedType,
-		Link:   f.Link,
-		Image:  image,
-		Items:  translateItems(f.Items),
+		Title:    f.Title,
+		Author:   author,
+		Desc:     f.Description,
+		Type:     f.FeedType,
+		Link:     f.Link,
+		Image:    image,
+		Language: strings.TrimSpace(f.Language),
+		Items:    translateItems(f.Items, &warn),
+		Warnings: warn,
+		Schedule: parseSchedule(f.Custom),
+	}
+}
+
+// feedWarnings collects the problems found while translating
+// a feed. None of them are serious enough to reject the feed
+// but they're worth reporting to the publisher.
+type feedWarnings []string
+
+func (w *feedWarnings) add(item *gofeed.Item, format string, args ...interface{}) {
+
+	name := item.Title
+	if name == "" {
+		name = item.GUID
 	}
+	if name == "" && len(item.Enclosures) > 0 {
+		name = item.Enclosures[0].URL
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	if name != "" {
+		msg = fmt.Sprintf("%q: %s", name, msg)
+	}
+
+	*w = append(*w, msg)
 }
 
-func translateItems(items []*gofeed.Item) []*kibner.Item {
+func translateItems(items []*gofeed.Item, warn *feedWarnings) []*kibner.Item {
 
 	feedItems := make([]*kibner.Item, 0, len(items))
 
 	for _, item := range items {
-		newItem := translateItem(item)
+		newItem := translateItem(item, warn)
 		if newItem != nil {
 			feedItems = append(feedItems, newItem)
 		}
@@ -1193,16 +2409,16 @@ func translateItems(items []*gofeed.Item) []*kibner.Item {
 	return feedItems
 }
 
-func translateItem(item *gofeed.Item) *kibner.Item {
+func translateItem(item *gofeed.Item, warn *feedWarnings) *kibner.Item {
 
-	url, filesize := translateItemEnclosures(item.Enclosures)
+	url, typ, filesize := translateItemEnclosures(item, warn)
 	if url == "" {
 		// Ignore items with no download URL.
-		// TODO: Log/output this error.
+		warn.add(item, "skipped (no download URL)")
 		return nil
 	}
 
-	pubdate := translateItemPubdate(item)
+	pubdate := translateItemPubdate(item, warn)
 
 	title := item.Title
 	if title == "" {
@@ -1217,21 +2433,29 @@ func translateItem(item *gofeed.Item) *kibner.Item {
 		guid = url
 	}
 
+	rawDesc := item.Content
+	if rawDesc == "" {
+		rawDesc = item.Description
+	}
+
 	return &kibner.Item{
 		Title:    title,
 		Pubdate:  pubdate,
 		Desc:     item.Description,
+		RawDesc:  rawDesc,
 		URL:      url,
+		Type:     typ,
 		Filesize: filesize,
-		Duration: translateItemDuration(item),
+		Duration: translateItemDuration(item, warn),
 		GUID:     guid,
 	}
 }
 
-func translateItemEnclosures(encs []*gofeed.Enclosure) (string, int64) {
+func translateItemEnclosures(item *gofeed.Item, warn *feedWarnings) (string, string, int64) {
 
+	encs := item.Enclosures
 	if len(encs) == 0 {
-		return "", 0
+		return "", "", 0
 	}
 
 	// TODO: Handle multiple enclosures?
@@ -1239,29 +2463,40 @@ func translateItemEnclosures(encs []*gofeed.Enclosure) (string, int64) {
 
 	filesize, err := strconv.ParseInt(enc.Length, 10, 64)
 	if err != nil {
-		// Swallow this error.
-		// No big deal if we don't have the filesize.
-		// TODO: Log/output this error.
+		// No big deal if we don't have the filesize, but
+		// a value we can't read is worth mentioning.
+		if enc.Length != "" {
+			warn.add(item, "invalid file size %q", enc.Length)
+		}
 		filesize = 0
 	}
 
-	return enc.URL, filesize
+	return enc.URL, enc.Type, filesize
 }
 
-func translateItemPubdate(item *gofeed.Item) time.Time {
+func translateItemPubdate(item *gofeed.Item, warn *feedWarnings) time.Time {
+
+	if item.PublishedParsed != nil {
+		return *item.PublishedParsed
+	}
+
+	if item.Published == "" {
+		warn.add(item, "no release date")
+		return time.Time{}
+	}
 
-	if item.PublishedParsed == nil {
-		// Date was in an invalid format and could not be parsed.
-		// Swallow this error.
-		// TODO: Log/output this error.
-		// TODO: Check for common typos? e.g. Tues, Thur, Sept
+	// The date is in a format that gofeed doesn't recognise.
+	// Try to make sense of it ourselves.
+	t, err := parsePubdate(item.Published)
+	if err != nil {
+		warn.add(item, "invalid release date %q", item.Published)
 		return time.Time{}
 	}
 
-	return *item.PublishedParsed
+	return t
 }
 
-func translateItemDuration(item *gofeed.Item) time.Duration {
+func translateItemDuration(item *gofeed.Item, warn *feedWarnings) time.Duration {
 
 	if item.ITunesExt == nil {
 		return 0
@@ -1269,16 +2504,18 @@ func translateItemDuration(item *gofeed.Item) time.Duration {
 
 	duration, err := parseDuration(item.ITunesExt.Duration)
 	if err != nil {
-		// Swallow this error.
-		// No big deal if we don't have the duration.
-		// TODO: Log/output this error.
+		// No big deal if we don't have the duration, but
+		// a value we can't read is worth mentioning.
+		if item.ITunesExt.Duration != "" {
+			warn.add(item, "invalid duration %q", item.ITunesExt.Duration)
+		}
 		return 0
 	}
 
 	return duration
 }
 
-func fetchAndParseMultiple(urls []string, maxWorkers int) (map[string]*kibner.Feed, map[string]error) {
+func fetchAndParseMultiple(urls []string, maxWorkers int, progress io.Writer) (map[string]*kibner.Feed, map[string]error) {
 
 	feeds := make(chan struct {
 		string
@@ -1289,13 +2526,18 @@ func fetchAndParseMultiple(urls []string, maxWorkers int) (map[string]*kibner.Fe
 		error
 	})
 	workers := make(chan struct{}, maxWorkers)
+	hosts := newHostLimiter(httpSettings.MaxPerHost)
 
 	for i := range urls {
 		go func(url string) {
 
+			// Wait for the host before taking a worker so that
+			// feeds from a busy host don't hold up the rest.
+			release := hosts.acquire(url)
 			workers <- struct{}{}
 
 			feed, err := fetchAndParse(url)
+			release()
 			switch {
 			case err != nil:
 				errors <- struct {
@@ -1324,12 +2566,21 @@ func fetchAndParseMultiple(urls []string, maxWorkers int) (map[string]*kibner.Fe
 		}
 
 		<-workers
-		fmt.Printf("Fetched %d of %d feeds...\r", i+1, len(urls))
+		printProgress(progress, "Fetched %d of %d feeds...", i+1, len(urls))
 	}
 
 	return oks, errs
 }
 
+// printProgress writes a progress message to w, if it's not nil.
+// The message ends with a carriage return so that the next one
+// overwrites it.
+func printProgress(w io.Writer, format string, args ...interface{}) {
+	if w != nil {
+		fmt.Fprintf(w, format+"\r", args...)
+	}
+}
+
 func deleteItems(tx *sql.Tx, feedID int64) error {
 
 	_, err := tx.Exec("DELETE FROM items WHERE feedid = ?", feedID)
@@ -1342,6 +2593,10 @@ func deleteFeed(tx *sql.Tx, feedID int64) error {
 	return err
 }
 
+// saveFeed saves a new feed and its items. Items without
+// release dates are left undated: when a feed is first added,
+// its items could have been released at any time, so the
+// timestamp is no indication of when.
 func saveFeed(db *sql.DB, feed *kibner.Feed, timestamp time.Time) (int64, error) {
 
 	tx, err := db.Begin()
@@ -1364,12 +2619,15 @@ func saveFeed(db *sql.DB, feed *kibner.Feed, timestamp time.Time) (int64, error)
 
 func saveNewItems(db *sql.DB, feedID int64, items []*kibner.Item) error {
 
+	now := time.Now()
+	fillMissingPubdates(items, now)
+
 	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
 
-	err = insertItems(tx, feedID, items, true, time.Now())
+	err = insertItems(tx, feedID, items, true, now)
 	if err != nil {
 		return rollback(tx, err)
 	}
@@ -1377,21 +2635,102 @@ func saveNewItems(db *sql.DB, feedID int64, items []*kibner.Item) error {
 	return tx.Commit()
 }
 
-func updatePlayedStatus(db *sql.DB, played bool, urls ...string) error {
+func updatePlayedStatus(db *sql.DB, hooks *hookRunner, played bool, ids ...int64) error {
 
-	params := make([]interface{}, len(urls)+1)
+	params := make([]interface{}, len(ids)+2)
 	params[0] = !played
-	placeholders := make([]string, len(urls))
+	params[1] = time.Now().Unix()
+	placeholders := make([]string, len(ids))
 
-	for i := range urls {
-		params[i+1] = urls[i]
+	for i := range ids {
+		params[i+2] = ids[i]
 		placeholders[i] = "?"
 	}
 
-	q := fmt.Sprintf("UPDATE items SET unplayed = ? WHERE url IN(%s)", strings.Join(placeholders, ", "))
+	q := fmt.Sprintf("UPDATE items SET unplayed = ?, updated = ? WHERE id IN(%s)", strings.Join(placeholders, ", "))
 
-	_, err := db.Exec(q, params...)
-	return err
+	if _, err := db.Exec(q, params...); err != nil {
+		return err
+	}
+
+	if played {
+		firePlayedHooks(db, hooks, params[2:], placeholders)
+	}
+
+	return nil
+}
+
+// firePlayedHooks runs the item-played hooks for the given
+// items, once per feed.
+func firePlayedHooks(db *sql.DB, hooks *hookRunner, ids []interface{}, placeholders []string) {
+
+	if hooks == nil {
+		return
+	}
+
+	q := fmt.Sprintf(`SELECT
+			f.id,
+			f.title,
+			f.url,
+			i.id,
+			i.guid,
+			i.title,
+			i.url,
+			i.pubdate,
+			i.duration
+		FROM
+			items i
+		INNER JOIN
+			feeds f ON f.id = i.feedid
+		WHERE
+			i.id IN(%s)
+		ORDER BY
+			f.id, i.id`, strings.Join(placeholders, ", "))
+
+	var rows []struct {
+		FeedID    int64
+		FeedTitle string
+		FeedURL   string
+		ID        int64
+		GUID      string
+		Title     string
+		URL       string
+		Pubdate   time.Time
+		Duration  int64
+	}
+
+	if err := queryRows(&rows, db, q, ids...); err != nil {
+		hooks.log.Warnf("could not load played items for hooks: %s", err)
+		return
+	}
+
+	var payload *hookPayload
+
+	for _, r := range rows {
+
+		if payload == nil || payload.Feed.ID != r.FeedID {
+			if payload != nil {
+				fireHooks(db, hooks, payload)
+			}
+			payload = &hookPayload{
+				Event: hookItemPlayed,
+				Feed:  hookFeed{ID: r.FeedID, Title: r.FeedTitle, URL: r.FeedURL},
+			}
+		}
+
+		payload.Items = append(payload.Items, hookItem{
+			ID:       r.ID,
+			GUID:     r.GUID,
+			Title:    r.Title,
+			URL:      r.URL,
+			Pubdate:  r.Pubdate,
+			Duration: r.Duration,
+		})
+	}
+
+	if payload != nil {
+		fireHooks(db, hooks, payload)
+	}
 }
 
 func updateFeed(db *sql.DB, feedID int64, values map[string]interface{}) error {
@@ -1446,10 +2785,11 @@ func insertFeed(tx *sql.Tx, feed *kibner.Feed, timestamp time.Time) (int64, erro
 			type,
 			link,
 			image,
+			language,
 			timestamp
-		) VALUES(?, ?, ?, ?, ?, ?, ?, ?)`
+		) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
-	res, err := tx.Exec(sql, normaliseText(feed.Title), normaliseText(feed.Author), normaliseText(feed.Desc), feed.URL, feed.Type, feed.Link, feed.Image, timestamp.Unix())
+	res, err := tx.Exec(sql, normaliseText(feed.Title), normaliseText(feed.Author), normaliseText(feed.Desc), feed.URL, feed.Type, feed.Link, feed.Image, feed.Language, timestamp.Unix())
 	if err != nil {
 		return 0, err
 	}
@@ -1470,8 +2810,10 @@ func insertItems(tx *sql.Tx, feedid int64, items []*kibner.Item, unplayed bool,
 			filesize,
 			duration,
 			guid,
+			type,
+			rawdesc,
 			timestamp
-		) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+		) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
 	stmt, err := tx.Prepare(sql)
 	if err != nil {
@@ -1481,7 +2823,7 @@ func insertItems(tx *sql.Tx, feedid int64, items []*kibner.Item, unplayed bool,
 
 	for _, item := range items {
 
-		_, err := stmt.Exec(feedid, unplayed, normaliseText(item.Title), normaliseText(item.Desc), item.Pubdate.Unix(), item.URL, item.Filesize, item.Duration.Seconds(), item.GUID, timestamp.Unix())
+		_, err := stmt.Exec(feedid, unplayed, normaliseText(item.Title), normaliseText(item.Desc), item.Pubdate.Unix(), item.URL, item.Filesize, item.Duration.Seconds(), item.GUID, item.Type, item.RawDesc, timestamp.Unix())
 		if err != nil {
 			return err
 		}
@@ -1567,37 +2909,129 @@ func formatSeconds(secs int64) string {
 	return s
 }
 
+func formatBytes(n int64) string {
+
+	if n < 1000 {
+		return fmt.Sprintf("%d bytes", n)
+	}
+
+	units := []string{"KB", "MB", "GB"}
+
+	size, i := float64(n)/1000, 0
+	for size >= 1000 && i < len(units)-1 {
+		size /= 1000
+		i++
+	}
+
+	return fmt.Sprintf("%.1f %s", size, units[i])
+}
+
 var errNoFeedChosen = errors.New("No feed selected")
 var errNoFeedFound = errors.New("No such feed")
+var errNoInput = errors.New("input required but --no-input was given")
+
+// feedChoice describes which feeds to choose and how much to
+// ask the user along the way.
+type feedChoice struct {
+	// Name is matched against feed titles.
+	Name string
+	// ID, if set, chooses a feed by ID instead of by name.
+	ID int64
+	// Exact matches Name against whole titles rather than
+	// as a substring.
+	Exact bool
+	// Confirm asks the user to confirm each feed, even if
+	// there's only one match.
+	Confirm bool
+	// Yes skips confirmation.
+	Yes bool
+	// All chooses every matching feed.
+	All bool
+}
+
+// ambiguousFeedError is returned when more than one feed matches
+// and there's no way to ask the user which one they meant.
+type ambiguousFeedError struct {
+	Name  string
+	Feeds []feedMatch
+}
 
-func chooseFeed(db *sql.DB, feedTitle string, prompt string, alwaysPrompt bool) (int64, error) {
+type feedMatch struct {
+	ID    int64
+	Title string
+}
 
-	q := `SELECT id, title FROM feeds WHERE title LIKE ? ORDER BY title`
+func (e *ambiguousFeedError) Error() string {
 
-	var rows []struct {
-		ID    int64
-		Title string
+	s := fmt.Sprintf("%q matches %d feeds:\n", e.Name, len(e.Feeds))
+	for _, f := range e.Feeds {
+		s += fmt.Sprintf("  %4d  %s\n", f.ID, f.Title)
 	}
 
-	err := queryRows(&rows, db, q, "%"+feedTitle+"%")
+	return s + "Use --id or --exact to choose one, or --all-matches to choose them all"
+}
+
+// chooseFeed chooses a single feed. It's chooseFeeds without
+// the All option.
+func chooseFeed(db *sql.DB, env *Env, choice feedChoice, prompt string) (int64, error) {
+
+	choice.All = false
+
+	ids, err := chooseFeeds(db, env, choice, prompt)
 	if err != nil {
 		return 0, err
 	}
 
+	return ids[0], nil
+}
+
+// chooseFeeds returns the IDs of the feeds matching choice,
+// prompting the user to choose between them if necessary. The
+// prompt is a format string for the feed title.
+func chooseFeeds(db *sql.DB, env *Env, choice feedChoice, prompt string) ([]int64, error) {
+
+	var rows []feedMatch
+	var err error
+
+	switch {
+	case choice.ID != 0:
+		err = queryRows(&rows, db, `SELECT id, title FROM feeds WHERE id = ?`, choice.ID)
+	case choice.Exact:
+		err = queryRows(&rows, db, `SELECT id, title FROM feeds WHERE title = ? COLLATE NOCASE ORDER BY title`, choice.Name)
+	default:
+		err = queryRows(&rows, db, `SELECT id, title FROM feeds WHERE title LIKE ? ORDER BY title`, "%"+choice.Name+"%")
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	if len(rows) == 0 {
-		return 0, errNoFeedFound
+		return nil, errNoFeedFound
+	}
+
+	if len(rows) > 1 && !choice.All && (choice.Yes || env.NoInput) {
+		return nil, &ambiguousFeedError{
+			Name:  choice.Name,
+			Feeds: rows,
+		}
 	}
 
-	if len(rows) == 1 && !alwaysPrompt {
-		return rows[0].ID, nil
+	if (len(rows) == 1 || choice.All) && (!choice.Confirm || choice.Yes) {
+		ids := make([]int64, len(rows))
+		for i, r := range rows {
+			ids[i] = r.ID
+		}
+		return ids, nil
 	}
 
+	var ids []int64
+
 	for i, r := range rows {
 
 		s := fmt.Sprintf("[%d/%d] %s? Yes, No, Quit", i+1, len(rows), fmt.Sprintf(prompt, r.Title))
-		c, err := ask(s, "ynq")
+		c, err := ask(env, s, "ynq")
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 
 		if c == 'q' {
@@ -1605,26 +3039,43 @@ func chooseFeed(db *sql.DB, feedTitle string, prompt string, alwaysPrompt bool)
 		}
 
 		if c == 'y' {
-			return r.ID, nil
+			ids = append(ids, r.ID)
+			if !choice.All {
+				break
+			}
 		}
 	}
 
-	return 0, errNoFeedChosen
+	if len(ids) == 0 {
+		return nil, errNoFeedChosen
+	}
+
+	return ids, nil
 }
 
-func ask(prompt string, responses string) (rune, error) {
+// ask prompts for one of the given responses until it gets one.
+// Only the first character of each line of input is considered.
+func ask(env *Env, prompt string, responses string) (rune, error) {
 
 	responses = strings.ToLower(responses)
 
+	if env.NoInput {
+		return 0, errNoInput
+	}
+
 	for {
-		fmt.Printf("%s: ", prompt)
-		c, _, err := bufio.NewReader(os.Stdin).ReadRune()
+		fmt.Fprintf(env.Stdout, "%s: ", prompt)
+
+		line, err := env.ReadLine()
 		if err != nil {
 			return 0, err
 		}
 
-		if c = unicode.ToLower(c); strings.ContainsRune(responses, c) {
-			return c, nil
+		for _, c := range strings.TrimSpace(line) {
+			if c = unicode.ToLower(c); strings.ContainsRune(responses, c) {
+				return c, nil
+			}
+			break
 		}
 	}
 }
@@ -1692,49 +3143,26 @@ func daysFrom(refdate, t time.Time) int {
 	return int(startOfDay(t).Sub(startOfDay(refdate)).Seconds() / (60 * 60 * 24))
 }
 
-func parseDuration(hhmmss string) (time.Duration, error) {
-
-	var units []time.Duration
-	var duration time.Duration
-
-	parts := strings.Split(hhmmss, ":")
-
-	switch len(parts) {
-	case 1:
-		units = []time.Duration{time.Second}
-	case 2:
-		units = []time.Duration{time.Minute, time.Second}
-	case 3:
-		units = []time.Duration{time.Hour, time.Minute, time.Second}
-	default:
-		return 0, errors.New("invalid duration format: " + hhmmss)
-	}
-
-	for i := range parts {
-		n, err := strconv.Atoi(parts[i])
-		if err != nil {
-			return 0, errors.New("could not parse duration " + hhmmss + ": " + err.Error())
-		}
-		duration += time.Duration(n) * units[i]
-	}
-
-	return duration, nil
-}
-
+// formatLines splits s into lines of at most linelen
+// characters, breaking at spaces where possible.
 func formatLines(linelen int, s string) []string {
 
 	var lines []string
 
+	// Work in runes rather than bytes so that lines with
+	// non-ASCII characters aren't wrapped too early.
+	r := []rune(s)
+
 	for {
-		if len(s) <= linelen {
-			if len(s) > 0 {
-				lines = append(lines, s)
+		if len(r) <= linelen {
+			if len(r) > 0 {
+				lines = append(lines, string(r))
 			}
 			break
 		}
 
 		pos := linelen
-		for pos > 0 && s[pos] > ' ' {
+		for pos > 0 && r[pos] > ' ' {
 			pos--
 		}
 
@@ -1742,38 +3170,18 @@ func formatLines(linelen int, s string) []string {
 			pos = linelen
 		}
 
-		lines = append(lines, s[:pos])
+		lines = append(lines, string(r[:pos]))
 
-		for pos < len(s) && s[pos] <= ' ' {
+		for pos < len(r) && r[pos] <= ' ' {
 			pos++
 		}
 
-		if pos >= len(s) {
+		if pos >= len(r) {
 			break
 		}
 
-		s = s[pos:]
+		r = r[pos:]
 	}
 
 	return lines
 }
-
-func parseCommand(command string, args ...string) (*exec.Cmd, error) {
-
-	parts := strings.Fields(command)
-	if len(parts) < 1 {
-		return nil, errors.New("no command given")
-	}
-
-	exe, err := exec.LookPath(parts[0])
-	if err != nil {
-		return nil, err
-	}
-
-	cmd := exec.Command(exe, append(parts[1:], args...)...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	return cmd, nil
-}
@@ -157,6 +157,12 @@ func testWithInitDB(t *testing.T, fn func(t *testing.T, db *sql.DB)) {
 
 func TestMain(m *testing.M) {
 	rand.Seed(time.Now().UnixNano())
+
+	// Test feeds link to real files. Don't go looking for them.
+	lookupLastModified = func(string) (time.Time, error) {
+		return time.Time{}, errors.New("no network access in tests")
+	}
+
 	os.Exit(m.Run())
 }
 
@@ -171,11 +177,18 @@ func testInitDB(t *testing.T, db *sql.DB) {
 	}
 
 	verifyTables(t, db, map[string]int{
-		"feeds":           0,
-		"items":           0,
-		"sqlite_sequence": 0,
+		"feeds":                 0,
+		"items":                 0,
+		"sqlite_sequence":       1,
+		"gpodder_state":         0,
+		"gpodder_subscriptions": 0,
+		"feed_tags":             0,
+		"hooks":                 0,
+		"feed_schedules":        0,
 	})
 
+	verifySchemaVersion(t, db, len(schemaUpgrades))
+
 	verifyColumns(t, db, "feeds", []sqlitemeta.Column{
 		{
 			ID:         0,
@@ -228,6 +241,12 @@ func testInitDB(t *testing.T, db *sql.DB) {
 			Type:    "DATETIME",
 			NotNull: true,
 		},
+		{
+			ID:      9,
+			Name:    "language",
+			Type:    "TEXT",
+			Default: []byte("''"),
+		},
 	})
 
 	verifyIndexes(t, db, "feeds", []sqlitemeta.Index{
@@ -243,64 +262,100 @@ func testInitDB(t *testing.T, db *sql.DB) {
 
 	verifyColumns(t, db, "items", []sqlitemeta.Column{
 		{
-			ID:      0,
+			ID:         0,
+			Name:       "id",
+			Type:       "INTEGER",
+			PrimaryKey: 1,
+		},
+		{
+			ID:      1,
 			Name:    "feedid",
 			Type:    "INTEGER",
 			NotNull: true,
 		},
 		{
-			ID:      1,
+			ID:      2,
 			Name:    "title",
 			Type:    "TEXT",
 			NotNull: true,
 		},
 		{
-			ID:   2,
+			ID:   3,
 			Name: "desc",
 			Type: "TEXT",
 		},
 		{
-			ID:      3,
+			ID:      4,
 			Name:    "pubdate",
 			Type:    "DATETIME",
 			NotNull: true,
 		},
 		{
-			ID:      4,
+			ID:      5,
 			Name:    "url",
 			Type:    "TEXT",
 			NotNull: true,
 		},
 		{
-			ID:      5,
+			ID:      6,
 			Name:    "filesize",
 			Type:    "INTEGER",
 			Default: []byte("0"),
 		},
 		{
-			ID:      6,
+			ID:      7,
 			Name:    "duration",
 			Type:    "INTEGER",
 			Default: []byte("0"),
 		},
 		{
-			ID:      7,
+			ID:      8,
 			Name:    "guid",
 			Type:    "TEXT",
 			NotNull: true,
 		},
 		{
-			ID:      8,
+			ID:      9,
 			Name:    "unplayed",
 			Type:    "BOOLEAN",
 			Default: []byte("0"),
 		},
 		{
-			ID:      9,
+			ID:      10,
 			Name:    "timestamp",
 			Type:    "DATETIME",
 			NotNull: true,
 		},
+		{
+			ID:      11,
+			Name:    "position",
+			Type:    "INTEGER",
+			Default: []byte("0"),
+		},
+		{
+			ID:      12,
+			Name:    "updated",
+			Type:    "DATETIME",
+			Default: []byte("0"),
+		},
+		{
+			ID:      13,
+			Name:    "type",
+			Type:    "TEXT",
+			Default: []byte("''"),
+		},
+		{
+			ID:      14,
+			Name:    "rawdesc",
+			Type:    "TEXT",
+			Default: []byte("''"),
+		},
+		{
+			ID:      15,
+			Name:    "probed",
+			Type:    "DATETIME",
+			Default: []byte("0"),
+		},
 	})
 
 	verifyIndexes(t, db, "items", []sqlitemeta.Index{
@@ -325,6 +380,294 @@ func testInitDB(t *testing.T, db *sql.DB) {
 			OnDelete:    sqlitemeta.ForeignKeyActionNone,
 		},
 	})
+
+	verifyColumns(t, db, "gpodder_state", []sqlitemeta.Column{
+		{
+			ID:         0,
+			Name:       "account",
+			Type:       "TEXT",
+			PrimaryKey: 1,
+		},
+		{
+			ID:      1,
+			Name:    "subscriptions",
+			Type:    "INTEGER",
+			Default: []byte("0"),
+		},
+		{
+			ID:      2,
+			Name:    "actions",
+			Type:    "INTEGER",
+			Default: []byte("0"),
+		},
+		{
+			ID:      3,
+			Name:    "uploaded",
+			Type:    "DATETIME",
+			Default: []byte("0"),
+		},
+	})
+
+	verifyColumns(t, db, "gpodder_subscriptions", []sqlitemeta.Column{
+		{
+			ID:      0,
+			Name:    "account",
+			Type:    "TEXT",
+			NotNull: true,
+		},
+		{
+			ID:      1,
+			Name:    "url",
+			Type:    "TEXT",
+			NotNull: true,
+		},
+	})
+
+	verifyIndexes(t, db, "gpodder_subscriptions", []sqlitemeta.Index{
+		{
+			Name:        "unique_gpodder_url",
+			Type:        sqlitemeta.IndexTypeNormal,
+			IsUnique:    true,
+			ColumnNames: nullStrings("account", "url"),
+		},
+	})
+
+	verifyColumns(t, db, "feed_tags", []sqlitemeta.Column{
+		{
+			ID:      0,
+			Name:    "feedid",
+			Type:    "INTEGER",
+			NotNull: true,
+		},
+		{
+			ID:      1,
+			Name:    "tag",
+			Type:    "TEXT",
+			NotNull: true,
+		},
+	})
+
+	verifyIndexes(t, db, "feed_tags", []sqlitemeta.Index{
+		{
+			Name:        "unique_feed_tag",
+			Type:        sqlitemeta.IndexTypeNormal,
+			IsUnique:    true,
+			ColumnNames: nullStrings("feedid", "tag"),
+		},
+	})
+
+	verifyForeignKeys(t, db, "feed_tags", []sqlitemeta.ForeignKey{
+		{
+			ID:         0,
+			ChildTable: "feed_tags",
+			ChildKey: []string{
+				"feedid",
+			},
+			ParentTable: "feeds",
+			ParentKey:   nullStrings("id"),
+			OnUpdate:    sqlitemeta.ForeignKeyActionNone,
+			OnDelete:    sqlitemeta.ForeignKeyActionNone,
+		},
+	})
+
+	verifyColumns(t, db, "hooks", []sqlitemeta.Column{
+		{
+			ID:         0,
+			Name:       "id",
+			Type:       "INTEGER",
+			PrimaryKey: 1,
+		},
+		{
+			ID:      1,
+			Name:    "event",
+			Type:    "TEXT",
+			NotNull: true,
+		},
+		{
+			ID:      2,
+			Name:    "target",
+			Type:    "TEXT",
+			NotNull: true,
+		},
+	})
+
+	verifyIndexes(t, db, "hooks", []sqlitemeta.Index{
+		{
+			Name:        "unique_hook",
+			Type:        sqlitemeta.IndexTypeNormal,
+			IsUnique:    true,
+			ColumnNames: nullStrings("event", "target"),
+		},
+	})
+
+	verifyColumns(t, db, "feed_schedules", []sqlitemeta.Column{
+		{
+			ID:         0,
+			Name:       "feedid",
+			Type:       "INTEGER",
+			PrimaryKey: 1,
+		},
+		{
+			ID:      1,
+			Name:    "synced",
+			Type:    "DATETIME",
+			Default: []byte("0"),
+		},
+		{
+			ID:      2,
+			Name:    "next",
+			Type:    "DATETIME",
+			Default: []byte("0"),
+		},
+		{
+			ID:      3,
+			Name:    "interval",
+			Type:    "INTEGER",
+			Default: []byte("0"),
+		},
+		{
+			ID:      4,
+			Name:    "failures",
+			Type:    "INTEGER",
+			Default: []byte("0"),
+		},
+		{
+			ID:      5,
+			Name:    "error",
+			Type:    "TEXT",
+			Default: []byte("''"),
+		},
+	})
+
+	verifyForeignKeys(t, db, "feed_schedules", []sqlitemeta.ForeignKey{
+		{
+			ID:         0,
+			ChildTable: "feed_schedules",
+			ChildKey: []string{
+				"feedid",
+			},
+			ParentTable: "feeds",
+			ParentKey:   nullStrings("id"),
+			OnUpdate:    sqlitemeta.ForeignKeyActionNone,
+			OnDelete:    sqlitemeta.ForeignKeyActionNone,
+		},
+	})
+}
+
+func TestUpgradeDB(t *testing.T) {
+	testWithDB(t, testUpgradeDB)
+}
+
+func testUpgradeDB(t *testing.T, db *sql.DB) {
+
+	testInitDB(t, db)
+
+	// Upgrading an up-to-date database is a no-op.
+	if err := upgradeDB(db); err != nil {
+		t.Fatalf("upgradeDB returned error %q", err)
+	}
+	verifySchemaVersion(t, db, len(schemaUpgrades))
+
+	// Databases from the future are rejected.
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(schemaUpgrades)+1)); err != nil {
+		t.Fatalf("Error setting user_version: %s", err)
+	}
+
+	exp := fmt.Errorf("unsupported database version %d", len(schemaUpgrades)+1)
+	if err := upgradeDB(db); !equalErrors(exp, err) {
+		t.Errorf("Expected upgradeDB to return error %q, got %v", exp, err)
+	}
+}
+
+func TestUpgradeDBItemIDs(t *testing.T) {
+	testWithDB(t, testUpgradeDBItemIDs)
+}
+
+func testUpgradeDBItemIDs(t *testing.T, db *sql.DB) {
+
+	// Create a version 1 database, i.e. one without item ids.
+	upgrades := schemaUpgrades
+	schemaUpgrades = schemaUpgrades[:1]
+	err := initDB(db)
+	schemaUpgrades = upgrades
+
+	if err != nil {
+		t.Fatalf("initDB returned error %q", err)
+	}
+
+	feed := allTestCases["Columbo"].NewFeed()
+
+	// saveFeed writes to columns that a version 1 database
+	// doesn't have, so add the rows by hand.
+	res, err := db.Exec("INSERT INTO feeds(title, author, type, url, timestamp) VALUES(?, ?, ?, ?, ?)", feed.Title, feed.Author, feed.Type, feed.URL, time.Now().Unix())
+	if err != nil {
+		t.Fatalf("Error inserting feed: %s", err)
+	}
+
+	feedID, err := res.LastInsertId()
+	if err != nil {
+		t.Fatalf("LastInsertId returned error %q", err)
+	}
+
+	for _, item := range feed.Items {
+		_, err := db.Exec("INSERT INTO items(feedid, title, pubdate, url, guid, timestamp) VALUES(?, ?, ?, ?, ?, ?)", feedID, item.Title, item.Pubdate.Unix(), item.URL, item.GUID, time.Now().Unix())
+		if err != nil {
+			t.Fatalf("Error inserting item: %s", err)
+		}
+	}
+
+	// Leave a gap in the ROWIDs.
+	if _, err := db.Exec("DELETE FROM items WHERE guid = ?", feed.Items[1].GUID); err != nil {
+		t.Fatalf("Error deleting item: %s", err)
+	}
+
+	rowids := map[string]int64{}
+
+	rows, err := db.Query("SELECT ROWID, guid FROM items")
+	if err != nil {
+		t.Fatalf("Error querying items: %s", err)
+	}
+	for rows.Next() {
+		var id int64
+		var guid string
+		if err := rows.Scan(&id, &guid); err != nil {
+			t.Fatalf("Error scanning items: %s", err)
+		}
+		rowids[guid] = id
+	}
+	rows.Close()
+
+	if err := upgradeDB(db); err != nil {
+		t.Fatalf("upgradeDB returned error %q", err)
+	}
+
+	verifySchemaVersion(t, db, len(schemaUpgrades))
+
+	for guid, rowid := range rowids {
+		var id int64
+		if err := db.QueryRow("SELECT id FROM items WHERE guid = ?", guid).Scan(&id); err != nil {
+			t.Fatalf("Error loading item %s: %s", guid, err)
+		}
+		if id != rowid {
+			t.Errorf("Expected item %s to have id %d, got %d", guid, rowid, id)
+		}
+	}
+
+	// New items get new ids.
+	extra := &kibner.Item{
+		Title:   "Extra",
+		URL:     "http://example.com/extra.mp3",
+		GUID:    "extra",
+		Pubdate: time.Now(),
+	}
+
+	if err := saveNewItems(db, feedID, []*kibner.Item{extra}); err != nil {
+		t.Fatalf("saveNewItems returned error %q", err)
+	}
+
+	if got, exp := itemIDByURL(t, db, extra.URL), int64(len(feed.Items)+1); got != exp {
+		t.Errorf("Expected new item to have id %d, got %d", exp, got)
+	}
 }
 
 func TestAddFeed(t *testing.T) {
@@ -345,7 +688,7 @@ func testAddFeed(t *testing.T, db *sql.DB) {
 		feed := test.NewFeed()
 		feed.URL = url
 
-		res, err := addFeed(db, url)
+		res, err := addFeed(db, nil, url)
 		if err != nil {
 			t.Fatalf("%s: addFeed returned error %q", name, err)
 			continue
@@ -361,11 +704,12 @@ func testAddFeed(t *testing.T, db *sql.DB) {
 		verifyTables(t, db, map[string]int{
 			"feeds":           feeds,
 			"items":           items,
-			"sqlite_sequence": 1,
+			"sqlite_sequence": 2,
 		})
 
 		verifySequenceNumbers(t, db, map[string]int64{
 			"feeds": res.ID,
+			"items": int64(items),
 		})
 	}
 }
@@ -385,7 +729,7 @@ func testAddFeedNotFound(t *testing.T, db *sql.DB) {
 
 		url := serverURL(ts, test.Filename)
 
-		if _, err := addFeed(db, url); !equalErrors(exp, err) {
+		if _, err := addFeed(db, nil, url); !equalErrors(exp, err) {
 			t.Errorf("%s: expected addFeed to return error %q, got %v", name, exp, err)
 		}
 	}
@@ -410,7 +754,7 @@ func testAddFeedDuplicate(t *testing.T, db *sql.DB) {
 
 			url := serverURL(ts, test.Filename)
 
-			if _, err := addFeed(db, url); !equalErrors(exp, err) {
+			if _, err := addFeed(db, nil, url); !equalErrors(exp, err) {
 				t.Errorf("%s: expected addFeed to return error %v, got %v", name, exp, err)
 			}
 		}
@@ -429,7 +773,7 @@ func testAddFeedDuplicateGUID(t *testing.T, db *sql.DB) {
 	url := serverURL(ts, "errors/duplicate-guid.xml")
 	exp := errors.New("could not save feed: UNIQUE constraint failed: items.feedid, items.guid")
 
-	if _, err := addFeed(db, url); !equalErrors(exp, err) {
+	if _, err := addFeed(db, nil, url); !equalErrors(exp, err) {
 		t.Errorf("expected addFeed to return %v, got %v", exp, err)
 	}
 }
@@ -446,34 +790,111 @@ func testAddFeedNoTitle(t *testing.T, db *sql.DB) {
 	url := serverURL(ts, "errors/no-title.xml")
 	exp := errors.New("could not fetch feed: bad feed: no title")
 
-	if _, err := addFeed(db, url); !equalErrors(exp, err) {
+	if _, err := addFeed(db, nil, url); !equalErrors(exp, err) {
 		t.Errorf("expected addFeed to return %q, got %v", exp, err)
 	}
 }
 
-func TestAddFeedMultiple(t *testing.T) {
-	testWithInitDB(t, testAddFeedMultiple)
+func TestAddFeedWarnings(t *testing.T) {
+	testWithInitDB(t, testAddFeedWarnings)
 }
 
-func testAddFeedMultiple(t *testing.T, db *sql.DB) {
+func testAddFeedWarnings(t *testing.T, db *sql.DB) {
 
 	ts := newFileServer()
 	defer ts.Close()
 
-	urls := make([]string, 0, len(allTestCases))
-	feedsByURL := map[string]*kibner.Feed{}
-
-	for _, test := range allTestCases {
+	tests := map[string][]string{
+		"Columbo": {
+			`"Dead Weight": no release date`,
+			`"Death Lends a Hand": invalid file size "xxx"`,
+			`"Ransom for a Dead Man": invalid duration "xxx"`,
+		},
+		"Why We Eat": {
+			`"The Search for Big Kale": skipped (no download URL)`,
+			`"Introducing: Why We Eat What We Eat": skipped (no download URL)`,
+		},
+		"Serial": nil,
+	}
 
-		url := serverURL(ts, test.Filename)
-		urls = append(urls, url)
+	for name, exp := range tests {
 
-		feed := test.NewFeed()
+		res, err := addFeed(db, nil, serverURL(ts, allTestCases[name].Filename))
+		if err != nil {
+			t.Fatalf("%s: addFeed returned error %q", name, err)
+		}
+
+		if !reflect.DeepEqual(res.Warnings, exp) {
+			t.Errorf("%s: expected addFeed to return warnings %q, got %q", name, exp, res.Warnings)
+		}
+
+		res, err = syncOne(db, nil, res.ID)
+		if err != nil {
+			t.Fatalf("%s: syncOne returned error %q", name, err)
+		}
+
+		if !reflect.DeepEqual(res.Warnings, exp) {
+			t.Errorf("%s: expected syncOne to return warnings %q, got %q", name, exp, res.Warnings)
+		}
+	}
+}
+
+func TestAddFeedLanguage(t *testing.T) {
+	testWithInitDB(t, testAddFeedLanguage)
+}
+
+func testAddFeedLanguage(t *testing.T, db *sql.DB) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	tests := map[string]string{
+		"Serial":       "en",
+		"Gadget Lab":   "en-US",
+		"Minimal Feed": "",
+	}
+
+	for name, exp := range tests {
+
+		res, err := addFeed(db, nil, serverURL(ts, allTestCases[name].Filename))
+		if err != nil {
+			t.Fatalf("%s: addFeed returned error %q", name, err)
+		}
+
+		var got string
+		if err := db.QueryRow("SELECT language FROM feeds WHERE id = ?", res.ID).Scan(&got); err != nil {
+			t.Fatalf("%s: error querying language: %s", name, err)
+		}
+
+		if got != exp {
+			t.Errorf("%s: expected language %q, got %q", name, exp, got)
+		}
+	}
+}
+
+func TestAddFeedMultiple(t *testing.T) {
+	testWithInitDB(t, testAddFeedMultiple)
+}
+
+func testAddFeedMultiple(t *testing.T, db *sql.DB) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	urls := make([]string, 0, len(allTestCases))
+	feedsByURL := map[string]*kibner.Feed{}
+
+	for _, test := range allTestCases {
+
+		url := serverURL(ts, test.Filename)
+		urls = append(urls, url)
+
+		feed := test.NewFeed()
 		feed.URL = url
 		feedsByURL[url] = feed
 	}
 
-	results := addFeedMultiple(db, urls)
+	results := addFeedMultiple(db, nil, urls, nil)
 
 	if len(results) != len(allTestCases) {
 		t.Fatalf("expected %d results from addFeedMultiple, got %d", len(allTestCases), len(results))
@@ -508,11 +929,12 @@ func testAddFeedMultiple(t *testing.T, db *sql.DB) {
 	verifyTables(t, db, map[string]int{
 		"feeds":           feeds,
 		"items":           items,
-		"sqlite_sequence": 1,
+		"sqlite_sequence": 2,
 	})
 
 	verifySequenceNumbers(t, db, map[string]int64{
 		"feeds": maxID,
+		"items": int64(items),
 	})
 }
 
@@ -536,7 +958,7 @@ func testAddFeedMultipleNotFound(t *testing.T, db *sql.DB) {
 		namesByURL[url] = name
 	}
 
-	results := addFeedMultiple(db, urls)
+	results := addFeedMultiple(db, nil, urls, nil)
 
 	if len(results) != len(allTestCases) {
 		t.Fatalf("expected %d results from addFeedMultiple, got %d", len(allTestCases), len(results))
@@ -573,7 +995,7 @@ func testRemoveFeed(t *testing.T, db *sql.DB) {
 
 	for name, test := range allTestCases {
 
-		res, err := addFeed(db, serverURL(ts, test.Filename))
+		res, err := addFeed(db, nil, serverURL(ts, test.Filename))
 		if err != nil {
 			t.Fatalf("%s: addFeed returned error %q", name, err)
 		}
@@ -584,9 +1006,12 @@ func testRemoveFeed(t *testing.T, db *sql.DB) {
 		results = append(results, res)
 	}
 
+	// Item ids, like feed ids, aren't reused.
+	maxItemID := int64(items)
+
 	for _, res := range results {
 
-		err := removeFeed(db, res.ID)
+		err := removeFeed(db, nil, res.ID)
 		if err != nil {
 			t.Fatalf("%s: removeFeed returned error %q", res.Title, err)
 		}
@@ -597,11 +1022,12 @@ func testRemoveFeed(t *testing.T, db *sql.DB) {
 		verifyTables(t, db, map[string]int{
 			"feeds":           feeds,
 			"items":           items,
-			"sqlite_sequence": 1,
+			"sqlite_sequence": 2,
 		})
 
 		verifySequenceNumbers(t, db, map[string]int64{
 			"feeds": maxID,
+			"items": maxItemID,
 		})
 	}
 }
@@ -640,16 +1066,20 @@ func testSyncFeed(t *testing.T, db *sql.DB) {
 			verifyTables(t, db, map[string]int{
 				"feeds":           1,
 				"items":           len(feed2.Items),
-				"sqlite_sequence": 1,
+				"sqlite_sequence": 2,
 			})
 			verifyUnplayedItemCount(t, db, id, 0)
 			verifyFeed(t, db, id, feed2)
 
-			res, err := syncOne(db, id)
+			before := time.Now().Truncate(time.Second)
+
+			res, err := syncOne(db, nil, id)
 			if err != nil {
 				t.Fatalf("%s: syncOne returned error %s", name, err)
 			}
 
+			after := time.Now()
+
 			if res.ID != id {
 				t.Errorf("%s: expected syncOne to return id %d, got %d", name, id, res.ID)
 			}
@@ -661,16 +1091,232 @@ func testSyncFeed(t *testing.T, db *sql.DB) {
 			verifyTables(t, db, map[string]int{
 				"feeds":           1,
 				"items":           len(feed.Items),
-				"sqlite_sequence": 1,
+				"sqlite_sequence": 2,
 			})
 			verifyUnplayedItemCount(t, db, id, unplayed)
 
-			feed2.Items = feed.Items
+			feed2.Items = expectSyncedPubdates(t, feed.Items[:unplayed], getItems(t, db, id), before, after)
+			feed2.Items = append(feed2.Items, feed.Items[unplayed:]...)
+			sortItems(feed2.Items)
 			verifyFeed(t, db, id, feed2)
 		}
 	}
 }
 
+// expectSyncedPubdates returns copies of the given new items
+// with the release dates that syncing should have given them.
+// Items with no release date are dated when they're first seen,
+// i.e. at some point between before and after.
+func expectSyncedPubdates(t *testing.T, items, dbItems []*kibner.Item, before, after time.Time) []*kibner.Item {
+
+	var exp []*kibner.Item
+
+	for _, item := range items {
+
+		item2 := *item
+
+		if item2.Pubdate.IsZero() {
+			for _, dbItem := range dbItems {
+				if dbItem.GUID != item.GUID {
+					continue
+				}
+				if dbItem.Pubdate.Before(before) || dbItem.Pubdate.After(after) {
+					t.Errorf("Expected item %q to have a Pubdate between %v and %v, got %v", item.Title, before, after, dbItem.Pubdate)
+				}
+				item2.Pubdate = dbItem.Pubdate
+			}
+		}
+
+		exp = append(exp, &item2)
+	}
+
+	return exp
+}
+
+// sortItems sorts items in the same order as getItems.
+func sortItems(items []*kibner.Item) {
+	sort.SliceStable(items, func(i, j int) bool {
+		if !items[i].Pubdate.Equal(items[j].Pubdate) {
+			return items[i].Pubdate.After(items[j].Pubdate)
+		}
+		return items[i].GUID < items[j].GUID
+	})
+}
+
+// newRedirectServer serves the test feeds, with each path in
+// redirects permanently redirected to another path.
+func newRedirectServer(redirects map[string]string) *httptest.Server {
+
+	files := http.FileServer(http.Dir("internal/testdata/rss"))
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if to, ok := redirects[r.URL.Path]; ok {
+			http.Redirect(w, r, to, http.StatusMovedPermanently)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+}
+
+func TestPreviewFeedMultiple(t *testing.T) {
+	testWithInitDB(t, testPreviewFeedMultiple)
+}
+
+func testPreviewFeedMultiple(t *testing.T, db *sql.DB) {
+
+	ts := newRedirectServer(map[string]string{
+		"/moved.xml": "/rework.xml",
+	})
+	defer ts.Close()
+
+	serial := serverURL(ts, "serial.xml")
+	rework := serverURL(ts, "rework.xml")
+	moved := serverURL(ts, "moved.xml")
+	missing := serverURL(ts, "missing.xml")
+
+	added := addFeedMultiple(db, nil, []string{serial}, nil)
+	if len(added) != 1 || added[0].Err != nil {
+		t.Fatalf("addFeedMultiple returned %s", jsonify(added))
+	}
+
+	results, err := previewFeedMultiple(db, []string{serial, rework, moved, missing}, nil)
+	if err != nil {
+		t.Fatalf("previewFeedMultiple returned error %q", err)
+	}
+
+	exp := map[string]string{
+		serial:  errAlreadySubscribed.Error(),
+		rework:  "",
+		moved:   "duplicate of " + rework,
+		missing: "bad status: 404 Not Found",
+	}
+
+	if len(results) != len(exp) {
+		t.Fatalf("expected previewFeedMultiple to return %d results, got %d", len(exp), len(results))
+	}
+
+	for _, res := range results {
+
+		if got := errString(res.Err); got != exp[res.Source] {
+			t.Errorf("%s: expected error %q, got %q", res.Source, exp[res.Source], got)
+		}
+
+		if res.Source == rework {
+			if n := len(allTestCases["Rework"].NewFeed().Items); res.Title != "REWORK" || res.Items != n {
+				t.Errorf("expected REWORK with %d items, got %q with %d", n, res.Title, res.Items)
+			}
+		}
+	}
+
+	// Nothing is saved.
+	verifyTables(t, db, map[string]int{
+		"feeds":           1,
+		"items":           added[0].Items,
+		"sqlite_sequence": 2,
+	})
+}
+
+func TestPreviewSyncMultiple(t *testing.T) {
+	testWithInitDB(t, testPreviewSyncMultiple)
+}
+
+func testPreviewSyncMultiple(t *testing.T, db *sql.DB) {
+
+	ts := newRedirectServer(map[string]string{
+		"/old-serial.xml": "/serial.xml",
+	})
+	defer ts.Close()
+
+	added := addFeedMultiple(db, nil, []string{serverURL(ts, "serial.xml")}, nil)
+	if len(added) != 1 || added[0].Err != nil {
+		t.Fatalf("addFeedMultiple returned %s", jsonify(added))
+	}
+
+	id := added[0].ID
+	items := added[0].Items
+
+	// Forget the two most recent items and pretend the feed
+	// used to live at another URL.
+	_, err := db.Exec("DELETE FROM items WHERE id IN(SELECT id FROM items WHERE feedid = ? ORDER BY pubdate DESC LIMIT 2)", id)
+	if err != nil {
+		t.Fatalf("Exec returned error %q", err)
+	}
+
+	if err := updateFeed(db, id, map[string]interface{}{"url": serverURL(ts, "old-serial.xml")}); err != nil {
+		t.Fatalf("updateFeed returned error %q", err)
+	}
+
+	infos, err := loadSyncInfo(db, 0)
+	if err != nil {
+		t.Fatalf("loadSyncInfo returned error %q", err)
+	}
+
+	results := previewSyncMultiple(infos, nil)
+
+	if len(results) != 1 {
+		t.Fatalf("expected previewSyncMultiple to return 1 result, got %d", len(results))
+	}
+
+	res := results[0]
+
+	if res.Err != nil || res.Items != 2 || res.NewURL != serverURL(ts, "serial.xml") {
+		t.Errorf("expected 2 new items and a move to %s, got %s", serverURL(ts, "serial.xml"), jsonify(res))
+	}
+
+	// Nothing is saved.
+	verifyTables(t, db, map[string]int{
+		"feeds":           1,
+		"items":           items - 2,
+		"sqlite_sequence": 2,
+	})
+
+	url, err := loadFeedURL(db, id, targetFeed)
+	if err != nil {
+		t.Fatalf("loadFeedURL returned error %q", err)
+	}
+
+	if url != serverURL(ts, "old-serial.xml") {
+		t.Errorf("expected feed URL to be unchanged, got %s", url)
+	}
+}
+
+func TestLoadRemoveSummary(t *testing.T) {
+	testWithInitDB(t, testLoadRemoveSummary)
+}
+
+func testLoadRemoveSummary(t *testing.T, db *sql.DB) {
+
+	feed := allTestCases["Serial"].NewFeed()
+
+	id, err := saveFeed(db, feed, time.Now())
+	if err != nil {
+		t.Fatalf("saveFeed returned error %q", err)
+	}
+
+	if _, err := db.Exec("UPDATE items SET unplayed = 1 WHERE feedid = ? AND guid = ?", id, feed.Items[0].GUID); err != nil {
+		t.Fatalf("Exec returned error %q", err)
+	}
+
+	got, err := loadRemoveSummary(db, id)
+	if err != nil {
+		t.Fatalf("loadRemoveSummary returned error %q", err)
+	}
+
+	exp := &removeSummary{
+		Title:         feed.Title,
+		Items:         int64(len(feed.Items)),
+		UnplayedItems: 1,
+	}
+
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected loadRemoveSummary to return %+v, got %+v", exp, got)
+	}
+
+	if _, err := loadRemoveSummary(db, id+1); err != errNoFeedFound {
+		t.Errorf("expected loadRemoveSummary to return error %q, got %v", errNoFeedFound, err)
+	}
+}
+
 func TestSyncAll(t *testing.T) {
 	testWithInitDB(t, testSyncAll)
 }
@@ -716,10 +1362,10 @@ func testSyncAll(t *testing.T, db *sql.DB) {
 	verifyTables(t, db, map[string]int{
 		"feeds":           feeds,
 		"items":           items,
-		"sqlite_sequence": 1,
+		"sqlite_sequence": 2,
 	})
 
-	results, err := syncAll(db)
+	results, err := syncAll(db, nil, nil)
 	if err != nil {
 		t.Fatalf("syncAll returned error %q", err)
 	}
@@ -751,7 +1397,7 @@ func testSyncAll(t *testing.T, db *sql.DB) {
 	verifyTables(t, db, map[string]int{
 		"feeds":           feeds,
 		"items":           items,
-		"sqlite_sequence": 1,
+		"sqlite_sequence": 2,
 	})
 }
 
@@ -1307,7 +1953,14 @@ func testDefaultFeedTemplate(t *testing.T, db *sql.DB) {
 		"Why We Eat":            0,
 	}
 
-	for name, unplayed := range feeds {
+	// Add the feeds in a fixed order so that their IDs are
+	// predictable.
+	names := mapKeys(feeds)
+	sort.Strings(names)
+
+	for _, name := range names {
+
+		unplayed := feeds[name]
 
 		id, err := saveFeed(db, allTestCases[name].NewFeed(), time.Now())
 		if err != nil {
@@ -1337,7 +1990,7 @@ func testDefaultFeedTemplate(t *testing.T, db *sql.DB) {
 
       1. Crooked Conversations
          Crooked Media
-         1 item, 1 unplayed (updated Today)`,
+         1 item, 1 unplayed (updated Today) | ID: 1`,
 		},
 		{
 			Opts: listFeedOptions{
@@ -1347,11 +2000,11 @@ func testDefaultFeedTemplate(t *testing.T, db *sql.DB) {
 
       1. Homecoming
          Gimlet
-         13 items (updated over a month ago)
+         13 items (updated over a month ago) | ID: 2
 
       2. Why We Eat What We Eat
          Blue Apron / Gimlet Creative
-         0 items`,
+         0 items | ID: 4`,
 		},
 		{
 			Opts: listFeedOptions{
@@ -1361,34 +2014,34 @@ func testDefaultFeedTemplate(t *testing.T, db *sql.DB) {
 
       1. Crooked Conversations
          Crooked Media
-         One side effect of our national addiction to Trump’s tweets and
-         other news cycle garbage is that fascinating issues, brilliant books
-         and important debates aren't getting the attention they deserve. With
-         a rotating crew of your favorite Crooked Media hosts, contributors,
-         and special guests, Crooked Conversations brings Pod Save America's
+         One side effect of our national addiction to Trump’s tweets and other
+         news cycle garbage is that fascinating issues, brilliant books and
+         important debates aren't getting the attention they deserve. With a
+         rotating crew of your favorite Crooked Media hosts, contributors, and
+         special guests, Crooked Conversations brings Pod Save America's
          no-b.s., conversational style to topics in politics, media, culture,
          sports, and technology that aren’t making headlines but still have a
          major impact on our world.
-         1 item, 1 unplayed (updated Today)
+         1 item, 1 unplayed (updated Today) | ID: 1
 
       2. REWORK
          Basecamp
          A podcast by Basecamp about a better way to work and run your
          business. We bring you stories and unconventional wisdom from
          Basecamp’s co-founders and other business owners.
-         5 items, 2 unplayed (updated 8 days ago)
+         5 items, 2 unplayed (updated 8 days ago) | ID: 3
 
       3. Homecoming
          Gimlet
          A new psychological thriller from Gimlet Media, starring Catherine
          Keener, Oscar Isaac, and David Schwimmer.
-         13 items (updated over a month ago)
+         13 items (updated over a month ago) | ID: 2
 
       4. Why We Eat What We Eat
          Blue Apron / Gimlet Creative
          A podcast from Blue Apron and Gimlet Creative for anyone who has ever
          eaten.
-         0 items`,
+         0 items | ID: 4`,
 		},
 	}
 
@@ -1905,7 +2558,7 @@ func testListItems(t *testing.T, db *sql.DB) {
 
 			w := &bytes.Buffer{}
 
-			err := listItems(db, w, tmpl, test.Opts[i])
+			err := listItems(db, &Env{Stdout: w}, tmpl, test.Opts[i])
 			if err != nil {
 				t.Fatalf("%s: listItems returned error %q", test.Name, err)
 			}
@@ -1967,7 +2620,7 @@ func testDefaultListTemplate(t *testing.T, db *sql.DB) {
 
     * 1. Étude in Black
          From Columbo, Today
-         Duration: 1h38m`,
+         Duration: 1h38m | ID: 1`,
 		},
 		{
 			Opts: listItemOptions{
@@ -1980,11 +2633,11 @@ func testDefaultListTemplate(t *testing.T, db *sql.DB) {
 
       1. Dead Weight
          From Columbo, Date unknown
-         Duration: 1h13m
+         Duration: 1h13m | ID: 10
 
       2. Ransom for a Dead Man
          From Columbo, Today
-         Duration: Unknown`,
+         Duration: Unknown | ID: 8`,
 		},
 		{
 			Opts: listItemOptions{
@@ -1997,15 +2650,15 @@ func testDefaultListTemplate(t *testing.T, db *sql.DB) {
 
       1. Prescription: Murder
          From Columbo, in 1968
-         Duration: Unknown
+         Duration: Unknown | ID: 9
 
       2. Murder by the Book
          From Columbo, over 4 months ago
-         Duration: 1h13m
+         Duration: 1h13m | ID: 7
 
     * 3. Blueprint for Murder
          From Columbo, 4 days ago
-         Duration: 1h13m`,
+         Duration: 1h13m | ID: 2`,
 		},
 		{
 			Opts: listItemOptions{
@@ -2019,15 +2672,15 @@ func testDefaultListTemplate(t *testing.T, db *sql.DB) {
 
       1. Prescription: Murder
          Released in 1968
-         Duration: Unknown
+         Duration: Unknown | ID: 9
 
       2. Murder by the Book
          Released over 4 months ago
-         Duration: 1h13m
+         Duration: 1h13m | ID: 7
 
     * 3. Blueprint for Murder
          Released 4 days ago
-         Duration: 1h13m`,
+         Duration: 1h13m | ID: 2`,
 		},
 		{
 			Opts: listItemOptions{
@@ -2046,7 +2699,7 @@ func testDefaultListTemplate(t *testing.T, db *sql.DB) {
          Foch) and persuades his mistress Joan Hudson (Katherine Justice), who
          is an actress and one of his patients, to support his alibi by
          impersonating her.
-         Duration: Unknown
+         Duration: Unknown | ID: 9
 
       2. Murder by the Book
          Released over 4 months ago
@@ -2058,11 +2711,11 @@ func testDefaultListTemplate(t *testing.T, db *sql.DB) {
          convinces Ferris to call home and say he's working late at the office.
          During the call, Franklin shoots Ferris, then takes his body back
          north and dumps it on his lawn.
-         Duration: 1h13m
+         Duration: 1h13m | ID: 7
 
     * 3. Blueprint for Murder
          Released 4 days ago
-         Duration: 1h13m`,
+         Duration: 1h13m | ID: 2`,
 		},
 	}
 
@@ -2074,7 +2727,7 @@ func testDefaultListTemplate(t *testing.T, db *sql.DB) {
 		tmpl := defaultItemTemplate(test.Now)
 
 		wgot := &bytes.Buffer{}
-		err := listItems(db, wgot, tmpl, test.Opts)
+		err := listItems(db, &Env{Stdout: wgot}, tmpl, test.Opts)
 		if err != nil {
 			t.Fatalf("listItems returned error %q", err)
 		}
@@ -2191,289 +2844,822 @@ func testUpdateFeedNoFeed(t *testing.T, db *sql.DB) {
 	if err := updateFeed(db, 1, values); !equalErrors(exp, err) {
 		t.Errorf("Expected updateFeed to return error %q, got %v", exp, err)
 	}
-}
-
-func TestLoadFeedURL(t *testing.T) {
-	testWithInitDB(t, testLoadFeedURL)
-}
+}
+
+func TestLoadFeedURL(t *testing.T) {
+	testWithInitDB(t, testLoadFeedURL)
+}
+
+func testLoadFeedURL(t *testing.T, db *sql.DB) {
+
+	now := time.Now()
+	for name, test := range allTestCases {
+
+		feed := test.NewFeed()
+
+		id, err := saveFeed(db, feed, now)
+		if err != nil {
+			t.Fatalf("%s: saveFeed returned error %q", name, err)
+		}
+
+		m := map[target]string{
+			targetFeed:  feed.URL,
+			targetImage: feed.Image,
+			targetLink:  feed.Link,
+		}
+
+		for target, exp := range m {
+
+			url, err := loadFeedURL(db, id, target)
+			if err != nil {
+				t.Fatalf("%s: loadFeedURL %v returned error %q", name, target, err)
+			}
+
+			if url != exp {
+				t.Errorf("%s: expected loadFeedURL to return %q, got %q", name, exp, url)
+			}
+		}
+	}
+}
+
+func TestLoadFeedURLNoFeeds(t *testing.T) {
+	testWithInitDB(t, testLoadFeedURLNoFeeds)
+}
+
+func testLoadFeedURLNoFeeds(t *testing.T, db *sql.DB) {
+	if _, err := loadFeedURL(db, 1, targetFeed); err != errNoFeedFound {
+		t.Errorf("Expected loadFeedURL to return error %v, got %v", errNoFeedFound, err)
+	}
+}
+
+func TestExportList(t *testing.T) {
+	testWithInitDB(t, testExportList)
+}
+
+func testExportList(t *testing.T, db *sql.DB) {
+
+	now := time.Now()
+	urls := make([]string, 0, len(allTestCases))
+
+	for name, test := range allTestCases {
+
+		feed := test.NewFeed()
+		urls = append(urls, feed.URL)
+
+		_, err := saveFeed(db, feed, now)
+		if err != nil {
+			t.Fatalf("%s: saveFeed returned error %s", name, err)
+		}
+	}
+
+	sort.Slice(urls, func(i, j int) bool {
+		return strings.ToLower(urls[i]) < strings.ToLower(urls[j])
+	})
+
+	wexp := &bytes.Buffer{}
+	for _, s := range urls {
+		fmt.Fprintln(wexp, s)
+	}
+
+	wgot := &bytes.Buffer{}
+	if err := exportList(db, wgot); err != nil {
+		t.Fatalf("exportList returned error %q", err)
+	}
+
+	if got, exp := wgot.String(), wexp.String(); got != exp {
+		t.Errorf("Expected exportList to write %q, got %q", exp, got)
+	}
+}
+
+func TestExportListNoFeeds(t *testing.T) {
+	testWithInitDB(t, testExportListNoFeeds)
+}
+
+func testExportListNoFeeds(t *testing.T, db *sql.DB) {
+
+	exp := errors.New("no feeds to export")
+
+	if got := exportList(db, ioutil.Discard); !equalErrors(exp, got) {
+		t.Fatalf("expected exportList to return error %q, got %v", exp, got)
+	}
+}
+
+func TestExportOPML(t *testing.T) {
+	testWithInitDB(t, testExportOPML)
+}
+
+func testExportOPML(t *testing.T, db *sql.DB) {
+
+	now := time.Now()
+	entries := make([]*kibner.Feed, 0, len(allTestCases))
+
+	for name, test := range allTestCases {
+
+		feed := test.NewFeed()
+		entries = append(entries, feed)
+
+		_, err := saveFeed(db, feed, now)
+		if err != nil {
+			t.Fatalf("%s: saveFeed returned error %s", name, err)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		x, y := entries[i], entries[j]
+		if strings.ToLower(x.Title) == strings.ToLower(y.Title) {
+			return strings.ToLower(x.URL) < strings.ToLower(y.URL)
+		}
+		return strings.ToLower(x.Title) < strings.ToLower(y.Title)
+	})
+
+	wexp := &bytes.Buffer{}
+	writeOPMLHeader(t, wexp, now)
+	for _, e := range entries {
+		writeOPMLFeed(t, wexp, e)
+	}
+	writeOPMLFooter(t, wexp)
+
+	wgot := &bytes.Buffer{}
+	if err := exportOPML(db, wgot, now); err != nil {
+		t.Fatalf("exportOPML returned error %q", err)
+	}
+
+	if got, exp := wgot.String(), wexp.String(); got != exp {
+		t.Errorf("Expected exportOPML to write %q, got %q", exp, got)
+	}
+}
+
+func TestExportOPMLNoFeeds(t *testing.T) {
+	testWithInitDB(t, testExportOPMLNoFeeds)
+}
+
+func testExportOPMLNoFeeds(t *testing.T, db *sql.DB) {
+
+	exp := errors.New("no feeds to export")
+
+	if got := exportOPML(db, ioutil.Discard, time.Now()); !equalErrors(exp, got) {
+		t.Fatalf("expected exportOPML to return error %q, got %v", exp, got)
+	}
+}
+
+func TestExtractURLsList(t *testing.T) {
+
+	w := &bytes.Buffer{}
+	urls := make([]string, 0, len(allTestCases))
+
+	fmt.Fprintln(w, "#", len(allTestCases), "Feed URLs")
+	fmt.Fprintln(w)
+
+	for _, test := range allTestCases {
+
+		url := test.NewFeed().URL
+		urls = append(urls, url)
+
+		for i := 0; i <= rand.Intn(2); i++ {
+			fmt.Fprint(w, strings.Repeat(" ", 1+rand.Intn(5)))
+			fmt.Fprintln(w, url)
+		}
+
+		switch {
+		case len(urls)%3 == 0:
+			fmt.Fprintln(w)
+		case len(urls)%5 == 0:
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, "# Comment")
+			fmt.Fprintln(w)
+		}
+	}
+
+	fmt.Fprintln(w, "  ://invalid-url.com")
+
+	got, err := extractURLsList(w)
+	if err != nil {
+		t.Fatalf("extractURLsList returned error %q", err)
+	}
+
+	if !equalStringSlices(got, urls) {
+		t.Errorf("expected extractURLsList to return urls %s, got %s", jsonify(urls), jsonify(got))
+	}
+}
+
+func TestExtractURLsOPML(t *testing.T) {
+
+	w := &bytes.Buffer{}
+	urls := make([]string, 0, len(allTestCases))
+
+	writeOPMLHeader(t, w, time.Now())
+
+	for _, test := range allTestCases {
+
+		feed := test.NewFeed()
+		urls = append(urls, feed.URL)
+
+		for i := 0; i <= rand.Intn(2); i++ {
+			writeOPMLEntry(t, w, feed.Type, feed.Title, feed.Desc, feed.URL)
+		}
+	}
+
+	writeOPMLEntry(t, w, "rss", "Invalid URL", "This URL is invalid", "://invalid-url.com")
+	writeOPMLFooter(t, w)
+
+	got, _, err := extractURLsOPML(w)
+	if err != nil {
+		t.Fatalf("extractURLsOPML returned error %q", err)
+	}
+
+	if !equalStringSlices(got, urls) {
+		t.Errorf("expected extractURLsOPML to return urls %s, got %s", jsonify(urls), jsonify(got))
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	testWithInitDB(t, testExportJSON)
+}
+
+func testExportJSON(t *testing.T, db *sql.DB) {
+
+	now := time.Now()
+	feeds := map[string]*kibner.Feed{}
+
+	for _, name := range []string{"Serial", "Rework"} {
+
+		feed := allTestCases[name].NewFeed()
+		feeds[name] = feed
+
+		id, err := saveFeed(db, feed, now)
+		if err != nil {
+			t.Fatalf("%s: saveFeed returned error %q", name, err)
+		}
+
+		if name == "Serial" {
+			if err := tagFeed(db, id, []string{"true crime"}); err != nil {
+				t.Fatalf("tagFeed returned error %q", err)
+			}
+		}
+	}
+
+	w := &bytes.Buffer{}
+	if err := exportJSON(db, w); err != nil {
+		t.Fatalf("exportJSON returned error %q", err)
+	}
+
+	var views []feedView
+	if err := json.Unmarshal(w.Bytes(), &views); err != nil {
+		t.Fatalf("Unmarshal returned error %q", err)
+	}
+
+	// Sorted by title.
+	if len(views) != 2 {
+		t.Fatalf("expected exportJSON to write 2 feeds, got %d", len(views))
+	}
+	compareFeedView(t, feedViewFromFeed(feeds["Rework"]), &views[0])
+	compareFeedView(t, feedViewFromFeed(feeds["Serial"]), &views[1])
+
+	if format := detectFileFormat(w.Bytes()); format != fileFormatJSON {
+		t.Errorf("expected detectFileFormat to return %v, got %v", fileFormatJSON, format)
+	}
+
+	urls, details, err := extractURLsJSON(w)
+	if err != nil {
+		t.Fatalf("extractURLsJSON returned error %q", err)
+	}
+
+	expURLs := []string{feeds["Rework"].URL, feeds["Serial"].URL}
+	if !reflect.DeepEqual(urls, expURLs) {
+		t.Errorf("expected extractURLsJSON to return urls %s, got %s", jsonify(expURLs), jsonify(urls))
+	}
+
+	serial := feeds["Serial"]
+	expDetails := &importDetails{
+		Title: serial.Title,
+		Tags:  []string{"true crime"},
+		Link:  serial.Link,
+		Image: serial.Image,
+	}
+
+	if got := details[serial.URL]; !reflect.DeepEqual(got, expDetails) {
+		t.Errorf("expected extractURLsJSON to return details %s, got %s", jsonify(expDetails), jsonify(got))
+	}
+}
+
+func TestExportJSONNoFeeds(t *testing.T) {
+	testWithInitDB(t, testExportJSONNoFeeds)
+}
+
+func testExportJSONNoFeeds(t *testing.T, db *sql.DB) {
+
+	exp := errors.New("no feeds to export")
+
+	if got := exportJSON(db, ioutil.Discard); !equalErrors(exp, got) {
+		t.Fatalf("expected exportJSON to return error %q, got %v", exp, got)
+	}
+}
+
+func TestExtractURLsJSON(t *testing.T) {
+
+	// A single object is allowed. Feeds without URLs are
+	// skipped.
+	input := `{"URL": " http://example.com/feed.xml ", "Title": "Example", "Tags": ["news", " / "]}`
+
+	urls, details, err := extractURLsJSON(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("extractURLsJSON returned error %q", err)
+	}
+
+	if exp := []string{"http://example.com/feed.xml"}; !reflect.DeepEqual(urls, exp) {
+		t.Errorf("expected extractURLsJSON to return urls %s, got %s", jsonify(exp), jsonify(urls))
+	}
+
+	exp := &importDetails{
+		Title: "Example",
+		Tags:  []string{"news"},
+	}
+
+	if got := details["http://example.com/feed.xml"]; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected extractURLsJSON to return details %s, got %s", jsonify(exp), jsonify(got))
+	}
+
+	if _, _, err := extractURLsJSON(strings.NewReader("[{")); err == nil {
+		t.Errorf("expected extractURLsJSON to return an error for invalid JSON")
+	}
+}
+
+func TestDetectFileFormat(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Format fileFormat
+	}{
+		{
+			Input:  "http://example.com/feed.xml\n",
+			Format: fileFormatList,
+		},
+		{
+			Input:  "# Comment\nhttp://example.com/feed.xml\n",
+			Format: fileFormatList,
+		},
+		{
+			Input:  "",
+			Format: fileFormatList,
+		},
+		{
+			Input:  "\xef\xbb\xbf\n<?xml version=\"1.0\"?><opml></opml>",
+			Format: fileFormatOPML,
+		},
+		{
+			Input:  "  [{\"URL\": \"http://example.com/feed.xml\"}]",
+			Format: fileFormatJSON,
+		},
+		{
+			Input:  "{}",
+			Format: fileFormatJSON,
+		},
+	}
+
+	for _, test := range tests {
+		if got := detectFileFormat([]byte(test.Input)); got != test.Format {
+			t.Errorf("%q: expected detectFileFormat to return %v, got %v", test.Input, test.Format, got)
+		}
+	}
+}
+
+func TestExportFormatFromName(t *testing.T) {
+
+	tests := map[string]fileFormat{
+		"feeds.opml": fileFormatOPML,
+		"feeds.XML":  fileFormatOPML,
+		"feeds.json": fileFormatJSON,
+		"feeds.txt":  fileFormatList,
+		"feeds":      fileFormatList,
+		"-":          fileFormatList,
+	}
+
+	for name, exp := range tests {
+		if got := exportFormatFromName(name); got != exp {
+			t.Errorf("%s: expected exportFormatFromName to return %v, got %v", name, exp, got)
+		}
+	}
+}
+
+func TestAddCallbackTemplate(t *testing.T) {
+
+	N := 100
+	tmpl := template.Must(
+		template.New("test").Parse(`{{range .Values}}{{template "double" .}}{{end}}`),
+	)
+
+	values := make([]int, N)
+	for i := range values {
+		values[i] = rand.Intn(1000)
+	}
+
+	var results []int
+	double := func(i int) error {
+		results = append(results, i*2)
+		return nil
+	}
+
+	tmpl2, err := addCallbackTemplate(tmpl, "double", double)
+	if err != nil {
+		t.Fatalf("addCallbackTemplate returned error %q", err)
+	}
+
+	w := &bytes.Buffer{}
+	err = tmpl2.Execute(w, map[string]interface{}{
+		"Values": values,
+	})
+	if err != nil {
+		t.Fatalf("template.Execute returned error %q", err)
+	}
+
+	if w.String() != "" {
+		t.Errorf("Expected no output from template.Execute, got %q", w.String())
+	}
+
+	if len(results) != N {
+		t.Fatalf("Expected %d results, got %d", N, len(results))
+	}
+
+	for i := 0; i < N; i++ {
+		if results[i] != values[i]*2 {
+			t.Errorf("Expected results[%d] to be %d, got %d", i, values[i]*2, results[i])
+		}
+	}
+}
+
+func TestChooseFeeds(t *testing.T) {
+	testWithInitDB(t, testChooseFeeds)
+}
+
+func testChooseFeeds(t *testing.T, db *sql.DB) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	ids := map[string]int64{}
+
+	for _, filename := range []string{"serial.xml", "rework.xml", "uncivil.xml"} {
+		res, err := addFeed(db, nil, serverURL(ts, filename))
+		if err != nil {
+			t.Fatalf("addFeed returned error %q", err)
+		}
+		ids[res.Title] = res.ID
+	}
+
+	// "e" matches REWORK and Serial but not Uncivil.
+	tests := []struct {
+		Name    string
+		Choice  feedChoice
+		Input   string
+		NoInput bool
+		Titles  []string
+		Err     error
+	}{
+		{
+			Name:   "Single match",
+			Choice: feedChoice{Name: "serial"},
+			Titles: []string{"Serial"},
+		},
+		{
+			Name:   "Multiple matches",
+			Choice: feedChoice{Name: "e"},
+			Input:  "n\ny\n",
+			Titles: []string{"Serial"},
+		},
+		{
+			Name:   "Multiple matches, quit",
+			Choice: feedChoice{Name: "e"},
+			Input:  "q\n",
+			Err:    errNoFeedChosen,
+		},
+		{
+			Name:   "Multiple matches, yes",
+			Choice: feedChoice{Name: "e", Yes: true},
+			Err:    &ambiguousFeedError{},
+		},
+		{
+			Name:    "Multiple matches, no input",
+			Choice:  feedChoice{Name: "e"},
+			NoInput: true,
+			Err:     &ambiguousFeedError{},
+		},
+		{
+			Name:   "All matches",
+			Choice: feedChoice{Name: "e", All: true},
+			Titles: []string{"REWORK", "Serial"},
+		},
+		{
+			Name:   "All matches, confirm",
+			Choice: feedChoice{Name: "e", All: true, Confirm: true},
+			Input:  "y\nn\n",
+			Titles: []string{"REWORK"},
+		},
+		{
+			Name:    "All matches, confirm, yes",
+			Choice:  feedChoice{Name: "e", All: true, Confirm: true, Yes: true},
+			NoInput: true,
+			Titles:  []string{"REWORK", "Serial"},
+		},
+		{
+			Name:    "Single match, confirm, no input",
+			Choice:  feedChoice{Name: "serial", Confirm: true},
+			NoInput: true,
+			Err:     errNoInput,
+		},
+		{
+			Name:    "Single match, confirm, yes",
+			Choice:  feedChoice{Name: "serial", Confirm: true, Yes: true},
+			NoInput: true,
+			Titles:  []string{"Serial"},
+		},
+		{
+			Name:   "Exact, no match",
+			Choice: feedChoice{Name: "seria", Exact: true},
+			Err:    errNoFeedFound,
+		},
+		{
+			Name:   "Exact, match",
+			Choice: feedChoice{Name: "SERIAL", Exact: true},
+			Titles: []string{"Serial"},
+		},
+		{
+			Name:    "ID",
+			Choice:  feedChoice{ID: ids["Uncivil"]},
+			NoInput: true,
+			Titles:  []string{"Uncivil"},
+		},
+		{
+			Name:   "ID, no match",
+			Choice: feedChoice{ID: 999},
+			Err:    errNoFeedFound,
+		},
+	}
 
-func testLoadFeedURL(t *testing.T, db *sql.DB) {
+	for _, test := range tests {
 
-	now := time.Now()
-	for name, test := range allTestCases {
+		env := &Env{
+			Stdin:   strings.NewReader(test.Input),
+			Stdout:  ioutil.Discard,
+			NoInput: test.NoInput,
+		}
 
-		feed := test.NewFeed()
+		got, err := chooseFeeds(db, env, test.Choice, "Choose %s")
 
-		id, err := saveFeed(db, feed, now)
-		if err != nil {
-			t.Fatalf("%s: saveFeed returned error %q", name, err)
+		if _, ok := test.Err.(*ambiguousFeedError); ok {
+			if _, ok := err.(*ambiguousFeedError); !ok {
+				t.Errorf("%s: Expected chooseFeeds to return an ambiguousFeedError, got %v", test.Name, err)
+			}
+			continue
 		}
 
-		m := map[target]string{
-			targetFeed:  feed.URL,
-			targetImage: feed.Image,
-			targetLink:  feed.Link,
+		if err != test.Err {
+			t.Errorf("%s: Expected chooseFeeds to return error %v, got %v", test.Name, test.Err, err)
+			continue
 		}
 
-		for target, exp := range m {
-
-			url, err := loadFeedURL(db, id, target)
-			if err != nil {
-				t.Fatalf("%s: loadFeedURL %v returned error %q", name, target, err)
-			}
+		var exp []int64
+		for _, title := range test.Titles {
+			exp = append(exp, ids[title])
+		}
 
-			if url != exp {
-				t.Errorf("%s: expected loadFeedURL to return %q, got %q", name, exp, url)
-			}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("%s: Expected chooseFeeds to return IDs %v, got %v", test.Name, exp, got)
 		}
 	}
 }
 
-func TestLoadFeedURLNoFeeds(t *testing.T) {
-	testWithInitDB(t, testLoadFeedURLNoFeeds)
-}
+func TestAmbiguousFeedError(t *testing.T) {
 
-func testLoadFeedURLNoFeeds(t *testing.T, db *sql.DB) {
-	if _, err := loadFeedURL(db, 1, targetFeed); err != errNoFeedFound {
-		t.Errorf("Expected loadFeedURL to return error %v, got %v", errNoFeedFound, err)
+	err := &ambiguousFeedError{
+		Name: "e",
+		Feeds: []feedMatch{
+			{ID: 2, Title: "REWORK"},
+			{ID: 1, Title: "Serial"},
+		},
 	}
-}
-
-func TestExportList(t *testing.T) {
-	testWithInitDB(t, testExportList)
-}
-
-func testExportList(t *testing.T, db *sql.DB) {
-
-	now := time.Now()
-	urls := make([]string, 0, len(allTestCases))
 
-	for name, test := range allTestCases {
-
-		feed := test.NewFeed()
-		urls = append(urls, feed.URL)
+	exp := `"e" matches 2 feeds:
+     2  REWORK
+     1  Serial
+Use --id or --exact to choose one, or --all-matches to choose them all`
 
-		_, err := saveFeed(db, feed, now)
-		if err != nil {
-			t.Fatalf("%s: saveFeed returned error %s", name, err)
-		}
+	if got := err.Error(); got != exp {
+		t.Errorf("Expected error %q, got %q", exp, got)
 	}
+}
 
-	sort.Slice(urls, func(i, j int) bool {
-		return strings.ToLower(urls[i]) < strings.ToLower(urls[j])
-	})
+func TestSelectItems(t *testing.T) {
 
-	wexp := &bytes.Buffer{}
-	for _, s := range urls {
-		fmt.Fprintln(wexp, s)
+	items := []itemView{
+		{url: "url1", guid: "guid1"},
+		{url: "url2", guid: "guid2"},
+		{url: "url3", guid: "guid3"},
+		{url: "url4", guid: "1"},
 	}
 
-	wgot := &bytes.Buffer{}
-	if err := exportList(db, wgot); err != nil {
-		t.Fatalf("exportList returned error %q", err)
+	tests := []struct {
+		Selectors []string
+		URLs      []string
+		Err       string
+	}{
+		{
+			Selectors: []string{"2", "3"},
+			URLs:      []string{"url2", "url3"},
+		},
+		{
+			// GUIDs take precedence over positions.
+			Selectors: []string{"1"},
+			URLs:      []string{"url4"},
+		},
+		{
+			Selectors: []string{"#1", "#3"},
+			URLs:      []string{"url1", "url3"},
+		},
+		{
+			Selectors: []string{"guid2", "#1"},
+			URLs:      []string{"url2", "url1"},
+		},
+		{
+			Selectors: []string{"0"},
+			Err:       "no item 0 in the list",
+		},
+		{
+			Selectors: []string{"5"},
+			Err:       "no item 5 in the list",
+		},
+		{
+			Selectors: []string{"guid4"},
+			Err:       "no item with GUID guid4 in the list",
+		},
 	}
 
-	if got, exp := wgot.String(), wexp.String(); got != exp {
-		t.Errorf("Expected exportList to write %q, got %q", exp, got)
-	}
-}
+	for _, test := range tests {
 
-func TestExportListNoFeeds(t *testing.T) {
-	testWithInitDB(t, testExportListNoFeeds)
-}
+		selected, err := selectItems(items, test.Selectors)
 
-func testExportListNoFeeds(t *testing.T, db *sql.DB) {
+		if test.Err != "" {
+			if err == nil || err.Error() != test.Err {
+				t.Errorf("%v: Expected selectItems to return error %q, got %v", test.Selectors, test.Err, err)
+			}
+			continue
+		}
 
-	exp := errors.New("no feeds to export")
+		if err != nil {
+			t.Errorf("%v: selectItems returned error %q", test.Selectors, err)
+			continue
+		}
 
-	if got := exportList(db, ioutil.Discard); !equalErrors(exp, got) {
-		t.Fatalf("expected exportList to return error %q, got %v", exp, got)
+		var urls []string
+		for _, item := range selected {
+			urls = append(urls, item.url)
+		}
+
+		if !reflect.DeepEqual(urls, test.URLs) {
+			t.Errorf("%v: Expected selectItems to return %v, got %v", test.Selectors, test.URLs, urls)
+		}
 	}
 }
 
-func TestExportOPML(t *testing.T) {
-	testWithInitDB(t, testExportOPML)
-}
+// itemIDByURL returns the ID of the item with the given URL.
+func itemIDByURL(t *testing.T, db *sql.DB, url string) int64 {
 
-func testExportOPML(t *testing.T, db *sql.DB) {
+	var id int64
 
-	type entry struct {
-		Type  string
-		Title string
-		Desc  string
-		URL   string
+	if err := db.QueryRow("SELECT id FROM items WHERE url = ?", url).Scan(&id); err != nil {
+		t.Fatalf("Error loading item ID for %s: %s", url, err)
 	}
 
-	now := time.Now()
-	entries := make([]entry, 0, len(allTestCases))
+	return id
+}
 
-	for name, test := range allTestCases {
+func TestLoadItemsByID(t *testing.T) {
+	testWithInitDB(t, testLoadItemsByID)
+}
 
-		feed := test.NewFeed()
-		entries = append(entries, entry{
-			Type:  feed.Type,
-			Title: feed.Title,
-			Desc:  feed.Desc,
-			URL:   feed.URL,
-		})
+func testLoadItemsByID(t *testing.T, db *sql.DB) {
 
-		_, err := saveFeed(db, feed, now)
-		if err != nil {
-			t.Fatalf("%s: saveFeed returned error %s", name, err)
-		}
+	feed := allTestCases["Columbo"].NewFeed()
+
+	if _, err := saveFeed(db, feed, time.Now()); err != nil {
+		t.Fatalf("saveFeed returned error %q", err)
 	}
 
-	sort.Slice(entries, func(i, j int) bool {
-		x, y := entries[i], entries[j]
-		if strings.ToLower(x.Title) == strings.ToLower(y.Title) {
-			return strings.ToLower(x.URL) < strings.ToLower(y.URL)
-		}
-		return strings.ToLower(x.Title) < strings.ToLower(y.Title)
-	})
+	items, err := loadItemsByID(db, []int64{3, 1})
+	if err != nil {
+		t.Fatalf("loadItemsByID returned error %q", err)
+	}
 
-	wexp := &bytes.Buffer{}
-	writeOPMLHeader(t, wexp, now)
-	for _, e := range entries {
-		writeOPMLEntry(t, wexp, e.Type, e.Title, e.Desc, e.URL)
+	if len(items) != 2 {
+		t.Fatalf("Expected loadItemsByID to return 2 items, got %d", len(items))
 	}
-	writeOPMLFooter(t, wexp)
 
-	wgot := &bytes.Buffer{}
-	if err := exportOPML(db, wgot, now); err != nil {
-		t.Fatalf("exportOPML returned error %q", err)
+	for i, exp := range []*kibner.Item{feed.Items[2], feed.Items[0]} {
+		if items[i].Title != exp.Title || items[i].url != exp.URL {
+			t.Errorf("Expected item %d to be %q, got %q", i, exp.Title, items[i].Title)
+		}
 	}
 
-	if got, exp := wgot.String(), wexp.String(); got != exp {
-		t.Errorf("Expected exportOPML to write %q, got %q", exp, got)
+	exp := errors.New("no item with ID 999")
+	if _, err := loadItemsByID(db, []int64{1, 999}); !equalErrors(exp, err) {
+		t.Errorf("Expected loadItemsByID to return error %q, got %v", exp, err)
 	}
 }
 
-func TestExportOPMLNoFeeds(t *testing.T) {
-	testWithInitDB(t, testExportOPMLNoFeeds)
+func TestUpdatePlayedStatus(t *testing.T) {
+	testWithInitDB(t, testUpdatePlayedStatus)
 }
 
-func testExportOPMLNoFeeds(t *testing.T, db *sql.DB) {
-
-	exp := errors.New("no feeds to export")
+func testUpdatePlayedStatus(t *testing.T, db *sql.DB) {
 
-	if got := exportOPML(db, ioutil.Discard, time.Now()); !equalErrors(exp, got) {
-		t.Fatalf("expected exportOPML to return error %q, got %v", exp, got)
+	// Two items that share a URL.
+	feed := &kibner.Feed{
+		Title: "Reruns",
+		URL:   "http://example.com/feed.xml",
+		Items: []*kibner.Item{
+			{Title: "First airing", URL: "http://example.com/1.mp3", GUID: "1", Pubdate: time.Now()},
+			{Title: "Rerun", URL: "http://example.com/1.mp3", GUID: "2", Pubdate: time.Now()},
+		},
 	}
-}
-
-func TestExtractURLsList(t *testing.T) {
-
-	w := &bytes.Buffer{}
-	urls := make([]string, 0, len(allTestCases))
-
-	fmt.Fprintln(w, "#", len(allTestCases), "Feed URLs")
-	fmt.Fprintln(w)
-
-	for _, test := range allTestCases {
 
-		url := test.NewFeed().URL
-		urls = append(urls, url)
-
-		for i := 0; i <= rand.Intn(2); i++ {
-			fmt.Fprint(w, strings.Repeat(" ", 1+rand.Intn(5)))
-			fmt.Fprintln(w, url)
-		}
+	feedID, err := saveFeed(db, feed, time.Now())
+	if err != nil {
+		t.Fatalf("saveFeed returned error %q", err)
+	}
 
-		switch {
-		case len(urls)%3 == 0:
-			fmt.Fprintln(w)
-		case len(urls)%5 == 0:
-			fmt.Fprintln(w)
-			fmt.Fprintln(w, "# Comment")
-			fmt.Fprintln(w)
-		}
+	if err := updatePlayedStatus(db, nil, false, 2); err != nil {
+		t.Fatalf("updatePlayedStatus returned error %q", err)
 	}
 
-	fmt.Fprintln(w, "  ://invalid-url.com")
+	verifyUnplayedItemCount(t, db, feedID, 1)
 
-	got, err := extractURLsList(w)
+	items, err := loadItemViews(db, listItemOptions{Unplayed: true})
 	if err != nil {
-		t.Fatalf("extractURLsList returned error %q", err)
+		t.Fatalf("loadItemViews returned error %q", err)
 	}
 
-	if !equalStringSlices(got, urls) {
-		t.Errorf("expected extractURLsList to return urls %s, got %s", jsonify(urls), jsonify(got))
+	if len(items) != 1 || items[0].Title != "Rerun" {
+		t.Errorf("Expected only the rerun to be unplayed, got %v", items)
 	}
 }
 
-func TestExtractURLsOPML(t *testing.T) {
-
-	w := &bytes.Buffer{}
-	urls := make([]string, 0, len(allTestCases))
-
-	writeOPMLHeader(t, w, time.Now())
+func TestShowItem(t *testing.T) {
+	testWithInitDB(t, testShowItem)
+}
 
-	for _, test := range allTestCases {
+func testShowItem(t *testing.T, db *sql.DB) {
 
-		feed := test.NewFeed()
-		urls = append(urls, feed.URL)
+	feed := allTestCases["Columbo"].NewFeed()
 
-		for i := 0; i <= rand.Intn(2); i++ {
-			writeOPMLEntry(t, w, feed.Type, feed.Title, feed.Desc, feed.URL)
-		}
-	}
+	item := feed.Items[0]
+	item.Type = "audio/mpeg"
+	item.RawDesc = `<p>Alex Benedict (<a href="https://www.imdb.com/name/nm0001023/">John Cassavetes</a>), the married conductor of the Los Angeles Philharmonic Orchestra, murders his mistress.</p>
+<p>Guest star: <a href="https://www.imdb.com/name/nm0174007/">Anjanette Comer</a><br/>Episode guide: <a href="http://www.columbopodcast.com">http://www.columbopodcast.com</a></p>`
 
-	writeOPMLEntry(t, w, "rss", "Invalid URL", "This URL is invalid", "://invalid-url.com")
-	writeOPMLFooter(t, w)
+	added := time.Date(2018, time.March, 5, 19, 15, 0, 0, time.UTC)
 
-	got, err := extractURLsOPML(w)
-	if err != nil {
-		t.Fatalf("extractURLsOPML returned error %q", err)
+	if _, err := saveFeed(db, feed, added); err != nil {
+		t.Fatalf("saveFeed returned error %q", err)
 	}
 
-	if !equalStringSlices(got, urls) {
-		t.Errorf("expected extractURLsOPML to return urls %s, got %s", jsonify(urls), jsonify(got))
+	now := time.Date(1972, time.September, 18, 10, 30, 0, 0, time.UTC)
+	date := func(t time.Time) string {
+		return t.Local().Format("Mon Jan 2, 2006 15:04")
 	}
-}
 
-func TestAddCallbackTemplate(t *testing.T) {
+	exp := `Étude in Black
+From Columbo
 
-	N := 100
-	tmpl := template.Must(
-		template.New("test").Parse(`{{range .Values}}{{template "double" .}}{{end}}`),
-	)
+ID:       1
+Released: ` + date(item.Pubdate) + ` (Today)
+Duration: 1h38m
+Played:   Yes
+Size:     82.6 MB
+Added:    ` + date(added) + `
+URL:      ` + item.URL + `
+Type:     audio/mpeg
+GUID:     ` + item.GUID + `
 
-	values := make([]int, N)
-	for i := range values {
-		values[i] = rand.Intn(1000)
-	}
+Alex Benedict (John Cassavetes [1]), the married conductor of the Los
+Angeles Philharmonic Orchestra, murders his mistress.
 
-	var results []int
-	double := func(i int) error {
-		results = append(results, i*2)
-		return nil
-	}
+Guest star: Anjanette Comer [2]
+Episode guide: http://www.columbopodcast.com
 
-	tmpl2, err := addCallbackTemplate(tmpl, "double", double)
-	if err != nil {
-		t.Fatalf("addCallbackTemplate returned error %q", err)
-	}
+[1] https://www.imdb.com/name/nm0001023/
+[2] https://www.imdb.com/name/nm0174007/
+`
 
 	w := &bytes.Buffer{}
-	err = tmpl2.Execute(w, map[string]interface{}{
-		"Values": values,
-	})
-	if err != nil {
-		t.Fatalf("template.Execute returned error %q", err)
+	if err := showItem(db, w, defaultShowTemplate(now), 1); err != nil {
+		t.Fatalf("showItem returned error %q", err)
 	}
 
-	if w.String() != "" {
-		t.Errorf("Expected no output from template.Execute, got %q", w.String())
-	}
-
-	if len(results) != N {
-		t.Fatalf("Expected %d results, got %d", N, len(results))
+	if got := w.String(); got != exp {
+		t.Errorf("Expected showItem to output %q, got %q", exp, got)
 	}
 
-	for i := 0; i < N; i++ {
-		if results[i] != values[i]*2 {
-			t.Errorf("Expected results[%d] to be %d, got %d", i, values[i]*2, results[i])
-		}
+	if err := showItem(db, w, defaultShowTemplate(now), 999); err == nil {
+		t.Errorf("Expected showItem to return an error for a missing item")
 	}
 }
 
@@ -2520,8 +3706,30 @@ func verifySequenceNumbers(t *testing.T, db *sql.DB, seqnos map[string]int64) {
 	}
 }
 
+// emptyTables lists the tables that initDB creates but which
+// most tests never write to. verifyTables expects them to be
+// empty unless told otherwise.
+var emptyTables = []string{
+	"feed_tags",
+	"feed_schedules",
+	"hooks",
+	"gpodder_state",
+	"gpodder_subscriptions",
+}
+
 func verifyTables(t *testing.T, db *sql.DB, tables map[string]int) {
 
+	if tables != nil {
+		all := make(map[string]int, len(tables)+len(emptyTables))
+		for _, name := range emptyTables {
+			all[name] = 0
+		}
+		for name, count := range tables {
+			all[name] = count
+		}
+		tables = all
+	}
+
 	got := getTableNames(t, db)
 
 	if len(got) != len(tables) {
@@ -2666,6 +3874,18 @@ func verifyForeignKeys(t *testing.T, db *sql.DB, tableName string, exp []sqlitem
 	}
 }
 
+func verifySchemaVersion(t *testing.T, db *sql.DB, version int) {
+
+	var got int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&got); err != nil {
+		t.Fatalf("Error querying user_version: %s", err)
+	}
+
+	if got != version {
+		t.Errorf("Expected schema version %d, got %d", version, got)
+	}
+}
+
 func verifyForeignKeysEnabled(t *testing.T, db *sql.DB, enabled bool) {
 	if got := getForeignKeysEnabled(t, db); got != enabled {
 		t.Errorf("Expected foreign keys enabled to be %v, got %v", enabled, got)
@@ -3109,13 +4329,44 @@ func writeOPMLEntry(t *testing.T, w io.Writer, typ, title, desc, url string) {
 	xml.EscapeText(w, []byte(title))
 	fmt.Fprint(w, `" title="`)
 	xml.EscapeText(w, []byte(title))
-	fmt.Fprint(w, `" description="`)
-	xml.EscapeText(w, []byte(desc))
+	if desc != "" {
+		fmt.Fprint(w, `" description="`)
+		xml.EscapeText(w, []byte(desc))
+	}
 	fmt.Fprint(w, `" xmlUrl="`)
 	xml.EscapeText(w, []byte(url))
 	fmt.Fprintln(w, `"></outline>`)
 }
 
+// writeOPMLFeed writes an outline element with every attribute
+// that exportOPML writes for a feed.
+func writeOPMLFeed(t *testing.T, w io.Writer, feed *kibner.Feed) {
+
+	fmt.Fprint(w, `        <outline`)
+
+	for _, attr := range []struct {
+		Name, Value string
+	}{
+		{"type", feed.Type},
+		{"text", feed.Title},
+		{"title", feed.Title},
+		{"description", feed.Desc},
+		{"xmlUrl", feed.URL},
+		{"htmlUrl", feed.Link},
+		{"imageUrl", feed.Image},
+		{"language", feed.Language},
+	} {
+		if attr.Value == "" && attr.Name != "text" {
+			continue
+		}
+		fmt.Fprintf(w, ` %s="`, attr.Name)
+		xml.EscapeText(w, []byte(attr.Value))
+		fmt.Fprint(w, `"`)
+	}
+
+	fmt.Fprintln(w, `></outline>`)
+}
+
 func equalErrors(exp, got error) bool {
 
 	switch {
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Feeds come from servers we don't control, so fetchGoFeed
+// checks them before and after parsing. A feed is rejected if:
+//
+// - it's served as something other than XML, e.g. an HTML page
+// - it's larger than MaxFeedSize once decompressed
+// - it declares its own XML entities (the basis of "billion
+//   laughs" attacks)
+// - its elements are nested more than MaxFeedDepth deep
+// - it has more than MaxFeedItems items
+//
+// Redirects and itunes:new-feed-url links are followed at most
+// MaxRedirects and MaxFeedHops times respectively.
+
+// checkContentType rejects responses that can't be feeds.
+// Misconfigured servers often serve feeds as plain text or
+// generic binary data, so those are allowed, as are responses
+// with no content type at all.
+func checkContentType(header http.Header) error {
+	return checkMediaType(header, "an RSS or Atom feed", isXMLMediaType)
+}
+
+// checkImportContentType is checkContentType for the files
+// that the import command fetches, which can also be JSON or
+// OPML.
+func checkImportContentType(header http.Header) error {
+	return checkMediaType(header, "an OPML, JSON or text file", func(mediatype string) bool {
+		switch {
+		case mediatype == "text/x-opml", mediatype == "application/json", strings.HasSuffix(mediatype, "+json"):
+			return true
+		default:
+			return isXMLMediaType(mediatype)
+		}
+	})
+}
+
+func checkMediaType(header http.Header, expected string, allowed func(string) bool) error {
+
+	ct := header.Get("Content-Type")
+	if ct == "" {
+		return nil
+	}
+
+	mediatype, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return errors.New("bad content type: " + strconv.Quote(ct))
+	}
+
+	switch {
+	case mediatype == "text/plain", mediatype == "application/octet-stream":
+		return nil
+	case allowed(mediatype):
+		return nil
+	default:
+		return errors.New("bad content type: " + mediatype + " (expected " + expected + ")")
+	}
+}
+
+func isXMLMediaType(mediatype string) bool {
+	return strings.HasSuffix(mediatype, "/xml") || strings.HasSuffix(mediatype, "+xml")
+}
+
+// readFeed reads a feed into memory, up to the maximum feed
+// size.
+func readFeed(r io.Reader) ([]byte, error) {
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, defaults.MaxFeedSize+1))
+	if err != nil {
+		return nil, errors.New("fetch error: " + err.Error())
+	}
+
+	if int64(len(data)) > defaults.MaxFeedSize {
+		return nil, errors.New("bad feed: larger than " + formatBytes(defaults.MaxFeedSize))
+	}
+
+	return data, nil
+}
+
+// checkFeedStructure rejects documents that declare entities
+// or nest elements too deeply. Syntax errors are left for the
+// feed parser to report.
+func checkFeedStructure(data []byte) error {
+
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	// Feeds often contain unescaped HTML, so void elements
+	// like <br> mustn't count towards the depth.
+	d.AutoClose = xml.HTMLAutoClose
+	// Only the structure matters here, so the text can stay in
+	// whatever encoding it's in.
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	depth := 0
+
+	for {
+
+		tok, err := d.Token()
+		if err != nil {
+			return nil
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth > defaults.MaxFeedDepth {
+				return errors.New("bad feed: elements nested more than " + strconv.Itoa(defaults.MaxFeedDepth) + " deep")
+			}
+		case xml.EndElement:
+			depth--
+		case xml.Directive:
+			if bytes.Contains(tok, []byte("<!ENTITY")) {
+				return errors.New("bad feed: entity declarations aren't allowed")
+			}
+		}
+	}
+}
+
+// checkItemCount rejects feeds with too many items.
+func checkItemCount(n int) error {
+
+	if n > defaults.MaxFeedItems {
+		return errors.New("bad feed: " + strconv.Itoa(n) + " items (the limit is " + strconv.Itoa(defaults.MaxFeedItems) + ")")
+	}
+
+	return nil
+}
+
+// checkRedirect is the http.Client's redirect policy.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+
+	if len(via) > defaults.MaxRedirects {
+		return errors.New("stopped after " + strconv.Itoa(defaults.MaxRedirects) + " redirects")
+	}
+
+	return nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testRSS returns a minimal RSS feed with the given extra
+// channel elements and number of items.
+func testRSS(channel string, items int) string {
+
+	var buf strings.Builder
+
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd">
+<channel>
+<title>Abuse</title>
+`)
+	buf.WriteString(channel)
+
+	for i := 0; i < items; i++ {
+		fmt.Fprintf(&buf, "<item><title>Item %d</title><guid>%d</guid></item>\n", i, i)
+	}
+
+	buf.WriteString("</channel>\n</rss>\n")
+	return buf.String()
+}
+
+func newAbuseServer() *httptest.Server {
+
+	mux := http.NewServeMux()
+
+	serve := func(contentType, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Write([]byte(body))
+		}
+	}
+
+	mux.Handle("/ok.xml", serve("application/rss+xml", testRSS("", 3)))
+	mux.Handle("/plain.xml", serve("text/plain; charset=utf-8", testRSS("", 3)))
+	mux.Handle("/page.html", serve("text/html; charset=utf-8", "<html><body>Not a feed</body></html>"))
+	mux.Handle("/audio.mp3", serve("audio/mpeg", "ID3"))
+	mux.Handle("/feeds.json", serve("application/json", `{"feeds": []}`))
+
+	mux.Handle("/large.xml", serve("text/xml", testRSS("<description>"+strings.Repeat("x", 10000)+"</description>\n", 3)))
+
+	// A small download that decompresses into a large feed.
+	mux.HandleFunc("/bomb.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write([]byte(testRSS("<description>"+strings.Repeat(" ", 1000*1000)+"</description>\n", 3)))
+		zw.Close()
+	})
+
+	mux.Handle("/laughs.xml", serve("text/xml", `<?xml version="1.0"?>
+<!DOCTYPE rss [
+  <!ENTITY lol "lol">
+  <!ENTITY lol2 "&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;">
+  <!ENTITY lol3 "&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;">
+]>
+<rss version="2.0"><channel><title>&lol3;</title></channel></rss>`))
+
+	mux.Handle("/nested.xml", serve("text/xml", testRSS(strings.Repeat("<x>", 200)+strings.Repeat("</x>", 200)+"\n", 3)))
+
+	mux.Handle("/many.xml", serve("text/xml", testRSS("", 20)))
+
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+
+	// Each feed in the chain moves to the next one.
+	mux.HandleFunc("/moved/", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/moved/"))
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(testRSS(fmt.Sprintf("<itunes:new-feed-url>http://%s/moved/%d</itunes:new-feed-url>\n", r.Host, n+1), 3)))
+	})
+
+	// These feeds move to each other.
+	for _, pair := range [][2]string{{"a", "b"}, {"b", "a"}} {
+		to := pair[1]
+		mux.HandleFunc("/circle/"+pair[0], func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(testRSS(fmt.Sprintf("<itunes:new-feed-url>http://%s/circle/%s</itunes:new-feed-url>\n", r.Host, to), 3)))
+		})
+	}
+
+	return httptest.NewServer(mux)
+}
+
+func TestFetchAndParseLimits(t *testing.T) {
+
+	defer func(size int64, items int) {
+		defaults.MaxFeedSize = size
+		defaults.MaxFeedItems = items
+	}(defaults.MaxFeedSize, defaults.MaxFeedItems)
+
+	defaults.MaxFeedSize = 5000
+	defaults.MaxFeedItems = 10
+
+	ts := newAbuseServer()
+	defer ts.Close()
+
+	tests := []struct {
+		Name   string
+		Path   string
+		Err    string
+		ErrEnd string
+		URL    string
+	}{
+		{
+			Name: "OK",
+			Path: "ok.xml",
+			URL:  "ok.xml",
+		},
+		{
+			Name: "Plain text",
+			Path: "plain.xml",
+			URL:  "plain.xml",
+		},
+		{
+			Name: "HTML",
+			Path: "page.html",
+			Err:  "bad content type: text/html (expected an RSS or Atom feed)",
+		},
+		{
+			Name: "Audio",
+			Path: "audio.mp3",
+			Err:  "bad content type: audio/mpeg (expected an RSS or Atom feed)",
+		},
+		{
+			Name: "Too large",
+			Path: "large.xml",
+			Err:  "bad feed: larger than 5.0 KB",
+		},
+		{
+			Name: "Compression bomb",
+			Path: "bomb.xml",
+			Err:  "bad feed: larger than 5.0 KB",
+		},
+		{
+			Name: "Entity expansion",
+			Path: "laughs.xml",
+			Err:  "bad feed: entity declarations aren't allowed",
+		},
+		{
+			Name: "Deeply nested",
+			Path: "nested.xml",
+			Err:  "bad feed: elements nested more than 100 deep",
+		},
+		{
+			Name: "Too many items",
+			Path: "many.xml",
+			Err:  "bad feed: 20 items (the limit is 10)",
+		},
+		{
+			Name:   "Redirect loop",
+			Path:   "loop",
+			ErrEnd: "stopped after 10 redirects",
+		},
+		{
+			Name: "Endless new feed URLs",
+			Path: "moved/0",
+			Err:  "bad feed: stopped after 5 new feed URLs",
+		},
+		{
+			Name: "Circular new feed URLs",
+			Path: "circle/a",
+			URL:  "circle/b",
+		},
+	}
+
+	for _, test := range tests {
+
+		feed, err := fetchAndParse(serverURL(ts, test.Path))
+
+		switch {
+		case test.ErrEnd != "":
+			if err == nil || !strings.HasSuffix(err.Error(), test.ErrEnd) {
+				t.Errorf("%s: expected error ending %q, got %v", test.Name, test.ErrEnd, err)
+			}
+		case test.Err != "":
+			if errString(err) != test.Err {
+				t.Errorf("%s: expected error %q, got %v", test.Name, test.Err, err)
+			}
+		case err != nil:
+			t.Errorf("%s: fetchAndParse returned error %q", test.Name, err)
+		case feed.URL != serverURL(ts, test.URL):
+			t.Errorf("%s: expected feed URL %s, got %s", test.Name, serverURL(ts, test.URL), feed.URL)
+		}
+	}
+}
+
+func TestFetchURLLimits(t *testing.T) {
+
+	defer func(size int64) { defaults.MaxFeedSize = size }(defaults.MaxFeedSize)
+	defaults.MaxFeedSize = 5000
+
+	ts := newAbuseServer()
+	defer ts.Close()
+
+	tests := []struct {
+		Path string
+		Err  string
+	}{
+		{
+			Path: "ok.xml",
+		},
+		{
+			Path: "feeds.json",
+		},
+		{
+			Path: "plain.xml",
+		},
+		{
+			Path: "page.html",
+			Err:  "bad content type: text/html (expected an OPML, JSON or text file)",
+		},
+		{
+			Path: "large.xml",
+			Err:  "bad feed: larger than 5.0 KB",
+		},
+		{
+			Path: "bomb.xml",
+			Err:  "bad feed: larger than 5.0 KB",
+		},
+		{
+			Path: "laughs.xml",
+			Err:  "bad feed: entity declarations aren't allowed",
+		},
+		{
+			Path: "nested.xml",
+			Err:  "bad feed: elements nested more than 100 deep",
+		},
+	}
+
+	for _, test := range tests {
+		if _, err := fetchURL(serverURL(ts, test.Path)); errString(err) != test.Err {
+			t.Errorf("%s: expected fetchURL to return %q, got %v", test.Path, test.Err, err)
+		}
+	}
+}
+
+func TestCheckFeedStructure(t *testing.T) {
+
+	tests := []struct {
+		Name string
+		XML  string
+		Err  string
+	}{
+		{
+			Name: "Unescaped HTML",
+			XML:  testRSS("<description>"+strings.Repeat("Line<br>", 200)+"</description>\n", 1),
+		},
+		{
+			Name: "Public DTD",
+			XML: `<?xml version="1.0"?>
+<!DOCTYPE rss PUBLIC "-//Netscape Communications//DTD RSS 0.91//EN" "http://my.netscape.com/publish/formats/rss-0.91.dtd">
+<rss version="0.91"><channel><title>Old</title></channel></rss>`,
+		},
+		{
+			Name: "Not XML",
+			XML:  `{"version": "https://jsonfeed.org/version/1"}`,
+		},
+		{
+			Name: "Nested at the limit",
+			XML:  strings.Repeat("<x>", 100) + strings.Repeat("</x>", 100),
+		},
+		{
+			Name: "Nested past the limit",
+			XML:  strings.Repeat("<x>", 101) + strings.Repeat("</x>", 101),
+			Err:  "bad feed: elements nested more than 100 deep",
+		},
+		{
+			Name: "External entity",
+			XML: `<?xml version="1.0"?>
+<!DOCTYPE rss [<!ENTITY xxe SYSTEM "file:///etc/passwd">]>
+<rss version="2.0"><channel><title>&xxe;</title></channel></rss>`,
+			Err: "bad feed: entity declarations aren't allowed",
+		},
+	}
+
+	for _, test := range tests {
+		if err := checkFeedStructure([]byte(test.XML)); errString(err) != test.Err {
+			t.Errorf("%s: expected checkFeedStructure to return %q, got %v", test.Name, test.Err, err)
+		}
+	}
+}
+
+func TestSyncLimits(t *testing.T) {
+	testWithInitDB(t, testSyncLimits)
+}
+
+func testSyncLimits(t *testing.T, db *sql.DB) {
+
+	ts := newAbuseServer()
+	defer ts.Close()
+
+	res, err := addFeed(db, nil, serverURL(ts, "ok.xml"))
+	if err != nil {
+		t.Fatalf("addFeed returned error %q", err)
+	}
+
+	// Point the feed at a web page.
+	if err := updateFeed(db, res.ID, map[string]interface{}{"url": serverURL(ts, "page.html")}); err != nil {
+		t.Fatalf("updateFeed returned error %q", err)
+	}
+
+	infos, err := loadSyncInfo(db, 0)
+	if err != nil {
+		t.Fatalf("loadSyncInfo returned error %q", err)
+	}
+
+	results := syncMultiple(db, nil, infos, nil)
+
+	if len(results) != 1 {
+		t.Fatalf("expected 1 sync result, got %d", len(results))
+	}
+
+	exp := "bad content type: text/html (expected an RSS or Atom feed)"
+
+	if got := results[0]; got.ID != res.ID || errString(got.Err) != exp {
+		t.Errorf("expected sync of feed %d to fail with %q, got feed %d and error %v", res.ID, exp, got.ID, got.Err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// logLevel determines which messages a Logger writes.
+type logLevel int
+
+const (
+	logLevelWarn logLevel = iota
+	logLevelInfo
+	logLevelDebug
+)
+
+var logLevelNames = map[logLevel]string{
+	logLevelWarn:  "warning",
+	logLevelInfo:  "info",
+	logLevelDebug: "debug",
+}
+
+// Logger writes diagnostic messages at or below a given
+// level. Warnings are always written, informational messages
+// need --verbose and debug messages need --debug. A nil
+// Logger discards everything, so code that doesn't care
+// about logging doesn't have to set one up.
+type Logger struct {
+	w     io.Writer
+	level logLevel
+	mu    sync.Mutex
+}
+
+// NewLogger creates a Logger that writes messages up to
+// the given level to w.
+func NewLogger(w io.Writer, level logLevel) *Logger {
+	return &Logger{
+		w:     w,
+		level: level,
+	}
+}
+
+// Enabled reports whether messages at the given level are
+// written.
+func (l *Logger) Enabled(level logLevel) bool {
+	return l != nil && l.w != nil && level <= l.level
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(logLevelWarn, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(logLevelInfo, format, args...)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(logLevelDebug, format, args...)
+}
+
+func (l *Logger) logf(level logLevel, format string, args ...interface{}) {
+
+	if !l.Enabled(level) {
+		return
+	}
+
+	msg := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+
+	// Messages may come from several goroutines, e.g. when
+	// feeds are fetched in parallel.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	fmt.Fprintf(l.w, "%s: %s\n", logLevelNames[level], msg)
+}
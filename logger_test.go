@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+
+	tests := []struct {
+		Level logLevel
+		Exp   string
+	}{
+		{
+			Level: logLevelWarn,
+			Exp:   "warning: one\n",
+		},
+		{
+			Level: logLevelInfo,
+			Exp:   "warning: one\ninfo: two\n",
+		},
+		{
+			Level: logLevelDebug,
+			Exp:   "warning: one\ninfo: two\ndebug: three 3\n",
+		},
+	}
+
+	for _, test := range tests {
+
+		var buf bytes.Buffer
+
+		log := NewLogger(&buf, test.Level)
+		log.Warnf("one")
+		log.Infof("two\n")
+		log.Debugf("three %d", 3)
+
+		if got := buf.String(); got != test.Exp {
+			t.Errorf("level %d: expected Logger to write %q, got %q", test.Level, test.Exp, got)
+		}
+	}
+
+	// A nil Logger discards everything.
+	var log *Logger
+	log.Warnf("nothing")
+
+	if log.Enabled(logLevelWarn) {
+		t.Errorf("expected a nil Logger not to be enabled")
+	}
+}
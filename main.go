@@ -1,17 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/deepilla/itunes"
@@ -44,63 +49,170 @@ const (
 	flagUse        = "use"
 	flagFormat     = "format"
 	flagTarget     = "target"
+	flagServer     = "server"
+	flagUser       = "user"
+	flagPassword   = "password"
+	flagDevice     = "device"
+	flagAddr       = "addr"
+	flagMediaDir   = "media-dir"
+	flagMediaURL   = "media-url"
+	flagPlayer     = "player"
+	flagID         = "id"
+	flagExact      = "exact"
+	flagYes        = "yes"
+	flagAllMatches = "all-matches"
+	flagSelect     = "select"
+	flagProbe      = "probe"
+	flagForce      = "force"
+	flagTag        = "tag"
+	flagDryRun     = "dry-run"
 )
 
 // TODO: Make these settings configurable.
 var defaults = struct {
-	Timeout    time.Duration
-	MaxWorkers int
+	Timeout           time.Duration
+	MaxWorkers        int
+	SaveInterval      time.Duration
+	HookTimeout       time.Duration
+	SyncInterval      time.Duration
+	MinSyncInterval   time.Duration
+	MaxSyncInterval   time.Duration
+	DaemonPoll        time.Duration
+	ConnectTimeout    time.Duration
+	HeaderTimeout     time.Duration
+	BodyTimeout       time.Duration
+	MaxRetries        int
+	RetryWait         time.Duration
+	MaxRetryWait      time.Duration
+	MaxPerHost        int
+	MaxRedirects      int
+	MaxFeedHops       int
+	MaxFeedSize       int64
+	MaxFeedDepth      int
+	MaxFeedItems      int
+	BusyTimeout       time.Duration
+	MaxPubdateLookups int
 }{
-	Timeout:    10 * time.Second,
-	MaxWorkers: 10,
-}
-
-var defaultClient = &http.Client{
-	Timeout: defaults.Timeout,
+	Timeout:           10 * time.Second,
+	MaxWorkers:        10,
+	SaveInterval:      5 * time.Second,
+	HookTimeout:       10 * time.Second,
+	SyncInterval:      time.Hour,
+	MinSyncInterval:   15 * time.Minute,
+	MaxSyncInterval:   24 * time.Hour,
+	DaemonPoll:        time.Minute,
+	ConnectTimeout:    10 * time.Second,
+	HeaderTimeout:     30 * time.Second,
+	BodyTimeout:       30 * time.Second,
+	MaxRetries:        3,
+	RetryWait:         time.Second,
+	MaxRetryWait:      time.Minute,
+	MaxPerHost:        2,
+	MaxRedirects:      10,
+	MaxFeedHops:       5,
+	MaxFeedSize:       50 * 1000 * 1000,
+	MaxFeedDepth:      100,
+	MaxFeedItems:      10000,
+	BusyTimeout:       10 * time.Second,
+	MaxPubdateLookups: 50,
 }
 
 func main() {
 
 	cs := NewCommandSet("kibner", getCommands()...)
+	env := StdEnv()
 
 	if len(os.Args) < 2 {
-		cs.Usage()
+		cs.Usage(env.Stdout)
 		os.Exit(1)
 	}
 
-	err := cs.Run(os.Args[1], os.Args[2:])
+	cfg := defaultHTTPConfig()
+	if err := cfg.loadEnv(os.Getenv); err != nil {
+		fmt.Fprintln(env.Stdout, "Whoops:", err)
+		os.Exit(2)
+	}
+	configureHTTP(cfg)
+
+	err := cs.RunArgs(os.Args[1:], env)
 	if err != nil {
-		fmt.Println("Whoops:", err)
+		fmt.Fprintln(env.Stdout, "Whoops:", err)
 		os.Exit(2)
 	}
 }
 
+func newSortItemsFlag() uintFlag {
+
+	var f uintFlag
+	f.AddValue("pubdate", sortItemsByPubdate, "Sort by pubdate")
+	f.AddValue("title", sortItemsByTitle, "Sort by title")
+	f.AddValue("feed", sortItemsByFeed, "Sort by feed")
+	f.AddValue("duration", sortItemsByDuration, "Sort by duration")
+	f.AddValue("timestamp", sortItemsByTimestamp, "Sort by timestamp")
+	f.MustSet("pubdate")
+
+	return f
+}
+
+func newSortFeedsFlag() uintFlag {
+
+	var f uintFlag
+	f.AddValue("pubdate", sortFeedsByPubdate, "Sort by last pubdate")
+	f.AddValue("title", sortFeedsByTitle, "Sort by title")
+	f.AddValue("items", sortFeedsByItemCount, "Sort by item count")
+	f.AddValue("unplayed", sortFeedsByUnplayedCount, "Sort by unplayed count")
+	f.AddValue("timestamp", sortFeedsByTimestamp, "Sort by timestamp")
+	f.AddValue("tag", sortFeedsByTag, "Sort and group by tag")
+	f.MustSet("pubdate")
+
+	return f
+}
+
+func newPlayerFlag() uintFlag {
+
+	var f uintFlag
+	f.AddValue("exec", playerExec, "Run the --use program")
+	f.AddValue("mpv", playerMPV, "Play with mpv")
+	f.AddValue("vlc", playerVLC, "Play with VLC")
+	f.MustSet("exec")
+
+	return f
+}
+
+func newSortOrderFlag() uintFlag {
+
+	var f uintFlag
+	f.AddValue("asc", sortOrderAsc, "Ascending order")
+	f.AddValue("desc", sortOrderAsc, "Descending order")
+
+	return f
+}
+
 func getCommands() []*Command {
 
-	var sortItemsOpt uintFlag
-	sortItemsOpt.AddValue("pubdate", sortItemsByPubdate, "Sort by pubdate")
-	sortItemsOpt.AddValue("title", sortItemsByTitle, "Sort by title")
-	sortItemsOpt.AddValue("feed", sortItemsByFeed, "Sort by feed")
-	sortItemsOpt.AddValue("duration", sortItemsByDuration, "Sort by duration")
-	sortItemsOpt.AddValue("timestamp", sortItemsByTimestamp, "Sort by timestamp")
-	sortItemsOpt.MustSet("pubdate")
-
-	var sortFeedsOpt uintFlag
-	sortFeedsOpt.AddValue("pubdate", sortFeedsByPubdate, "Sort by last pubdate")
-	sortFeedsOpt.AddValue("title", sortFeedsByTitle, "Sort by title")
-	sortFeedsOpt.AddValue("items", sortFeedsByItemCount, "Sort by item count")
-	sortFeedsOpt.AddValue("unplayed", sortFeedsByUnplayedCount, "Sort by unplayed count")
-	sortFeedsOpt.AddValue("timestamp", sortFeedsByTimestamp, "Sort by timestamp")
-	sortFeedsOpt.MustSet("pubdate")
-
-	var sortOrderOpt uintFlag
-	sortOrderOpt.AddValue("asc", sortOrderAsc, "Ascending order")
-	sortOrderOpt.AddValue("desc", sortOrderAsc, "Descending order")
+	sortItemsOpt := newSortItemsFlag()
+	sortFeedsOpt := newSortFeedsFlag()
+	sortOrderOpt := newSortOrderFlag()
 
 	var fileFormatOpt uintFlag
+	fileFormatOpt.AddValue("auto", fileFormatAuto, "Work out the format from the file")
 	fileFormatOpt.AddValue("list", fileFormatList, "Plain text")
 	fileFormatOpt.AddValue("opml", fileFormatOPML, "OPML file")
-	fileFormatOpt.MustSet("list")
+	fileFormatOpt.AddValue("json", fileFormatJSON, "JSON")
+	fileFormatOpt.MustSet("auto")
+
+	var historyFormatOpt uintFlag
+	historyFormatOpt.AddValue("auto", historyFormatAuto, "Work out the format from the file")
+	historyFormatOpt.AddValue("antennapod", historyFormatAntennaPod, "AntennaPod database backup")
+	historyFormatOpt.AddValue("gpodder", historyFormatGPodder, "gPodder database")
+	historyFormatOpt.AddValue("opml", historyFormatOPML, "OPML file with episodes (e.g. from Overcast)")
+	historyFormatOpt.AddValue("csv", historyFormatCSV, "CSV file of feed URL, item GUID or URL, played and position")
+	historyFormatOpt.MustSet("auto")
+
+	var statsFormatOpt uintFlag
+	statsFormatOpt.AddValue("text", fileFormatList, "Plain text")
+	statsFormatOpt.AddValue("json", fileFormatJSON, "JSON")
+	statsFormatOpt.MustSet("text")
 
 	var targetOpt uintFlag
 	targetOpt.AddValue("link", targetLink, "Website")
@@ -120,14 +232,23 @@ func getCommands() []*Command {
 		NewCommand("remove",
 			runRemove,
 			WithAlias("rm"),
-			WithSyntax("kibner remove <name>"),
+			WithSyntax("kibner remove [options] <name>"),
 			WithDescription("Unsubscribe from a feed"),
+			WithOption(flagID, "remove the feed with the given `id` instead of by name", uint(0)),
+			WithOption(flagExact, "only match feeds with exactly the given name", false),
+			WithOptionAlias(flagYes, "y", "don't ask for confirmation", false),
+			WithOption(flagAllMatches, "remove every matching feed", false),
+			WithOption(flagDryRun, "show what would be removed without removing it", false),
 		),
 
 		NewCommand("update",
 			runUpdate,
 			WithSyntax("kibner update <options> <name>"),
 			WithDescription("Edit feed details"),
+			WithOption(flagID, "update the feed with the given `id` instead of by name", uint(0)),
+			WithOption(flagExact, "only match feeds with exactly the given name", false),
+			WithOptionAlias(flagYes, "y", "don't ask for confirmation", false),
+			WithOption(flagAllMatches, "update every matching feed", false),
 			WithOption(flagTitle, "set feed title to the given value", ""),
 			WithOption(flagAuthor, "set feed author to the given value", ""),
 			WithOption(flagDesc, "set feed description to the given value", ""),
@@ -137,8 +258,24 @@ func getCommands() []*Command {
 
 		NewCommand("sync",
 			runSync,
-			WithSyntax("kibner sync [name]"),
+			WithSyntax("kibner sync [options] [name]"),
 			WithDescription("Check for new items"),
+			WithOption(flagID, "sync the feed with the given `id` instead of by name", uint(0)),
+			WithOption(flagExact, "only match feeds with exactly the given name", false),
+			WithOption(flagAllMatches, "sync every matching feed", false),
+			WithOption(flagProbe, "read missing durations from media files", false),
+			WithOption(flagTag, "sync feeds with the given `tag`", ""),
+			WithOption(flagDryRun, "show what would change without saving anything", false),
+		),
+
+		NewCommand("probe",
+			runProbe,
+			WithSyntax("kibner probe [options] [name]"),
+			WithDescription("Read item durations from media files"),
+			WithOption(flagID, "probe items from the feed with the given `id` instead of by name", uint(0)),
+			WithOption(flagExact, "only match feeds with exactly the given name", false),
+			WithOption(flagAllMatches, "probe items from every matching feed", false),
+			WithOption(flagForce, "probe items that already have a duration", false),
 		),
 
 		NewCommand("feeds",
@@ -150,9 +287,47 @@ func getCommands() []*Command {
 			WithOptionAlias(flagLimit, "N", "the maximum `number` of feeds to display", uint(0)),
 			WithOption(flagWithTitle, "show feeds that match the given title", ""),
 			WithOption(flagWithAuthor, "show feeds that match the given author", ""),
+			WithOption(flagTag, "show feeds with the given `tag`", ""),
 			WithOptionAlias(flagShowDesc, "d", "show feed descriptions", false),
 		),
 
+		NewCommand("tag",
+			runTag,
+			WithSyntax("kibner tag [options] <name> <tag>..."),
+			WithDescription("Add tags to a feed"),
+			WithOption(flagID, "tag the feed with the given `id` instead of by name", uint(0)),
+			WithOption(flagExact, "only match feeds with exactly the given name", false),
+			WithOption(flagAllMatches, "tag every matching feed", false),
+		),
+
+		NewCommand("untag",
+			runUntag,
+			WithSyntax("kibner untag [options] <name> [tag...]"),
+			WithDescription("Remove tags from a feed"),
+			WithOption(flagID, "untag the feed with the given `id` instead of by name", uint(0)),
+			WithOption(flagExact, "only match feeds with exactly the given name", false),
+			WithOptionAlias(flagYes, "y", "don't ask for confirmation", false),
+			WithOption(flagAllMatches, "untag every matching feed", false),
+		),
+
+		NewCommand("hook",
+			runHook,
+			WithSyntax("kibner hook <event> <program|url>"),
+			WithDescription("Run a program or call a webhook when something happens"),
+		),
+
+		NewCommand("unhook",
+			runUnhook,
+			WithSyntax("kibner unhook <id>..."),
+			WithDescription("Remove hooks"),
+		),
+
+		NewCommand("hooks",
+			runHooks,
+			WithSyntax("kibner hooks"),
+			WithDescription("List hooks and the events that trigger them"),
+		),
+
 		NewCommand("list",
 			runList,
 			WithAlias("ls"),
@@ -164,40 +339,152 @@ func getCommands() []*Command {
 			WithOptionAlias(flagStartDate, "T", "show items released on or after the given `date`", reldate{}),
 			WithOptionAlias(flagUnplayed, "u", "show unplayed items", false),
 			WithOption(flagWithTitle, "show items that match the given title", ""),
+			WithOption(flagTag, "show items from feeds with the given `tag`", ""),
 			WithOptionAlias(flagPlay, "p", "play selected items", false),
 			WithOption(flagMark, "mark selected items as played", false),
 			WithOption(flagUnmark, "mark selected items as unplayed", false),
 			WithOption(flagRun, "run the specified program on selected items", false),
 			WithOption(flagUse, "a `program` to play or run items", ""),
+			WithOption(flagPlayer, "the type of player to play items with", newPlayerFlag()),
+			WithOption(flagSelect, "comma-separated item `numbers` or GUIDs to act on without prompting", ""),
+			WithOptionAlias(flagYes, "y", "act on every listed item without prompting", false),
+			WithOption(flagID, "list items from the feed with the given `id`", uint(0)),
+			WithOption(flagExact, "only match feeds with exactly the given name", false),
 			WithOptionAlias(flagShowDesc, "d", "show item descriptions", false),
 		),
 
+		NewCommand("show",
+			runShow,
+			WithSyntax("kibner show <id>"),
+			WithDescription("Show an item's details"),
+		),
+
+		NewCommand("play",
+			runPlay,
+			WithSyntax("kibner play [options] <id>"),
+			WithDescription("Play an item"),
+			WithOption(flagUse, "a `program` to play the item", ""),
+			WithOption(flagPlayer, "the type of player to play the item with", newPlayerFlag()),
+		),
+
+		NewCommand("mark",
+			runMark,
+			WithSyntax("kibner mark <id>..."),
+			WithDescription("Mark items as played"),
+		),
+
+		NewCommand("unmark",
+			runUnmark,
+			WithSyntax("kibner unmark <id>..."),
+			WithDescription("Mark items as unplayed"),
+		),
+
+		NewCommand("stats",
+			runStats,
+			WithSyntax("kibner stats [options] [name]"),
+			WithDescription("Show listening statistics"),
+			WithOptionAlias(flagStartDate, "T", "only count listening and releases since the given `date`", reldate{}),
+			WithOption(flagFormat, "the output `format`", statsFormatOpt),
+			WithOption(flagID, "show statistics for the feed with the given `id`", uint(0)),
+			WithOption(flagExact, "only match feeds with exactly the given name", false),
+			WithOption(flagAllMatches, "show statistics for every matching feed", false),
+		),
+
 		NewCommand("import",
 			runImport,
-			WithSyntax("kibner import [options] <filename>"),
+			WithSyntax("kibner import [options] <filename|url|->"),
 			WithDescription("Import subscriptions from a file"),
 			WithOption(flagFormat, "the `type` of file being imported", fileFormatOpt),
+			WithOption(flagDryRun, "show what would be added without saving anything", false),
 		),
 
 		NewCommand("export",
 			runExport,
-			WithSyntax("kibner export [options] <filename>"),
+			WithSyntax("kibner export [options] <filename|->"),
 			WithDescription("Export subscriptions to a file"),
 			WithOption(flagFormat, "the `type` of file to export", fileFormatOpt),
 		),
 
+		NewCommand("history",
+			runHistory,
+			WithSyntax("kibner history [options] <filename>"),
+			WithDescription("Import listening history from another app"),
+			WithOption(flagFormat, "the `type` of file being imported", historyFormatOpt),
+		),
+
+		NewCommand("validate",
+			runValidate,
+			WithSyntax("kibner validate [options] <url|feed>"),
+			WithDescription("Check a feed for problems"),
+			WithOption(flagID, "check the feed with the given `id` instead of by name", uint(0)),
+			WithOption(flagExact, "only match feeds with exactly the given name", false),
+			WithOption(flagAllMatches, "check every feed that matches the given name", false),
+		),
+
 		NewCommand("open",
 			runOpen,
 			WithSyntax("kibner open [options] <name>"),
 			WithDescription("View a feed's website, RSS feed, or image"),
 			WithOption(flagTarget, "which `property` of the feed to view", targetOpt),
 			WithOption(flagUse, "a `program` to use as the viewer", "xdg-open"),
+			WithOption(flagID, "open the feed with the given `id` instead of by name", uint(0)),
+			WithOption(flagExact, "only match feeds with exactly the given name", false),
+		),
+
+		NewCommand("tui",
+			runTUI,
+			WithSyntax("kibner tui [options]"),
+			WithDescription("Browse feeds and items in a terminal interface"),
+			WithOption(flagUse, "a `program` to play items", ""),
+			WithOption(flagPlayer, "the type of player to play items with", newPlayerFlag()),
+		),
+
+		NewCommand("daemon",
+			runDaemon,
+			WithSyntax("kibner daemon [status]"),
+			WithDescription("Sync feeds in the background, each on its own schedule"),
+		),
+
+		NewCommand("serve",
+			runServe,
+			WithSyntax("kibner serve [options]"),
+			WithDescription("Run a web server for controlling kibner remotely"),
+			WithOption(flagAddr, "the `address` to listen on", "localhost:8686"),
+			WithOption(flagMediaDir, "a `directory` of downloaded items to serve", ""),
+		),
+
+		NewCommand("publish",
+			runPublish,
+			WithSyntax("kibner publish [options] <filename> [name]"),
+			WithDescription("Write items to an RSS feed"),
+			WithOption(flagSortBy, "sort items by the given property", newSortItemsFlag()),
+			WithOption(flagSortOrder, "sort in ascending or descending order", newSortOrderFlag()),
+			WithOptionAlias(flagLimit, "N", "the maximum `number` of items to include", uint(0)),
+			WithOptionAlias(flagStartDate, "T", "include items released on or after the given `date`", reldate{}),
+			WithOptionAlias(flagUnplayed, "u", "include unplayed items", false),
+			WithOption(flagWithTitle, "include items that match the given title", ""),
+			WithOption(flagTitle, "the `title` of the RSS feed", "Kibner"),
+			WithOption(flagMediaDir, "a `directory` of downloaded items", ""),
+			WithOption(flagMediaURL, "the base `url` for items in the media directory", ""),
+			WithOption(flagID, "include items from the feed with the given `id`", uint(0)),
+			WithOption(flagExact, "only match feeds with exactly the given name", false),
+		),
+
+		NewCommand("gpodder",
+			runGpodder,
+			WithSyntax("kibner gpodder [options]"),
+			WithDescription("Sync subscriptions and played items with gpodder.net"),
+			WithOption(flagServer, "the `url` of a gpodder.net-compatible server", "https://gpodder.net"),
+			WithOption(flagUser, "your gpodder.net `username`", ""),
+			WithOption(flagPassword, "your gpodder.net `password` (default $KIBNER_GPODDER_PASSWORD)", ""),
+			WithOption(flagDevice, "the device `id` to sync as", "kibner"),
 		),
 
 		NewCommand("reset",
 			runReset,
-			WithSyntax("kibner nuke"),
+			WithSyntax("kibner reset [options]"),
 			WithDescription("Wipe all existing data"),
+			WithOptionAlias(flagYes, "y", "don't ask for confirmation", false),
 		),
 
 		NewCommand("version",
@@ -239,205 +526,1418 @@ func runAdd(opts Options, args []string, env *Env) error {
 
 	return runDB(func(db *sql.DB) error {
 
-		res, err := addFeed(db, url)
+		env.Log.Debugf("adding feed %s", url)
+
+		res, err := addFeed(db, env.Hooks, url)
+		if err != nil {
+			return err
+		}
+
+		showWarnings := env.Log.Enabled(logLevelInfo)
+
+		fmt.Fprintf(env.Stdout, "Added %s - %d items", res.Title, res.Items)
+		printWarningCount(env.Stdout, len(res.Warnings), showWarnings)
+		fmt.Fprintln(env.Stdout)
+
+		if showWarnings {
+			printWarnings(env.Stdout, []*syncResult{res})
+		}
+		return nil
+	})
+}
+
+func runRemove(opts Options, args []string, env *Env) error {
+
+	choice, ok, err := getFeedChoice(opts, args)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrBadArgs
+	}
+
+	dryRun := opts.Get(flagDryRun).Bool()
+	choice.Confirm = !dryRun
+
+	return runDB(func(db *sql.DB) error {
+
+		ids, err := chooseFeeds(db, env, choice, "Remove %s")
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+
+			if dryRun {
+				summary, err := loadRemoveSummary(db, id)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(env.Stdout, "Would remove %s and its %s (%d unplayed)\n", summary.Title, formatCount(summary.Items, "item"), summary.UnplayedItems)
+				continue
+			}
+
+			if err := removeFeed(db, env.Hooks, id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func runUpdate(opts Options, args []string, env *Env) error {
+
+	choice, ok, err := getFeedChoice(opts, args)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrBadArgs
+	}
+
+	choice.Confirm = true
+
+	fieldsByFlag := map[string]string{
+		flagTitle:  "title",
+		flagAuthor: "author",
+		flagDesc:   "desc",
+		flagLink:   "link",
+		flagImage:  "image",
+	}
+
+	values := map[string]interface{}{}
+
+	for flagName, fieldName := range fieldsByFlag {
+
+		s := strings.TrimSpace(opts.Get(flagName).String())
+		if s == "" {
+			continue
+		}
+
+		values[fieldName] = s
+	}
+
+	if len(values) == 0 {
+		return errors.New("no values to update")
+	}
+
+	return runDB(func(db *sql.DB) error {
+
+		ids, err := chooseFeeds(db, env, choice, "Update %s")
 		if err != nil {
 			return err
 		}
 
-		fmt.Printf("Added %s - %d items\n", res.Title, res.Items)
+		for _, id := range ids {
+			if err := updateFeed(db, id, values); err != nil {
+				return err
+			}
+		}
+
 		return nil
 	})
 }
 
-func runRemove(opts Options, args []string, env *Env) error {
+func runSync(opts Options, args []string, env *Env) error {
+
+	choice, ok, err := getFeedChoice(opts, args)
+	if err != nil {
+		return err
+	}
+
+	probe := opts.Get(flagProbe).Bool()
+
+	tag, err := getTagFilter(opts)
+	if err != nil {
+		return err
+	}
+
+	if ok && tag != "" {
+		return errors.New("--" + flagTag + " can't be used with a feed name")
+	}
+
+	dryRun := opts.Get(flagDryRun).Bool()
+
+	if dryRun && probe {
+		return errors.New("--" + flagProbe + " can't be used with --" + flagDryRun)
+	}
+
+	return runDB(func(db *sql.DB) error {
+
+		if dryRun {
+			return runSyncPreview(db, env, choice, ok, tag)
+		}
+
+		var ids []int64
+		var err error
+
+		if !ok {
+			ids, err = runSyncAll(db, env, tag)
+		} else {
+			ids, err = runSyncFeeds(db, env, choice)
+		}
+
+		if err != nil || !probe {
+			return err
+		}
+
+		return probeFeeds(db, env, ids, false)
+	})
+}
+
+// runSyncAll syncs every feed, or every feed with the given tag
+// if tag is not empty. In the latter case it returns the IDs of
+// the tagged feeds.
+func runSyncAll(db *sql.DB, env *Env, tag string) ([]int64, error) {
+
+	var ids []int64
+	var results []*syncResult
+	var err error
+
+	if tag == "" {
+		results, err = syncAll(db, env.Hooks, env.Stdout)
+	} else {
+		results, err = syncTagged(db, env.Hooks, tag, env.Stdout)
+		for _, res := range results {
+			ids = append(ids, res.ID)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	resetOutput(env.Stdout)
+	logSyncResults(env.Log, results)
+	printSyncResults(env.Stdout, results, env.Log.Enabled(logLevelInfo))
+	return ids, nil
+}
+
+// runSyncPreview reports what syncing would change without
+// saving anything. It syncs the chosen feeds if ok is true,
+// otherwise the feeds with the given tag, or every feed.
+func runSyncPreview(db *sql.DB, env *Env, choice feedChoice, ok bool, tag string) error {
+
+	var infos []syncInfo
+	var err error
+
+	switch {
+	case ok:
+		var ids []int64
+		ids, err = chooseFeeds(db, env, choice, "Sync %s")
+		for _, id := range ids {
+			var feedInfos []syncInfo
+			if feedInfos, err = loadSyncInfo(db, id); err != nil {
+				break
+			}
+			infos = append(infos, feedInfos...)
+		}
+	case tag != "":
+		infos, err = loadSyncInfoTagged(db, tag)
+	default:
+		infos, err = loadSyncInfo(db, 0)
+		if err == nil && len(infos) == 0 {
+			err = errors.New("no feeds to sync")
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	results := previewSyncMultiple(infos, env.Stdout)
+
+	resetOutput(env.Stdout)
+	printSyncPreview(env.Stdout, results, env.Log.Enabled(logLevelInfo))
+	return nil
+}
+
+// runSyncFeeds syncs the chosen feeds and returns their IDs.
+func runSyncFeeds(db *sql.DB, env *Env, choice feedChoice) ([]int64, error) {
+
+	ids, err := chooseFeeds(db, env, choice, "Sync %s")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+
+		res, err := syncOne(db, env.Hooks, id)
+		if err != nil {
+			return nil, err
+		}
+
+		logSyncResults(env.Log, []*syncResult{res})
+
+		fmt.Fprintf(env.Stdout, "%s: ", res.Title)
+
+		resetOutput(env.Stdout)
+		printSyncResults(env.Stdout, []*syncResult{res}, env.Log.Enabled(logLevelInfo))
+	}
+
+	return ids, nil
+}
+
+func runStats(opts Options, args []string, env *Env) error {
+
+	choice, ok, err := getFeedChoice(opts, args)
+	if err != nil {
+		return err
+	}
+
+	since := opts.Get(flagStartDate).Value().(time.Time)
+	format := opts.Get(flagFormat).Value().(fileFormat)
+
+	return runDB(func(db *sql.DB) error {
+
+		var ids []int64
+
+		if ok {
+			ids, err = chooseFeeds(db, env, choice, "Show statistics for %s")
+			if err != nil {
+				return err
+			}
+		}
+
+		rows, err := loadStatsRows(db, ids)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		stats := computeStats(rows, since, now)
+
+		if format == fileFormatJSON {
+			enc := json.NewEncoder(env.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(stats)
+		}
+
+		return defaultStatsTemplate(now).Execute(env.Stdout, stats)
+	})
+}
+
+func runProbe(opts Options, args []string, env *Env) error {
+
+	choice, ok, err := getFeedChoice(opts, args)
+	if err != nil {
+		return err
+	}
+
+	force := opts.Get(flagForce).Bool()
+
+	return runDB(func(db *sql.DB) error {
+
+		var ids []int64
+
+		if ok {
+			ids, err = chooseFeeds(db, env, choice, "Probe items from %s")
+			if err != nil {
+				return err
+			}
+		}
+
+		return probeFeeds(db, env, ids, force)
+	})
+}
+
+// probeFeeds probes the durations of items from the given feeds
+// (or from every feed, if ids is empty) and prints the results.
+func probeFeeds(db *sql.DB, env *Env, ids []int64, force bool) error {
+
+	items, err := loadProbeItems(db, ids, force)
+	if err != nil {
+		return err
+	}
+
+	if len(items) == 0 {
+		fmt.Fprintln(env.Stdout, "No items to probe")
+		return nil
+	}
+
+	res, err := probeItems(db, items, defaults.MaxWorkers, env.Stdout)
+	if err != nil {
+		return err
+	}
+
+	resetOutput(env.Stdout)
+	env.Log.Debugf("probed %d items: %d durations found", res.Items, res.Found)
+	printProbeResults(env.Stdout, res, env.Log.Enabled(logLevelInfo))
+	return nil
+}
+
+// printProbeResults writes a summary of the results of probing.
+// Items whose durations couldn't be found are counted as warnings
+// and listed in full if showWarnings is true.
+func printProbeResults(w io.Writer, res *probeResult, showWarnings bool) {
+
+	fmt.Fprintf(w, "Probed %d items, found %d durations", res.Items, res.Found)
+	printWarningCount(w, len(res.Warnings), showWarnings)
+	fmt.Fprintln(w)
+
+	if showWarnings && len(res.Warnings) > 0 {
+		fmt.Fprintln(w, "\nWarnings:")
+		for _, warning := range res.Warnings {
+			fmt.Fprintln(w, "  "+warning)
+		}
+	}
+}
+
+func logSyncResults(log *Logger, results []*syncResult) {
+	for _, res := range results {
+		if res.Err != nil {
+			log.Debugf("synced %s: %s", res.URL, res.Err)
+			continue
+		}
+		log.Debugf("synced %s: %d new items, %d warnings", res.URL, res.Items, len(res.Warnings))
+	}
+}
+
+// getFeedChoice reads the name argument and options that commands
+// use to choose feeds. The bool is false if no feed was given.
+func getFeedChoice(opts Options, args []string) (feedChoice, bool, error) {
+
+	var choice feedChoice
+
+	if len(args) > 1 {
+		return choice, false, ErrBadArgs
+	}
+
+	if len(args) == 1 {
+		choice.Name = args[0]
+	}
+
+	if o := opts.Get(flagID); o != nil {
+		choice.ID = int64(o.Uint())
+	}
+
+	if choice.ID != 0 && choice.Name != "" {
+		return choice, false, errors.New("--" + flagID + " can't be used with a feed name")
+	}
+
+	for name, p := range map[string]*bool{
+		flagExact:      &choice.Exact,
+		flagYes:        &choice.Yes,
+		flagAllMatches: &choice.All,
+	} {
+		if o := opts.Get(name); o != nil {
+			*p = o.Bool()
+		}
+	}
+
+	return choice, choice.ID != 0 || choice.Name != "", nil
+}
+
+// printSyncResults writes a summary of the results of a sync.
+// Feed warnings are counted in the summary and listed in full
+// if showWarnings is true.
+func printSyncResults(w io.Writer, results []*syncResult, showWarnings bool) {
+
+	items, errs, warnings := 0, 0, 0
+
+	for _, res := range results {
+
+		items += res.Items
+		if res.Err != nil {
+			errs++
+		}
+		warnings += len(res.Warnings)
+	}
+
+	switch items {
+	case 0:
+		fmt.Fprint(w, "No new items")
+	case 1:
+		fmt.Fprint(w, "1 new item")
+	default:
+		fmt.Fprintf(w, "%d new items", items)
+	}
+
+	switch errs {
+	case 0:
+	case 1:
+		fmt.Fprint(w, ", 1 error")
+	default:
+		fmt.Fprintf(w, ", %d errors", errs)
+	}
+
+	printWarningCount(w, warnings, showWarnings)
+	fmt.Fprintln(w)
+
+	i := 0
+	for _, res := range results {
+
+		if res.Err == nil {
+			continue
+		}
+
+		fmt.Fprintln(w, i+1, res.Title, res.Err)
+		i++
+	}
+
+	if showWarnings {
+		printWarnings(w, results)
+	}
+}
+
+// printSyncPreview writes a summary of what a sync would change,
+// followed by the changes to each feed.
+func printSyncPreview(w io.Writer, results []*syncResult, showWarnings bool) {
+
+	fmt.Fprint(w, "Dry run: ")
+	printSyncResults(w, results, showWarnings)
+
+	for _, res := range results {
+
+		if res.Err != nil {
+			continue
+		}
+
+		if res.Items > 0 {
+			fmt.Fprintf(w, "Would add %s to %s\n", formatCount(int64(res.Items), "new item"), res.Title)
+		}
+
+		if res.NewURL != "" {
+			fmt.Fprintf(w, "Would move %s from %s to %s\n", res.Title, res.URL, res.NewURL)
+		}
+	}
+}
+
+// formatCount formats a number followed by a noun, which is
+// pluralised if the number isn't 1.
+func formatCount(n int64, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+func printWarningCount(w io.Writer, warnings int, showWarnings bool) {
+
+	switch warnings {
+	case 0:
+		return
+	case 1:
+		fmt.Fprint(w, ", 1 warning")
+	default:
+		fmt.Fprintf(w, ", %d warnings", warnings)
+	}
+
+	if !showWarnings {
+		fmt.Fprint(w, " (use -v to list them)")
+	}
+}
+
+// printWarnings lists the warnings for each feed, e.g. items
+// that were skipped and why.
+func printWarnings(w io.Writer, results []*syncResult) {
+
+	for _, res := range results {
+
+		if len(res.Warnings) == 0 {
+			continue
+		}
+
+		title := res.Title
+		if title == "" {
+			title = res.URL
+		}
+
+		fmt.Fprintf(w, "\nWarnings for %s:\n", title)
+		for _, warning := range res.Warnings {
+			fmt.Fprintln(w, "  "+warning)
+		}
+	}
+}
+
+func runFeeds(opts Options, args []string, env *Env) error {
+
+	if len(args) != 0 {
+		return ErrBadArgs
+	}
+
+	tag, err := getTagFilter(opts)
+	if err != nil {
+		return err
+	}
+
+	listOpts := listFeedOptions{
+		SortBy:    opts.Get(flagSortBy).Value().(sortFeedsBy),
+		SortOrder: opts.Get(flagSortOrder).Value().(sortOrder),
+		Limit:     opts.Get(flagLimit).Uint(),
+		Title:     opts.Get(flagWithTitle).String(),
+		Author:    opts.Get(flagWithAuthor).String(),
+		Tag:       tag,
+		ShowDesc:  opts.Get(flagShowDesc).Bool(),
+	}
+
+	return runDB(func(db *sql.DB) error {
+		return listFeeds(db, env.Stdout, defaultFeedTemplate(time.Now()), listOpts)
+	})
+}
+
+func runList(opts Options, args []string, env *Env) error {
+
+	choice, ok, err := getFeedChoice(opts, args)
+	if err != nil {
+		return err
+	}
+
+	tag, err := getTagFilter(opts)
+	if err != nil {
+		return err
+	}
+
+	action := actionNone
+
+	switch {
+	case opts.Get(flagPlay).Bool():
+		action = actionPlay
+	case opts.Get(flagRun).Bool():
+		action = actionRun
+	case opts.Get(flagMark).Bool():
+		action = actionMark
+	case opts.Get(flagUnmark).Bool():
+		action = actionUnmark
+	}
+
+	listOpts := listItemOptions{
+		SortBy:    opts.Get(flagSortBy).Value().(sortItemsBy),
+		SortOrder: opts.Get(flagSortOrder).Value().(sortOrder),
+		Limit:     opts.Get(flagLimit).Uint(),
+		Unplayed:  opts.Get(flagUnplayed).Bool(),
+		StartDate: opts.Get(flagStartDate).Value().(time.Time),
+		Title:     opts.Get(flagWithTitle).String(),
+		Tag:       tag,
+		ShowDesc:  opts.Get(flagShowDesc).Bool(),
+		Action:    action,
+		Use:       opts.Get(flagUse).String(),
+		Player:    opts.Get(flagPlayer).Value().(playerType),
+		Yes:       opts.Get(flagYes).Bool(),
+	}
+
+	if s := opts.Get(flagSelect).String(); s != "" {
+		for _, sel := range strings.Split(s, ",") {
+			if sel = strings.TrimSpace(sel); sel != "" {
+				listOpts.Select = append(listOpts.Select, sel)
+			}
+		}
+	}
+
+	return runDB(func(db *sql.DB) error {
+
+		if ok {
+			feedID, err := chooseFeed(db, env, choice, "List %s")
+			if err != nil {
+				return err
+			}
+			listOpts.FeedID = feedID
+		}
+
+		return listItems(db, env, defaultItemTemplate(time.Now()), listOpts)
+	})
+}
+
+func runTag(opts Options, args []string, env *Env) error {
+
+	choice, tags, ok, err := getTagArgs(opts, args)
+	if err != nil {
+		return err
+	}
+	if !ok || len(tags) == 0 {
+		return ErrBadArgs
+	}
+
+	return runDB(func(db *sql.DB) error {
+
+		ids, err := chooseFeeds(db, env, choice, "Tag %s")
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if err := tagFeed(db, id, tags); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func runHook(opts Options, args []string, env *Env) error {
+
+	if len(args) < 2 {
+		return ErrBadArgs
+	}
+
+	event, err := parseHookEvent(args[0])
+	if err != nil {
+		return err
+	}
+
+	// A single argument is a whole command line. Separate
+	// arguments are quoted so that they stay separate.
+	target := args[1]
+	if len(args) > 2 {
+		target = joinCommand(args[1:])
+	}
+
+	return runDB(func(db *sql.DB) error {
+
+		id, err := addHook(db, event, target)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(env.Stdout, "Added %s hook %d\n", event, id)
+		return nil
+	})
+}
+
+func runUnhook(opts Options, args []string, env *Env) error {
+
+	if len(args) == 0 {
+		return ErrBadArgs
+	}
+
+	ids := make([]int64, len(args))
+
+	for i, arg := range args {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || id <= 0 {
+			return errors.New("invalid hook ID " + arg)
+		}
+		ids[i] = id
+	}
+
+	return runDB(func(db *sql.DB) error {
+
+		for _, id := range ids {
+			if err := removeHook(db, id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func runHooks(opts Options, args []string, env *Env) error {
+
+	if len(args) > 0 {
+		return ErrBadArgs
+	}
+
+	return runDB(func(db *sql.DB) error {
+
+		hooks, err := loadHooks(db, "")
+		if err != nil {
+			return err
+		}
+
+		for _, name := range hookEventNames() {
+
+			event := hookEvent(name)
+			fmt.Fprintf(env.Stdout, "%s: when %s\n", event, hookEvents[event])
+
+			n := 0
+			for _, h := range hooks {
+				if h.Event == event {
+					fmt.Fprintf(env.Stdout, "%6d  %s\n", h.ID, h.Target)
+					n++
+				}
+			}
+
+			if n == 0 {
+				fmt.Fprintln(env.Stdout, "        No hooks")
+			}
+		}
+
+		return nil
+	})
+}
+
+func runUntag(opts Options, args []string, env *Env) error {
+
+	choice, tags, ok, err := getTagArgs(opts, args)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrBadArgs
+	}
+
+	// Removing every tag is harder to undo.
+	choice.Confirm = len(tags) == 0
+
+	return runDB(func(db *sql.DB) error {
+
+		prompt := "Untag %s"
+		if len(tags) == 0 {
+			prompt = "Remove all tags from %s"
+		}
+
+		ids, err := chooseFeeds(db, env, choice, prompt)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if err := untagFeed(db, id, tags); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// getTagArgs reads the arguments to the tag and untag commands.
+// The first argument is the feed name and the rest are tags,
+// unless the feed is chosen with --id, in which case they're
+// all tags.
+func getTagArgs(opts Options, args []string) (feedChoice, []string, bool, error) {
+
+	var name []string
+	if opts.Get(flagID).Uint() == 0 && len(args) > 0 {
+		name, args = args[:1], args[1:]
+	}
+
+	choice, ok, err := getFeedChoice(opts, name)
+	if err != nil {
+		return choice, nil, false, err
+	}
+
+	tags, err := normaliseTags(args)
+	if err != nil {
+		return choice, nil, false, err
+	}
+
+	return choice, tags, ok, nil
+}
+
+// getTagFilter reads the --tag option of commands that filter
+// feeds by tag.
+func getTagFilter(opts Options) (string, error) {
+
+	s := opts.Get(flagTag).String()
+	if s == "" {
+		return "", nil
+	}
+
+	return normaliseTag(s)
+}
+
+func runShow(opts Options, args []string, env *Env) error {
+
+	if len(args) != 1 {
+		return ErrBadArgs
+	}
+
+	ids, err := parseItemIDs(args)
+	if err != nil {
+		return err
+	}
+
+	return runDB(func(db *sql.DB) error {
+		return showItem(db, env.Stdout, defaultShowTemplate(time.Now()), ids[0])
+	})
+}
+
+func runPlay(opts Options, args []string, env *Env) error {
+
+	if len(args) != 1 {
+		return ErrBadArgs
+	}
+
+	ids, err := parseItemIDs(args)
+	if err != nil {
+		return err
+	}
+
+	backend, err := newPlayerBackend(playerOptions{
+		Type:    opts.Get(flagPlayer).Value().(playerType),
+		Program: opts.Get(flagUse).String(),
+		Env:     env,
+	})
+	if err != nil {
+		return err
+	}
+
+	return runDB(func(db *sql.DB) error {
+
+		items, err := loadItemsByID(db, ids)
+		if err != nil {
+			return err
+		}
+
+		return actOnItems(db, env, backend, actionPlay, "", items)
+	})
+}
+
+func runMark(opts Options, args []string, env *Env) error {
+	return runMarkItems(args, env, actionMark)
+}
+
+func runUnmark(opts Options, args []string, env *Env) error {
+	return runMarkItems(args, env, actionUnmark)
+}
+
+func runMarkItems(args []string, env *Env, action listItemAction) error {
+
+	if len(args) == 0 {
+		return ErrBadArgs
+	}
+
+	ids, err := parseItemIDs(args)
+	if err != nil {
+		return err
+	}
+
+	return runDB(func(db *sql.DB) error {
+
+		items, err := loadItemsByID(db, ids)
+		if err != nil {
+			return err
+		}
+
+		return actOnItems(db, env, nil, action, "", items)
+	})
+}
+
+// parseItemIDs parses item IDs given on the command line.
+func parseItemIDs(args []string) ([]int64, error) {
+
+	ids := make([]int64, len(args))
+
+	for i, arg := range args {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, errors.New("invalid item ID " + arg)
+		}
+		ids[i] = id
+	}
+
+	return ids, nil
+}
+
+func runImport(opts Options, args []string, env *Env) error {
+
+	if len(args) != 1 {
+		return ErrBadArgs
+	}
+
+	data, err := readImportFile(args[0], env)
+	if err != nil {
+		return err
+	}
+
+	format := opts.Get(flagFormat).Value().(fileFormat)
+	if format == fileFormatAuto {
+		format = detectFileFormat(data)
+	}
+
+	var extractURLs func(io.Reader) ([]string, map[string]*importDetails, error)
+
+	switch format {
+	case fileFormatList:
+		extractURLs = func(r io.Reader) ([]string, map[string]*importDetails, error) {
+			urls, err := extractURLsList(r)
+			return urls, nil, err
+		}
+	case fileFormatOPML:
+		extractURLs = extractURLsOPML
+	case fileFormatJSON:
+		extractURLs = extractURLsJSON
+	default:
+		return errors.New("unsupported file format")
+	}
+
+	urls, details, err := extractURLs(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	if opts.Get(flagDryRun).Bool() {
+		return runDB(func(db *sql.DB) error {
+
+			results, err := previewFeedMultiple(db, urls, env.Stdout)
+			if err != nil {
+				return err
+			}
+
+			resetOutput(env.Stdout)
+			printImportPreview(env.Stdout, results, env.Log.Enabled(logLevelInfo))
+			return nil
+		})
+	}
+
+	return runDB(func(db *sql.DB) error {
+
+		results := addFeedMultiple(db, env.Hooks, urls, env.Stdout)
+
+		for _, res := range results {
+			d := details[res.Source]
+			if res.Err != nil || d == nil {
+				continue
+			}
+			if err := applyImportDetails(db, res.ID, d); err != nil {
+				res.Warnings = append(res.Warnings, "could not apply details from file: "+err.Error())
+			}
+		}
+
+		resetOutput(env.Stdout)
+		logSyncResults(env.Log, results)
+		printImportResults(env.Stdout, results, env.Log.Enabled(logLevelInfo))
+		return nil
+	})
+}
+
+func printImportResults(w io.Writer, results []*syncResult, showWarnings bool) {
+
+	var oks, errs, warnings int
+
+	for _, res := range results {
+		if res.Err != nil {
+			errs++
+		} else {
+			oks++
+		}
+		warnings += len(res.Warnings)
+	}
+
+	fmt.Fprintf(w, "Added %d of %d feeds, %d errors", oks, len(results), errs)
+	printWarningCount(w, warnings, showWarnings)
+	fmt.Fprintln(w)
+
+	for _, res := range results {
+		if res.Err != nil {
+			fmt.Fprintln(w, res.Err)
+		}
+	}
+
+	if showWarnings {
+		printWarnings(w, results)
+	}
+}
+
+func runHistory(opts Options, args []string, env *Env) error {
+
+	if len(args) != 1 {
+		return ErrBadArgs
+	}
+
+	entries, err := readHistoryFile(args[0], opts.Get(flagFormat).Value().(historyFormat))
+	if err != nil {
+		return err
+	}
+
+	return runDB(func(db *sql.DB) error {
+
+		res, err := importHistory(db, env.Hooks, entries, env.Stdout)
+		if err != nil {
+			return err
+		}
+
+		resetOutput(env.Stdout)
+		logSyncResults(env.Log, res.Added)
+		printHistoryResults(env.Stdout, res, env.Log.Enabled(logLevelInfo))
+		return nil
+	})
+}
+
+func printHistoryResults(w io.Writer, res *historyResult, showUnmatched bool) {
+
+	if len(res.Added) > 0 {
+		printImportResults(w, res.Added, showUnmatched)
+	}
+
+	fmt.Fprintf(w, "Matched %d of %d items, %d updated", res.Matched, res.Entries, res.Updated)
+
+	switch unmatched := len(res.Unmatched); {
+	case unmatched == 0:
+	case showUnmatched:
+		fmt.Fprintf(w, ", %d not matched:\n", unmatched)
+		for _, s := range res.Unmatched {
+			fmt.Fprintln(w, "   ", s)
+		}
+		return
+	default:
+		fmt.Fprintf(w, ", %d not matched (use -v to list them)", unmatched)
+	}
+
+	fmt.Fprintln(w)
+}
+
+// readImportFile reads the contents of a file to import. The
+// name can be a local file, an http(s) URL or "-" for stdin.
+func readImportFile(name string, env *Env) ([]byte, error) {
+
+	var r io.Reader
+
+	switch {
+	case name == "-":
+		r = env.Stdin
+	case strings.HasPrefix(name, "http://"), strings.HasPrefix(name, "https://"):
+		return fetchURL(name)
+	default:
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+// printImportPreview writes a summary of what an import would
+// add, followed by the feeds themselves.
+func printImportPreview(w io.Writer, results []*syncResult, showWarnings bool) {
+
+	var oks, errs, warnings int
+
+	for _, res := range results {
+		if res.Err != nil {
+			errs++
+		} else {
+			oks++
+		}
+		warnings += len(res.Warnings)
+	}
+
+	fmt.Fprintf(w, "Dry run: would add %d of %d feeds, %d errors", oks, len(results), errs)
+	printWarningCount(w, warnings, showWarnings)
+	fmt.Fprintln(w)
+
+	for _, res := range results {
+		if res.Err == nil {
+			fmt.Fprintf(w, "Would add %s (%s) with %s\n", res.Title, res.URL, formatCount(int64(res.Items), "item"))
+		}
+	}
+
+	for _, res := range results {
+		if res.Err != nil {
+			fmt.Fprintf(w, "%s: %s\n", res.Source, res.Err)
+		}
+	}
+
+	if showWarnings {
+		printWarnings(w, results)
+	}
+}
+
+func runExport(opts Options, args []string, env *Env) error {
+
+	if len(args) != 1 {
+		return ErrBadArgs
+	}
+
+	format := opts.Get(flagFormat).Value().(fileFormat)
+	if format == fileFormatAuto {
+		format = exportFormatFromName(args[0])
+	}
+
+	var export func(*sql.DB, io.Writer) error
+
+	switch format {
+	case fileFormatList:
+		export = exportList
+	case fileFormatOPML:
+		export = func(db *sql.DB, w io.Writer) error {
+			return exportOPML(db, w, time.Now())
+		}
+	case fileFormatJSON:
+		export = exportJSON
+	default:
+		return errors.New("unsupported file format")
+	}
+
+	if args[0] == "-" {
+		return runDB(func(db *sql.DB) error {
+			return export(db, env.Stdout)
+		})
+	}
+
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return runDB(func(db *sql.DB) error {
+		return export(db, f)
+	})
+}
+
+// exportFormatFromName works out the export format from a file
+// extension, defaulting to a plain list.
+func exportFormatFromName(name string) fileFormat {
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".opml", ".xml":
+		return fileFormatOPML
+	case ".json":
+		return fileFormatJSON
+	default:
+		return fileFormatList
+	}
+}
+
+func runOpen(opts Options, args []string, env *Env) error {
+
+	choice, ok, err := getFeedChoice(opts, args)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrBadArgs
+	}
+
+	var name string
+	target := opts.Get(flagTarget).Value().(target)
+
+	switch target {
+	case targetFeed:
+		name = "RSS feed"
+	case targetImage:
+		name = "image"
+	case targetLink:
+		name = "website"
+	default:
+		return errors.New("unsupported target")
+	}
+
+	use := opts.Get(flagUse).String()
+
+	if _, err := parseCommand(use, nil); err != nil {
+		return err
+	}
+
+	return runDB(func(db *sql.DB) error {
+
+		id, err := chooseFeed(db, env, choice, "Open "+name+" for %s")
+		if err != nil {
+			return err
+		}
+
+		url, err := loadFeedURL(db, id, target)
+		if err != nil {
+			return err
+		}
+
+		if url == "" {
+			return errors.New("no " + name + " found for this feed")
+		}
+
+		data, err := loadFeedCommandData(db, id, url)
+		if err != nil {
+			return err
+		}
+
+		cmd, err := parseURLCommand(use, data)
+		if err != nil {
+			return err
+		}
+
+		env.attach(cmd)
+		return cmd.Start()
+	})
+}
+
+func runValidate(opts Options, args []string, env *Env) error {
+
+	var urls []string
+
+	if len(args) == 1 && isURL(args[0]) {
+		urls = args
+	} else {
+
+		choice, ok, err := getFeedChoice(opts, args)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrBadArgs
+		}
+
+		err = runDB(func(db *sql.DB) error {
+
+			ids, err := chooseFeeds(db, env, choice, "Check %s")
+			if err != nil {
+				return err
+			}
+
+			for _, id := range ids {
+				url, err := loadFeedURL(db, id, targetFeed)
+				if err != nil {
+					return err
+				}
+				urls = append(urls, url)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	problems := 0
 
-	if len(args) != 1 {
-		return ErrBadArgs
-	}
+	for i, url := range urls {
 
-	return runDB(func(db *sql.DB) error {
+		env.Log.Debugf("validating %s", url)
 
-		id, err := chooseFeed(db, args[0], "Remove %s", true)
+		v, err := validateFeed(url)
 		if err != nil {
-			return err
+			return errors.New("could not check " + url + ": " + err.Error())
 		}
 
-		return removeFeed(db, id)
-	})
-}
-
-func runUpdate(opts Options, args []string, env *Env) error {
+		if i > 0 {
+			fmt.Fprintln(env.Stdout)
+		}
+		printValidation(env.Stdout, v)
 
-	if len(args) != 1 {
-		return ErrBadArgs
+		problems += len(v.Problems)
 	}
 
-	fieldsByFlag := map[string]string{
-		flagTitle:  "title",
-		flagAuthor: "author",
-		flagDesc:   "desc",
-		flagLink:   "link",
-		flagImage:  "image",
+	// Return an error so that scripts can tell when a feed
+	// has problems.
+	if problems > 0 {
+		return fmt.Errorf("%d problems found", problems)
 	}
 
-	values := map[string]interface{}{}
+	return nil
+}
 
-	for _, opt := range opts {
+func isURL(s string) bool {
+	s = strings.ToLower(s)
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
 
-		s := strings.TrimSpace(opt.String())
-		if s == "" {
-			continue
-		}
+func runTUI(opts Options, args []string, env *Env) error {
 
-		fieldName, ok := fieldsByFlag[opt.Name]
-		if !ok {
-			return errors.New("unsupported update " + opt.Name)
-		}
+	if len(args) != 0 {
+		return ErrBadArgs
+	}
 
-		values[fieldName] = s
+	var backend playerBackend
+
+	app := opts.Get(flagUse).String()
+	typ := opts.Get(flagPlayer).Value().(playerType)
+
+	if app != "" || typ != playerExec {
+		var err error
+		backend, err = newPlayerBackend(playerOptions{
+			Type:    typ,
+			Program: app,
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	if len(values) == 0 {
-		return errors.New("no values to update")
+	// The terminal's settings are changed with stty, which needs
+	// an actual terminal rather than any old reader.
+	tty, ok := env.Stdin.(*os.File)
+	if !ok {
+		return errors.New("tui requires a terminal")
 	}
 
 	return runDB(func(db *sql.DB) error {
 
-		id, err := chooseFeed(db, args[0], "Update %s", true)
+		term, err := newTTYTerminal(tty, env.Stdout)
 		if err != nil {
 			return err
 		}
+		defer term.Close()
 
-		return updateFeed(db, id, values)
+		return newTUIApp(db, env.Hooks, backend).Run(term, readKeys(tty))
 	})
 }
 
-func runSync(opts Options, args []string, env *Env) error {
+func runDaemon(opts Options, args []string, env *Env) error {
 
-	switch len(args) {
-	case 0:
-		return runDB(runSyncAll)
-	case 1:
-		return runDB(func(db *sql.DB) error {
-			return runSyncOne(db, args[0])
-		})
-	default:
+	if len(args) > 1 || (len(args) == 1 && args[0] != "status") {
 		return ErrBadArgs
 	}
-}
-
-func runSyncAll(db *sql.DB) error {
-
-	results, err := syncAll(db)
-	if err != nil {
-		return err
-	}
-
-	resetOutput()
-	printSyncResults(results)
-	return nil
-}
 
-func runSyncOne(db *sql.DB, feedName string) error {
-
-	id, err := chooseFeed(db, feedName, "Sync %s", false)
+	path, err := daemonSocketPath()
 	if err != nil {
 		return err
 	}
 
-	res, err := syncOne(db, id)
-	if err != nil {
-		return err
+	if len(args) == 1 {
+		status, err := readDaemonStatus(path)
+		if err != nil {
+			return err
+		}
+		printDaemonStatus(env.Stdout, status, time.Now())
+		return nil
 	}
 
-	fmt.Printf("%s: ", res.Title)
-
-	resetOutput()
-	printSyncResults([]*syncResult{res})
-	return nil
-}
-
-func printSyncResults(results []*syncResult) {
-
-	items, errs := 0, 0
-
-	for _, res := range results {
+	return runDB(func(db *sql.DB) error {
 
-		items += res.Items
-		if res.Err != nil {
-			errs++
+		l, err := listenStatus(path)
+		if err != nil {
+			return err
 		}
-	}
-
-	switch items {
-	case 0:
-		fmt.Print("No new items")
-	case 1:
-		fmt.Print("1 new item")
-	default:
-		fmt.Printf("%d new items", items)
-	}
+		defer l.Close()
 
-	switch errs {
-	case 0:
-	case 1:
-		fmt.Print(", 1 error")
-	default:
-		fmt.Printf(", %d errors", errs)
-	}
+		d := newDaemon(db, env.Hooks, realClock{}, env.Log)
+		go d.serveStatus(l)
 
-	fmt.Println()
+		stop := make(chan struct{})
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(sigs)
 
-	i := 0
-	for _, res := range results {
+		go func() {
+			<-sigs
+			close(stop)
+		}()
 
-		if res.Err == nil {
-			continue
-		}
+		fmt.Fprintln(env.Stdout, "Daemon started, press Ctrl+C to stop")
 
-		fmt.Println(i+1, res.Title, res.Err)
-		i++
-	}
+		return d.run(stop)
+	})
 }
 
-func runFeeds(opts Options, args []string, env *Env) error {
+func runServe(opts Options, args []string, env *Env) error {
 
 	if len(args) != 0 {
 		return ErrBadArgs
 	}
 
-	listOpts := listFeedOptions{
-		SortBy:    opts.Get(flagSortBy).Value().(sortFeedsBy),
-		SortOrder: opts.Get(flagSortOrder).Value().(sortOrder),
-		Limit:     opts.Get(flagLimit).Uint(),
-		Title:     opts.Get(flagWithTitle).String(),
-		Author:    opts.Get(flagWithAuthor).String(),
-		ShowDesc:  opts.Get(flagShowDesc).Bool(),
-	}
+	addr := opts.Get(flagAddr).String()
+	mediaDir := opts.Get(flagMediaDir).String()
 
 	return runDB(func(db *sql.DB) error {
-		return listFeeds(db, env.Stdout, defaultFeedTemplate(time.Now()), listOpts)
+
+		fmt.Fprintf(env.Stdout, "Listening on http://%s\n", addr)
+
+		server := &http.Server{
+			Addr:    addr,
+			Handler: newAPIServer(db, env.Hooks, mediaDir, addr),
+		}
+
+		return server.ListenAndServe()
 	})
 }
 
-func runList(opts Options, args []string, env *Env) error {
+func runPublish(opts Options, args []string, env *Env) error {
 
-	nArgs := len(args)
-	if nArgs != 0 && nArgs != 1 {
+	if len(args) < 1 {
 		return ErrBadArgs
 	}
 
-	action := actionNone
-
-	switch {
-	case opts.Get(flagPlay).Bool():
-		action = actionPlay
-	case opts.Get(flagRun).Bool():
-		action = actionRun
-	case opts.Get(flagMark).Bool():
-		action = actionMark
-	case opts.Get(flagUnmark).Bool():
-		action = actionUnmark
+	choice, ok, err := getFeedChoice(opts, args[1:])
+	if err != nil {
+		return err
 	}
 
 	listOpts := listItemOptions{
@@ -447,155 +1947,86 @@ func runList(opts Options, args []string, env *Env) error {
 		Unplayed:  opts.Get(flagUnplayed).Bool(),
 		StartDate: opts.Get(flagStartDate).Value().(time.Time),
 		Title:     opts.Get(flagWithTitle).String(),
-		ShowDesc:  opts.Get(flagShowDesc).Bool(),
-		Action:    action,
-		Use:       opts.Get(flagUse).String(),
+	}
+
+	pubOpts := publishOptions{
+		Title:    opts.Get(flagTitle).String(),
+		MediaDir: opts.Get(flagMediaDir).String(),
+		MediaURL: opts.Get(flagMediaURL).String(),
+	}
+
+	if pubOpts.MediaDir != "" && pubOpts.MediaURL == "" {
+		return errors.New("--" + flagMediaDir + " requires --" + flagMediaURL)
 	}
 
 	return runDB(func(db *sql.DB) error {
 
-		if nArgs == 1 {
-			feedID, err := chooseFeed(db, args[0], "List %s", false)
+		if ok {
+			feedID, err := chooseFeed(db, env, choice, "Publish %s")
 			if err != nil {
 				return err
 			}
 			listOpts.FeedID = feedID
 		}
 
-		return listItems(db, env.Stdout, defaultItemTemplate(time.Now()), listOpts)
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return publishItems(db, f, listOpts, pubOpts, time.Now())
 	})
 }
 
-func runImport(opts Options, args []string, env *Env) error {
+func runGpodder(opts Options, args []string, env *Env) error {
 
-	if len(args) != 1 {
+	if len(args) != 0 {
 		return ErrBadArgs
 	}
 
-	var extractURLs func(io.Reader) ([]string, error)
-
-	switch opts.Get(flagFormat).Value().(fileFormat) {
-	case fileFormatList:
-		extractURLs = extractURLsList
-	case fileFormatOPML:
-		extractURLs = extractURLsOPML
-	default:
-		return errors.New("unsupported file format")
+	user := opts.Get(flagUser).String()
+	if user == "" {
+		return errors.New("no username given")
 	}
 
-	f, err := os.Open(args[0])
-	if err != nil {
-		return err
+	password := opts.Get(flagPassword).String()
+	if password == "" {
+		password = os.Getenv("KIBNER_GPODDER_PASSWORD")
 	}
-	defer f.Close()
 
-	urls, err := extractURLs(f)
-	if err != nil {
-		return err
-	}
+	c := newGpodderClient(opts.Get(flagServer).String(), user, password, opts.Get(flagDevice).String())
 
 	return runDB(func(db *sql.DB) error {
-		resetOutput()
-		printImportResults(addFeedMultiple(db, urls))
-		return nil
-	})
-}
-
-func printImportResults(results []*syncResult) {
-
-	var oks, errs int
-
-	for _, res := range results {
-		if res.Err != nil {
-			errs++
-		} else {
-			oks++
-		}
-	}
-
-	fmt.Printf("Added %d of %d feeds, %d errors\n", oks, len(results), errs)
-
-	for _, res := range results {
-		if res.Err != nil {
-			fmt.Println(res.Err)
-		}
-	}
-}
-
-func runExport(opts Options, args []string, env *Env) error {
-
-	if len(args) != 1 {
-		return ErrBadArgs
-	}
 
-	var export func(*sql.DB, io.Writer) error
-
-	switch opts.Get(flagFormat).Value().(fileFormat) {
-	case fileFormatList:
-		export = exportList
-	case fileFormatOPML:
-		export = func(db *sql.DB, w io.Writer) error {
-			return exportOPML(db, w, time.Now())
+		res, err := gpodderSync(db, env.Hooks, c)
+		if err != nil {
+			return err
 		}
-	default:
-		return errors.New("unsupported file format")
-	}
-
-	f, err := os.Create(args[0])
-	if err != nil {
-		return err
-	}
-	defer f.Close()
 
-	return runDB(func(db *sql.DB) error {
-		return export(db, f)
+		resetOutput(env.Stdout)
+		printGpodderResults(env.Stdout, res)
+		return nil
 	})
 }
 
-func runOpen(opts Options, args []string, env *Env) error {
-
-	if len(args) != 1 {
-		return ErrBadArgs
-	}
-
-	var name string
-	target := opts.Get(flagTarget).Value().(target)
-
-	switch target {
-	case targetFeed:
-		name = "RSS feed"
-	case targetImage:
-		name = "image"
-	case targetLink:
-		name = "website"
-	default:
-		return errors.New("unsupported target")
-	}
-
-	cmd, err := parseCommand(opts.Get(flagUse).String())
-	if err != nil {
-		return err
-	}
-
-	return runDB(func(db *sql.DB) error {
+func printGpodderResults(w io.Writer, res *gpodderResult) {
 
-		id, err := chooseFeed(db, args[0], "Open "+name+" for %s", false)
-		if err != nil {
-			return err
+	var adds int
+	for _, r := range res.LocalAdds {
+		if r.Err == nil {
+			adds++
 		}
+	}
 
-		url, err := loadFeedURL(db, id, target)
-		if err != nil {
-			return err
-		}
+	fmt.Fprintf(w, "Subscriptions: %d added, %d removed locally; %d added, %d removed on server\n", adds, res.LocalRemoves, res.RemoteAdds, res.RemoteRemoves)
+	fmt.Fprintf(w, "Episode actions: %d uploaded, %d applied, %d skipped\n", res.ActionsSent, res.ActionsApplied, res.ActionsSkipped)
 
-		if url == "" {
-			return errors.New("no " + name + " found for this feed")
+	for _, r := range res.LocalAdds {
+		if r.Err != nil {
+			fmt.Fprintln(w, r.URL, r.Err)
 		}
-
-		cmd.Args = append(cmd.Args, url)
-		return cmd.Start()
-	})
+	}
 }
 
 func runReset(opts Options, args []string, env *Env) error {
@@ -604,7 +2035,11 @@ func runReset(opts Options, args []string, env *Env) error {
 		return ErrBadArgs
 	}
 
-	c, err := ask("Reset Kibner (this will wipe all existing data!)? Yes, No", "yn")
+	if opts.Get(flagYes).Bool() {
+		return runDB(initDB)
+	}
+
+	c, err := ask(env, "Reset Kibner (this will wipe all existing data!)? Yes, No", "yn")
 	if err != nil {
 		return err
 	}
@@ -622,7 +2057,7 @@ func runVersion(opts Options, args []string, env *Env) error {
 		return ErrBadArgs
 	}
 
-	fmt.Printf("Kibner v%s\n", version)
+	fmt.Fprintf(env.Stdout, "Kibner v%s\n", version)
 	return nil
 }
 
@@ -646,6 +2081,7 @@ const (
 	sortFeedsByItemCount
 	sortFeedsByUnplayedCount
 	sortFeedsByTimestamp
+	sortFeedsByTag
 )
 
 type sortOrder uint
@@ -661,6 +2097,18 @@ type fileFormat uint
 const (
 	fileFormatList fileFormat = iota
 	fileFormatOPML
+	fileFormatJSON
+	fileFormatAuto
+)
+
+type historyFormat uint
+
+const (
+	historyFormatAuto historyFormat = iota
+	historyFormatAntennaPod
+	historyFormatGPodder
+	historyFormatOPML
+	historyFormatCSV
 )
 
 type target uint
@@ -852,6 +2300,23 @@ func openDB() (*sql.DB, error) {
 	return dbAtPath(path)
 }
 
+// daemonSocketPath returns the path of the socket that the
+// daemon reports its status on.
+func daemonSocketPath() (string, error) {
+
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(home, ".config", "kibner")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "daemon.sock"), nil
+}
+
 func dbAtPath(path string) (*sql.DB, error) {
 
 	isNew := false
@@ -866,18 +2331,31 @@ func dbAtPath(path string) (*sql.DB, error) {
 		return nil, err
 	}
 
+	// Kibner can run as several processes at once (the server,
+	// the daemon, hooks and the command line) so writers wait
+	// for each other instead of failing with "database is
+	// locked". WAL mode lets readers carry on during a write,
+	// and immediate transactions take the write lock up front,
+	// where the busy timeout applies, rather than part way
+	// through.
 	db, err := connect(path, map[string]string{
 		"_foreign_keys": "1",
+		"_busy_timeout": strconv.FormatInt(int64(defaults.BusyTimeout/time.Millisecond), 10),
+		"_journal_mode": "WAL",
+		"_txlock":       "immediate",
 	})
 	if err != nil {
 		return nil, err
 	}
 
 	if isNew {
-		if err := initDB(db); err != nil {
-			db.Close()
-			return nil, err
-		}
+		err = initDB(db)
+	} else {
+		err = upgradeDB(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
 	}
 
 	return db, nil
@@ -897,7 +2375,7 @@ func connect(path string, options map[string]string) (*sql.DB, error) {
 	return sql.Open("sqlite3", "file:"+path)
 }
 
-func resetOutput() {
+func resetOutput(w io.Writer) {
 	// TODO: Implement on Windows
-	fmt.Printf("%c[2K\r", 27)
+	fmt.Fprintf(w, "%c[2K\r", 27)
 }
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// mpvBackend plays URLs with mpv, which is controlled over its
+// JSON IPC socket. See https://mpv.io/manual/stable/#json-ipc.
+func mpvBackend(program string, env *Env) playerBackend {
+	return func(item *commandData) (player, error) {
+
+		dir, err := ioutil.TempDir("", "kibner-mpv")
+		if err != nil {
+			return nil, err
+		}
+
+		sock := filepath.Join(dir, "mpv.sock")
+
+		args := []string{"--input-ipc-server=" + sock}
+		if item.Position > 0 {
+			args = append(args, fmt.Sprintf("--start=%d", item.Position))
+		}
+		if env == nil {
+			args = append(args, "--no-terminal")
+		}
+		args = append(args, "--", item.URL)
+
+		cmd, err := parseCommand(program, item, args...)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+
+		proc, err := startProcess(cmd, env, func() {
+			os.RemoveAll(dir)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := dialPlayer("unix", sock, proc.Done())
+		if err != nil {
+			proc.Kill()
+			<-proc.Done()
+			return nil, errors.New("Could not connect to mpv: " + err.Error())
+		}
+
+		return &mpvPlayer{
+			process: proc,
+			client:  newMPVClient(conn),
+		}, nil
+	}
+}
+
+// dialPlayer connects to a player's control socket. Players
+// take a moment to create their sockets so dialPlayer keeps
+// trying until it connects, the player exits or it times out.
+func dialPlayer(network, addr string, done <-chan struct{}) (net.Conn, error) {
+
+	timeout := time.After(defaults.Timeout)
+
+	for {
+		conn, err := net.Dial(network, addr)
+		if err == nil {
+			return conn, nil
+		}
+
+		select {
+		case <-done:
+			return nil, errors.New("player exited")
+		case <-timeout:
+			return nil, err
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+type mpvPlayer struct {
+	*process
+	client *mpvClient
+}
+
+func (p *mpvPlayer) Pause(paused bool) error {
+	_, err := p.client.Command("set_property", "pause", paused)
+	return err
+}
+
+func (p *mpvPlayer) Seek(pos time.Duration) error {
+	_, err := p.client.Command("seek", pos.Seconds(), "absolute")
+	return err
+}
+
+func (p *mpvPlayer) SetSpeed(speed float64) error {
+	_, err := p.client.Command("set_property", "speed", speed)
+	return err
+}
+
+func (p *mpvPlayer) Position() (time.Duration, error) {
+	return p.client.Seconds("time-pos")
+}
+
+func (p *mpvPlayer) Duration() (time.Duration, error) {
+	return p.client.Seconds("duration")
+}
+
+func (p *mpvPlayer) Stop() error {
+
+	if _, err := p.client.Command("quit"); err != nil {
+		return p.Kill()
+	}
+
+	return nil
+}
+
+// Err returns errPlaybackStopped if mpv exited before the end
+// of the file, e.g. because the user quit.
+func (p *mpvPlayer) Err() error {
+
+	if err := p.process.Err(); err != nil {
+		return err
+	}
+
+	// Make sure we've seen all of mpv's messages.
+	select {
+	case <-p.client.closed:
+	case <-time.After(time.Second):
+	}
+
+	if reason := p.client.EndReason(); reason != "" && reason != "eof" {
+		return errPlaybackStopped
+	}
+
+	return nil
+}
+
+type mpvRequest struct {
+	Command   []interface{} `json:"command"`
+	RequestID int64         `json:"request_id"`
+}
+
+type mpvMessage struct {
+	Data      json.RawMessage `json:"data"`
+	Error     string          `json:"error"`
+	RequestID int64           `json:"request_id"`
+	Event     string          `json:"event"`
+	Reason    string          `json:"reason"`
+}
+
+// mpvClient sends commands to mpv. It's safe for concurrent use.
+type mpvClient struct {
+	conn   io.ReadWriteCloser
+	closed chan struct{}
+
+	wmu sync.Mutex
+
+	mu        sync.Mutex
+	nextID    int64
+	pending   map[int64]chan *mpvMessage
+	err       error
+	endReason string
+}
+
+func newMPVClient(conn io.ReadWriteCloser) *mpvClient {
+
+	c := &mpvClient{
+		conn:    conn,
+		closed:  make(chan struct{}),
+		pending: map[int64]chan *mpvMessage{},
+	}
+
+	go c.read()
+	return c
+}
+
+func (c *mpvClient) read() {
+
+	dec := json.NewDecoder(c.conn)
+
+	for {
+		var msg mpvMessage
+		if err := dec.Decode(&msg); err != nil {
+			c.close(err)
+			return
+		}
+
+		c.mu.Lock()
+
+		switch {
+		case msg.Event == "end-file":
+			c.endReason = msg.Reason
+		case msg.Event == "":
+			if ch, ok := c.pending[msg.RequestID]; ok {
+				delete(c.pending, msg.RequestID)
+				ch <- &msg
+			}
+		}
+
+		c.mu.Unlock()
+	}
+}
+
+func (c *mpvClient) close(err error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	if err == io.EOF {
+		err = errors.New("connection closed")
+	}
+
+	c.err = errors.New("mpv: " + err.Error())
+
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+
+	c.conn.Close()
+	close(c.closed)
+}
+
+func (c *mpvClient) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// EndReason returns the reason given by mpv's most recent
+// end-file event.
+func (c *mpvClient) EndReason() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.endReason
+}
+
+// Command runs an mpv command and returns its result.
+func (c *mpvClient) Command(args ...interface{}) (json.RawMessage, error) {
+
+	c.mu.Lock()
+
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+
+	c.nextID++
+	id := c.nextID
+	ch := make(chan *mpvMessage, 1)
+	c.pending[id] = ch
+
+	c.mu.Unlock()
+
+	b, err := json.Marshal(mpvRequest{args, id})
+	if err != nil {
+		return nil, err
+	}
+
+	c.wmu.Lock()
+	_, err = c.conn.Write(append(b, '\n'))
+	c.wmu.Unlock()
+
+	if err != nil {
+		c.close(err)
+		return nil, c.closeErr()
+	}
+
+	msg, ok := <-ch
+	if !ok {
+		return nil, c.closeErr()
+	}
+
+	switch msg.Error {
+	case "success":
+		return msg.Data, nil
+	case "property unavailable":
+		return nil, errPositionUnavailable
+	default:
+		return nil, errors.New("mpv: " + msg.Error)
+	}
+}
+
+// Seconds reads a property measured in seconds.
+func (c *mpvClient) Seconds(property string) (time.Duration, error) {
+
+	data, err := c.Command("get_property", property)
+	if err != nil {
+		return 0, err
+	}
+
+	var secs float64
+	if err := json.Unmarshal(data, &secs); err != nil {
+		return 0, errors.New("mpv: invalid " + property + ": " + err.Error())
+	}
+
+	return time.Duration(secs * float64(time.Second)), nil
+}
@@ -2,17 +2,32 @@ package main
 
 import (
 	"encoding/xml"
-	"errors"
 	"io"
+	"strings"
 	"time"
 )
 
+// entry is an outline element. Feeds have a URL. Outlines
+// without one are folders, which contain other outlines.
 type entry struct {
-	Type  string `xml:"type,attr"`
-	Text  string `xml:"text,attr"`
-	Title string `xml:"title,attr"`
-	Desc  string `xml:"description,attr"`
-	URL   string `xml:"xmlUrl,attr"`
+	Type     string   `xml:"type,attr,omitempty"`
+	Text     string   `xml:"text,attr"`
+	Title    string   `xml:"title,attr,omitempty"`
+	Desc     string   `xml:"description,attr,omitempty"`
+	URL      string   `xml:"xmlUrl,attr,omitempty"`
+	Link     string   `xml:"htmlUrl,attr,omitempty"`
+	Image    string   `xml:"imageUrl,attr,omitempty"`
+	Language string   `xml:"language,attr,omitempty"`
+	Category string   `xml:"category,attr,omitempty"`
+	Entries  []*entry `xml:"outline"`
+}
+
+// name returns the entry's display name.
+func (e *entry) name() string {
+	if s := strings.TrimSpace(e.Text); s != "" {
+		return s
+	}
+	return strings.TrimSpace(e.Title)
 }
 
 type opml struct {
@@ -31,6 +46,69 @@ func newOPML(title string) *opml {
 	}
 }
 
+// categories returns the entry's categories as tags. The
+// category attribute is a comma-separated list of categories,
+// which are either flat (news) or slash-delimited paths
+// starting with a slash (/news/tech).
+func (e *entry) categories() []string {
+
+	var tags []string
+
+	for _, s := range strings.Split(e.Category, ",") {
+		if tag, err := normaliseTag(s); err == nil {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+// setCategories sets the category attribute to the given tags.
+// Tags are written as category paths so that nested tags keep
+// their hierarchy.
+func (e *entry) setCategories(tags []string) {
+
+	categories := make([]string, len(tags))
+	for i, tag := range tags {
+		categories[i] = "/" + tag
+	}
+
+	e.Category = strings.Join(categories, ",")
+}
+
+// folder returns the folder for the given tag, creating it and
+// any parent folders if they don't already exist. Folders are
+// keyed by their lowercase paths in the given map.
+func (o *opml) folder(tag string, folders map[string]*entry) *entry {
+
+	var path string
+	var folder *entry
+
+	entries := &o.Entries
+
+	for _, name := range strings.Split(tag, "/") {
+
+		if path != "" {
+			path += "/"
+		}
+		path += strings.ToLower(name)
+
+		f, ok := folders[path]
+		if !ok {
+			f = &entry{
+				Text: name,
+			}
+			folders[path] = f
+			*entries = append(*entries, f)
+		}
+
+		folder = f
+		entries = &f.Entries
+	}
+
+	return folder
+}
+
 func (o *opml) writeTo(w io.Writer) error {
 
 	_, err := w.Write([]byte(xml.Header))
@@ -57,21 +135,17 @@ func (ot *opmltime) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 		return err
 	}
 
-	layouts := []string{
-		time.RFC1123Z, // "Mon, 02 Jan 2006 15:04:05 -0700"
-		time.RFC1123,  // "Mon, 02 Jan 2006 15:04:05 MST"
-		time.RFC822Z,  // "02 Jan 06 15:04 -0700"
-		time.RFC822,   // "02 Jan 06 15:04 MST"
-	}
-
-	for _, l := range layouts {
-		if t, err := time.Parse(l, s); err == nil {
-			*ot = opmltime(t)
-			return nil
-		}
+	// Exporters write all sorts of dates here (AntennaPod
+	// uses "02 Jan 06 15:04:05 -0700", for example). We
+	// don't use the date for anything, so a date we can't
+	// read isn't worth rejecting the whole file over.
+	t, err := parsePubdate(s)
+	if err != nil {
+		t = time.Time{}
 	}
 
-	return errors.New("unsupported date format: " + s)
+	*ot = opmltime(t)
+	return nil
 }
 
 func (ot *opmltime) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExtractURLsOPMLSamples(t *testing.T) {
+
+	tests := []struct {
+		Filename string
+		URLs     []string
+		Details  map[string]*importDetails
+	}{
+		{
+			// Every feed is in a "feeds" folder, which isn't a
+			// tag. Playlists and episodes are ignored.
+			Filename: "overcast.opml",
+			URLs: []string{
+				"http://feeds.serialpodcast.org/serialpodcast",
+				"http://feeds.feedburner.com/basecamp/rework",
+			},
+			Details: map[string]*importDetails{
+				"http://feeds.serialpodcast.org/serialpodcast": {
+					Title: "Serial",
+					Link:  "https://serialpodcast.org",
+				},
+				"http://feeds.feedburner.com/basecamp/rework": {
+					Title: "Rework (Basecamp)",
+					Link:  "https://rework.fm",
+				},
+			},
+		},
+		{
+			Filename: "pocketcasts.opml",
+			URLs: []string{
+				"http://www.columbopodcast.com/feed/podcast/",
+				"http://feeds.earhustlesq.com/earhustlesq",
+			},
+			Details: map[string]*importDetails{
+				"http://www.columbopodcast.com/feed/podcast/": {
+					Title: "Columbo",
+				},
+				"http://feeds.earhustlesq.com/earhustlesq": {
+					Title: "Ear Hustle",
+				},
+			},
+		},
+		{
+			// Has a dateCreated in a non-standard format.
+			Filename: "antennapod.opml",
+			URLs: []string{
+				"https://audioboom.com/channels/2399216.rss",
+				"https://feeds.megaphone.fm/uncivil",
+			},
+			Details: map[string]*importDetails{
+				"https://audioboom.com/channels/2399216.rss": {
+					Title: "No Such Thing As A Fish",
+					Link:  "http://www.qi.com/podcast",
+				},
+				"https://feeds.megaphone.fm/uncivil": {
+					Title: "Uncivil",
+					Link:  "https://www.gimletmedia.com/uncivil",
+				},
+			},
+		},
+		{
+			// Nested folders and categories. Uncivil appears
+			// twice, so its tags are combined.
+			Filename: "folders.opml",
+			URLs: []string{
+				"https://www.wired.com/feed/podcast/gadget-lab",
+				"http://feeds.feedburner.com/RevisionistHistory",
+				"https://feeds.megaphone.fm/uncivil",
+			},
+			Details: map[string]*importDetails{
+				"https://www.wired.com/feed/podcast/gadget-lab": {
+					Title:    "Gadget Lab",
+					Tags:     []string{"Technology/Gadgets", "favourites", "News/Tech"},
+					Link:     "https://www.wired.com",
+					Image:    "https://www.wired.com/gadget-lab.jpg",
+					Language: "en-us",
+				},
+				"http://feeds.feedburner.com/RevisionistHistory": {
+					Title: "Revisionist History",
+					Tags:  []string{"History"},
+				},
+				"https://feeds.megaphone.fm/uncivil": {
+					Title: "Uncivil",
+					Tags:  []string{"History", "Gimlet"},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		f, err := os.Open(filepath.Join("internal", "testdata", "opml", test.Filename))
+		if err != nil {
+			t.Fatalf("%s: Open returned error %q", test.Filename, err)
+		}
+
+		urls, details, err := extractURLsOPML(f)
+		f.Close()
+
+		if err != nil {
+			t.Errorf("%s: extractURLsOPML returned error %q", test.Filename, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(urls, test.URLs) {
+			t.Errorf("%s: expected extractURLsOPML to return urls %s, got %s", test.Filename, jsonify(test.URLs), jsonify(urls))
+		}
+
+		if !reflect.DeepEqual(details, test.Details) {
+			t.Errorf("%s: expected extractURLsOPML to return details %s, got %s", test.Filename, jsonify(test.Details), jsonify(details))
+		}
+	}
+}
+
+func TestApplyImportDetails(t *testing.T) {
+	testWithInitDB(t, testApplyImportDetails)
+}
+
+func testApplyImportDetails(t *testing.T, db *sql.DB) {
+
+	feed := allTestCases["Serial"].NewFeed()
+
+	id, err := saveFeed(db, feed, time.Now())
+	if err != nil {
+		t.Fatalf("saveFeed returned error %q", err)
+	}
+
+	err = applyImportDetails(db, id, &importDetails{
+		Title:    "My Serial",
+		Tags:     []string{"true crime"},
+		Link:     "http://example.com",
+		Language: "en",
+	})
+	if err != nil {
+		t.Fatalf("applyImportDetails returned error %q", err)
+	}
+
+	var got struct {
+		Title    string
+		Link     string
+		Language string
+	}
+
+	err = db.QueryRow("SELECT title, link, language FROM feeds WHERE id = ?", id).Scan(&got.Title, &got.Link, &got.Language)
+	if err != nil {
+		t.Fatalf("Error loading feed: %s", err)
+	}
+
+	// The title is overridden but the feed's own link is
+	// kept. Missing details are filled in.
+	if got.Title != "My Serial" || got.Link != feed.Link || got.Language != "en" {
+		t.Errorf("expected feed to have title %q, link %q and language %q, got %+v", "My Serial", feed.Link, "en", got)
+	}
+
+	tags, err := loadFeedTags(db)
+	if err != nil {
+		t.Fatalf("loadFeedTags returned error %q", err)
+	}
+
+	if exp := []string{"true crime"}; !reflect.DeepEqual(tags[id], exp) {
+		t.Errorf("expected feed to have tags %v, got %v", exp, tags[id])
+	}
+}
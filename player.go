@@ -0,0 +1,340 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+type playerType uint
+
+const (
+	playerExec playerType = iota
+	playerMPV
+	playerVLC
+)
+
+var (
+	errPlayerUnsupported   = errors.New("not supported by this player")
+	errPositionUnavailable = errors.New("position unavailable")
+	errPlaybackStopped     = errors.New("playback stopped")
+)
+
+// playedMargin is how close to the end of an item playback
+// has to get for the item to count as played.
+const playedMargin = 60 * time.Second
+
+// A player controls the playback of a single URL. Players that
+// can't do something return errPlayerUnsupported.
+type player interface {
+	Pause(paused bool) error
+	Seek(pos time.Duration) error
+	SetSpeed(speed float64) error
+	Position() (time.Duration, error)
+	Duration() (time.Duration, error)
+	Stop() error
+	// Done returns a channel that's closed when the player
+	// exits. Err then returns the reason, if any.
+	Done() <-chan struct{}
+	Err() error
+}
+
+// A playerBackend starts playing an item's URL from the item's
+// position.
+type playerBackend func(item *commandData) (player, error)
+
+type playerOptions struct {
+	Type playerType
+	// Program is the player command. It defaults to mpv or
+	// vlc for those player types, and is required for exec.
+	Program string
+	// Env, if set, is the environment the player reads input
+	// from and writes output to. Otherwise it runs in the
+	// background without any input or output.
+	Env *Env
+}
+
+func newPlayerBackend(opts playerOptions) (playerBackend, error) {
+
+	program := opts.Program
+
+	if program == "" {
+		switch opts.Type {
+		case playerMPV:
+			program = "mpv"
+		case playerVLC:
+			program = "vlc"
+		}
+	}
+
+	if _, err := parseCommand(program, nil); err != nil {
+		return nil, err
+	}
+
+	switch opts.Type {
+	case playerExec:
+		return execBackend(program, opts.Env), nil
+	case playerMPV:
+		return mpvBackend(program, opts.Env), nil
+	case playerVLC:
+		return vlcBackend(program, opts.Env), nil
+	default:
+		return nil, errors.New("unsupported player type")
+	}
+}
+
+// process is a running player program.
+type process struct {
+	cmd     *exec.Cmd
+	done    chan struct{}
+	err     error
+	cleanup func()
+}
+
+func startProcess(cmd *exec.Cmd, env *Env, cleanup func()) (*process, error) {
+
+	if env != nil {
+		env.attach(cmd)
+		env.Log.Debugf("running %q", cmd.Args)
+	}
+
+	if err := cmd.Start(); err != nil {
+		if cleanup != nil {
+			cleanup()
+		}
+		return nil, err
+	}
+
+	p := &process{
+		cmd:     cmd,
+		done:    make(chan struct{}),
+		cleanup: cleanup,
+	}
+
+	go func() {
+		p.err = cmd.Wait()
+		if p.cleanup != nil {
+			p.cleanup()
+		}
+		close(p.done)
+	}()
+
+	return p, nil
+}
+
+func (p *process) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *process) Err() error {
+	<-p.done
+	return p.err
+}
+
+func (p *process) Kill() error {
+
+	select {
+	case <-p.done:
+		return nil
+	default:
+	}
+
+	return p.cmd.Process.Kill()
+}
+
+// execPlayer runs an arbitrary program on the URL. Kibner can
+// start and stop it, but that's all.
+type execPlayer struct {
+	*process
+}
+
+func execBackend(program string, env *Env) playerBackend {
+	return func(item *commandData) (player, error) {
+
+		cmd, err := parseURLCommand(program, item)
+		if err != nil {
+			return nil, err
+		}
+
+		proc, err := startProcess(cmd, env, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return &execPlayer{proc}, nil
+	}
+}
+
+func (p *execPlayer) Pause(bool) error {
+	return errPlayerUnsupported
+}
+
+func (p *execPlayer) Seek(time.Duration) error {
+	return errPlayerUnsupported
+}
+
+func (p *execPlayer) SetSpeed(float64) error {
+	return errPlayerUnsupported
+}
+
+func (p *execPlayer) Position() (time.Duration, error) {
+	return 0, errPlayerUnsupported
+}
+
+func (p *execPlayer) Duration() (time.Duration, error) {
+	return 0, errPlayerUnsupported
+}
+
+func (p *execPlayer) Stop() error {
+	return p.Kill()
+}
+
+// playback plays an item, resuming from and saving progress to
+// the database.
+type playback struct {
+	player
+	db    *sql.DB
+	hooks *hookRunner
+	id    int64
+
+	mu       sync.Mutex
+	position time.Duration
+	duration time.Duration
+	tracked  bool
+}
+
+func startItemPlayback(db *sql.DB, hooks *hookRunner, backend playerBackend, id int64) (*playback, error) {
+
+	items, err := loadItemsByID(db, []int64{id})
+	if err != nil {
+		return nil, err
+	}
+
+	secs, err := loadItemPosition(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := backend(newItemCommandData(items[0], secs))
+	if err != nil {
+		return nil, err
+	}
+
+	pb := &playback{
+		player:   p,
+		db:       db,
+		hooks:    hooks,
+		id:       id,
+		position: time.Duration(secs) * time.Second,
+	}
+
+	return pb, nil
+}
+
+// Progress returns the position and duration as of the last
+// call to SaveProgress. The bool is false if the player can't
+// report its position.
+func (pb *playback) Progress() (time.Duration, time.Duration, bool) {
+
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	return pb.position, pb.duration, pb.tracked
+}
+
+// SaveProgress asks the player for its position and saves it
+// to the database.
+func (pb *playback) SaveProgress() error {
+
+	pos, err := pb.Position()
+	if err == errPlayerUnsupported || err == errPositionUnavailable {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Not every player knows the duration (e.g. live streams).
+	dur, _ := pb.Duration()
+
+	pb.mu.Lock()
+	pb.position, pb.duration, pb.tracked = pos, dur, true
+	pb.mu.Unlock()
+
+	return saveItemPosition(pb.db, pb.id, int64(pos/time.Second))
+}
+
+// Wait waits for playback to finish, saving progress every time
+// ticks fires. If the item played to the end, it's marked as
+// played. If stop is closed, or the player exits early, Wait
+// returns errPlaybackStopped.
+func (pb *playback) Wait(ticks <-chan time.Time, stop <-chan struct{}) error {
+
+	for {
+		select {
+		case <-ticks:
+			// Errors here are usually because the player is
+			// on its way out, which is handled below.
+			pb.SaveProgress()
+
+		case <-stop:
+			pb.SaveProgress()
+			pb.Stop()
+			<-pb.Done()
+			return errPlaybackStopped
+
+		case <-pb.Done():
+			if err := pb.Err(); err != nil {
+				return err
+			}
+
+			// The player has exited so its position is no
+			// longer available. Use the last known value.
+			pos, dur, tracked := pb.Progress()
+			if tracked && dur > 0 && dur-pos > playedMargin {
+				return errPlaybackStopped
+			}
+
+			if err := updatePlayedStatus(pb.db, pb.hooks, true, pb.id); err != nil {
+				return err
+			}
+
+			return saveItemPosition(pb.db, pb.id, 0)
+		}
+	}
+}
+
+// playItem plays an item from start to finish, saving progress
+// as it goes. It returns errPlaybackStopped if the user quits
+// the player before the end.
+func playItem(db *sql.DB, hooks *hookRunner, backend playerBackend, id int64) error {
+
+	pb, err := startItemPlayback(db, hooks, backend, id)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(defaults.SaveInterval)
+	defer ticker.Stop()
+
+	return pb.Wait(ticker.C, nil)
+}
+
+func loadItemPosition(db *sql.DB, id int64) (int64, error) {
+
+	var secs int64
+
+	err := db.QueryRow("SELECT position FROM items WHERE id = ?", id).Scan(&secs)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return secs, err
+}
+
+func saveItemPosition(db *sql.DB, id int64, secs int64) error {
+	_, err := db.Exec("UPDATE items SET position = ?, updated = ? WHERE id = ?", secs, time.Now().Unix(), id)
+	return err
+}
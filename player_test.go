@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBackend is a playerBackend whose players don't play
+// anything. Tests set their positions and tell them when to
+// finish.
+type fakeBackend struct {
+	sync.Mutex
+	players []*fakePlayer
+	// Unsupported players behave like execPlayer.
+	Unsupported bool
+}
+
+func (b *fakeBackend) Start(item *commandData) (player, error) {
+
+	b.Lock()
+	defer b.Unlock()
+
+	start := time.Duration(item.Position) * time.Second
+
+	p := &fakePlayer{
+		URL:         item.URL,
+		Start:       start,
+		position:    start,
+		speed:       1,
+		unsupported: b.Unsupported,
+		done:        make(chan struct{}),
+	}
+
+	b.players = append(b.players, p)
+	return p, nil
+}
+
+func (b *fakeBackend) Players() []*fakePlayer {
+	b.Lock()
+	defer b.Unlock()
+	return append([]*fakePlayer(nil), b.players...)
+}
+
+func (b *fakeBackend) Last() *fakePlayer {
+	players := b.Players()
+	if len(players) == 0 {
+		return nil
+	}
+	return players[len(players)-1]
+}
+
+type fakePlayer struct {
+	sync.Mutex
+	URL         string
+	Start       time.Duration
+	position    time.Duration
+	duration    time.Duration
+	speed       float64
+	paused      bool
+	unsupported bool
+	commands    []string
+	done        chan struct{}
+	err         error
+}
+
+func (p *fakePlayer) command(format string, args ...interface{}) error {
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.unsupported {
+		return errPlayerUnsupported
+	}
+
+	p.commands = append(p.commands, fmt.Sprintf(format, args...))
+	return nil
+}
+
+func (p *fakePlayer) Commands() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string(nil), p.commands...)
+}
+
+func (p *fakePlayer) Pause(paused bool) error {
+	if err := p.command("pause %t", paused); err != nil {
+		return err
+	}
+	p.Lock()
+	p.paused = paused
+	p.Unlock()
+	return nil
+}
+
+func (p *fakePlayer) Seek(pos time.Duration) error {
+	if err := p.command("seek %s", pos); err != nil {
+		return err
+	}
+	p.Lock()
+	p.position = pos
+	p.Unlock()
+	return nil
+}
+
+func (p *fakePlayer) SetSpeed(speed float64) error {
+	if err := p.command("speed %g", speed); err != nil {
+		return err
+	}
+	p.Lock()
+	p.speed = speed
+	p.Unlock()
+	return nil
+}
+
+func (p *fakePlayer) SetProgress(pos, dur time.Duration) {
+	p.Lock()
+	p.position, p.duration = pos, dur
+	p.Unlock()
+}
+
+func (p *fakePlayer) Position() (time.Duration, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.unsupported {
+		return 0, errPlayerUnsupported
+	}
+	return p.position, nil
+}
+
+func (p *fakePlayer) Duration() (time.Duration, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.unsupported {
+		return 0, errPlayerUnsupported
+	}
+	return p.duration, nil
+}
+
+func (p *fakePlayer) Stop() error {
+	p.Lock()
+	p.commands = append(p.commands, "stop")
+	p.Unlock()
+	p.Finish(nil)
+	return nil
+}
+
+// Finish ends playback with the given error.
+func (p *fakePlayer) Finish(err error) {
+
+	p.Lock()
+	defer p.Unlock()
+
+	select {
+	case <-p.done:
+	default:
+		p.err = err
+		close(p.done)
+	}
+}
+
+func (p *fakePlayer) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *fakePlayer) Err() error {
+	<-p.done
+	p.Lock()
+	defer p.Unlock()
+	return p.err
+}
+
+func TestPlayback(t *testing.T) {
+	testWithInitDB(t, testPlayback)
+}
+
+func testPlayback(t *testing.T, db *sql.DB) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	res, err := addFeed(db, nil, serverURL(ts, allTestCases["Serial"].Filename))
+	if err != nil {
+		t.Fatalf("addFeed returned error %q", err)
+	}
+
+	items := allTestCases["Serial"].NewFeed().Items
+	url := items[0].URL
+	id := itemIDByURL(t, db, url)
+	hour := time.Hour
+
+	if err := updatePlayedStatus(db, nil, false, id); err != nil {
+		t.Fatalf("updatePlayedStatus returned error %q", err)
+	}
+
+	if err := saveItemPosition(db, id, 120); err != nil {
+		t.Fatalf("saveItemPosition returned error %q", err)
+	}
+
+	data := []struct {
+		Name        string
+		Unsupported bool
+		Position    time.Duration
+		Duration    time.Duration
+		Stop        bool
+		Err         error
+		ExpErr      error
+		ExpPosition int64
+		ExpUnplayed int
+	}{
+		{
+			Name:        "Resume and quit early",
+			Position:    300 * time.Second,
+			Duration:    hour,
+			ExpErr:      errPlaybackStopped,
+			ExpPosition: 300,
+			ExpUnplayed: 1,
+		},
+		{
+			Name:        "Stop",
+			Position:    600 * time.Second,
+			Duration:    hour,
+			Stop:        true,
+			ExpErr:      errPlaybackStopped,
+			ExpPosition: 600,
+			ExpUnplayed: 1,
+		},
+		{
+			Name:        "Player error",
+			Position:    900 * time.Second,
+			Duration:    hour,
+			Err:         errors.New("boom"),
+			ExpErr:      errors.New("boom"),
+			ExpPosition: 900,
+			ExpUnplayed: 1,
+		},
+		{
+			Name:        "Play to the end",
+			Position:    hour - 30*time.Second,
+			Duration:    hour,
+			ExpPosition: 0,
+			ExpUnplayed: 0,
+		},
+		{
+			Name:        "Unsupported",
+			Unsupported: true,
+			ExpPosition: 0,
+			ExpUnplayed: 0,
+		},
+	}
+
+	for _, test := range data {
+
+		if test.Unsupported {
+			if err := updatePlayedStatus(db, nil, false, id); err != nil {
+				t.Fatalf("updatePlayedStatus returned error %q", err)
+			}
+		}
+
+		prev, err := loadItemPosition(db, id)
+		if err != nil {
+			t.Fatalf("%s: loadItemPosition returned error %q", test.Name, err)
+		}
+
+		backend := &fakeBackend{Unsupported: test.Unsupported}
+
+		pb, err := startItemPlayback(db, nil, backend.Start, id)
+		if err != nil {
+			t.Fatalf("%s: startItemPlayback returned error %q", test.Name, err)
+		}
+
+		fake := backend.Last()
+		if fake.URL != url || fake.Start != time.Duration(prev)*time.Second {
+			t.Errorf("%s: expected player to start %s at %ds, got %s at %s", test.Name, url, prev, fake.URL, fake.Start)
+		}
+
+		ticks := make(chan time.Time)
+		stop := make(chan struct{})
+		result := make(chan error)
+
+		go func() {
+			result <- pb.Wait(ticks, stop)
+		}()
+
+		fake.SetProgress(test.Position, test.Duration)
+		ticks <- time.Now()
+
+		if test.Stop {
+			close(stop)
+		} else {
+			fake.Finish(test.Err)
+		}
+
+		if err := <-result; !equalErrors(err, test.ExpErr) {
+			t.Errorf("%s: expected Wait to return %v, got %v", test.Name, test.ExpErr, err)
+		}
+
+		if test.Stop {
+			verifyStrings(t, "commands", fake.Commands(), []string{"stop"})
+		}
+
+		if pos, _ := loadItemPosition(db, id); pos != test.ExpPosition {
+			t.Errorf("%s: expected position %d, got %d", test.Name, test.ExpPosition, pos)
+		}
+
+		verifyUnplayedItemCount(t, db, res.ID, test.ExpUnplayed)
+	}
+}
+
+func TestExecBackend(t *testing.T) {
+	testWithInitDB(t, testExecBackend)
+}
+
+func testExecBackend(t *testing.T, db *sql.DB) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	res, err := addFeed(db, nil, serverURL(ts, allTestCases["Serial"].Filename))
+	if err != nil {
+		t.Fatalf("addFeed returned error %q", err)
+	}
+
+	id := itemIDByURL(t, db, allTestCases["Serial"].NewFeed().Items[0].URL)
+
+	if err := updatePlayedStatus(db, nil, false, id); err != nil {
+		t.Fatalf("updatePlayedStatus returned error %q", err)
+	}
+
+	if _, err := newPlayerBackend(playerOptions{Type: playerExec}); err == nil {
+		t.Errorf("Expected an error for an exec player with no program")
+	}
+
+	if _, err := newPlayerBackend(playerOptions{Type: playerMPV, Program: "kibner-no-such-player"}); err == nil {
+		t.Errorf("Expected an error for a missing program")
+	}
+
+	backend, err := newPlayerBackend(playerOptions{Type: playerExec, Program: "false"})
+	if err != nil {
+		t.Fatalf("newPlayerBackend returned error %q", err)
+	}
+
+	if err := playItem(db, nil, backend, id); err == nil {
+		t.Errorf("Expected playItem to return an error")
+	}
+
+	verifyUnplayedItemCount(t, db, res.ID, 1)
+
+	backend, err = newPlayerBackend(playerOptions{Type: playerExec, Program: "true"})
+	if err != nil {
+		t.Fatalf("newPlayerBackend returned error %q", err)
+	}
+
+	if err := playItem(db, nil, backend, id); err != nil {
+		t.Errorf("playItem returned error %q", err)
+	}
+
+	verifyUnplayedItemCount(t, db, res.ID, 0)
+}
+
+// fakeMPV answers mpv IPC requests on conn and records the
+// commands it receives.
+func fakeMPV(conn net.Conn, commands chan<- string) {
+
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+
+	// Events can arrive at any time.
+	enc.Encode(map[string]string{"event": "file-loaded"})
+
+	for {
+		var req mpvRequest
+		if err := dec.Decode(&req); err != nil {
+			conn.Close()
+			return
+		}
+
+		args := make([]string, len(req.Command))
+		for i, arg := range req.Command {
+			args[i] = fmt.Sprint(arg)
+		}
+
+		cmd := strings.Join(args, " ")
+
+		resp := map[string]interface{}{
+			"request_id": req.RequestID,
+			"error":      "success",
+		}
+
+		switch cmd {
+		case "get_property time-pos":
+			resp["data"] = 12.5
+		case "get_property duration":
+			resp["data"] = 3600
+		case "get_property nonsense":
+			resp["error"] = "property not found"
+		case "get_property chapter":
+			resp["error"] = "property unavailable"
+		case "quit":
+			enc.Encode(map[string]string{"event": "end-file", "reason": "quit"})
+		}
+
+		enc.Encode(resp)
+
+		if commands != nil {
+			commands <- cmd
+		}
+
+		if cmd == "quit" {
+			conn.Close()
+			return
+		}
+	}
+}
+
+func TestMPVClient(t *testing.T) {
+
+	client, server := net.Pipe()
+	commands := make(chan string, 10)
+
+	go fakeMPV(server, commands)
+
+	p := &mpvPlayer{
+		client: newMPVClient(client),
+	}
+
+	if err := p.Pause(true); err != nil {
+		t.Errorf("Pause returned error %q", err)
+	}
+
+	if err := p.Seek(90 * time.Second); err != nil {
+		t.Errorf("Seek returned error %q", err)
+	}
+
+	if err := p.SetSpeed(1.5); err != nil {
+		t.Errorf("SetSpeed returned error %q", err)
+	}
+
+	if pos, err := p.Position(); err != nil || pos != 12500*time.Millisecond {
+		t.Errorf("Expected position 12.5s, got %s (%v)", pos, err)
+	}
+
+	if dur, err := p.Duration(); err != nil || dur != time.Hour {
+		t.Errorf("Expected duration 1h, got %s (%v)", dur, err)
+	}
+
+	if _, err := p.client.Seconds("nonsense"); err == nil || err.Error() != "mpv: property not found" {
+		t.Errorf("Expected property not found error, got %v", err)
+	}
+
+	if _, err := p.client.Seconds("chapter"); err != errPositionUnavailable {
+		t.Errorf("Expected errPositionUnavailable, got %v", err)
+	}
+
+	if err := p.Stop(); err != nil {
+		t.Errorf("Stop returned error %q", err)
+	}
+
+	<-p.client.closed
+
+	if reason := p.client.EndReason(); reason != "quit" {
+		t.Errorf("Expected end reason quit, got %q", reason)
+	}
+
+	if _, err := p.Position(); err == nil {
+		t.Errorf("Expected an error after the connection closed")
+	}
+
+	close(commands)
+
+	var got []string
+	for cmd := range commands {
+		got = append(got, cmd)
+	}
+
+	verifyStrings(t, "commands", got, []string{
+		"set_property pause true",
+		"seek 90 absolute",
+		"set_property speed 1.5",
+		"get_property time-pos",
+		"get_property duration",
+		"get_property nonsense",
+		"get_property chapter",
+		"quit",
+	})
+}
+
+// fakeVLC answers VLC RC commands on conn, prefixing responses
+// with prompts and noise like the real thing.
+func fakeVLC(conn net.Conn, commands chan<- string) {
+
+	r := bufio.NewReader(conn)
+	playing := true
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		cmd := strings.TrimSpace(line)
+		if strings.HasPrefix(cmd, "kibner-") {
+			fmt.Fprintf(conn, "> Unknown command `%s'. Type `help' for help.\n", cmd)
+			continue
+		}
+
+		commands <- cmd
+
+		switch cmd {
+		case "get_time":
+			fmt.Fprint(conn, "> status change: ( time: 42s )\n> 42\n")
+		case "get_length":
+			fmt.Fprint(conn, "3600\n")
+		case "is_playing":
+			if playing {
+				fmt.Fprint(conn, "> 1\n")
+			} else {
+				fmt.Fprint(conn, "> 0\n")
+			}
+		case "pause":
+			playing = !playing
+		case "seek 90":
+			// Output that nobody reads, which shouldn't be
+			// mistaken for the response to a later query.
+			fmt.Fprint(conn, "> status change: ( time: 90s )\n> 90\n")
+		case "shutdown":
+			conn.Close()
+			return
+		}
+	}
+}
+
+func TestVLCClient(t *testing.T) {
+
+	// Use a real socket rather than net.Pipe, which would
+	// block on output that the client doesn't read.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned error %q", err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial returned error %q", err)
+	}
+	defer client.Close()
+
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept returned error %q", err)
+	}
+
+	commands := make(chan string, 20)
+
+	go fakeVLC(server, commands)
+
+	p := &vlcPlayer{
+		client: newVLCClient(client),
+	}
+
+	for _, paused := range []bool{true, true, false} {
+		if err := p.Pause(paused); err != nil {
+			t.Errorf("Pause returned error %q", err)
+		}
+	}
+
+	if err := p.Seek(90 * time.Second); err != nil {
+		t.Errorf("Seek returned error %q", err)
+	}
+
+	if err := p.SetSpeed(1.5); err != nil {
+		t.Errorf("SetSpeed returned error %q", err)
+	}
+
+	if pos, err := p.Position(); err != nil || pos != 42*time.Second {
+		t.Errorf("Expected position 42s, got %s (%v)", pos, err)
+	}
+
+	if dur, err := p.Duration(); err != nil || dur != time.Hour {
+		t.Errorf("Expected duration 1h, got %s (%v)", dur, err)
+	}
+
+	if n, err := p.client.Int("get_title"); err == nil {
+		t.Errorf("Expected get_title to return an error, got %d", n)
+	}
+
+	if err := p.Stop(); err != nil {
+		t.Errorf("Stop returned error %q", err)
+	}
+
+	var got []string
+	for len(got) < 11 {
+		select {
+		case cmd := <-commands:
+			got = append(got, cmd)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for commands, got %v", got)
+		}
+	}
+
+	verifyStrings(t, "commands", got, []string{
+		"is_playing",
+		"pause",
+		"is_playing",
+		"is_playing",
+		"pause",
+		"seek 90",
+		"rate 1.5",
+		"get_time",
+		"get_length",
+		"get_title",
+		"shutdown",
+	})
+}
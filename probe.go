@@ -0,0 +1,648 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The number of bytes to read from the start of a file.
+	// It's enough for most ID3 tags (unless they contain large
+	// images) and MP3 frame headers.
+	probeHeadSize = 64 * 1024
+
+	// The number of bytes to search for an MP3 frame header
+	// after any ID3 tag.
+	probeFrameSize = 16 * 1024
+
+	// The largest MP4 moov atom we're prepared to download.
+	probeMaxAtomSize = 16 * 1024 * 1024
+
+	// How much of a file we'll download to get to a header
+	// when the server doesn't support range requests.
+	probeMaxSkip = 32 * 1024 * 1024
+)
+
+var errUnknownFormat = errors.New("unrecognised file format")
+
+// probeDuration works out the duration of the media file at
+// url by reading its headers, using HTTP range requests to
+// avoid downloading the whole thing. MP3 and MP4/M4A files
+// are supported. The filesize from the feed is used for MP3
+// files with a constant bitrate if the server doesn't say how
+// big the file is.
+func probeDuration(url string, filesize int64) (time.Duration, error) {
+
+	r := &rangeReader{
+		url:  url,
+		size: filesize,
+	}
+
+	head, err := r.ReadRange(0, probeHeadSize)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(head) >= 8 && string(head[4:8]) == "ftyp" {
+		return probeMP4(r, head)
+	}
+
+	return probeMP3(r, head)
+}
+
+// rangeReader reads parts of a remote file.
+type rangeReader struct {
+	url  string
+	size int64
+}
+
+// ReadRange returns up to n bytes of the file, starting at
+// offset. It returns fewer than n bytes if the file ends first.
+func (r *rangeReader) ReadRange(offset, n int64) ([]byte, error) {
+
+	req, err := newRequest(r.url)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+n-1))
+
+	resp, err := defaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if total := contentRangeSize(resp.Header.Get("Content-Range")); total > 0 {
+			r.size = total
+		}
+	case http.StatusOK:
+		// The server ignored the range and is sending the
+		// whole file.
+		if resp.ContentLength > 0 {
+			r.size = resp.ContentLength
+		}
+		if offset > probeMaxSkip {
+			return nil, errors.New("server does not support range requests")
+		}
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			return nil, err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, nil
+	default:
+		return nil, errors.New("bad status: " + resp.Status)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(resp.Body, n))
+}
+
+// contentRangeSize returns the total size from a Content-Range
+// header, e.g. "bytes 0-99/1234". It returns zero if the size
+// is missing or unknown.
+func contentRangeSize(s string) int64 {
+
+	i := strings.LastIndex(s, "/")
+	if i < 0 {
+		return 0
+	}
+
+	n, err := strconv.ParseInt(s[i+1:], 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return n
+}
+
+// probeMP3 gets the duration of an MP3 file from its ID3 tag,
+// if the tag has a TLEN frame, or from the first MPEG frame.
+func probeMP3(r *rangeReader, head []byte) (time.Duration, error) {
+
+	var start int64
+
+	if len(head) >= 10 && string(head[:3]) == "ID3" {
+
+		if d := id3Length(head); d > 0 {
+			return d, nil
+		}
+
+		start = 10 + int64(syncsafeInt(head[6:10]))
+		if head[5]&0x10 != 0 {
+			// Footer
+			start += 10
+		}
+	}
+
+	buf := head
+	switch {
+	case start+probeFrameSize <= int64(len(head)):
+		buf = head[start:]
+	default:
+		var err error
+		buf, err = r.ReadRange(start, probeFrameSize)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	pos, frame, ok := findMPEGFrame(buf)
+	if !ok {
+		return 0, errUnknownFormat
+	}
+
+	if frames := vbrFrameCount(buf[pos:], frame); frames > 0 {
+		return frame.duration(frames), nil
+	}
+
+	// Assume a constant bitrate.
+	if r.size <= 0 {
+		return 0, errors.New("unknown file size")
+	}
+
+	audio := r.size - start - int64(pos)
+	if audio <= 0 {
+		return 0, errUnknownFormat
+	}
+
+	return time.Duration(float64(audio) * 8 / float64(frame.bitrate) * float64(time.Second)), nil
+}
+
+// id3Length returns the value of the TLEN (length in
+// milliseconds) frame of an ID3v2 tag, or zero if there isn't
+// one in the given data.
+func id3Length(tag []byte) time.Duration {
+
+	version := tag[3]
+	size := 10 + syncsafeInt(tag[6:10])
+	if size > len(tag) {
+		size = len(tag)
+	}
+
+	id, idLen, headerLen := "TLEN", 4, 10
+	if version == 2 {
+		id, idLen, headerLen = "TLE", 3, 6
+	}
+
+	pos := 10
+
+	// Skip the extended header.
+	if tag[5]&0x40 != 0 && version > 2 && pos+4 <= size {
+		n := int(binary.BigEndian.Uint32(tag[pos:]))
+		if version == 4 {
+			pos += syncsafeInt(tag[pos:])
+		} else {
+			pos += 4 + n
+		}
+	}
+
+	for pos+headerLen <= size && tag[pos] != 0 {
+
+		var n int
+		switch version {
+		case 2:
+			n = int(tag[pos+3])<<16 | int(tag[pos+4])<<8 | int(tag[pos+5])
+		case 4:
+			n = syncsafeInt(tag[pos+4:])
+		default:
+			n = int(binary.BigEndian.Uint32(tag[pos+4:]))
+		}
+
+		data := tag[pos+headerLen:]
+		if n < 0 || n > len(data) {
+			break
+		}
+		data = data[:n]
+
+		if string(tag[pos:pos+idLen]) == id && len(data) > 1 {
+			// Skip the encoding byte and pick out the digits,
+			// which works for any of the text encodings.
+			var digits []byte
+			for _, b := range data[1:] {
+				if b >= '0' && b <= '9' {
+					digits = append(digits, b)
+				}
+			}
+			ms, _ := strconv.ParseInt(string(digits), 10, 64)
+			return time.Duration(ms) * time.Millisecond
+		}
+
+		pos += headerLen + n
+	}
+
+	return 0
+}
+
+// syncsafeInt decodes a 28-bit ID3 "syncsafe" integer, which
+// uses the low 7 bits of 4 bytes.
+func syncsafeInt(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// mpegFrame holds the details of an MPEG audio frame header.
+type mpegFrame struct {
+	version    int // 1, 2, or 3 for MPEG 2.5
+	layer      int
+	bitrate    int // bits per second
+	sampleRate int
+	padding    int
+	mono       bool
+}
+
+// Bitrates in kbps, indexed by version (MPEG 1 or 2/2.5),
+// layer and the bitrate bits of the header.
+var mpegBitrates = [2][3][15]int{
+	{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	},
+	{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	},
+}
+
+// Sample rates indexed by version and the sample rate bits of
+// the header.
+var mpegSampleRates = [3][3]int{
+	{44100, 48000, 32000},
+	{22050, 24000, 16000},
+	{11025, 12000, 8000},
+}
+
+// parseMPEGFrame decodes the 4-byte frame header at the start
+// of b.
+func parseMPEGFrame(b []byte) (mpegFrame, bool) {
+
+	var f mpegFrame
+
+	if len(b) < 4 || b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return f, false
+	}
+
+	switch (b[1] >> 3) & 3 {
+	case 0:
+		f.version = 3
+	case 2:
+		f.version = 2
+	case 3:
+		f.version = 1
+	default:
+		return f, false
+	}
+
+	layer := int((b[1] >> 1) & 3)
+	if layer == 0 {
+		return f, false
+	}
+	f.layer = 4 - layer
+
+	bitrate := int(b[2] >> 4)
+	rate := int((b[2] >> 2) & 3)
+	if bitrate == 0 || bitrate == 15 || rate == 3 {
+		// Free format, or invalid.
+		return f, false
+	}
+
+	table := 0
+	if f.version > 1 {
+		table = 1
+	}
+
+	f.bitrate = mpegBitrates[table][f.layer-1][bitrate] * 1000
+	f.sampleRate = mpegSampleRates[f.version-1][rate]
+	f.padding = int((b[2] >> 1) & 1)
+	f.mono = b[3]>>6 == 3
+
+	return f, true
+}
+
+// samples returns the number of audio samples in the frame.
+func (f mpegFrame) samples() int {
+	switch {
+	case f.layer == 1:
+		return 384
+	case f.layer == 3 && f.version > 1:
+		return 576
+	default:
+		return 1152
+	}
+}
+
+// size returns the length of the frame in bytes.
+func (f mpegFrame) size() int {
+	if f.layer == 1 {
+		return (12*f.bitrate/f.sampleRate + f.padding) * 4
+	}
+	return f.samples()/8*f.bitrate/f.sampleRate + f.padding
+}
+
+// duration returns the duration of the given number of frames.
+func (f mpegFrame) duration(frames int) time.Duration {
+	return time.Duration(float64(frames) * float64(f.samples()) / float64(f.sampleRate) * float64(time.Second))
+}
+
+// findMPEGFrame returns the position of the first frame header
+// in b. To avoid being fooled by stray bytes that look like a
+// header, the next frame has to start where this one ends (as
+// long as b is long enough to check).
+func findMPEGFrame(b []byte) (int, mpegFrame, bool) {
+
+	for pos := 0; pos+4 <= len(b); pos++ {
+
+		f, ok := parseMPEGFrame(b[pos:])
+		if !ok {
+			continue
+		}
+
+		next := pos + f.size()
+		if next+4 <= len(b) {
+			if _, ok := parseMPEGFrame(b[next:]); !ok {
+				continue
+			}
+		}
+
+		return pos, f, true
+	}
+
+	return 0, mpegFrame{}, false
+}
+
+// vbrFrameCount returns the number of frames in a variable
+// bitrate file, as recorded in a Xing (or Info) or VBRI header
+// in the first frame. It returns zero if there's no header.
+func vbrFrameCount(b []byte, f mpegFrame) int {
+
+	// The Xing header follows the side information, whose
+	// size depends on the version and the number of channels.
+	offset := 4 + 32
+	switch {
+	case f.version == 1 && f.mono:
+		offset = 4 + 17
+	case f.version > 1 && f.mono:
+		offset = 4 + 9
+	case f.version > 1:
+		offset = 4 + 17
+	}
+
+	if len(b) >= offset+12 {
+		x := b[offset:]
+		if bytes.HasPrefix(x, []byte("Xing")) || bytes.HasPrefix(x, []byte("Info")) {
+			if flags := binary.BigEndian.Uint32(x[4:]); flags&1 != 0 {
+				return int(binary.BigEndian.Uint32(x[8:]))
+			}
+		}
+	}
+
+	// The VBRI header is always 32 bytes after the frame
+	// header.
+	if len(b) >= 4+32+18 {
+		if x := b[4+32:]; bytes.HasPrefix(x, []byte("VBRI")) {
+			return int(binary.BigEndian.Uint32(x[14:]))
+		}
+	}
+
+	return 0
+}
+
+// probeMP4 gets the duration of an MP4 file from the movie
+// header (mvhd) in its moov atom. The moov atom can come before
+// or after the media data, so we skip from atom to atom until
+// we find it.
+func probeMP4(r *rangeReader, head []byte) (time.Duration, error) {
+
+	var offset int64
+
+	for {
+
+		var hdr []byte
+		if offset+16 <= int64(len(head)) {
+			hdr = head[offset : offset+16]
+		} else {
+			var err error
+			hdr, err = r.ReadRange(offset, 16)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		if len(hdr) < 8 {
+			return 0, errors.New("no movie header found")
+		}
+
+		size := int64(binary.BigEndian.Uint32(hdr))
+		typ := string(hdr[4:8])
+		hlen := int64(8)
+
+		switch size {
+		case 0:
+			// The atom runs to the end of the file.
+			if r.size <= 0 {
+				return 0, errors.New("no movie header found")
+			}
+			size = r.size - offset
+		case 1:
+			// 64-bit size.
+			if len(hdr) < 16 {
+				return 0, errors.New("no movie header found")
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:]))
+			hlen = 16
+		}
+
+		if size < hlen {
+			return 0, errors.New("invalid atom size")
+		}
+
+		if typ == "moov" {
+
+			if size > probeMaxAtomSize {
+				return 0, errors.New("movie header is too big")
+			}
+
+			var moov []byte
+			if offset+size <= int64(len(head)) {
+				moov = head[offset+hlen : offset+size]
+			} else {
+				var err error
+				moov, err = r.ReadRange(offset+hlen, size-hlen)
+				if err != nil {
+					return 0, err
+				}
+			}
+
+			return mvhdDuration(moov)
+		}
+
+		offset += size
+	}
+}
+
+// mvhdDuration finds the mvhd atom in the contents of a moov
+// atom and returns the duration it records.
+func mvhdDuration(moov []byte) (time.Duration, error) {
+
+	for len(moov) >= 8 {
+
+		size := int(binary.BigEndian.Uint32(moov))
+		if size < 8 || size > len(moov) {
+			break
+		}
+
+		if string(moov[4:8]) != "mvhd" {
+			moov = moov[size:]
+			continue
+		}
+
+		b := moov[8:size]
+
+		var timescale uint32
+		var duration uint64
+
+		switch {
+		case len(b) >= 20 && b[0] == 0:
+			timescale = binary.BigEndian.Uint32(b[12:])
+			duration = uint64(binary.BigEndian.Uint32(b[16:]))
+		case len(b) >= 32 && b[0] == 1:
+			timescale = binary.BigEndian.Uint32(b[20:])
+			duration = binary.BigEndian.Uint64(b[24:])
+		default:
+			return 0, errors.New("invalid movie header")
+		}
+
+		if timescale == 0 {
+			return 0, errors.New("invalid movie header")
+		}
+
+		return time.Duration(float64(duration) / float64(timescale) * float64(time.Second)), nil
+	}
+
+	return 0, errors.New("no movie header found")
+}
+
+// probeItem is an item whose duration is to be probed.
+type probeItem struct {
+	ID       int64
+	Title    string
+	URL      string
+	Filesize int64
+}
+
+type probeResult struct {
+	Items    int
+	Found    int
+	Warnings []string
+}
+
+// loadProbeItems returns the items in the given feeds (or in
+// every feed, if feedIDs is empty) that have no duration and
+// haven't been probed before. If force is true, it returns
+// every item so that existing durations can be corrected.
+func loadProbeItems(db *sql.DB, feedIDs []int64, force bool) ([]probeItem, error) {
+
+	var where []string
+	var params []interface{}
+
+	if len(feedIDs) > 0 {
+		placeholders := make([]string, len(feedIDs))
+		for i, id := range feedIDs {
+			placeholders[i] = "?"
+			params = append(params, id)
+		}
+		where = append(where, "feedid IN("+strings.Join(placeholders, ", ")+")")
+	}
+
+	if !force {
+		where = append(where, "duration = 0", "probed = 0")
+	}
+
+	q := "SELECT id, title, url, filesize FROM items"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY pubdate DESC, id DESC"
+
+	var items []probeItem
+	if err := queryRows(&items, db, q, params...); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// probeItems probes the durations of the given items and saves
+// them in the database. Items are marked as probed even if the
+// probe fails, so that they're not probed again every time.
+// Progress messages are written to progress, which may be nil.
+func probeItems(db *sql.DB, items []probeItem, maxWorkers int, progress io.Writer) (*probeResult, error) {
+
+	type probed struct {
+		item     probeItem
+		duration time.Duration
+		err      error
+	}
+
+	results := make(chan probed)
+	workers := make(chan struct{}, maxWorkers)
+
+	for i := range items {
+		go func(item probeItem) {
+			workers <- struct{}{}
+			d, err := probeDuration(item.URL, item.Filesize)
+			results <- probed{item, d, err}
+		}(items[i])
+	}
+
+	res := &probeResult{
+		Items: len(items),
+	}
+
+	now := time.Now()
+	var err error
+
+	for i := range items {
+
+		p := <-results
+		<-workers
+
+		printProgress(progress, "Probed %d of %d items...", i+1, len(items))
+
+		// Keep going after a database error so that the
+		// workers aren't left blocked.
+		if err != nil {
+			continue
+		}
+
+		if p.err == nil && p.duration <= 0 {
+			p.err = errors.New("no duration found")
+		}
+
+		if p.err != nil {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("%q: %s", p.item.Title, p.err))
+			_, err = db.Exec("UPDATE items SET probed = ? WHERE id = ?", now.Unix(), p.item.ID)
+			continue
+		}
+
+		res.Found++
+		_, err = db.Exec("UPDATE items SET duration = ?, probed = ? WHERE id = ?", int64(p.duration.Round(time.Second).Seconds()), now.Unix(), p.item.ID)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	kibner "github.com/deepilla/kibner/internal/types"
+)
+
+// An MPEG 1 Layer III frame header: 128kbps, 44.1kHz, stereo.
+var testMP3Header = []byte{0xff, 0xfb, 0x90, 0x00}
+
+const (
+	testMP3FrameSize = 417
+	testMP3Samples   = 1152
+	testMP3Rate      = 44100
+)
+
+// testMP3 returns an MP3 file with the given number of frames.
+// If vbrFrames is non-zero, the first frame has a Xing header
+// claiming that the file has that many frames.
+func testMP3(frames, vbrFrames int) []byte {
+
+	var buf bytes.Buffer
+
+	for i := 0; i < frames; i++ {
+
+		frame := make([]byte, testMP3FrameSize)
+		copy(frame, testMP3Header)
+
+		if i == 0 && vbrFrames > 0 {
+			copy(frame[4+32:], "Xing")
+			binary.BigEndian.PutUint32(frame[4+32+4:], 1)
+			binary.BigEndian.PutUint32(frame[4+32+8:], uint32(vbrFrames))
+		}
+
+		buf.Write(frame)
+	}
+
+	return buf.Bytes()
+}
+
+// testID3 returns an ID3v2.3 tag containing the given frames,
+// which are alternating IDs and values.
+func testID3(frames ...string) []byte {
+
+	var body bytes.Buffer
+
+	for i := 0; i+1 < len(frames); i += 2 {
+		body.WriteString(frames[i])
+		binary.Write(&body, binary.BigEndian, uint32(len(frames[i+1])+1))
+		body.Write([]byte{0, 0, 0})
+		body.WriteString(frames[i+1])
+	}
+
+	// Padding
+	body.Write(make([]byte, 100))
+
+	n := body.Len()
+	hdr := []byte{'I', 'D', '3', 3, 0, 0, byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+
+	return append(hdr, body.Bytes()...)
+}
+
+func testAtom(typ string, contents ...[]byte) []byte {
+
+	body := bytes.Join(contents, nil)
+
+	atom := make([]byte, 8)
+	binary.BigEndian.PutUint32(atom, uint32(len(body)+8))
+	copy(atom[4:], typ)
+
+	return append(atom, body...)
+}
+
+// testMP4 returns an MP4 file with the moov atom after a large
+// mdat atom, as written by a lot of encoders.
+func testMP4(timescale, duration uint32) []byte {
+
+	mvhd := make([]byte, 20)
+	binary.BigEndian.PutUint32(mvhd[12:], timescale)
+	binary.BigEndian.PutUint32(mvhd[16:], duration)
+
+	return bytes.Join([][]byte{
+		testAtom("ftyp", []byte("M4A \x00\x00\x00\x00")),
+		testAtom("mdat", make([]byte, 2*probeHeadSize)),
+		testAtom("moov", testAtom("mvhd", mvhd), testAtom("trak")),
+	}, nil)
+}
+
+func newProbeServer(files map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		data, ok := files[strings.TrimPrefix(r.URL.Path, "/norange")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/norange/") {
+			// Ignore the Range header.
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data)
+			return
+		}
+
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+}
+
+func TestProbeDuration(t *testing.T) {
+
+	frameDuration := func(frames int) time.Duration {
+		return time.Duration(float64(frames*testMP3Samples) / testMP3Rate * float64(time.Second))
+	}
+
+	files := map[string][]byte{
+		"/cbr.mp3":  testMP3(500, 0),
+		"/vbr.mp3":  append(testID3("TIT2", "Title"), testMP3(10, 100000)...),
+		"/tlen.mp3": append(testID3("TIT2", "Title", "TLEN", "3723000"), testMP3(10, 0)...),
+		"/big.mp3":  append(testID3("APIC", string(make([]byte, 2*probeHeadSize))), testMP3(500, 0)...),
+		"/test.m4a": testMP4(1000, 3723000),
+		"/test.txt": []byte(strings.Repeat("Not a media file. ", 1000)),
+	}
+
+	ts := newProbeServer(files)
+	defer ts.Close()
+
+	tests := []struct {
+		Path     string
+		Duration time.Duration
+		Error    bool
+	}{
+		{
+			// Constant bitrate, worked out from the file size.
+			Path:     "/cbr.mp3",
+			Duration: frameDuration(500),
+		},
+		{
+			Path:     "/norange/cbr.mp3",
+			Duration: frameDuration(500),
+		},
+		{
+			// Variable bitrate, from the Xing header.
+			Path:     "/vbr.mp3",
+			Duration: frameDuration(100000),
+		},
+		{
+			// From the ID3 tag.
+			Path:     "/tlen.mp3",
+			Duration: time.Hour + 2*time.Minute + 3*time.Second,
+		},
+		{
+			// An ID3 tag bigger than the first read.
+			Path:     "/big.mp3",
+			Duration: frameDuration(500),
+		},
+		{
+			// From the movie header at the end of the file.
+			Path:     "/test.m4a",
+			Duration: time.Hour + 2*time.Minute + 3*time.Second,
+		},
+		{
+			Path:     "/norange/test.m4a",
+			Duration: time.Hour + 2*time.Minute + 3*time.Second,
+		},
+		{
+			Path:  "/test.txt",
+			Error: true,
+		},
+		{
+			Path:  "/missing.mp3",
+			Error: true,
+		},
+	}
+
+	for _, test := range tests {
+
+		got, err := probeDuration(ts.URL+test.Path, 0)
+
+		if test.Error {
+			if err == nil {
+				t.Errorf("%s: expected probeDuration to return an error, got %s", test.Path, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: probeDuration returned error %q", test.Path, err)
+			continue
+		}
+
+		// Durations based on file size are approximate.
+		if diff := got - test.Duration; diff < -test.Duration/100 || diff > test.Duration/100 {
+			t.Errorf("%s: expected probeDuration to return %s, got %s", test.Path, test.Duration, got)
+		}
+	}
+}
+
+func TestProbeItems(t *testing.T) {
+	testWithInitDB(t, testProbeItems)
+}
+
+func testProbeItems(t *testing.T, db *sql.DB) {
+
+	ts := newProbeServer(map[string][]byte{
+		"/one.m4a": testMP4(1, 3600),
+		"/two.m4a": testMP4(1, 1800),
+	})
+	defer ts.Close()
+
+	feed := &kibner.Feed{
+		Title: "Probe",
+		URL:   ts.URL + "/feed.xml",
+		Items: []*kibner.Item{
+			{
+				Title:   "One",
+				URL:     ts.URL + "/one.m4a",
+				GUID:    "one",
+				Pubdate: time.Date(2017, time.September, 3, 0, 0, 0, 0, time.UTC),
+			},
+			{
+				Title:   "Two",
+				URL:     ts.URL + "/two.m4a",
+				GUID:    "two",
+				Pubdate: time.Date(2017, time.September, 2, 0, 0, 0, 0, time.UTC),
+			},
+			{
+				Title:   "Missing",
+				URL:     ts.URL + "/missing.m4a",
+				GUID:    "missing",
+				Pubdate: time.Date(2017, time.September, 1, 0, 0, 0, 0, time.UTC),
+			},
+			{
+				Title:    "Known",
+				URL:      ts.URL + "/one.m4a",
+				GUID:     "known",
+				Pubdate:  time.Date(2017, time.August, 1, 0, 0, 0, 0, time.UTC),
+				Duration: time.Minute,
+			},
+		},
+	}
+
+	id, err := saveFeed(db, feed, time.Now())
+	if err != nil {
+		t.Fatalf("saveFeed returned error %q", err)
+	}
+
+	items, err := loadProbeItems(db, []int64{id}, false)
+	if err != nil {
+		t.Fatalf("loadProbeItems returned error %q", err)
+	}
+
+	if len(items) != 3 {
+		t.Fatalf("expected loadProbeItems to return 3 items, got %d", len(items))
+	}
+
+	res, err := probeItems(db, items, 2, nil)
+	if err != nil {
+		t.Fatalf("probeItems returned error %q", err)
+	}
+
+	if res.Items != 3 || res.Found != 2 || len(res.Warnings) != 1 {
+		t.Errorf("expected probeItems to return 3 items, 2 found and 1 warning, got %+v", res)
+	}
+
+	durations := []time.Duration{time.Hour, 30 * time.Minute, 0, time.Minute}
+	for i, item := range getItems(t, db, id) {
+		if item.Duration != durations[i] {
+			t.Errorf("expected item %q to have duration %s, got %s", item.Title, durations[i], item.Duration)
+		}
+	}
+
+	// Items are only probed once...
+	items, err = loadProbeItems(db, nil, false)
+	if err != nil {
+		t.Fatalf("loadProbeItems returned error %q", err)
+	}
+
+	if len(items) != 0 {
+		t.Errorf("expected loadProbeItems to return no items, got %d", len(items))
+	}
+
+	// ...unless we insist.
+	items, err = loadProbeItems(db, nil, true)
+	if err != nil {
+		t.Fatalf("loadProbeItems returned error %q", err)
+	}
+
+	if len(items) != 4 {
+		t.Errorf("expected loadProbeItems to return 4 items, got %d", len(items))
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// publishOptions controls how items are written out as an
+// RSS feed.
+type publishOptions struct {
+	Title string
+	Link  string
+	// MediaDir is a directory of downloaded enclosures.
+	// Items whose files exist in MediaDir are published
+	// with enclosure URLs relative to MediaURL instead of
+	// their original URLs.
+	MediaDir string
+	MediaURL string
+}
+
+type rssDocument struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	ITunes  string     `xml:"xmlns:itunes,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string     `xml:"title"`
+	Link          string     `xml:"link"`
+	Description   string     `xml:"description"`
+	LastBuildDate string     `xml:"lastBuildDate"`
+	Generator     string     `xml:"generator"`
+	Items         []*rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string       `xml:"title"`
+	Description string       `xml:"description,omitempty"`
+	PubDate     string       `xml:"pubDate,omitempty"`
+	GUID        rssGUID      `xml:"guid"`
+	Enclosure   rssEnclosure `xml:"enclosure"`
+	Author      string       `xml:"itunes:author,omitempty"`
+	Duration    string       `xml:"itunes:duration,omitempty"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// publishItems writes the items matching the given list
+// options to w as an RSS 2.0 feed.
+func publishItems(db *sql.DB, w io.Writer, listOpts listItemOptions, opts publishOptions, now time.Time) error {
+
+	items, err := loadItemViews(db, listOpts)
+	if err != nil {
+		return err
+	}
+
+	return writeRSS(w, items, opts, now)
+}
+
+func writeRSS(w io.Writer, items []itemView, opts publishOptions, now time.Time) error {
+
+	title := opts.Title
+	if title == "" {
+		title = "Kibner"
+	}
+
+	doc := &rssDocument{
+		Version: "2.0",
+		ITunes:  "http://www.itunes.com/dtds/podcast-1.0.dtd",
+		Channel: rssChannel{
+			Title:         title,
+			Link:          opts.Link,
+			Description:   "Episodes from your Kibner subscriptions",
+			LastBuildDate: now.Format(time.RFC1123Z),
+			Generator:     "kibner/" + version,
+			Items:         make([]*rssItem, len(items)),
+		},
+	}
+
+	for i, item := range items {
+
+		u, size := item.url, item.filesize
+		if name, fi := findMediaFile(opts.MediaDir, item.url); fi != nil {
+			u = strings.TrimRight(opts.MediaURL, "/") + "/" + url.PathEscape(name)
+			size = fi.Size()
+		}
+
+		var pubdate string
+		if !item.Pubdate.IsZero() {
+			pubdate = item.Pubdate.Format(time.RFC1123Z)
+		}
+
+		var duration string
+		if item.Duration > 0 {
+			duration = formatHHMMSS(item.Duration)
+		}
+
+		doc.Channel.Items[i] = &rssItem{
+			Title:       item.Title,
+			Description: item.Desc,
+			PubDate:     pubdate,
+			GUID: rssGUID{
+				Value: publishedGUID(item),
+			},
+			Enclosure: rssEnclosure{
+				URL:    u,
+				Length: size,
+				Type:   enclosureType(item),
+			},
+			Author:   item.FeedTitle,
+			Duration: duration,
+		}
+	}
+
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+
+	e := xml.NewEncoder(w)
+	e.Indent("", "    ")
+
+	return e.Encode(doc)
+}
+
+// publishedGUID returns a GUID for an item in a published
+// feed. Items come from many feeds, and a GUID is only unique
+// within its own feed, so it's qualified with the feed's ID.
+// Items without a GUID use their own ID.
+func publishedGUID(item itemView) string {
+
+	if item.guid == "" {
+		return "kibner:item:" + strconv.FormatInt(item.ID, 10)
+	}
+
+	return "kibner:feed:" + strconv.FormatInt(item.feedID, 10) + ":" + item.guid
+}
+
+// mediaFilename returns the name of the file that an
+// enclosure is expected to be saved as when downloaded,
+// i.e. the last element of the URL path. This matches
+// the behaviour of tools like curl -O and wget.
+func mediaFilename(enclosureURL string) string {
+
+	u, err := url.Parse(enclosureURL)
+	if err != nil {
+		return ""
+	}
+
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return ""
+	}
+
+	return name
+}
+
+// findMediaFile looks for a downloaded copy of an enclosure
+// in dir. It returns nil if dir is blank or the file doesn't
+// exist.
+func findMediaFile(dir string, enclosureURL string) (string, os.FileInfo) {
+
+	if dir == "" {
+		return "", nil
+	}
+
+	name := mediaFilename(enclosureURL)
+	if name == "" {
+		return "", nil
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, name))
+	if err != nil || !fi.Mode().IsRegular() {
+		return "", nil
+	}
+
+	return name, fi
+}
+
+var mediaTypes = map[string]string{
+	".aac":  "audio/aac",
+	".flac": "audio/flac",
+	".m4a":  "audio/x-m4a",
+	".m4v":  "video/x-m4v",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".oga":  "audio/ogg",
+	".ogg":  "audio/ogg",
+	".opus": "audio/opus",
+	".wav":  "audio/wav",
+}
+
+// enclosureType returns the MIME type of an item's enclosure.
+// That's the type given in the original feed if there was one.
+func enclosureType(item itemView) string {
+	if item.mimetype != "" {
+		return item.mimetype
+	}
+	return mediaType(item.url)
+}
+
+// mediaType guesses the MIME type of an enclosure from its
+// file extension.
+func mediaType(enclosureURL string) string {
+
+	ext := strings.ToLower(path.Ext(mediaFilename(enclosureURL)))
+
+	if typ, ok := mediaTypes[ext]; ok {
+		return typ
+	}
+
+	if typ := mime.TypeByExtension(ext); typ != "" {
+		return typ
+	}
+
+	return "audio/mpeg"
+}
+
+func formatHHMMSS(secs int64) string {
+
+	h, m, s := secs/3600, (secs%3600)/60, secs%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+
+	return fmt.Sprintf("%d:%02d", m, s)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPublishItems(t *testing.T) {
+	testWithInitDB(t, testPublishItems)
+}
+
+func testPublishItems(t *testing.T, db *sql.DB) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	serial := allTestCases["Serial"].NewFeed()
+
+	res, err := addFeed(db, nil, serverURL(ts, allTestCases["Serial"].Filename))
+	if err != nil {
+		t.Fatalf("addFeed returned error %q", err)
+	}
+
+	dir, err := ioutil.TempDir("", "kibner-publish")
+	if err != nil {
+		t.Fatalf("TempDir returned error %q", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Fake a downloaded copy of the first item.
+	local := mediaFilename(serial.Items[0].URL)
+	if err := ioutil.WriteFile(filepath.Join(dir, local), []byte("12345"), 0644); err != nil {
+		t.Fatalf("WriteFile returned error %q", err)
+	}
+
+	listOpts := listItemOptions{
+		FeedID: res.ID,
+		Limit:  3,
+	}
+
+	opts := publishOptions{
+		Title:    "My Feed",
+		Link:     "http://example.com/",
+		MediaDir: dir,
+		MediaURL: "http://example.com/media/",
+	}
+
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	if err := publishItems(db, &buf, listOpts, opts, now); err != nil {
+		t.Fatalf("publishItems returned error %q", err)
+	}
+
+	doc := decodeRSS(t, buf.Bytes())
+
+	if doc.Version != "2.0" {
+		t.Errorf("Expected RSS version 2.0, got %q", doc.Version)
+	}
+
+	if doc.Channel.Title != opts.Title || doc.Channel.Link != opts.Link {
+		t.Errorf("Expected channel %q (%s), got %q (%s)", opts.Title, opts.Link, doc.Channel.Title, doc.Channel.Link)
+	}
+
+	if exp := now.Format(time.RFC1123Z); doc.Channel.LastBuildDate != exp {
+		t.Errorf("Expected lastBuildDate %q, got %q", exp, doc.Channel.LastBuildDate)
+	}
+
+	if len(doc.Channel.Items) != 3 {
+		t.Fatalf("Expected 3 items, got %d", len(doc.Channel.Items))
+	}
+
+	for i, got := range doc.Channel.Items {
+
+		exp := serial.Items[i]
+
+		if got.Title != exp.Title {
+			t.Errorf("Item %d: expected title %q, got %q", i, exp.Title, got.Title)
+		}
+
+		expGUID := "kibner:feed:" + strconv.FormatInt(res.ID, 10) + ":" + exp.GUID
+
+		if got.GUID.Value != expGUID || got.GUID.IsPermaLink {
+			t.Errorf("Item %d: expected non-permalink GUID %q, got %q (%t)", i, expGUID, got.GUID.Value, got.GUID.IsPermaLink)
+		}
+
+		expType := exp.Type
+		if expType == "" {
+			expType = mediaType(exp.URL)
+		}
+
+		if got.Enclosure.Type != expType {
+			t.Errorf("Item %d: expected enclosure type %q, got %q", i, expType, got.Enclosure.Type)
+		}
+
+		url, size := exp.URL, exp.Filesize
+		if i == 0 {
+			url, size = "http://example.com/media/"+local, 5
+		}
+
+		if got.Enclosure.URL != url || got.Enclosure.Length != size {
+			t.Errorf("Item %d: expected enclosure %s (%d bytes), got %s (%d bytes)", i, url, size, got.Enclosure.URL, got.Enclosure.Length)
+		}
+	}
+}
+
+func TestPublishSharedGUIDs(t *testing.T) {
+	testWithInitDB(t, testPublishSharedGUIDs)
+}
+
+func testPublishSharedGUIDs(t *testing.T, db *sql.DB) {
+
+	// Two copies of the same feed, so every GUID appears twice.
+	for _, u := range []string{"http://example.com/serial.xml", "http://example.com/serial-mirror.xml"} {
+		feed := allTestCases["Serial"].NewFeed()
+		feed.URL = u
+		if _, err := saveFeed(db, feed, time.Now()); err != nil {
+			t.Fatalf("saveFeed returned error %q", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := publishItems(db, &buf, listItemOptions{}, publishOptions{}, time.Now()); err != nil {
+		t.Fatalf("publishItems returned error %q", err)
+	}
+
+	doc := decodeRSS(t, buf.Bytes())
+
+	if exp := 2 * len(allTestCases["Serial"].NewFeed().Items); len(doc.Channel.Items) != exp {
+		t.Fatalf("Expected %d items, got %d", exp, len(doc.Channel.Items))
+	}
+
+	seen := map[string]bool{}
+
+	for i, item := range doc.Channel.Items {
+		if seen[item.GUID.Value] {
+			t.Errorf("Item %d: duplicate GUID %q", i, item.GUID.Value)
+		}
+		seen[item.GUID.Value] = true
+	}
+}
+
+func TestPublishedGUID(t *testing.T) {
+
+	tests := []struct {
+		Item itemView
+		Exp  string
+	}{
+		{
+			Item: itemView{ID: 7, feedID: 2, guid: "episode-1"},
+			Exp:  "kibner:feed:2:episode-1",
+		},
+		{
+			Item: itemView{ID: 7, feedID: 3, guid: "episode-1"},
+			Exp:  "kibner:feed:3:episode-1",
+		},
+		{
+			Item: itemView{ID: 7, feedID: 2},
+			Exp:  "kibner:item:7",
+		},
+	}
+
+	for _, test := range tests {
+		if got := publishedGUID(test.Item); got != test.Exp {
+			t.Errorf("expected publishedGUID(%+v) to return %q, got %q", test.Item, test.Exp, got)
+		}
+	}
+}
+
+func TestAPIServerRSS(t *testing.T) {
+	testWithInitDB(t, testAPIServerRSS)
+}
+
+func testAPIServerRSS(t *testing.T, db *sql.DB) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	for _, name := range []string{"Serial", "S-Town"} {
+		if _, err := addFeed(db, nil, serverURL(ts, allTestCases[name].Filename)); err != nil {
+			t.Fatalf("%s: addFeed returned error %q", name, err)
+		}
+	}
+
+	api := newTestAPIServer(db, "")
+	defer api.Close()
+
+	// Newly added feeds are marked as played.
+	doc := decodeRSS(t, []byte(doAPIRequest(t, api, http.MethodGet, "/rss/unplayed.xml", nil, http.StatusOK, nil)))
+
+	if len(doc.Channel.Items) != 0 {
+		t.Errorf("Expected no unplayed items, got %d", len(doc.Channel.Items))
+	}
+
+	doc = decodeRSS(t, []byte(doAPIRequest(t, api, http.MethodGet, "/rss/items.xml?top=5&name=Latest", nil, http.StatusOK, nil)))
+
+	if doc.Channel.Title != "Latest" {
+		t.Errorf("Expected channel title %q, got %q", "Latest", doc.Channel.Title)
+	}
+
+	if len(doc.Channel.Items) != 5 {
+		t.Errorf("Expected 5 items, got %d", len(doc.Channel.Items))
+	}
+
+	doAPIRequest(t, api, http.MethodGet, "/rss/items.xml?sortby=nonsense", nil, http.StatusBadRequest, nil)
+	doAPIRequest(t, api, http.MethodPost, "/rss/unplayed.xml", nil, http.StatusMethodNotAllowed, nil)
+	doAPIRequest(t, api, http.MethodGet, "/media/", nil, http.StatusNotFound, nil)
+}
+
+func TestFormatHHMMSS(t *testing.T) {
+
+	data := map[int64]string{
+		0:    "0:00",
+		59:   "0:59",
+		61:   "1:01",
+		3599: "59:59",
+		3600: "1:00:00",
+		5025: "1:23:45",
+	}
+
+	for secs, exp := range data {
+		if got := formatHHMMSS(secs); got != exp {
+			t.Errorf("%d: expected %q, got %q", secs, exp, got)
+		}
+	}
+}
+
+func TestMediaType(t *testing.T) {
+
+	data := map[string]string{
+		"http://example.com/episode.mp3":           "audio/mpeg",
+		"http://example.com/episode.M4A?x=1":       "audio/x-m4a",
+		"http://example.com/path/video.mp4#t=10":   "video/mp4",
+		"http://example.com/episode":               "audio/mpeg",
+		"http://example.com/":                      "audio/mpeg",
+		"http://example.com/episode.ogg/download/": "audio/mpeg",
+	}
+
+	for url, exp := range data {
+		if got := mediaType(url); got != exp {
+			t.Errorf("%s: expected %q, got %q", url, exp, got)
+		}
+	}
+}
+
+func TestEnclosureType(t *testing.T) {
+
+	tests := []struct {
+		Item itemView
+		Type string
+	}{
+		{
+			Item: itemView{url: "http://example.com/episode.mp3", mimetype: "audio/mpeg"},
+			Type: "audio/mpeg",
+		},
+		{
+			// The original type wins over the file extension.
+			Item: itemView{url: "http://example.com/episode.mp3", mimetype: "audio/x-custom"},
+			Type: "audio/x-custom",
+		},
+		{
+			Item: itemView{url: "http://example.com/episode.m4a"},
+			Type: "audio/x-m4a",
+		},
+	}
+
+	for _, test := range tests {
+		if got := enclosureType(test.Item); got != test.Type {
+			t.Errorf("%s (%q): expected %q, got %q", test.Item.url, test.Item.mimetype, test.Type, got)
+		}
+	}
+}
+
+func decodeRSS(t *testing.T, b []byte) *rssDocument {
+
+	var doc rssDocument
+	if err := xml.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("error decoding RSS: %s\n%s", err, b)
+	}
+
+	return &doc
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"regexp"
+	"strings"
 
 	"github.com/mmcdole/gofeed"
 	"github.com/mmcdole/gofeed/rss"
@@ -34,10 +35,12 @@ func (t *RSSTranslator) Translate(feed interface{}) (*gofeed.Feed, error) {
 		Link:        t.translateFeedLink(rss),
 		Image:       t.translateFeedImage(rss),
 		Description: t.translateFeedDescription(rss),
+		Language:    rss.Language,
 		Items:       t.translateFeedItems(rss),
 		ITunesExt:   rss.ITunesExt,
 		FeedVersion: rss.Version,
 		FeedType:    "rss",
+		Custom:      t.translateFeedSchedule(rss),
 	}, nil
 }
 
@@ -47,7 +50,9 @@ func (t *RSSTranslator) translateFeedItem(item *rss.Item) *gofeed.Item {
 		Title:           t.translateItemTitle(item),
 		GUID:            t.translateItemGUID(item),
 		Description:     t.translateItemDescription(item),
+		Content:         t.translateItemContent(item),
 		Enclosures:      t.translateItemEnclosures(item),
+		Published:       item.PubDate,
 		PublishedParsed: item.PubDateParsed,
 		ITunesExt:       item.ITunesExt,
 	}
@@ -144,6 +149,36 @@ func (t *RSSTranslator) translateFeedDescription(rss *rss.Feed) string {
 	return shortestDescription(descs, title)
 }
 
+// translateFeedSchedule passes on the feed's update hints,
+// which gofeed has no fields for, as custom values. They're
+// parsed by parseSchedule.
+func (t *RSSTranslator) translateFeedSchedule(rss *rss.Feed) map[string]string {
+
+	custom := map[string]string{}
+
+	if rss.TTL != "" {
+		custom["ttl"] = rss.TTL
+	}
+	if len(rss.SkipHours) > 0 {
+		custom["skipHours"] = strings.Join(rss.SkipHours, ",")
+	}
+	if len(rss.SkipDays) > 0 {
+		custom["skipDays"] = strings.Join(rss.SkipDays, ",")
+	}
+
+	for _, name := range []string{"updatePeriod", "updateFrequency"} {
+		if exts := rss.Extensions["sy"][name]; len(exts) > 0 {
+			custom["sy:"+name] = exts[0].Value
+		}
+	}
+
+	if len(custom) == 0 {
+		return nil
+	}
+
+	return custom
+}
+
 func (t *RSSTranslator) translateFeedItems(rss *rss.Feed) []*gofeed.Item {
 
 	results := make([]*gofeed.Item, len(rss.Items))
@@ -196,6 +231,35 @@ func (t *RSSTranslator) translateItemDescription(item *rss.Item) string {
 	return shortestDescription(descs, t.translateItemTitle(item))
 }
 
+func (t *RSSTranslator) translateItemContent(item *rss.Item) string {
+
+	var descs []string
+
+	// Use the longest of the RSS content, iTunes summary and
+	// RSS item description. This is usually the only one with
+	// any formatting.
+	descs = append(descs, item.Content)
+	if itunes := item.ITunesExt; itunes != nil {
+		descs = append(descs, itunes.Summary)
+	}
+	descs = append(descs, item.Description)
+
+	return longestDescription(descs)
+}
+
+func longestDescription(descs []string) string {
+
+	var desc string
+
+	for _, s := range descs {
+		if len(s) > len(desc) {
+			desc = s
+		}
+	}
+
+	return desc
+}
+
 func shortestDescription(descs []string, title string) string {
 
 	var desc string
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"database/sql"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	kibner "github.com/deepilla/kibner/internal/types"
+)
+
+// Feeds are synced on individual schedules (see daemon.go).
+// A feed's sync interval starts off as a fraction of the time
+// between its recent items, so that feeds that publish often
+// are checked often. The feed's own hints (the RSS ttl and the
+// syndication module's updatePeriod) can lengthen the interval
+// but not shorten it. Failing feeds back off exponentially.
+// Finally, some jitter is added so that feeds added at the same
+// time don't stay in lockstep, and the sync is moved out of any
+// hours or days that the feed asks to be skipped.
+
+const (
+	// cadenceItems is the number of recent items used to work
+	// out how often a feed publishes.
+	cadenceItems = 10
+	// cadenceFraction is the fraction of the time between
+	// items that feeds are synced at.
+	cadenceFraction = 4
+	// syncJitter is the maximum jitter as a fraction of the
+	// sync interval.
+	syncJitter = 0.1
+	// maxBackoff caps the number of failures that double a
+	// feed's sync interval.
+	maxBackoff = 10
+)
+
+var syPeriods = map[string]time.Duration{
+	"hourly":  time.Hour,
+	"daily":   24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+	"yearly":  365 * 24 * time.Hour,
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// parseSchedule parses the update hints passed on by the RSS
+// translator. Invalid values are ignored.
+func parseSchedule(custom map[string]string) kibner.Schedule {
+
+	var s kibner.Schedule
+
+	if mins, err := strconv.Atoi(strings.TrimSpace(custom["ttl"])); err == nil && mins > 0 {
+		s.TTL = time.Duration(mins) * time.Minute
+	}
+
+	for _, val := range strings.Split(custom["skipHours"], ",") {
+		// Some feeds use 24 for midnight.
+		if hour, err := strconv.Atoi(strings.TrimSpace(val)); err == nil && hour >= 0 && hour <= 24 {
+			s.SkipHours = append(s.SkipHours, hour%24)
+		}
+	}
+
+	for _, val := range strings.Split(custom["skipDays"], ",") {
+		if day, ok := weekdays[strings.ToLower(strings.TrimSpace(val))]; ok {
+			s.SkipDays = append(s.SkipDays, day)
+		}
+	}
+
+	// The syndication module's defaults are daily and 1, but
+	// only if the feed has at least one of the elements.
+	period, freq := custom["sy:updatePeriod"], custom["sy:updateFrequency"]
+
+	if period != "" || freq != "" {
+
+		d, ok := syPeriods[strings.ToLower(strings.TrimSpace(period))]
+		if !ok {
+			d = syPeriods["daily"]
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(freq))
+		if err != nil || n < 1 {
+			n = 1
+		}
+
+		s.UpdatePeriod = d / time.Duration(n)
+	}
+
+	return s
+}
+
+// publishInterval returns the median time between the given
+// publication dates, or 0 if there aren't enough to tell.
+func publishInterval(pubdates []time.Time) time.Duration {
+
+	dates := make([]time.Time, len(pubdates))
+	copy(dates, pubdates)
+
+	sort.Slice(dates, func(i, j int) bool {
+		return dates[i].Before(dates[j])
+	})
+
+	var gaps []time.Duration
+
+	for i := 1; i < len(dates); i++ {
+		if gap := dates[i].Sub(dates[i-1]); gap > 0 {
+			gaps = append(gaps, gap)
+		}
+	}
+
+	if len(gaps) < 2 {
+		return 0
+	}
+
+	sort.Slice(gaps, func(i, j int) bool {
+		return gaps[i] < gaps[j]
+	})
+
+	return gaps[len(gaps)/2]
+}
+
+// syncInterval returns the time to wait before syncing a feed
+// again, before jitter. pubdates are the dates of the feed's
+// recent items and failures is the number of syncs in a row
+// that have failed.
+func syncInterval(hints kibner.Schedule, pubdates []time.Time, failures int) time.Duration {
+
+	interval := defaults.SyncInterval
+
+	if d := publishInterval(pubdates); d > 0 {
+		interval = d / cadenceFraction
+	}
+
+	if hints.TTL > interval {
+		interval = hints.TTL
+	}
+
+	if hints.UpdatePeriod > interval {
+		interval = hints.UpdatePeriod
+	}
+
+	if interval < defaults.MinSyncInterval {
+		interval = defaults.MinSyncInterval
+	}
+
+	if failures > maxBackoff {
+		failures = maxBackoff
+	}
+
+	for i := 0; i < failures && interval < defaults.MaxSyncInterval; i++ {
+		interval *= 2
+	}
+
+	if interval > defaults.MaxSyncInterval {
+		interval = defaults.MaxSyncInterval
+	}
+
+	return interval
+}
+
+// nextSync returns the time of a feed's next sync, given the
+// time of its last one.
+func nextSync(last time.Time, interval time.Duration, hints kibner.Schedule, r *rand.Rand) time.Time {
+
+	jitter := time.Duration((2*r.Float64() - 1) * syncJitter * float64(interval))
+
+	return skipScheduled(last.Add(interval+jitter), hints)
+}
+
+// skipScheduled moves t to the start of the first hour that
+// the feed doesn't ask to be skipped. If the feed skips every
+// hour of the week, its hints are ignored.
+func skipScheduled(t time.Time, hints kibner.Schedule) time.Time {
+
+	if len(hints.SkipHours) == 0 && len(hints.SkipDays) == 0 {
+		return t
+	}
+
+	skipHour := make(map[int]bool, len(hints.SkipHours))
+	for _, h := range hints.SkipHours {
+		skipHour[h] = true
+	}
+
+	skipDay := make(map[time.Weekday]bool, len(hints.SkipDays))
+	for _, d := range hints.SkipDays {
+		skipDay[d] = true
+	}
+
+	next := t
+
+	for i := 0; i < 7*24; i++ {
+
+		u := next.UTC()
+		if !skipHour[u.Hour()] && !skipDay[u.Weekday()] {
+			return next
+		}
+
+		next = u.Truncate(time.Hour).Add(time.Hour).In(t.Location())
+	}
+
+	return t
+}
+
+// feedSchedule records when the daemon last synced a feed and
+// when it's next due. Feeds that haven't been synced yet have
+// zero times and are due straight away.
+type feedSchedule struct {
+	ID       int64     `json:"id"`
+	Title    string    `json:"title"`
+	Synced   time.Time `json:"synced"`
+	Next     time.Time `json:"next"`
+	Interval int64     `json:"interval_seconds"`
+	Failures int       `json:"failures"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// loadFeedSchedules returns the schedules of every feed, in
+// title order.
+func loadFeedSchedules(db *sql.DB) ([]feedSchedule, error) {
+
+	var rows []struct {
+		ID       int64
+		Title    string
+		Synced   int64
+		Next     int64
+		Interval int64
+		Failures int
+		Error    string
+	}
+
+	q := `SELECT f.id, f.title, IFNULL(s.synced, 0), IFNULL(s.next, 0), IFNULL(s.interval, 0), IFNULL(s.failures, 0), IFNULL(s.error, '')
+		FROM feeds f LEFT JOIN feed_schedules s ON s.feedid = f.id
+		ORDER BY f.title COLLATE NOCASE, f.id`
+
+	if err := queryRows(&rows, db, q); err != nil {
+		return nil, err
+	}
+
+	schedules := make([]feedSchedule, len(rows))
+
+	for i, r := range rows {
+		schedules[i] = feedSchedule{
+			ID:       r.ID,
+			Title:    r.Title,
+			Synced:   unixTime(r.Synced),
+			Next:     unixTime(r.Next),
+			Interval: r.Interval,
+			Failures: r.Failures,
+			Error:    r.Error,
+		}
+	}
+
+	return schedules, nil
+}
+
+func saveFeedSchedule(db *sql.DB, s *feedSchedule) error {
+
+	_, err := db.Exec("INSERT OR REPLACE INTO feed_schedules(feedid, synced, next, interval, failures, error) VALUES(?, ?, ?, ?, ?, ?)",
+		s.ID, s.Synced.Unix(), s.Next.Unix(), s.Interval, s.Failures, s.Error)
+
+	return err
+}
+
+func deleteSchedule(tx *sql.Tx, feedID int64) error {
+
+	_, err := tx.Exec("DELETE FROM feed_schedules WHERE feedid = ?", feedID)
+	return err
+}
+
+// loadPubdates returns the publication dates of a feed's most
+// recent items.
+func loadPubdates(db *sql.DB, feedID int64) ([]time.Time, error) {
+
+	var rows []struct {
+		Pubdate time.Time
+	}
+
+	q := "SELECT pubdate FROM items WHERE feedid = ? ORDER BY pubdate DESC LIMIT ?"
+	if err := queryRows(&rows, db, q, feedID, cadenceItems); err != nil {
+		return nil, err
+	}
+
+	dates := make([]time.Time, len(rows))
+	for i, r := range rows {
+		dates[i] = r.Pubdate
+	}
+
+	return dates, nil
+}
+
+// unixTime converts a timestamp from the database, where 0
+// means never, to a time.
+func unixTime(secs int64) time.Time {
+
+	if secs == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(secs, 0)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	kibner "github.com/deepilla/kibner/internal/types"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func TestParseSchedule(t *testing.T) {
+
+	const rss = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:sy="http://purl.org/rss/1.0/modules/syndication/">
+  <channel>
+    <title>Scheduled</title>
+    <ttl>90</ttl>
+    <skipHours><hour>0</hour><hour>24</hour><hour>7</hour><hour>25</hour></skipHours>
+    <skipDays><day>Saturday</day><day>sunday</day><day>Caturday</day></skipDays>
+    <sy:updatePeriod>daily</sy:updatePeriod>
+    <sy:updateFrequency>4</sy:updateFrequency>
+  </channel>
+</rss>`
+
+	parser := gofeed.NewParser()
+	parser.RSSTranslator = NewRSSTranslator()
+
+	f, err := parser.Parse(strings.NewReader(rss))
+	if err != nil {
+		t.Fatalf("Parse returned error %q", err)
+	}
+
+	exp := kibner.Schedule{
+		TTL:          90 * time.Minute,
+		UpdatePeriod: 6 * time.Hour,
+		SkipHours:    []int{0, 0, 7},
+		SkipDays:     []time.Weekday{time.Saturday, time.Sunday},
+	}
+
+	if got := translateFeed(f).Schedule; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected schedule %+v, got %+v", exp, got)
+	}
+
+	tests := []struct {
+		Custom map[string]string
+		Exp    kibner.Schedule
+	}{
+		{
+			Custom: nil,
+			Exp:    kibner.Schedule{},
+		},
+		{
+			Custom: map[string]string{"ttl": "-5"},
+			Exp:    kibner.Schedule{},
+		},
+		{
+			// The syndication module defaults to daily.
+			Custom: map[string]string{"sy:updateFrequency": "2"},
+			Exp:    kibner.Schedule{UpdatePeriod: 12 * time.Hour},
+		},
+		{
+			Custom: map[string]string{"sy:updatePeriod": "Weekly", "sy:updateFrequency": "x"},
+			Exp:    kibner.Schedule{UpdatePeriod: 7 * 24 * time.Hour},
+		},
+	}
+
+	for _, test := range tests {
+		if got := parseSchedule(test.Custom); !reflect.DeepEqual(got, test.Exp) {
+			t.Errorf("%v: expected parseSchedule to return %+v, got %+v", test.Custom, test.Exp, got)
+		}
+	}
+}
+
+func TestPublishInterval(t *testing.T) {
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		Name     string
+		Pubdates []time.Time
+		Exp      time.Duration
+	}{
+		{
+			Name: "No items",
+		},
+		{
+			Name:     "Too few items",
+			Pubdates: []time.Time{t0, t0.Add(day)},
+		},
+		{
+			Name:     "Weekly, newest first",
+			Pubdates: []time.Time{t0.Add(21 * day), t0.Add(14 * day), t0.Add(7 * day), t0},
+			Exp:      7 * day,
+		},
+		{
+			// Items published together and the odd gap in
+			// the schedule don't count for much.
+			Name:     "Irregular",
+			Pubdates: []time.Time{t0, t0, t0.Add(day), t0.Add(2 * day), t0.Add(30 * day)},
+			Exp:      day,
+		},
+	}
+
+	for _, test := range tests {
+		if got := publishInterval(test.Pubdates); got != test.Exp {
+			t.Errorf("%s: expected publishInterval to return %s, got %s", test.Name, test.Exp, got)
+		}
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	daily := []time.Time{t0, t0.Add(24 * time.Hour), t0.Add(48 * time.Hour)}
+	hourly := []time.Time{t0, t0.Add(time.Hour), t0.Add(2 * time.Hour)}
+	weekly := []time.Time{t0, t0.Add(7 * 24 * time.Hour), t0.Add(14 * 24 * time.Hour)}
+
+	tests := []struct {
+		Name     string
+		Hints    kibner.Schedule
+		Pubdates []time.Time
+		Failures int
+		Exp      time.Duration
+	}{
+		{
+			Name: "No information",
+			Exp:  defaults.SyncInterval,
+		},
+		{
+			Name:     "Daily",
+			Pubdates: daily,
+			Exp:      6 * time.Hour,
+		},
+		{
+			Name:     "Hourly",
+			Pubdates: hourly,
+			Exp:      defaults.MinSyncInterval,
+		},
+		{
+			Name:     "Weekly",
+			Pubdates: weekly,
+			Exp:      defaults.MaxSyncInterval,
+		},
+		{
+			Name:     "TTL",
+			Hints:    kibner.Schedule{TTL: 8 * time.Hour},
+			Pubdates: daily,
+			Exp:      8 * time.Hour,
+		},
+		{
+			Name:     "Short TTL",
+			Hints:    kibner.Schedule{TTL: time.Hour},
+			Pubdates: daily,
+			Exp:      6 * time.Hour,
+		},
+		{
+			Name:  "Update period",
+			Hints: kibner.Schedule{TTL: time.Hour, UpdatePeriod: 2 * time.Hour},
+			Exp:   2 * time.Hour,
+		},
+		{
+			Name:     "Backoff",
+			Pubdates: daily,
+			Failures: 1,
+			Exp:      12 * time.Hour,
+		},
+		{
+			Name:     "Maximum backoff",
+			Pubdates: daily,
+			Failures: 100,
+			Exp:      defaults.MaxSyncInterval,
+		},
+	}
+
+	for _, test := range tests {
+		if got := syncInterval(test.Hints, test.Pubdates, test.Failures); got != test.Exp {
+			t.Errorf("%s: expected syncInterval to return %s, got %s", test.Name, test.Exp, got)
+		}
+	}
+}
+
+func TestNextSync(t *testing.T) {
+
+	// A Friday.
+	t0 := time.Date(2020, 1, 3, 20, 30, 0, 0, time.UTC)
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 100; i++ {
+
+		next := nextSync(t0, time.Hour, kibner.Schedule{}, r)
+
+		if d := next.Sub(t0); d < 54*time.Minute || d > 66*time.Minute {
+			t.Fatalf("expected next sync within 10%% of an hour, got %s", d)
+		}
+	}
+
+	tests := []struct {
+		Name  string
+		Time  time.Time
+		Hints kibner.Schedule
+		Exp   time.Time
+	}{
+		{
+			Name:  "Not skipped",
+			Time:  t0,
+			Hints: kibner.Schedule{SkipHours: []int{0, 1}, SkipDays: []time.Weekday{time.Sunday}},
+			Exp:   t0,
+		},
+		{
+			Name:  "Skipped hours",
+			Time:  t0,
+			Hints: kibner.Schedule{SkipHours: []int{20, 21, 22}},
+			Exp:   time.Date(2020, 1, 3, 23, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:  "Skipped hours and days",
+			Time:  t0,
+			Hints: kibner.Schedule{SkipHours: []int{20, 21, 22, 23, 0}, SkipDays: []time.Weekday{time.Saturday}},
+			Exp:   time.Date(2020, 1, 5, 1, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:  "Skipped hours in another time zone",
+			Time:  t0.In(time.FixedZone("EST", -5*60*60)),
+			Hints: kibner.Schedule{SkipHours: []int{20}},
+			Exp:   time.Date(2020, 1, 3, 21, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:  "Everything skipped",
+			Time:  t0,
+			Hints: kibner.Schedule{SkipDays: []time.Weekday{0, 1, 2, 3, 4, 5, 6}},
+			Exp:   t0,
+		},
+	}
+
+	for _, test := range tests {
+		if got := skipScheduled(test.Time, test.Hints); !got.Equal(test.Exp) {
+			t.Errorf("%s: expected skipScheduled to return %s, got %s", test.Name, test.Exp, got)
+		}
+	}
+}
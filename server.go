@@ -0,0 +1,694 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiServer exposes kibner's feed and item operations as a
+// JSON API, plus a minimal HTML interface for browsers.
+//
+// The API has the following endpoints:
+//
+//	GET    /api/feeds              List feeds
+//	POST   /api/feeds              Subscribe to a feed
+//	DELETE /api/feeds/{id}         Unsubscribe from a feed
+//	POST   /api/feeds/{id}/sync    Sync a feed
+//	POST   /api/sync               Sync all feeds
+//	GET    /api/items              List items
+//	POST   /api/items/played       Mark items as played/unplayed
+//
+// List endpoints accept the same filters as the equivalent
+// command-line options, as query parameters.
+//
+// Items are also available as RSS feeds for devices that
+// don't support anything else:
+//
+//	GET    /rss/unplayed.xml       Unplayed items from all feeds
+//	GET    /rss/items.xml          Items matching the query parameters
+//
+// If mediaDir is set, its contents are served under /media/
+// and the RSS feeds link to local copies of enclosures where
+// available.
+//
+// The server has no authentication, so it only accepts requests
+// addressed to the address it's listening on (to prevent DNS
+// rebinding) and only accepts changes from its own pages or
+// from programs that post JSON (to prevent cross-site request
+// forgery).
+type apiServer struct {
+	db       *sql.DB
+	hooks    *hookRunner
+	mux      *http.ServeMux
+	mediaDir string
+	host     string
+	port     string
+}
+
+func newAPIServer(db *sql.DB, hooks *hookRunner, mediaDir string, addr string) *apiServer {
+
+	host, port := splitHostPort(addr, "80")
+
+	s := &apiServer{
+		db:       db,
+		hooks:    hooks,
+		mux:      http.NewServeMux(),
+		mediaDir: mediaDir,
+		host:     host,
+		port:     port,
+	}
+
+	s.mux.HandleFunc("/", s.handleIndex)
+	s.mux.HandleFunc("/api/feeds", s.handleFeeds)
+	s.mux.HandleFunc("/api/feeds/", s.handleFeed)
+	s.mux.HandleFunc("/api/sync", s.handleSyncAll)
+	s.mux.HandleFunc("/api/items", s.handleItems)
+	s.mux.HandleFunc("/api/items/played", s.handlePlayed)
+	s.mux.HandleFunc("/rss/unplayed.xml", s.handleRSSUnplayed)
+	s.mux.HandleFunc("/rss/items.xml", s.handleRSSItems)
+
+	if mediaDir != "" {
+		s.mux.Handle("/media/", http.StripPrefix("/media/", http.FileServer(http.Dir(mediaDir))))
+	}
+
+	return s
+}
+
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if status, err := s.checkRequest(r); err != nil {
+		writeAPIError(w, status, err)
+		return
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// checkRequest rejects requests for other hosts and requests
+// that try to change things from other sites. Browsers won't
+// send a cross-origin JSON request without asking first, so
+// requiring JSON also rules out forged form submissions.
+func (s *apiServer) checkRequest(r *http.Request) (int, error) {
+
+	if !s.isAllowedHost(r.Host) {
+		return http.StatusForbidden, errors.New("unknown host " + strconv.Quote(r.Host))
+	}
+
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return 0, nil
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, r.Host) {
+			return http.StatusForbidden, errors.New("cross-origin requests aren't allowed")
+		}
+	}
+
+	if r.Method == http.MethodPost {
+		mediatype, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediatype != "application/json" {
+			return http.StatusUnsupportedMediaType, errors.New("expected a JSON request body")
+		}
+	}
+
+	return 0, nil
+}
+
+// isAllowedHost reports whether a Host header refers to the
+// server's address. A server listening on a loopback address
+// also answers to localhost and the other loopback addresses.
+// A server listening on all interfaces answers to any IP
+// address, but not to host names, which could belong to
+// anyone.
+func (s *apiServer) isAllowedHost(hostport string) bool {
+
+	host, port := splitHostPort(hostport, "80")
+	if port != s.port {
+		return false
+	}
+
+	if strings.EqualFold(host, s.host) {
+		return true
+	}
+
+	switch {
+	case isLoopbackHost(s.host):
+		return isLoopbackHost(host)
+	case s.host == "" || isUnspecifiedHost(s.host):
+		return host == "localhost" || net.ParseIP(host) != nil
+	default:
+		return false
+	}
+}
+
+// splitHostPort splits an address into a host and port,
+// using the given port if the address doesn't have one.
+func splitHostPort(hostport string, port string) (string, string) {
+
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		return h, p
+	}
+
+	return strings.Trim(hostport, "[]"), port
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func isUnspecifiedHost(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+type apiItem struct {
+	ID         int64
+	Title      string
+	Desc       string
+	Duration   int64
+	Pubdate    time.Time
+	IsUnplayed bool
+	FeedID     int64
+	FeedTitle  string
+	URL        string
+}
+
+func newAPIItems(items []itemView) []apiItem {
+
+	results := make([]apiItem, len(items))
+
+	for i, item := range items {
+		results[i] = apiItem{
+			ID:         item.ID,
+			Title:      item.Title,
+			Desc:       item.Desc,
+			Duration:   item.Duration,
+			Pubdate:    item.Pubdate,
+			IsUnplayed: item.IsUnplayed,
+			FeedID:     item.feedID,
+			FeedTitle:  item.FeedTitle,
+			URL:        item.url,
+		}
+	}
+
+	return results
+}
+
+type apiSyncResult struct {
+	ID    int64
+	URL   string
+	Title string
+	Items int
+	Error string `json:",omitempty"`
+}
+
+func newAPISyncResults(results []*syncResult) []apiSyncResult {
+
+	data := make([]apiSyncResult, len(results))
+
+	for i, res := range results {
+		data[i] = apiSyncResult{
+			ID:    res.ID,
+			URL:   res.URL,
+			Title: res.Title,
+			Items: res.Items,
+		}
+		if res.Err != nil {
+			data[i].Error = res.Err.Error()
+		}
+	}
+
+	return data
+}
+
+var errMethodNotAllowed = errors.New("method not allowed")
+
+func (s *apiServer) handleFeeds(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+
+	case http.MethodGet:
+
+		opts, err := parseListFeedOptions(r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		feeds, err := loadFeedViews(s.db, opts)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeAPIResult(w, http.StatusOK, feeds)
+
+	case http.MethodPost:
+
+		var data struct {
+			URL string
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.URL == "" {
+			writeAPIError(w, http.StatusBadRequest, errors.New("no url given"))
+			return
+		}
+
+		res, err := addFeed(s.db, s.hooks, data.URL)
+		if err != nil {
+			writeAPIError(w, http.StatusBadGateway, err)
+			return
+		}
+
+		writeAPIResult(w, http.StatusCreated, newAPISyncResults([]*syncResult{res})[0])
+
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+	}
+}
+
+// handleFeed handles requests for an individual feed, i.e.
+// /api/feeds/{id} and /api/feeds/{id}/sync.
+func (s *apiServer) handleFeed(w http.ResponseWriter, r *http.Request) {
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/feeds/"), "/")
+
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || id <= 0 || len(parts) > 2 {
+		writeAPIError(w, http.StatusNotFound, errNoFeedFound)
+		return
+	}
+
+	switch {
+
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+
+		if _, err := loadFeedURL(s.db, id, targetFeed); err != nil {
+			writeAPIStatus(w, err)
+			return
+		}
+
+		if err := removeFeed(s.db, s.hooks, id); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 2 && parts[1] == "sync" && r.Method == http.MethodPost:
+
+		res, err := syncOne(s.db, s.hooks, id)
+		if err != nil {
+			writeAPIStatus(w, err)
+			return
+		}
+
+		writeAPIResult(w, http.StatusOK, newAPISyncResults([]*syncResult{res})[0])
+
+	case len(parts) == 2 && parts[1] != "sync":
+		writeAPIError(w, http.StatusNotFound, errors.New("not found"))
+
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+	}
+}
+
+func (s *apiServer) handleSyncAll(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+
+	results, err := syncAll(s.db, s.hooks, nil)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeAPIResult(w, http.StatusOK, newAPISyncResults(results))
+}
+
+func (s *apiServer) handleItems(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+
+	opts, err := parseListItemOptions(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	items, err := loadItemViews(s.db, opts)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeAPIResult(w, http.StatusOK, newAPIItems(items))
+}
+
+func (s *apiServer) handlePlayed(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+
+	var data struct {
+		IDs    []int64
+		Played bool
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || len(data.IDs) == 0 {
+		writeAPIError(w, http.StatusBadRequest, errors.New("no item ids given"))
+		return
+	}
+
+	if err := updatePlayedStatus(s.db, s.hooks, data.Played, data.IDs...); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *apiServer) handleRSSUnplayed(w http.ResponseWriter, r *http.Request) {
+
+	opts := listItemOptions{
+		Unplayed: true,
+	}
+
+	s.writeRSS(w, r, opts, "Kibner: Unplayed")
+}
+
+func (s *apiServer) handleRSSItems(w http.ResponseWriter, r *http.Request) {
+
+	opts, err := parseListItemOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	title := r.URL.Query().Get("name")
+	if title == "" {
+		title = "Kibner: Items"
+	}
+
+	s.writeRSS(w, r, opts, title)
+}
+
+func (s *apiServer) writeRSS(w http.ResponseWriter, r *http.Request, listOpts listItemOptions, title string) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, errMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	base := "http://" + r.Host
+
+	opts := publishOptions{
+		Title:    title,
+		Link:     base + "/",
+		MediaDir: s.mediaDir,
+		MediaURL: base + "/media",
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+
+	if err := publishItems(s.db, w, listOpts, opts, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *apiServer) handleIndex(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, errMethodNotAllowed)
+		return
+	}
+
+	feedOpts, err := parseListFeedOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	feedOpts.Title, feedOpts.Author = "", ""
+
+	itemOpts, err := parseListItemOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if itemOpts.Limit == 0 {
+		itemOpts.Limit = 100
+	}
+
+	feeds, err := loadFeedViews(s.db, feedOpts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	items, err := loadItemViews(s.db, itemOpts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	err = indexTemplate.Execute(w, map[string]interface{}{
+		"Feeds":    feeds,
+		"Items":    newAPIItems(items),
+		"FeedID":   itemOpts.FeedID,
+		"Unplayed": itemOpts.Unplayed,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func parseListFeedOptions(r *http.Request) (listFeedOptions, error) {
+
+	q := r.URL.Query()
+
+	sortBy := newSortFeedsFlag()
+	order := newSortOrderFlag()
+
+	if err := setFlagFromQuery(q.Get("sortby"), &sortBy); err != nil {
+		return listFeedOptions{}, err
+	}
+
+	if err := setFlagFromQuery(q.Get("order"), &order); err != nil {
+		return listFeedOptions{}, err
+	}
+
+	limit, err := parseUintQuery(q.Get("top"))
+	if err != nil {
+		return listFeedOptions{}, err
+	}
+
+	return listFeedOptions{
+		SortBy:    sortBy.Get().(sortFeedsBy),
+		SortOrder: order.Get().(sortOrder),
+		Limit:     limit,
+		Title:     q.Get("title"),
+		Author:    q.Get("author"),
+	}, nil
+}
+
+func parseListItemOptions(r *http.Request) (listItemOptions, error) {
+
+	q := r.URL.Query()
+
+	sortBy := newSortItemsFlag()
+	order := newSortOrderFlag()
+	var startDate reldate
+
+	if err := setFlagFromQuery(q.Get("sortby"), &sortBy); err != nil {
+		return listItemOptions{}, err
+	}
+
+	if err := setFlagFromQuery(q.Get("order"), &order); err != nil {
+		return listItemOptions{}, err
+	}
+
+	if err := setFlagFromQuery(q.Get("since"), &startDate); err != nil {
+		return listItemOptions{}, err
+	}
+
+	limit, err := parseUintQuery(q.Get("top"))
+	if err != nil {
+		return listItemOptions{}, err
+	}
+
+	var feedID int64
+	if s := q.Get("feed"); s != "" {
+		if feedID, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return listItemOptions{}, errors.New("invalid feed id " + s)
+		}
+	}
+
+	unplayed := false
+	if s := q.Get("unplayed"); s != "" {
+		if unplayed, err = strconv.ParseBool(s); err != nil {
+			return listItemOptions{}, errors.New("invalid value for unplayed: " + s)
+		}
+	}
+
+	return listItemOptions{
+		SortBy:    sortBy.Get().(sortItemsBy),
+		SortOrder: order.Get().(sortOrder),
+		Limit:     limit,
+		Unplayed:  unplayed,
+		StartDate: startDate.Get().(time.Time),
+		Title:     q.Get("title"),
+		FeedID:    feedID,
+	}, nil
+}
+
+func setFlagFromQuery(val string, f interface {
+	Set(string) error
+}) error {
+
+	if val == "" {
+		return nil
+	}
+
+	return f.Set(val)
+}
+
+func parseUintQuery(val string) (uint, error) {
+
+	if val == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseUint(val, 10, 32)
+	if err != nil {
+		return 0, errors.New("invalid number " + val)
+	}
+
+	return uint(n), nil
+}
+
+func writeAPIResult(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPIResult(w, status, map[string]string{
+		"error": err.Error(),
+	})
+}
+
+// writeAPIStatus writes an error response, using the error
+// to determine the appropriate HTTP status.
+func writeAPIStatus(w http.ResponseWriter, err error) {
+
+	status := http.StatusInternalServerError
+	if err == errNoFeedFound {
+		status = http.StatusNotFound
+	}
+
+	writeAPIError(w, status, err)
+}
+
+var indexTemplate = template.Must(template.New("index").Funcs(template.FuncMap{
+	"duration": formatSeconds,
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return "Date unknown"
+		}
+		return t.Local().Format("Jan 2, 2006")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Kibner</title>
+<style>
+body { font-family: sans-serif; margin: 0; display: flex; flex-wrap: wrap; }
+nav { width: 16em; padding: 1em; background: #f4f4f4; }
+main { flex: 1; padding: 1em; min-width: 20em; }
+nav a { display: block; padding: .2em 0; color: inherit; }
+nav a.current { font-weight: bold; }
+.item { border-bottom: 1px solid #ddd; padding: .5em 0; }
+.item.unplayed h3::before { content: "\2022  "; color: #c00; }
+.item h3 { margin: 0 0 .2em; font-size: 1em; }
+.meta { color: #666; font-size: .9em; }
+audio { width: 100%; margin-top: .3em; }
+#player { position: sticky; top: 0; background: #fff; padding-bottom: .5em; }
+</style>
+</head>
+<body>
+<nav>
+<a href="/?unplayed={{.Unplayed}}"{{if not .FeedID}} class="current"{{end}}>All feeds</a>
+{{range .Feeds}}<a href="/?feed={{.ID}}&amp;unplayed={{$.Unplayed}}"{{if eq .ID $.FeedID}} class="current"{{end}}>{{.Title}}{{with .UnplayedItems}} ({{.}}){{end}}</a>
+{{end}}
+<p><a href="/?{{with .FeedID}}feed={{.}}&amp;{{end}}unplayed={{not .Unplayed}}">{{if .Unplayed}}Show all items{{else}}Show unplayed items{{end}}</a></p>
+<p><button onclick="syncAll(this)">Sync all</button></p>
+</nav>
+<main>
+<div id="player"><audio id="audio" controls></audio><div id="now-playing" class="meta"></div></div>
+{{range .Items}}<div class="item{{if .IsUnplayed}} unplayed{{end}}">
+<h3>{{.Title}}</h3>
+<div class="meta">{{.FeedTitle}} &middot; {{date .Pubdate}}{{with .Duration}} &middot; {{duration .}}{{end}}</div>
+<button data-id="{{.ID}}" data-url="{{.URL}}" data-title="{{.Title}}" onclick="play(this)">Play</button>
+<button data-id="{{.ID}}" onclick="mark(this, {{.IsUnplayed}})">{{if .IsUnplayed}}Mark played{{else}}Mark unplayed{{end}}</button>
+</div>
+{{else}}<p>No items found</p>
+{{end}}
+</main>
+<script>
+function post(url, data) {
+	return fetch(url, {method: "POST", headers: {"Content-Type": "application/json"}, body: JSON.stringify(data)});
+}
+function play(btn) {
+	var audio = document.getElementById("audio");
+	audio.src = btn.dataset.url;
+	audio.dataset.id = btn.dataset.id;
+	audio.play();
+	document.getElementById("now-playing").textContent = btn.dataset.title;
+}
+function mark(btn, played) {
+	post("/api/items/played", {IDs: [Number(btn.dataset.id)], Played: played}).then(function() { location.reload(); });
+}
+function syncAll(btn) {
+	btn.disabled = true;
+	btn.textContent = "Syncing...";
+	post("/api/sync", {}).then(function() { location.reload(); });
+}
+document.getElementById("audio").addEventListener("ended", function() {
+	post("/api/items/played", {IDs: [Number(this.dataset.id)], Played: true});
+});
+</script>
+</body>
+</html>
+`))
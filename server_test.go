@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	kibner "github.com/deepilla/kibner/internal/types"
+)
+
+func TestAPIServer(t *testing.T) {
+	testWithInitDB(t, testAPIServer)
+}
+
+func testAPIServer(t *testing.T, db *sql.DB) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	api := newTestAPIServer(db, "")
+	defer api.Close()
+
+	serial := allTestCases["Serial"].NewFeed()
+	stown := allTestCases["S-Town"].NewFeed()
+
+	// Add feeds.
+
+	var added []apiSyncResult
+
+	for _, name := range []string{"Serial", "S-Town"} {
+
+		var res apiSyncResult
+		body := map[string]string{"URL": serverURL(ts, allTestCases[name].Filename)}
+
+		doAPIRequest(t, api, http.MethodPost, "/api/feeds", body, http.StatusCreated, &res)
+
+		if res.ID <= 0 || res.Title != allTestCases[name].NewFeed().Title {
+			t.Errorf("%s: unexpected add result %s", name, jsonify(res))
+		}
+
+		added = append(added, res)
+	}
+
+	doAPIRequest(t, api, http.MethodPost, "/api/feeds", map[string]string{"URL": serverURL(ts, allTestCases["Serial"].Filename)}, http.StatusBadGateway, nil)
+	doAPIRequest(t, api, http.MethodPost, "/api/feeds", map[string]string{}, http.StatusBadRequest, nil)
+
+	// List feeds.
+
+	var feeds []feedView
+	doAPIRequest(t, api, http.MethodGet, "/api/feeds?sortby=title", nil, http.StatusOK, &feeds)
+
+	if len(feeds) != 2 {
+		t.Fatalf("Expected 2 feeds, got %d", len(feeds))
+	}
+
+	feedsByTitle := map[string]feedView{
+		feeds[0].Title: feeds[0],
+		feeds[1].Title: feeds[1],
+	}
+
+	for _, feed := range []*feedViewTest{{serial, added[0].ID}, {stown, added[1].ID}} {
+
+		got, ok := feedsByTitle[feed.Title]
+		if !ok {
+			t.Errorf("Expected feed %q in results", feed.Title)
+			continue
+		}
+
+		if got.ID != feed.ID {
+			t.Errorf("Expected feed %q to have ID %d, got %d", feed.Title, feed.ID, got.ID)
+		}
+
+		compareFeedView(t, feedViewFromFeed(feed.Feed), &got)
+	}
+
+	doAPIRequest(t, api, http.MethodGet, "/api/feeds?sortby=nonsense", nil, http.StatusBadRequest, nil)
+
+	// List items.
+
+	var items []apiItem
+	doAPIRequest(t, api, http.MethodGet, "/api/items?top=3&feed="+strconv.FormatInt(added[0].ID, 10), nil, http.StatusOK, &items)
+
+	if len(items) != 3 {
+		t.Fatalf("Expected 3 items, got %d", len(items))
+	}
+
+	for i, item := range items {
+		if item.Title != serial.Items[i].Title || item.URL != serial.Items[i].URL || item.FeedID != added[0].ID {
+			t.Errorf("Unexpected item %d: %s", i, jsonify(item))
+		}
+	}
+
+	// Mark items as unplayed.
+
+	body := map[string]interface{}{
+		"IDs":    []int64{items[0].ID, items[1].ID},
+		"Played": false,
+	}
+
+	doAPIRequest(t, api, http.MethodPost, "/api/items/played", body, http.StatusNoContent, nil)
+	verifyUnplayedItemCount(t, db, added[0].ID, 2)
+
+	doAPIRequest(t, api, http.MethodGet, "/api/items?unplayed=true", nil, http.StatusOK, &items)
+
+	if len(items) != 2 {
+		t.Errorf("Expected 2 unplayed items, got %d", len(items))
+	}
+
+	doAPIRequest(t, api, http.MethodPost, "/api/items/played", map[string]interface{}{}, http.StatusBadRequest, nil)
+
+	// Sync.
+
+	var res apiSyncResult
+	doAPIRequest(t, api, http.MethodPost, "/api/feeds/"+strconv.FormatInt(added[1].ID, 10)+"/sync", nil, http.StatusOK, &res)
+
+	if res.ID != added[1].ID || res.Items != 0 {
+		t.Errorf("Unexpected sync result %s", jsonify(res))
+	}
+
+	var results []apiSyncResult
+	doAPIRequest(t, api, http.MethodPost, "/api/sync", nil, http.StatusOK, &results)
+
+	if len(results) != 2 {
+		t.Errorf("Expected 2 sync results, got %d", len(results))
+	}
+
+	doAPIRequest(t, api, http.MethodGet, "/api/sync", nil, http.StatusMethodNotAllowed, nil)
+
+	// HTML interface.
+
+	html := doAPIRequest(t, api, http.MethodGet, "/?feed="+strconv.FormatInt(added[0].ID, 10), nil, http.StatusOK, nil)
+
+	for _, s := range []string{"<audio", serial.Title, stown.Title, serial.Items[0].Title} {
+		if !strings.Contains(html, s) {
+			t.Errorf("Expected index page to contain %q", s)
+		}
+	}
+
+	doAPIRequest(t, api, http.MethodGet, "/nonsense", nil, http.StatusNotFound, nil)
+
+	// Remove feeds.
+
+	path := "/api/feeds/" + strconv.FormatInt(added[0].ID, 10)
+
+	doAPIRequest(t, api, http.MethodDelete, path, nil, http.StatusNoContent, nil)
+	doAPIRequest(t, api, http.MethodDelete, path, nil, http.StatusNotFound, nil)
+	doAPIRequest(t, api, http.MethodPost, path+"/sync", nil, http.StatusNotFound, nil)
+	doAPIRequest(t, api, http.MethodDelete, "/api/feeds/nonsense", nil, http.StatusNotFound, nil)
+
+	verifyTables(t, db, map[string]int{
+		"feeds":           1,
+		"items":           len(stown.Items),
+		"sqlite_sequence": 2,
+	})
+}
+
+func TestAPIServerRequestChecks(t *testing.T) {
+	testWithInitDB(t, testAPIServerRequestChecks)
+}
+
+func testAPIServerRequestChecks(t *testing.T, db *sql.DB) {
+
+	api := newTestAPIServer(db, "")
+	defer api.Close()
+
+	_, port := splitHostPort(api.Listener.Addr().String(), "")
+
+	tests := []struct {
+		Name        string
+		Method      string
+		Path        string
+		Host        string
+		Origin      string
+		ContentType string
+		Status      int
+	}{
+		{
+			Name:   "Own address",
+			Method: http.MethodGet,
+			Path:   "/api/feeds",
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "Localhost",
+			Method: http.MethodGet,
+			Path:   "/api/feeds",
+			Host:   "localhost:" + port,
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "Rebound host name",
+			Method: http.MethodGet,
+			Path:   "/api/feeds",
+			Host:   "attacker.example.com:" + port,
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:   "Wrong port",
+			Method: http.MethodGet,
+			Path:   "/api/feeds",
+			Host:   "localhost",
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:        "Same origin",
+			Method:      http.MethodPost,
+			Path:        "/api/items/played",
+			Origin:      api.URL,
+			ContentType: "application/json; charset=utf-8",
+			Status:      http.StatusBadRequest,
+		},
+		{
+			Name:        "Foreign origin",
+			Method:      http.MethodPost,
+			Path:        "/api/items/played",
+			Origin:      "http://attacker.example.com",
+			ContentType: "application/json",
+			Status:      http.StatusForbidden,
+		},
+		{
+			Name:   "Foreign origin delete",
+			Method: http.MethodDelete,
+			Path:   "/api/feeds/1",
+			Origin: "null",
+			Status: http.StatusForbidden,
+		},
+		{
+			Name:        "Form post",
+			Method:      http.MethodPost,
+			Path:        "/api/sync",
+			ContentType: "application/x-www-form-urlencoded",
+			Status:      http.StatusUnsupportedMediaType,
+		},
+		{
+			Name:        "Text post",
+			Method:      http.MethodPost,
+			Path:        "/api/feeds",
+			ContentType: "text/plain",
+			Status:      http.StatusUnsupportedMediaType,
+		},
+		{
+			Name:   "No content type",
+			Method: http.MethodPost,
+			Path:   "/api/sync",
+			Status: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, test := range tests {
+
+		req, err := http.NewRequest(test.Method, serverURL(api, test.Path), strings.NewReader("{}"))
+		if err != nil {
+			t.Fatalf("%s: http.NewRequest returned error %q", test.Name, err)
+		}
+
+		if test.Host != "" {
+			req.Host = test.Host
+		}
+		if test.Origin != "" {
+			req.Header.Set("Origin", test.Origin)
+		}
+		if test.ContentType != "" {
+			req.Header.Set("Content-Type", test.ContentType)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request returned error %q", test.Name, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.Status {
+			t.Errorf("%s: expected status %d, got %d", test.Name, test.Status, resp.StatusCode)
+		}
+	}
+}
+
+func TestIsAllowedHost(t *testing.T) {
+
+	tests := []struct {
+		Addr    string
+		Allowed []string
+		Denied  []string
+	}{
+		{
+			Addr:    "localhost:8686",
+			Allowed: []string{"localhost:8686", "127.0.0.1:8686", "[::1]:8686"},
+			Denied:  []string{"localhost:8080", "localhost", "192.168.1.2:8686", "attacker.example.com:8686"},
+		},
+		{
+			Addr:    "0.0.0.0:8686",
+			Allowed: []string{"localhost:8686", "192.168.1.2:8686", "[fe80::1]:8686"},
+			Denied:  []string{"kibner.local:8686", "attacker.example.com:8686"},
+		},
+		{
+			Addr:    ":80",
+			Allowed: []string{"192.168.1.2", "192.168.1.2:80"},
+			Denied:  []string{"attacker.example.com"},
+		},
+		{
+			Addr:    "kibner.local:8686",
+			Allowed: []string{"kibner.local:8686", "KIBNER.local:8686"},
+			Denied:  []string{"localhost:8686", "192.168.1.2:8686"},
+		},
+	}
+
+	for _, test := range tests {
+
+		s := newAPIServer(nil, nil, "", test.Addr)
+
+		for _, host := range test.Allowed {
+			if !s.isAllowedHost(host) {
+				t.Errorf("%s: expected host %s to be allowed", test.Addr, host)
+			}
+		}
+
+		for _, host := range test.Denied {
+			if s.isAllowedHost(host) {
+				t.Errorf("%s: expected host %s to be denied", test.Addr, host)
+			}
+		}
+	}
+}
+
+// newTestAPIServer starts an API server on a random local port.
+func newTestAPIServer(db *sql.DB, mediaDir string) *httptest.Server {
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config.Handler = newAPIServer(db, nil, mediaDir, ts.Listener.Addr().String())
+	ts.Start()
+	return ts
+}
+
+type feedViewTest struct {
+	*kibner.Feed
+	ID int64
+}
+
+// doAPIRequest makes a request to the API server and checks
+// the response status. If result is non-nil, the response body
+// is decoded into it. The body is also returned as a string.
+func doAPIRequest(t *testing.T, ts *httptest.Server, method, path string, data interface{}, status int, result interface{}) string {
+
+	var body bytes.Buffer
+
+	if data != nil {
+		if err := json.NewEncoder(&body).Encode(data); err != nil {
+			t.Fatalf("%s %s: error encoding request: %s", method, path, err)
+		}
+	}
+
+	req, err := http.NewRequest(method, serverURL(ts, path), &body)
+	if err != nil {
+		t.Fatalf("%s %s: http.NewRequest returned error %q", method, path, err)
+	}
+
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: request returned error %q", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: error reading response: %s", method, path, err)
+	}
+
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s: expected status %d, got %d (%s)", method, path, status, resp.StatusCode, b)
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(b, result); err != nil {
+			t.Fatalf("%s %s: error decoding response: %s", method, path, err)
+		}
+	}
+
+	return string(b)
+}
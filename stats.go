@@ -0,0 +1,359 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// listeningStats summarises what's been listened to and what's
+// waiting to be listened to.
+type listeningStats struct {
+	Since         *time.Time     `json:"since,omitempty"`
+	Listened      int64          `json:"listened_seconds"`
+	Played        int            `json:"played_items"`
+	Backlog       int64          `json:"backlog_seconds"`
+	Unplayed      int            `json:"unplayed_items"`
+	CurrentStreak int            `json:"current_streak_days"`
+	LongestStreak int            `json:"longest_streak_days"`
+	Weeks         []*periodStats `json:"weeks"`
+	Months        []*periodStats `json:"months"`
+	Feeds         []*feedStats   `json:"feeds"`
+}
+
+// periodStats is the listening done in a week or a month.
+type periodStats struct {
+	Start    time.Time `json:"start"`
+	Listened int64     `json:"listened_seconds"`
+	Played   int       `json:"played_items"`
+}
+
+type feedStats struct {
+	ID            int64      `json:"id"`
+	Title         string     `json:"title"`
+	Listened      int64      `json:"listened_seconds"`
+	Played        int        `json:"played_items"`
+	Backlog       int64      `json:"backlog_seconds"`
+	Unplayed      int        `json:"unplayed_items"`
+	Released      int        `json:"released_items"`
+	AverageLength int64      `json:"average_length_seconds"`
+	Cadence       float64    `json:"cadence_days"`
+	LastRelease   *time.Time `json:"last_release,omitempty"`
+}
+
+// statsRow is an item from the database. Times are Unix
+// timestamps.
+type statsRow struct {
+	FeedID    int64
+	FeedTitle string
+	Pubdate   int64
+	Duration  int64
+	Unplayed  bool
+	Position  int64
+	Updated   int64
+}
+
+func loadStatsRows(db *sql.DB, feedIDs []int64) ([]statsRow, error) {
+
+	var where string
+	var params []interface{}
+
+	if len(feedIDs) > 0 {
+		placeholders := make([]string, len(feedIDs))
+		for i, id := range feedIDs {
+			placeholders[i] = "?"
+			params = append(params, id)
+		}
+		where = "WHERE f.id IN(" + strings.Join(placeholders, ", ") + ")"
+	}
+
+	// Casting the DATETIME columns stops the driver from
+	// converting them to time.Time.
+	q := fmt.Sprintf(
+		`SELECT
+			f.id,
+			f.title,
+			CAST(i.pubdate AS INTEGER),
+			CAST(i.duration AS INTEGER),
+			i.unplayed,
+			i.position,
+			CAST(i.updated AS INTEGER)
+		FROM
+			items i
+		JOIN
+			feeds f ON f.id = i.feedid
+		%s
+		ORDER BY
+			f.title COLLATE NOCASE, f.id, i.pubdate`, where)
+
+	var rows []statsRow
+	if err := queryRows(&rows, db, q, params...); err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// computeStats works out listening statistics for the given
+// items. An item counts as listened to when it's marked as
+// played, which is when its updated time is set. Items that were
+// already played when their feed was added don't count. Partly
+// played items count for as far as they've been played.
+//
+// Listening is counted from the since date (unless it's zero),
+// as are releases for the purposes of average episode length
+// and publishing cadence. The backlog is always the current
+// unplayed items.
+func computeStats(rows []statsRow, since, now time.Time) *listeningStats {
+
+	stats := &listeningStats{}
+	if !since.IsZero() {
+		stats.Since = &since
+	}
+
+	feeds := map[int64]*feedStats{}
+	weeks := map[time.Time]*periodStats{}
+	months := map[time.Time]*periodStats{}
+	days := map[time.Time]bool{}
+
+	// Release dates, in ascending order, per feed.
+	pubdates := map[int64][]int64{}
+	lengths := map[int64][]int64{}
+
+	zeroPubdate := time.Time{}.Unix()
+
+	for _, row := range rows {
+
+		f := feeds[row.FeedID]
+		if f == nil {
+			f = &feedStats{
+				ID:    row.FeedID,
+				Title: row.FeedTitle,
+			}
+			feeds[row.FeedID] = f
+			stats.Feeds = append(stats.Feeds, f)
+		}
+
+		if row.Unplayed {
+			f.Unplayed++
+			if left := row.Duration - row.Position; left > 0 {
+				f.Backlog += left
+			}
+		}
+
+		if row.Pubdate > zeroPubdate {
+			pubdate := time.Unix(row.Pubdate, 0)
+			if f.LastRelease == nil || pubdate.After(*f.LastRelease) {
+				f.LastRelease = &pubdate
+			}
+			if !pubdate.Before(since) {
+				pubdates[f.ID] = append(pubdates[f.ID], row.Pubdate)
+				if row.Duration > 0 {
+					lengths[f.ID] = append(lengths[f.ID], row.Duration)
+				}
+			}
+		}
+
+		// What was listened to, and when?
+
+		if row.Updated <= 0 {
+			continue
+		}
+
+		updated := time.Unix(row.Updated, 0).In(now.Location())
+		if updated.Before(since) {
+			continue
+		}
+
+		var listened int64
+		var played int
+
+		switch {
+		case !row.Unplayed:
+			listened, played = row.Duration, 1
+		case row.Position > 0:
+			listened = row.Position
+		default:
+			// Marked as unplayed.
+			continue
+		}
+
+		f.Listened += listened
+		f.Played += played
+
+		day := startOfDay(updated)
+		days[day] = true
+
+		week := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		month := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, day.Location())
+
+		for _, period := range []struct {
+			m     map[time.Time]*periodStats
+			start time.Time
+		}{
+			{weeks, week},
+			{months, month},
+		} {
+			p := period.m[period.start]
+			if p == nil {
+				p = &periodStats{
+					Start: period.start,
+				}
+				period.m[period.start] = p
+			}
+			p.Listened += listened
+			p.Played += played
+		}
+	}
+
+	for _, f := range stats.Feeds {
+
+		stats.Listened += f.Listened
+		stats.Played += f.Played
+		stats.Backlog += f.Backlog
+		stats.Unplayed += f.Unplayed
+
+		dates := pubdates[f.ID]
+		f.Released = len(dates)
+
+		if len(dates) > 1 {
+			secs := dates[len(dates)-1] - dates[0]
+			f.Cadence = float64(secs) / (24 * 60 * 60) / float64(len(dates)-1)
+		}
+
+		if n := len(lengths[f.ID]); n > 0 {
+			var total int64
+			for _, secs := range lengths[f.ID] {
+				total += secs
+			}
+			f.AverageLength = total / int64(n)
+		}
+	}
+
+	sort.SliceStable(stats.Feeds, func(i, j int) bool {
+		return stats.Feeds[i].Listened > stats.Feeds[j].Listened
+	})
+
+	stats.Weeks = sortPeriods(weeks)
+	stats.Months = sortPeriods(months)
+	stats.CurrentStreak, stats.LongestStreak = listeningStreaks(days, startOfDay(now))
+
+	return stats
+}
+
+// sortPeriods returns the given periods, most recent first.
+func sortPeriods(m map[time.Time]*periodStats) []*periodStats {
+
+	periods := []*periodStats{}
+	for _, p := range m {
+		periods = append(periods, p)
+	}
+
+	sort.Slice(periods, func(i, j int) bool {
+		return periods[i].Start.After(periods[j].Start)
+	})
+
+	return periods
+}
+
+// listeningStreaks returns the number of consecutive days up to
+// today on which something was listened to, and the longest run
+// of such days. The current streak isn't broken until a whole
+// day passes without listening, i.e. it counts from yesterday if
+// nothing's been played yet today.
+func listeningStreaks(days map[time.Time]bool, today time.Time) (int, int) {
+
+	current := 0
+	day := today
+	if !days[day] {
+		day = day.AddDate(0, 0, -1)
+	}
+	for days[day] {
+		current++
+		day = day.AddDate(0, 0, -1)
+	}
+
+	longest := 0
+	for day := range days {
+
+		// Only count from the start of each run.
+		if days[day.AddDate(0, 0, -1)] {
+			continue
+		}
+
+		n := 0
+		for d := day; days[d]; d = d.AddDate(0, 0, 1) {
+			n++
+		}
+		if n > longest {
+			longest = n
+		}
+	}
+
+	return current, longest
+}
+
+// formatCadence describes how often a feed releases items.
+func formatCadence(days float64) string {
+	switch {
+	case days <= 0:
+		return "Release schedule unknown"
+	case days < 1.5:
+		return "New items daily"
+	default:
+		return fmt.Sprintf("New items every %.0f days", days)
+	}
+}
+
+func defaultStatsTemplate(now time.Time) *template.Template {
+
+	layout := `
+{{- with .Since}}Since {{.Local | date}}{{else}}All time{{end}}
+
+Listened: {{.Listened | duration}} ({{count .Played "item"}} played)
+Backlog:  {{.Backlog | duration}} ({{count .Unplayed "unplayed item"}})
+Streak:   {{count .CurrentStreak "day"}} (longest {{count .LongestStreak "day"}})
+{{with .Weeks}}
+By week:
+{{range .}}  Week of {{.Start | date | printf "%-12s"}} {{.Listened | duration | printf "%8s"}}  {{count .Played "item"}}
+{{end}}{{end}}
+{{- with .Months}}
+By month:
+{{range .}}  {{.Start | month | printf "%-20s"}} {{.Listened | duration | printf "%8s"}}  {{count .Played "item"}}
+{{end}}{{end}}
+{{- with .Feeds}}
+By feed:
+{{range .}}
+  {{.Title}}
+    Listened {{.Listened | duration}} ({{count .Played "item"}}) | Backlog {{.Backlog | duration}} ({{count .Unplayed "item"}})
+    Average length {{with .AverageLength}}{{. | duration}}{{else}}unknown{{end}} | {{.Cadence | cadence}}{{with .LastRelease}} | Last release {{.Local | ago}}{{end}}
+{{end}}{{end -}}
+`
+
+	funcs := template.FuncMap{
+		"ago": func(t time.Time) string {
+			return timeRelativeTo(now, t)
+		},
+		"date": func(t time.Time) string {
+			return t.Format("Jan 2, 2006")
+		},
+		"month": func(t time.Time) string {
+			return t.Format("January 2006")
+		},
+		"count": func(n int, noun string) string {
+			if n == 1 {
+				return "1 " + noun
+			}
+			return fmt.Sprintf("%d %ss", n, noun)
+		},
+		"duration": formatSeconds,
+		"cadence":  formatCadence,
+	}
+
+	return template.Must(
+		template.New("stats").Funcs(funcs).Parse(layout),
+	)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestComputeStats(t *testing.T) {
+
+	now := time.Date(2017, time.October, 11, 20, 0, 0, 0, time.UTC)
+
+	day := func(d int) int64 {
+		return time.Date(2017, time.October, d, 12, 0, 0, 0, time.UTC).Unix()
+	}
+
+	never := time.Time{}.Unix()
+
+	rows := []statsRow{
+
+		// Released weekly. Two played this week, one in the
+		// previous month, one half played and one not played.
+		{FeedID: 1, FeedTitle: "Weekly", Pubdate: day(1) - 21*24*60*60, Duration: 1800, Updated: day(1) - 7*24*60*60},
+		{FeedID: 1, FeedTitle: "Weekly", Pubdate: day(1) - 14*24*60*60, Duration: 1800},
+		{FeedID: 1, FeedTitle: "Weekly", Pubdate: day(1) - 7*24*60*60, Duration: 3600, Updated: day(9)},
+		{FeedID: 1, FeedTitle: "Weekly", Pubdate: day(1), Duration: 3600, Updated: day(10)},
+		{FeedID: 1, FeedTitle: "Weekly", Pubdate: day(8), Duration: 3600, Unplayed: true, Position: 600, Updated: day(11)},
+
+		// No durations or dates, never played.
+		{FeedID: 2, FeedTitle: "Unknown", Pubdate: never, Unplayed: true},
+		{FeedID: 2, FeedTitle: "Unknown", Pubdate: never, Unplayed: true},
+	}
+
+	got := computeStats(rows, time.Time{}, now)
+
+	if got.Since != nil {
+		t.Errorf("expected Since to be nil, got %v", got.Since)
+	}
+
+	for _, test := range []struct {
+		Name     string
+		Got, Exp interface{}
+	}{
+		{"Listened", got.Listened, int64(1800 + 3600 + 3600 + 600)},
+		{"Played", got.Played, 3},
+		{"Backlog", got.Backlog, int64(3000)},
+		{"Unplayed", got.Unplayed, 3},
+		{"CurrentStreak", got.CurrentStreak, 3},
+		{"LongestStreak", got.LongestStreak, 3},
+		{"Weeks", len(got.Weeks), 2},
+		{"Months", len(got.Months), 2},
+		{"Feeds", len(got.Feeds), 2},
+	} {
+		if !reflect.DeepEqual(test.Got, test.Exp) {
+			t.Errorf("expected %s to be %v, got %v", test.Name, test.Exp, test.Got)
+		}
+	}
+
+	// Most recent first.
+	exp := []*periodStats{
+		{
+			Start:    time.Date(2017, time.October, 9, 0, 0, 0, 0, time.UTC),
+			Listened: 3600 + 3600 + 600,
+			Played:   2,
+		},
+		{
+			Start:    time.Date(2017, time.September, 18, 0, 0, 0, 0, time.UTC),
+			Listened: 1800,
+			Played:   1,
+		},
+	}
+
+	if !reflect.DeepEqual(got.Weeks, exp) {
+		t.Errorf("expected Weeks to be %+v, got %+v", exp, got.Weeks)
+	}
+
+	weekly := got.Feeds[0]
+
+	if weekly.Title != "Weekly" {
+		t.Fatalf("expected the first feed to be %q, got %q", "Weekly", weekly.Title)
+	}
+
+	if weekly.Cadence != 7 {
+		t.Errorf("expected Weekly to have cadence 7, got %v", weekly.Cadence)
+	}
+
+	if exp := int64(1800+1800+3600+3600+3600) / 5; weekly.AverageLength != exp {
+		t.Errorf("expected Weekly to have average length %d, got %d", exp, weekly.AverageLength)
+	}
+
+	if weekly.LastRelease == nil || weekly.LastRelease.Unix() != day(8) {
+		t.Errorf("expected Weekly to have last release %v, got %v", time.Unix(day(8), 0), weekly.LastRelease)
+	}
+
+	unknown := got.Feeds[1]
+
+	if unknown.Cadence != 0 || unknown.AverageLength != 0 || unknown.LastRelease != nil {
+		t.Errorf("expected Unknown to have no cadence, length or last release, got %+v", unknown)
+	}
+
+	// Only count recent listening and releases.
+	since := time.Date(2017, time.October, 1, 0, 0, 0, 0, time.UTC)
+	got = computeStats(rows, since, now)
+
+	if exp := int64(3600 + 3600 + 600); got.Listened != exp {
+		t.Errorf("expected Listened since %v to be %d, got %d", since, exp, got.Listened)
+	}
+
+	if got.Backlog != 3000 {
+		t.Errorf("expected Backlog since %v to be %d, got %d", since, 3000, got.Backlog)
+	}
+
+	if weekly := got.Feeds[0]; weekly.Released != 2 || weekly.AverageLength != 3600 {
+		t.Errorf("expected Weekly to have 2 releases of 3600 seconds since %v, got %d of %d", since, weekly.Released, weekly.AverageLength)
+	}
+}
+
+func TestListeningStreaks(t *testing.T) {
+
+	today := time.Date(2017, time.October, 11, 0, 0, 0, 0, time.UTC)
+
+	days := func(offsets ...int) map[time.Time]bool {
+		m := map[time.Time]bool{}
+		for _, n := range offsets {
+			m[today.AddDate(0, 0, -n)] = true
+		}
+		return m
+	}
+
+	tests := []struct {
+		Days             map[time.Time]bool
+		Current, Longest int
+	}{
+		{
+			Days: days(),
+		},
+		{
+			Days:    days(0, 1, 2, 5, 6),
+			Current: 3,
+			Longest: 3,
+		},
+		{
+			// Not played today (yet).
+			Days:    days(1, 2),
+			Current: 2,
+			Longest: 2,
+		},
+		{
+			Days:    days(2, 3, 10, 11, 12, 13),
+			Current: 0,
+			Longest: 4,
+		},
+	}
+
+	for i, test := range tests {
+		current, longest := listeningStreaks(test.Days, today)
+		if current != test.Current || longest != test.Longest {
+			t.Errorf("Test %d: expected streaks %d and %d, got %d and %d", i+1, test.Current, test.Longest, current, longest)
+		}
+	}
+}
+
+func TestDefaultStatsTemplate(t *testing.T) {
+
+	now := time.Date(2017, time.October, 11, 20, 0, 0, 0, time.Local)
+	played := time.Date(2017, time.October, 10, 12, 0, 0, 0, time.Local).Unix()
+
+	rows := []statsRow{
+		{FeedID: 1, FeedTitle: "Daily", Pubdate: played - 24*60*60, Duration: 1800, Updated: played},
+		{FeedID: 1, FeedTitle: "Daily", Pubdate: played, Duration: 2700, Unplayed: true},
+	}
+
+	stats := computeStats(rows, time.Time{}, now)
+
+	exp := `All time
+
+Listened: 30m (1 item played)
+Backlog:  45m (1 unplayed item)
+Streak:   1 day (longest 1 day)
+
+By week:
+  Week of Oct 9, 2017       30m  1 item
+
+By month:
+  October 2017              30m  1 item
+
+By feed:
+
+  Daily
+    Listened 30m (1 item) | Backlog 45m (1 item)
+    Average length 38m | New items daily | Last release Yesterday
+`
+
+	var buf bytes.Buffer
+	if err := defaultStatsTemplate(now).Execute(&buf, stats); err != nil {
+		t.Fatalf("template returned error %q", err)
+	}
+
+	if got := buf.String(); got != exp {
+		t.Errorf("expected stats template to output %q, got %q", exp, got)
+	}
+
+	// JSON output uses seconds and lowercase names.
+	b, err := json.Marshal(stats)
+	if err != nil {
+		t.Fatalf("json.Marshal returned error %q", err)
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("json.Unmarshal returned error %q", err)
+	}
+
+	if got := m["listened_seconds"]; got != float64(1800) {
+		t.Errorf("expected listened_seconds to be 1800, got %v", got)
+	}
+
+	if _, ok := m["since"]; ok {
+		t.Errorf("expected no since field, got %v", m["since"])
+	}
+}
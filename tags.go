@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// normaliseTag tidies up a user-supplied tag. Slashes separate
+// nested folders, so news/tech is the tech folder inside the
+// news folder. Whitespace around folder names and empty folder
+// names are removed.
+func normaliseTag(s string) (string, error) {
+
+	// Commas would be ambiguous in lists of tags.
+	if strings.Contains(s, ",") {
+		return "", fmt.Errorf("invalid tag %q: tags can't contain commas", s)
+	}
+
+	var parts []string
+
+	for _, part := range strings.Split(s, "/") {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	if len(parts) == 0 {
+		return "", fmt.Errorf("invalid tag %q", s)
+	}
+
+	return strings.Join(parts, "/"), nil
+}
+
+func normaliseTags(tags []string) ([]string, error) {
+
+	normalised := make([]string, len(tags))
+
+	for i, tag := range tags {
+		s, err := normaliseTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		normalised[i] = s
+	}
+
+	return normalised, nil
+}
+
+// tagCondition returns a WHERE condition that matches feeds with
+// the given tag or with a tag in a folder inside it. The column
+// is the feed ID column to compare against.
+func tagCondition(column string, tag string) (string, []interface{}) {
+
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(tag)
+
+	cond := column + ` IN(SELECT feedid FROM feed_tags WHERE tag = ? COLLATE NOCASE OR tag LIKE ? ESCAPE '\')`
+	return cond, []interface{}{tag, escaped + "/%"}
+}
+
+// tagFeed adds tags to a feed. Tags that the feed already has
+// (ignoring case) are skipped.
+func tagFeed(db *sql.DB, feedID int64, tags []string) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := insertTags(tx, feedID, tags); err != nil {
+		return rollback(tx, err)
+	}
+
+	return tx.Commit()
+}
+
+// untagFeed removes tags from a feed. If no tags are given, all
+// of the feed's tags are removed.
+func untagFeed(db *sql.DB, feedID int64, tags []string) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if len(tags) == 0 {
+		err = deleteTags(tx, feedID)
+	} else {
+		for _, tag := range tags {
+			_, err = tx.Exec("DELETE FROM feed_tags WHERE feedid = ? AND tag = ? COLLATE NOCASE", feedID, tag)
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		return rollback(tx, err)
+	}
+
+	return tx.Commit()
+}
+
+func insertTags(tx *sql.Tx, feedID int64, tags []string) error {
+
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO feed_tags(feedid, tag) VALUES(?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, tag := range tags {
+		if _, err := stmt.Exec(feedID, tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func deleteTags(tx *sql.Tx, feedID int64) error {
+
+	_, err := tx.Exec("DELETE FROM feed_tags WHERE feedid = ?", feedID)
+	return err
+}
+
+// loadFeedTags returns the tags for every tagged feed, keyed by
+// feed ID. Each feed's tags are in alphabetical order.
+func loadFeedTags(db *sql.DB) (map[int64][]string, error) {
+
+	var rows []struct {
+		FeedID int64
+		Tag    string
+	}
+
+	q := "SELECT feedid, tag FROM feed_tags ORDER BY feedid, tag COLLATE NOCASE"
+
+	if err := queryRows(&rows, db, q); err != nil {
+		return nil, err
+	}
+
+	tags := map[int64][]string{}
+	for _, r := range rows {
+		tags[r.FeedID] = append(tags[r.FeedID], r.Tag)
+	}
+
+	return tags, nil
+}
+
+// loadTaggedFeedIDs returns the IDs of the feeds with the given
+// tag, or with a tag in a folder inside it.
+func loadTaggedFeedIDs(db *sql.DB, tag string) ([]int64, error) {
+
+	cond, params := tagCondition("id", tag)
+
+	var rows []struct {
+		ID int64
+	}
+
+	if err := queryRows(&rows, db, "SELECT id FROM feeds WHERE "+cond+" ORDER BY id", params...); err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, len(rows))
+	for i, r := range rows {
+		ids[i] = r.ID
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormaliseTag(t *testing.T) {
+
+	tests := []struct {
+		Input string
+		Tag   string
+		Error bool
+	}{
+		{
+			Input: "news",
+			Tag:   "news",
+		},
+		{
+			Input: "  True Crime ",
+			Tag:   "True Crime",
+		},
+		{
+			Input: "/news / tech//",
+			Tag:   "news/tech",
+		},
+		{
+			Input: " / ",
+			Error: true,
+		},
+		{
+			Input: "news,tech",
+			Error: true,
+		},
+	}
+
+	for _, test := range tests {
+
+		got, err := normaliseTag(test.Input)
+
+		if test.Error {
+			if err == nil {
+				t.Errorf("%q: expected normaliseTag to return an error, got %q", test.Input, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: normaliseTag returned error %q", test.Input, err)
+			continue
+		}
+
+		if got != test.Tag {
+			t.Errorf("%q: expected normaliseTag to return %q, got %q", test.Input, test.Tag, got)
+		}
+	}
+}
+
+func TestFeedTags(t *testing.T) {
+	testWithInitDB(t, testFeedTags)
+}
+
+func testFeedTags(t *testing.T, db *sql.DB) {
+
+	now := time.Now()
+	ids := map[string]int64{}
+
+	for _, name := range []string{"Serial", "Rework", "Columbo"} {
+		id, err := saveFeed(db, allTestCases[name].NewFeed(), now)
+		if err != nil {
+			t.Fatalf("%s: saveFeed returned error %q", name, err)
+		}
+		ids[name] = id
+	}
+
+	for name, tags := range map[string][]string{
+		"Serial":  {"news", "True Crime"},
+		"Rework":  {"business"},
+		"Columbo": {"true crime/tv", "news"},
+	} {
+		if err := tagFeed(db, ids[name], tags); err != nil {
+			t.Fatalf("%s: tagFeed returned error %q", name, err)
+		}
+	}
+
+	// Existing tags are ignored, whatever their case.
+	if err := tagFeed(db, ids["Serial"], []string{"NEWS"}); err != nil {
+		t.Fatalf("tagFeed returned error %q", err)
+	}
+
+	feedTags := func() map[string][]string {
+		views, err := loadFeedViews(db, listFeedOptions{SortBy: sortFeedsByTitle})
+		if err != nil {
+			t.Fatalf("loadFeedViews returned error %q", err)
+		}
+		m := map[string][]string{}
+		for _, v := range views {
+			m[v.Title] = v.Tags
+		}
+		return m
+	}
+
+	exp := map[string][]string{
+		"Serial":  {"news", "True Crime"},
+		"REWORK":  {"business"},
+		"Columbo": {"news", "true crime/tv"},
+	}
+
+	if got := feedTags(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected feed tags %v, got %v", exp, got)
+	}
+
+	// Tags match nested folders but not partial names.
+	for tag, titles := range map[string][]string{
+		"news":          {"Columbo", "Serial"},
+		"true crime":    {"Columbo", "Serial"},
+		"true crime/tv": {"Columbo"},
+		"true":          nil,
+		"business":      {"REWORK"},
+	} {
+
+		views, err := loadFeedViews(db, listFeedOptions{SortBy: sortFeedsByTitle, Tag: tag})
+		if err != nil {
+			t.Fatalf("%s: loadFeedViews returned error %q", tag, err)
+		}
+
+		var got []string
+		for _, v := range views {
+			got = append(got, v.Title)
+		}
+
+		if !reflect.DeepEqual(got, titles) {
+			t.Errorf("%s: expected feeds %v, got %v", tag, titles, got)
+		}
+
+		items, err := loadItemViews(db, listItemOptions{Tag: tag})
+		if err != nil {
+			t.Fatalf("%s: loadItemViews returned error %q", tag, err)
+		}
+
+		for _, item := range items {
+			if !containsFold(titles, item.FeedTitle) {
+				t.Errorf("%s: loadItemViews returned item from feed %q", tag, item.FeedTitle)
+			}
+		}
+	}
+
+	if err := untagFeed(db, ids["Serial"], []string{"true crime"}); err != nil {
+		t.Fatalf("untagFeed returned error %q", err)
+	}
+
+	if err := untagFeed(db, ids["Rework"], nil); err != nil {
+		t.Fatalf("untagFeed returned error %q", err)
+	}
+
+	exp = map[string][]string{
+		"Serial":  {"news"},
+		"REWORK":  nil,
+		"Columbo": {"news", "true crime/tv"},
+	}
+
+	if got := feedTags(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected feed tags %v, got %v", exp, got)
+	}
+
+	// Removing a feed removes its tags.
+	if err := removeFeed(db, nil, ids["Columbo"]); err != nil {
+		t.Fatalf("removeFeed returned error %q", err)
+	}
+
+	verifyTables(t, db, map[string]int{
+		"feeds":           2,
+		"items":           len(allTestCases["Serial"].NewFeed().Items) + len(allTestCases["Rework"].NewFeed().Items),
+		"feed_tags":       1,
+		"sqlite_sequence": 2,
+	})
+}
+
+func TestDefaultFeedTemplateTags(t *testing.T) {
+
+	feeds := []feedView{
+		{ID: 1, Title: "Serial", Author: "This American Life", Items: 2, Tags: []string{"news", "true crime"}},
+		{ID: 2, Title: "Columbo", Author: "Columbo Podcast", Items: 1, Tags: []string{"news"}},
+		{ID: 3, Title: "REWORK", Author: "Basecamp", Items: 3},
+	}
+
+	exp := `Showing 3 feeds:
+
+news:
+      1. Serial
+         This American Life
+         Tags: news, true crime
+         2 items | ID: 1
+
+      2. Columbo
+         Columbo Podcast
+         Tags: news
+         1 item | ID: 2
+
+Untagged:
+      3. REWORK
+         Basecamp
+         3 items | ID: 3
+`
+
+	var buf bytes.Buffer
+	err := defaultFeedTemplate(time.Now()).Execute(&buf, map[string]interface{}{
+		"Feeds":      feeds,
+		"GroupByTag": true,
+	})
+	if err != nil {
+		t.Fatalf("template returned error %q", err)
+	}
+
+	if got := buf.String(); got != exp {
+		t.Errorf("expected feed template to output %q, got %q", exp, got)
+	}
+}
+
+func TestExportOPMLTags(t *testing.T) {
+	testWithInitDB(t, testExportOPMLTags)
+}
+
+func testExportOPMLTags(t *testing.T, db *sql.DB) {
+
+	now := time.Now()
+
+	tags := map[string][]string{
+		"Serial":  {"news", "True Crime"},
+		"Columbo": {"true crime/tv"},
+		"Rework":  nil,
+	}
+
+	urls := map[string]string{}
+
+	for name, feedTags := range tags {
+
+		feed := allTestCases[name].NewFeed()
+		urls[name] = feed.URL
+
+		id, err := saveFeed(db, feed, now)
+		if err != nil {
+			t.Fatalf("%s: saveFeed returned error %q", name, err)
+		}
+
+		if err := tagFeed(db, id, feedTags); err != nil {
+			t.Fatalf("%s: tagFeed returned error %q", name, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := exportOPML(db, &buf, now); err != nil {
+		t.Fatalf("exportOPML returned error %q", err)
+	}
+
+	// Folders first, in alphabetical order, then untagged
+	// feeds. Nested folders are nested outlines.
+	out := buf.String()
+	order := []string{
+		`<outline text="news">`,
+		`title="Serial"`,
+		`<outline text="True Crime">`,
+		`<outline text="tv">`,
+		`title="Columbo"`,
+		`title="Serial"`,
+		`title="REWORK"`,
+	}
+
+	pos := 0
+	for _, s := range order {
+		i := strings.Index(out[pos:], s)
+		if i < 0 {
+			t.Fatalf("expected exportOPML output to contain %q after position %d, got %q", s, pos, out)
+		}
+		pos += i + len(s)
+	}
+
+	gotURLs, details, err := extractURLsOPML(&buf)
+	if err != nil {
+		t.Fatalf("extractURLsOPML returned error %q", err)
+	}
+
+	if len(gotURLs) != len(urls) {
+		t.Errorf("expected extractURLsOPML to return %d urls, got %d", len(urls), len(gotURLs))
+	}
+
+	gotTags := map[string][]string{}
+	for u, d := range details {
+		if len(d.Tags) > 0 {
+			gotTags[u] = d.Tags
+		}
+	}
+
+	// Tags come from categories, which keep their case even
+	// though Columbo's folder is merged with Serial's.
+	exp := map[string][]string{
+		urls["Serial"]:  {"news", "True Crime"},
+		urls["Columbo"]: {"true crime/tv"},
+	}
+
+	if !reflect.DeepEqual(gotTags, exp) {
+		t.Errorf("expected extractURLsOPML to return tags %v, got %v", exp, gotTags)
+	}
+}
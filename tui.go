@@ -0,0 +1,902 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The terminal UI draws into a tuiBuffer, a virtual screen of
+// character cells. A tuiTerminal copies the buffer to a real
+// terminal (see tui_term.go). Tests inspect the buffer directly.
+
+type tuiAttr uint8
+
+const (
+	attrBold tuiAttr = 1 << iota
+	attrReverse
+)
+
+type tuiCell struct {
+	Ch   rune
+	Attr tuiAttr
+}
+
+type tuiBuffer struct {
+	Width  int
+	Height int
+	cells  []tuiCell
+}
+
+func newTUIBuffer(width, height int) *tuiBuffer {
+
+	b := &tuiBuffer{
+		Width:  width,
+		Height: height,
+		cells:  make([]tuiCell, width*height),
+	}
+
+	b.Clear()
+	return b
+}
+
+func (b *tuiBuffer) Clear() {
+	for i := range b.cells {
+		b.cells[i] = tuiCell{Ch: ' '}
+	}
+}
+
+func (b *tuiBuffer) Cell(x, y int) tuiCell {
+	return b.cells[y*b.Width+x]
+}
+
+// Text writes s to the buffer starting at (x, y). Text that
+// overflows the right edge of the buffer is discarded. It
+// returns the x position after the last character written.
+func (b *tuiBuffer) Text(x, y int, s string, attr tuiAttr) int {
+
+	if y < 0 || y >= b.Height {
+		return x
+	}
+
+	for _, c := range s {
+		if x >= b.Width {
+			break
+		}
+		if x >= 0 {
+			b.cells[y*b.Width+x] = tuiCell{c, attr}
+		}
+		x++
+	}
+
+	return x
+}
+
+// Fill sets n cells starting at (x, y) to blanks with the
+// given attributes.
+func (b *tuiBuffer) Fill(x, y, n int, attr tuiAttr) {
+	b.Text(x, y, strings.Repeat(" ", n), attr)
+}
+
+// Line returns the text in row y, minus any trailing spaces.
+func (b *tuiBuffer) Line(y int) string {
+
+	runes := make([]rune, b.Width)
+	for x := range runes {
+		runes[x] = b.Cell(x, y).Ch
+	}
+
+	return strings.TrimRight(string(runes), " ")
+}
+
+func (b *tuiBuffer) String() string {
+
+	lines := make([]string, b.Height)
+	for y := range lines {
+		lines[y] = b.Line(y)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// truncate shortens s to at most n characters.
+func truncate(s string, n int) string {
+
+	if n <= 0 {
+		return ""
+	}
+
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+
+	return string([]rune(s)[:n-1]) + "…"
+}
+
+type tuiKeyCode int
+
+const (
+	keyNone tuiKeyCode = iota
+	keyRune
+	keyUp
+	keyDown
+	keyLeft
+	keyRight
+	keyPageUp
+	keyPageDown
+	keyHome
+	keyEnd
+	keyEnter
+	keyTab
+	keyBackspace
+	keyEsc
+	keyCtrlC
+)
+
+type tuiKey struct {
+	Code tuiKeyCode
+	Rune rune
+}
+
+type tuiPane int
+
+const (
+	paneFeeds tuiPane = iota
+	paneItems
+)
+
+// tuiApp holds the state of the terminal UI. All of its methods
+// must be called from the same goroutine. Background tasks
+// (syncing, playback) report back by sending functions on the
+// events channel for the main loop to run.
+type tuiApp struct {
+	db      *sql.DB
+	hooks   *hookRunner
+	backend playerBackend
+	now     func() time.Time
+	events  chan func()
+	// saveInterval is how often playback progress is saved.
+	saveInterval time.Duration
+
+	feeds   []feedView
+	items   []itemView
+	feedIdx int // 0 is "All feeds"
+	itemIdx int
+	feedTop int
+	itemTop int
+	focus   tuiPane
+
+	unplayed bool
+	search   string
+	editing  bool
+	input    string
+
+	queue   []itemView
+	playing *itemView
+	current *playback
+	stop    chan struct{}
+	advance bool
+	paused  bool
+	speed   float64
+
+	syncing bool
+	status  string
+	quit    bool
+}
+
+// newTUIApp creates a terminal UI that plays items with the
+// given backend. A nil backend disables playback.
+func newTUIApp(db *sql.DB, hooks *hookRunner, backend playerBackend) *tuiApp {
+	return &tuiApp{
+		db:           db,
+		hooks:        hooks,
+		backend:      backend,
+		now:          time.Now,
+		events:       make(chan func(), 16),
+		saveInterval: defaults.SaveInterval,
+		speed:        1,
+	}
+}
+
+// tuiTerminal is the interface to a real (or fake) terminal.
+type tuiTerminal interface {
+	Size() (int, int, error)
+	Draw(*tuiBuffer) error
+}
+
+// Run draws the UI and handles keys and background events
+// until the user quits or the keys channel is closed.
+func (a *tuiApp) Run(term tuiTerminal, keys <-chan tuiKey) error {
+
+	if err := a.reload(); err != nil {
+		return err
+	}
+
+	// Redraw regularly to keep the playback position current.
+	refresh := time.NewTicker(time.Second)
+	defer refresh.Stop()
+
+	for !a.quit {
+
+		w, h, err := term.Size()
+		if err != nil {
+			return err
+		}
+
+		buf := newTUIBuffer(w, h)
+		a.draw(buf)
+
+		if err := term.Draw(buf); err != nil {
+			return err
+		}
+
+		select {
+		case k, ok := <-keys:
+			if !ok {
+				a.quit = true
+				break
+			}
+			a.handleKey(k)
+		case fn := <-a.events:
+			fn()
+		case <-refresh.C:
+		}
+	}
+
+	if a.playing != nil {
+		a.stopPlayback(false)
+		for a.playing != nil {
+			(<-a.events)()
+		}
+	}
+
+	return nil
+}
+
+func (a *tuiApp) reload() error {
+
+	feeds, err := loadFeedViews(a.db, listFeedOptions{
+		SortBy: sortFeedsByTitle,
+	})
+	if err != nil {
+		return err
+	}
+
+	a.feeds = feeds
+	a.feedIdx = clamp(a.feedIdx, 0, len(a.feeds))
+
+	return a.reloadItems()
+}
+
+func (a *tuiApp) reloadItems() error {
+
+	opts := listItemOptions{
+		Unplayed: a.unplayed,
+		Title:    a.search,
+	}
+
+	if feed := a.selectedFeed(); feed != nil {
+		opts.FeedID = feed.ID
+	}
+
+	items, err := loadItemViews(a.db, opts)
+	if err != nil {
+		return err
+	}
+
+	a.items = items
+	a.itemIdx = clamp(a.itemIdx, 0, len(a.items)-1)
+
+	return nil
+}
+
+func (a *tuiApp) selectedFeed() *feedView {
+	if a.feedIdx < 1 || a.feedIdx > len(a.feeds) {
+		return nil
+	}
+	return &a.feeds[a.feedIdx-1]
+}
+
+func (a *tuiApp) selectedItem() *itemView {
+	if a.itemIdx < 0 || a.itemIdx >= len(a.items) {
+		return nil
+	}
+	return &a.items[a.itemIdx]
+}
+
+func (a *tuiApp) setError(err error) {
+	if err != nil {
+		a.status = "Error: " + err.Error()
+	}
+}
+
+func (a *tuiApp) handleKey(k tuiKey) {
+
+	if a.editing {
+		a.handleSearchKey(k)
+		return
+	}
+
+	switch k.Code {
+	case keyCtrlC:
+		a.quit = true
+	case keyUp:
+		a.move(-1)
+	case keyDown:
+		a.move(1)
+	case keyPageUp:
+		a.move(-10)
+	case keyPageDown:
+		a.move(10)
+	case keyHome:
+		a.move(-1 << 30)
+	case keyEnd:
+		a.move(1 << 30)
+	case keyTab:
+		a.focus = 1 - a.focus
+	case keyLeft:
+		a.focus = paneFeeds
+	case keyRight:
+		a.focus = paneItems
+	case keyEnter:
+		if a.focus == paneFeeds {
+			a.focus = paneItems
+		} else {
+			a.playNow()
+		}
+	case keyEsc:
+		if a.search != "" {
+			a.search = ""
+			a.setError(a.reloadItems())
+		}
+	case keyRune:
+		a.handleRune(k.Rune)
+	}
+}
+
+func (a *tuiApp) handleRune(c rune) {
+
+	switch c {
+	case 'q':
+		a.quit = true
+	case 'j':
+		a.move(1)
+	case 'k':
+		a.move(-1)
+	case 'g':
+		a.move(-1 << 30)
+	case 'G':
+		a.move(1 << 30)
+	case 'h':
+		a.focus = paneFeeds
+	case 'l':
+		a.focus = paneItems
+	case '/':
+		a.editing = true
+		a.input = a.search
+	case 'u':
+		a.unplayed = !a.unplayed
+		a.setError(a.reloadItems())
+	case 'm':
+		a.togglePlayed()
+	case 'a':
+		a.toggleQueued()
+	case 'p':
+		a.startPlayback()
+	case 'n':
+		a.skip()
+	case 'x':
+		a.stopPlayback(false)
+	case ' ':
+		a.togglePause()
+	case ',':
+		a.seek(-30 * time.Second)
+	case '.':
+		a.seek(30 * time.Second)
+	case '[':
+		a.changeSpeed(-0.25)
+	case ']':
+		a.changeSpeed(0.25)
+	case 's':
+		a.startSync()
+	case 'r':
+		a.setError(a.reload())
+	}
+}
+
+func (a *tuiApp) handleSearchKey(k tuiKey) {
+
+	switch k.Code {
+	case keyRune:
+		a.input += string(k.Rune)
+	case keyBackspace:
+		if n := utf8.RuneCountInString(a.input); n > 0 {
+			a.input = string([]rune(a.input)[:n-1])
+		}
+	case keyEnter:
+		a.editing = false
+		a.search = a.input
+		a.itemIdx = 0
+		a.focus = paneItems
+		a.setError(a.reloadItems())
+	case keyEsc, keyCtrlC:
+		a.editing = false
+	}
+}
+
+func (a *tuiApp) move(delta int) {
+
+	if a.focus == paneFeeds {
+		idx := clamp(a.feedIdx+delta, 0, len(a.feeds))
+		if idx != a.feedIdx {
+			a.feedIdx = idx
+			a.itemIdx = 0
+			a.setError(a.reloadItems())
+		}
+		return
+	}
+
+	a.itemIdx = clamp(a.itemIdx+delta, 0, len(a.items)-1)
+}
+
+func (a *tuiApp) togglePlayed() {
+
+	item := a.selectedItem()
+	if item == nil {
+		return
+	}
+
+	if err := updatePlayedStatus(a.db, a.hooks, item.IsUnplayed, item.ID); err != nil {
+		a.setError(err)
+		return
+	}
+
+	a.setError(a.reload())
+}
+
+func (a *tuiApp) isQueued(id int64) bool {
+	for _, item := range a.queue {
+		if item.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *tuiApp) toggleQueued() {
+
+	item := a.selectedItem()
+	if item == nil {
+		return
+	}
+
+	for i := range a.queue {
+		if a.queue[i].ID == item.ID {
+			a.queue = append(a.queue[:i], a.queue[i+1:]...)
+			return
+		}
+	}
+
+	a.queue = append(a.queue, *item)
+}
+
+// playNow plays the selected item, interrupting anything
+// that's currently playing.
+func (a *tuiApp) playNow() {
+
+	item := a.selectedItem()
+	if item == nil {
+		return
+	}
+
+	a.queue = append([]itemView{*item}, a.queue...)
+
+	if a.playing != nil {
+		a.skip()
+		return
+	}
+
+	a.startPlayback()
+}
+
+// startPlayback plays the next item in the queue. If the queue
+// is empty, it plays the selected item.
+func (a *tuiApp) startPlayback() {
+
+	if a.playing != nil {
+		return
+	}
+
+	if a.backend == nil {
+		a.status = "No player specified (see the --player and --use options)"
+		return
+	}
+
+	if len(a.queue) == 0 {
+		item := a.selectedItem()
+		if item == nil {
+			return
+		}
+		a.queue = append(a.queue, *item)
+	}
+
+	item := a.queue[0]
+	a.queue = a.queue[1:]
+
+	pb, err := startItemPlayback(a.db, a.hooks, a.backend, item.ID)
+	if err != nil {
+		a.status = fmt.Sprintf("Error playing %s: %s", item.Title, err)
+		return
+	}
+
+	a.playing = &item
+	a.current = pb
+	a.stop = make(chan struct{})
+	a.advance = false
+	a.paused = false
+	a.status = ""
+
+	if a.speed != 1 {
+		a.setError(pb.SetSpeed(a.speed))
+	}
+
+	stop, interval := a.stop, a.saveInterval
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		err := pb.Wait(ticker.C, stop)
+		a.events <- func() {
+			a.finishPlayback(item, err)
+		}
+	}()
+}
+
+func (a *tuiApp) togglePause() {
+
+	if a.current == nil {
+		return
+	}
+
+	if err := a.current.Pause(!a.paused); err != nil {
+		a.setError(err)
+		return
+	}
+
+	a.paused = !a.paused
+}
+
+func (a *tuiApp) seek(delta time.Duration) {
+
+	if a.current == nil {
+		return
+	}
+
+	pos, err := a.current.Position()
+	if err != nil {
+		a.setError(err)
+		return
+	}
+
+	if pos += delta; pos < 0 {
+		pos = 0
+	}
+
+	a.setError(a.current.Seek(pos))
+}
+
+func (a *tuiApp) changeSpeed(delta float64) {
+
+	speed := a.speed + delta
+	if speed < 0.5 || speed > 3 {
+		return
+	}
+
+	if a.current != nil {
+		if err := a.current.SetSpeed(speed); err != nil {
+			a.setError(err)
+			return
+		}
+	}
+
+	a.speed = speed
+}
+
+func (a *tuiApp) skip() {
+	a.stopPlayback(true)
+}
+
+func (a *tuiApp) stopPlayback(advance bool) {
+
+	if a.playing == nil || a.stop == nil {
+		return
+	}
+
+	a.advance = advance
+	close(a.stop)
+	a.stop = nil
+}
+
+func (a *tuiApp) finishPlayback(item itemView, err error) {
+
+	a.playing = nil
+	a.current = nil
+	a.stop = nil
+
+	switch err {
+	case nil:
+		a.advance = true
+		a.setError(a.reload())
+	case errPlaybackStopped:
+		a.status = "Stopped " + item.Title
+		a.setError(a.reload())
+	default:
+		a.status = fmt.Sprintf("Error playing %s: %s", item.Title, err)
+		return
+	}
+
+	if a.advance && len(a.queue) > 0 {
+		a.startPlayback()
+	}
+}
+
+func (a *tuiApp) startSync() {
+
+	if a.syncing {
+		return
+	}
+
+	a.syncing = true
+
+	go func() {
+		results, err := syncAll(a.db, a.hooks, nil)
+		a.events <- func() {
+			a.finishSync(results, err)
+		}
+	}()
+}
+
+func (a *tuiApp) finishSync(results []*syncResult, err error) {
+
+	a.syncing = false
+
+	if err != nil {
+		a.setError(err)
+		return
+	}
+
+	items, errs := 0, 0
+	for _, res := range results {
+		items += res.Items
+		if res.Err != nil {
+			errs++
+		}
+	}
+
+	switch items {
+	case 1:
+		a.status = "Synced: 1 new item"
+	default:
+		a.status = fmt.Sprintf("Synced: %d new items", items)
+	}
+
+	switch errs {
+	case 0:
+	case 1:
+		a.status += ", 1 error"
+	default:
+		a.status += fmt.Sprintf(", %d errors", errs)
+	}
+
+	a.setError(a.reload())
+}
+
+const tuiHelp = "q:Quit  Tab:Switch  Enter:Play  a:Queue  p:Play queue  n:Next  x:Stop  Space:Pause  ,/.:Seek  [/]:Speed  m:Mark  u:Unplayed  /:Search  s:Sync"
+
+func (a *tuiApp) draw(buf *tuiBuffer) {
+
+	w, h := buf.Width, buf.Height
+
+	if w < 40 || h < 6 {
+		buf.Text(0, 0, "Terminal too small", 0)
+		return
+	}
+
+	// Title bar.
+
+	buf.Fill(0, 0, w, attrReverse)
+	buf.Text(1, 0, "Kibner", attrReverse|attrBold)
+
+	if a.syncing {
+		indicator := "Syncing..."
+		buf.Text(w-len(indicator)-1, 0, indicator, attrReverse)
+	}
+
+	// Panes.
+
+	feedsWidth := w / 3
+	itemsX := feedsWidth + 1
+	itemsWidth := w - itemsX
+	rows := h - 4
+
+	for y := 1; y < h-2; y++ {
+		buf.Text(feedsWidth, y, "│", 0)
+	}
+
+	buf.Text(0, 1, truncate("Feeds", feedsWidth), attrBold)
+	buf.Text(itemsX, 1, truncate(a.itemsHeading(), itemsWidth), attrBold)
+
+	a.feedTop = scroll(a.feedTop, a.feedIdx, rows)
+	for i := 0; i < rows && a.feedTop+i <= len(a.feeds); i++ {
+		idx := a.feedTop + i
+		a.drawFeed(buf, 0, i+2, feedsWidth, idx, idx == a.feedIdx)
+	}
+
+	a.itemTop = scroll(a.itemTop, a.itemIdx, rows)
+	for i := 0; i < rows && a.itemTop+i < len(a.items); i++ {
+		idx := a.itemTop + i
+		a.drawItem(buf, itemsX, i+2, itemsWidth, &a.items[idx], idx == a.itemIdx)
+	}
+
+	// Status line.
+
+	buf.Fill(0, h-2, w, attrReverse)
+	buf.Text(1, h-2, truncate(a.statusLine(), w-2), attrReverse)
+
+	// Help or search prompt.
+
+	if a.editing {
+		buf.Text(0, h-1, truncate("/"+a.input+"_", w), 0)
+	} else {
+		buf.Text(0, h-1, truncate(tuiHelp, w), 0)
+	}
+}
+
+func (a *tuiApp) itemsHeading() string {
+
+	s := "All items"
+	if feed := a.selectedFeed(); feed != nil {
+		s = feed.Title
+	}
+
+	if a.unplayed {
+		s += " (unplayed)"
+	}
+
+	if a.search != "" {
+		s += fmt.Sprintf(" matching %q", a.search)
+	}
+
+	return s
+}
+
+func (a *tuiApp) statusLine() string {
+
+	var parts []string
+
+	if a.playing != nil {
+		s := "Playing: " + a.playing.Title
+		if pos, dur, ok := a.current.Progress(); ok {
+			s += " " + formatHHMMSS(int64(pos/time.Second))
+			if dur > 0 {
+				s += "/" + formatHHMMSS(int64(dur/time.Second))
+			}
+		}
+		if a.speed != 1 {
+			s += fmt.Sprintf(" %gx", a.speed)
+		}
+		if a.paused {
+			s += " (paused)"
+		}
+		parts = append(parts, s)
+	}
+
+	if n := len(a.queue); n > 0 {
+		parts = append(parts, fmt.Sprintf("%d queued", n))
+	}
+
+	if a.status != "" {
+		parts = append(parts, a.status)
+	}
+
+	return strings.Join(parts, " | ")
+}
+
+func (a *tuiApp) drawFeed(buf *tuiBuffer, x, y, width, idx int, selected bool) {
+
+	title := "All feeds"
+	var unplayed int64
+
+	if idx == 0 {
+		for _, f := range a.feeds {
+			unplayed += f.UnplayedItems
+		}
+	} else {
+		title = a.feeds[idx-1].Title
+		unplayed = a.feeds[idx-1].UnplayedItems
+	}
+
+	var attr tuiAttr
+	if selected {
+		attr = attrBold
+		if a.focus == paneFeeds {
+			attr = attrReverse
+		}
+		buf.Fill(x, y, width, attr)
+	}
+
+	var count string
+	if unplayed > 0 {
+		count = fmt.Sprintf(" %d", unplayed)
+	}
+
+	buf.Text(x, y, truncate(title, width-len(count)), attr)
+	buf.Text(x+width-len(count), y, count, attr)
+}
+
+func (a *tuiApp) drawItem(buf *tuiBuffer, x, y, width int, item *itemView, selected bool) {
+
+	var attr tuiAttr
+	if selected {
+		attr = attrBold
+		if a.focus == paneItems {
+			attr = attrReverse
+		}
+		buf.Fill(x, y, width, attr)
+	}
+
+	marker := ' '
+	switch {
+	case a.playing != nil && a.playing.ID == item.ID:
+		marker = '>'
+	case a.isQueued(item.ID):
+		marker = '+'
+	case item.IsUnplayed:
+		marker = '*'
+	}
+
+	var date string
+	if !item.Pubdate.IsZero() {
+		date = " " + timeRelativeTo(a.now(), item.Pubdate)
+	}
+
+	dateLen := utf8.RuneCountInString(date)
+	if dateLen > width/2 {
+		date, dateLen = "", 0
+	}
+
+	x = buf.Text(x, y, string(marker)+" ", attr)
+	buf.Text(x, y, truncate(item.Title, width-dateLen-2), attr)
+	buf.Text(x+width-dateLen-2, y, date, attr)
+}
+
+// scroll returns the index of the first visible row in a list
+// so that the selected row idx is visible.
+func scroll(top, idx, rows int) int {
+
+	if idx < top {
+		return idx
+	}
+
+	if idx >= top+rows {
+		return idx - rows + 1
+	}
+
+	return top
+}
+
+func clamp(n, min, max int) int {
+
+	if n > max {
+		n = max
+	}
+
+	if n < min {
+		n = min
+	}
+
+	return n
+}
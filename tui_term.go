@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ttyTerminal draws a tuiBuffer on a real terminal using ANSI
+// escape codes. The terminal is put into raw mode with stty.
+//
+// TODO: Implement on Windows
+type ttyTerminal struct {
+	tty   *os.File
+	out   io.Writer
+	saved string
+}
+
+func newTTYTerminal(tty *os.File, out io.Writer) (*ttyTerminal, error) {
+
+	saved, err := stty(tty, "-g")
+	if err != nil {
+		return nil, errors.New("Could not read terminal settings: " + err.Error())
+	}
+
+	if _, err := stty(tty, "raw", "-echo"); err != nil {
+		return nil, errors.New("Could not set terminal mode: " + err.Error())
+	}
+
+	t := &ttyTerminal{
+		tty:   tty,
+		out:   out,
+		saved: strings.TrimSpace(saved),
+	}
+
+	// Switch to the alternate screen and hide the cursor.
+	fmt.Fprint(t.out, "\x1b[?1049h\x1b[?25l")
+
+	return t, nil
+}
+
+func (t *ttyTerminal) Close() error {
+
+	// Show the cursor and restore the main screen.
+	fmt.Fprint(t.out, "\x1b[?25h\x1b[?1049l")
+
+	_, err := stty(t.tty, t.saved)
+	return err
+}
+
+func (t *ttyTerminal) Size() (int, int, error) {
+
+	s, err := stty(t.tty, "size")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var rows, cols int
+	if _, err := fmt.Sscan(s, &rows, &cols); err != nil {
+		return 0, 0, errors.New("Could not read terminal size: " + err.Error())
+	}
+
+	return cols, rows, nil
+}
+
+func (t *ttyTerminal) Draw(buf *tuiBuffer) error {
+
+	var b bytes.Buffer
+	var attr tuiAttr
+
+	b.WriteString("\x1b[H\x1b[0m")
+
+	for y := 0; y < buf.Height; y++ {
+
+		fmt.Fprintf(&b, "\x1b[%d;1H", y+1)
+
+		for x := 0; x < buf.Width; x++ {
+
+			c := buf.Cell(x, y)
+
+			if c.Attr != attr {
+				b.WriteString(ansiAttr(c.Attr))
+				attr = c.Attr
+			}
+
+			b.WriteRune(c.Ch)
+		}
+	}
+
+	b.WriteString("\x1b[0m")
+
+	_, err := t.out.Write(b.Bytes())
+	return err
+}
+
+func ansiAttr(attr tuiAttr) string {
+
+	s := "\x1b[0"
+
+	if attr&attrBold != 0 {
+		s += ";1"
+	}
+
+	if attr&attrReverse != 0 {
+		s += ";7"
+	}
+
+	return s + "m"
+}
+
+func stty(tty *os.File, args ...string) (string, error) {
+
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = tty
+
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// readKeys decodes key presses from r and sends them on the
+// returned channel, which is closed when r returns an error.
+func readKeys(r io.Reader) <-chan tuiKey {
+
+	keys := make(chan tuiKey)
+
+	go func() {
+		defer close(keys)
+
+		br := bufio.NewReader(r)
+		for {
+			k, err := readKey(br)
+			if err != nil {
+				return
+			}
+			if k.Code != keyNone {
+				keys <- k
+			}
+		}
+	}()
+
+	return keys
+}
+
+func readKey(r *bufio.Reader) (tuiKey, error) {
+
+	c, _, err := r.ReadRune()
+	if err != nil {
+		return tuiKey{}, err
+	}
+
+	switch c {
+	case '\r', '\n':
+		return tuiKey{Code: keyEnter}, nil
+	case '\t':
+		return tuiKey{Code: keyTab}, nil
+	case 8, 127:
+		return tuiKey{Code: keyBackspace}, nil
+	case 3:
+		return tuiKey{Code: keyCtrlC}, nil
+	case 27:
+		return readEscapeSequence(r)
+	}
+
+	if c < ' ' {
+		return tuiKey{}, nil
+	}
+
+	return tuiKey{Code: keyRune, Rune: c}, nil
+}
+
+// readEscapeSequence decodes the ANSI escape sequences sent
+// by the arrow and navigation keys. A lone Esc (i.e. one that
+// isn't immediately followed by more input) is the Esc key.
+func readEscapeSequence(r *bufio.Reader) (tuiKey, error) {
+
+	if r.Buffered() == 0 {
+		return tuiKey{Code: keyEsc}, nil
+	}
+
+	c, err := r.ReadByte()
+	if err != nil {
+		return tuiKey{}, err
+	}
+
+	if c != '[' && c != 'O' {
+		r.UnreadByte()
+		return tuiKey{Code: keyEsc}, nil
+	}
+
+	var params []byte
+
+	for {
+		c, err = r.ReadByte()
+		if err != nil {
+			return tuiKey{}, err
+		}
+		if c < '0' || c > '9' {
+			break
+		}
+		params = append(params, c)
+	}
+
+	switch c {
+	case 'A':
+		return tuiKey{Code: keyUp}, nil
+	case 'B':
+		return tuiKey{Code: keyDown}, nil
+	case 'C':
+		return tuiKey{Code: keyRight}, nil
+	case 'D':
+		return tuiKey{Code: keyLeft}, nil
+	case 'H':
+		return tuiKey{Code: keyHome}, nil
+	case 'F':
+		return tuiKey{Code: keyEnd}, nil
+	case '~':
+		switch string(params) {
+		case "1", "7":
+			return tuiKey{Code: keyHome}, nil
+		case "4", "8":
+			return tuiKey{Code: keyEnd}, nil
+		case "5":
+			return tuiKey{Code: keyPageUp}, nil
+		case "6":
+			return tuiKey{Code: keyPageDown}, nil
+		}
+	}
+
+	return tuiKey{}, nil
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTUIBuffer(t *testing.T) {
+
+	buf := newTUIBuffer(10, 3)
+
+	if x := buf.Text(2, 0, "Hello", attrBold); x != 7 {
+		t.Errorf("Expected Text to return 7, got %d", x)
+	}
+
+	if x := buf.Text(6, 1, "Overflow", 0); x != 10 {
+		t.Errorf("Expected Text to return 10, got %d", x)
+	}
+
+	buf.Text(0, 5, "Off screen", 0)
+
+	if exp := "  Hello\n      Over\n"; buf.String() != exp {
+		t.Errorf("Expected buffer %q, got %q", exp, buf.String())
+	}
+
+	if c := buf.Cell(2, 0); c.Ch != 'H' || c.Attr != attrBold {
+		t.Errorf("Expected bold H at (2, 0), got %q (%d)", c.Ch, c.Attr)
+	}
+
+	data := []struct {
+		In  string
+		N   int
+		Exp string
+	}{
+		{"Hello", 10, "Hello"},
+		{"Hello", 5, "Hello"},
+		{"Hello", 4, "Hel…"},
+		{"Héllo", 3, "Hé…"},
+		{"Hello", 0, ""},
+	}
+
+	for _, test := range data {
+		if got := truncate(test.In, test.N); got != test.Exp {
+			t.Errorf("truncate(%q, %d): expected %q, got %q", test.In, test.N, test.Exp, got)
+		}
+	}
+}
+
+func TestReadKey(t *testing.T) {
+
+	data := []struct {
+		Input string
+		Keys  []tuiKey
+	}{
+		{"jk", []tuiKey{{keyRune, 'j'}, {keyRune, 'k'}}},
+		{"é/", []tuiKey{{keyRune, 'é'}, {keyRune, '/'}}},
+		{"\r\t\x7f\x03", []tuiKey{{Code: keyEnter}, {Code: keyTab}, {Code: keyBackspace}, {Code: keyCtrlC}}},
+		{"\x1b[A\x1b[B\x1b[C\x1b[D", []tuiKey{{Code: keyUp}, {Code: keyDown}, {Code: keyRight}, {Code: keyLeft}}},
+		{"\x1bOA\x1b[H\x1b[F", []tuiKey{{Code: keyUp}, {Code: keyHome}, {Code: keyEnd}}},
+		{"\x1b[5~\x1b[6~\x1b[1~\x1b[4~", []tuiKey{{Code: keyPageUp}, {Code: keyPageDown}, {Code: keyHome}, {Code: keyEnd}}},
+		{"\x1b[3~x", []tuiKey{{}, {keyRune, 'x'}}},
+		{"\x1b", []tuiKey{{Code: keyEsc}}},
+		{"\x1bq", []tuiKey{{Code: keyEsc}, {keyRune, 'q'}}},
+		{"\x01", []tuiKey{{}}},
+	}
+
+	for _, test := range data {
+
+		r := bufio.NewReader(strings.NewReader(test.Input))
+
+		for i, exp := range test.Keys {
+			got, err := readKey(r)
+			if err != nil {
+				t.Errorf("%q: key %d: readKey returned error %q", test.Input, i, err)
+				break
+			}
+			if got != exp {
+				t.Errorf("%q: key %d: expected %v, got %v", test.Input, i, exp, got)
+			}
+		}
+
+		if _, err := readKey(r); err != io.EOF {
+			t.Errorf("%q: expected EOF, got %v", test.Input, err)
+		}
+	}
+}
+
+func TestTUI(t *testing.T) {
+	testWithInitDB(t, testTUI)
+}
+
+func testTUI(t *testing.T, db *sql.DB) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	names := []string{"Serial", "S-Town"}
+	feeds := map[string]*syncResult{}
+
+	for _, name := range names {
+		res, err := addFeed(db, nil, serverURL(ts, allTestCases[name].Filename))
+		if err != nil {
+			t.Fatalf("%s: addFeed returned error %q", name, err)
+		}
+		feeds[res.Title] = res
+	}
+
+	titles := make([]string, 0, len(feeds))
+	for title := range feeds {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+
+	first := feeds[titles[0]]
+	expItems := allTestCases["Serial"].NewFeed().Items
+	if first.Title != allTestCases["Serial"].NewFeed().Title {
+		expItems = allTestCases["S-Town"].NewFeed().Items
+	}
+
+	backend := &fakeBackend{}
+
+	app := newTUIApp(db, nil, backend.Start)
+	app.now = func() time.Time {
+		return time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	if err := app.reload(); err != nil {
+		t.Fatalf("reload returned error %q", err)
+	}
+
+	screen := drawTUI(app, 100, 20)
+
+	for i, exp := range []string{"All feeds", titles[0], titles[1]} {
+		if line := screen.Line(i + 2); !strings.HasPrefix(line, exp) {
+			t.Errorf("Expected line %d to start with %q, got %q", i+2, exp, line)
+		}
+	}
+
+	if got := screen.Cell(0, 2).Attr; got != attrReverse {
+		t.Errorf("Expected selected feed to be highlighted, got attributes %d", got)
+	}
+
+	if !strings.Contains(screen.Line(1), "All items") {
+		t.Errorf("Expected items heading \"All items\", got %q", screen.Line(1))
+	}
+
+	// Select the first feed and switch to the items pane.
+
+	sendKeys(app, tuiKey{Code: keyDown}, tuiKey{Code: keyEnter})
+
+	if app.focus != paneItems || app.selectedFeed() == nil || app.selectedFeed().ID != first.ID {
+		t.Fatalf("Expected items pane for feed %q to be focused", first.Title)
+	}
+
+	if len(app.items) != len(expItems) {
+		t.Fatalf("Expected %d items, got %d", len(expItems), len(app.items))
+	}
+
+	screen = drawTUI(app, 100, 20)
+	itemsX := 100/3 + 1
+
+	if line := screen.Line(2); !strings.Contains(line, "  "+prefix(expItems[0].Title, 10)) {
+		t.Errorf("Expected first item %q on line 2, got %q", expItems[0].Title, line)
+	}
+
+	// Mark an item as unplayed.
+
+	sendKeys(app, tuiKey{Code: keyDown}, tuiKey{keyRune, 'm'})
+	verifyUnplayedItemCount(t, db, first.ID, 1)
+
+	screen = drawTUI(app, 100, 20)
+
+	if c := screen.Cell(itemsX, 3); c.Ch != '*' || c.Attr != attrReverse {
+		t.Errorf("Expected highlighted unplayed marker on line 3, got %q (%d)", c.Ch, c.Attr)
+	}
+
+	if line := region(screen, 0, 3, itemsX-1); !strings.HasSuffix(line, " 1") {
+		t.Errorf("Expected feed unplayed count on line 3, got %q", line)
+	}
+
+	// Show unplayed items only.
+
+	sendKeys(app, tuiKey{keyRune, 'u'})
+
+	if len(app.items) != 1 || app.items[0].Title != expItems[1].Title {
+		t.Errorf("Expected 1 unplayed item %q, got %d items", expItems[1].Title, len(app.items))
+	}
+
+	sendKeys(app, tuiKey{keyRune, 'm'}, tuiKey{keyRune, 'u'})
+	verifyUnplayedItemCount(t, db, first.ID, 0)
+
+	// Search.
+
+	query := expItems[2].Title
+	keys := []tuiKey{{keyRune, '/'}, {keyRune, 'x'}, {Code: keyBackspace}}
+	for _, c := range query {
+		keys = append(keys, tuiKey{keyRune, c})
+	}
+
+	sendKeys(app, keys...)
+
+	if screen = drawTUI(app, 100, 20); screen.Line(19) != truncate("/"+query+"_", 100) {
+		t.Errorf("Expected search prompt, got %q", screen.Line(19))
+	}
+
+	sendKeys(app, tuiKey{Code: keyEnter})
+
+	if len(app.items) < 1 || app.items[0].Title != query {
+		t.Errorf("Expected search results for %q, got %d items", query, len(app.items))
+	}
+
+	if screen = drawTUI(app, 100, 20); !strings.Contains(screen.Line(1), "matching") {
+		t.Errorf("Expected search heading, got %q", screen.Line(1))
+	}
+
+	sendKeys(app, tuiKey{Code: keyEsc})
+
+	if len(app.items) != len(expItems) {
+		t.Errorf("Expected search to be cleared, got %d items", len(app.items))
+	}
+
+	// Queue and play items.
+
+	sendKeys(app, tuiKey{Code: keyHome}, tuiKey{keyRune, 'a'}, tuiKey{keyRune, 'j'}, tuiKey{keyRune, 'a'}, tuiKey{keyRune, 'j'}, tuiKey{keyRune, 'a'}, tuiKey{keyRune, 'a'})
+
+	if len(app.queue) != 2 {
+		t.Fatalf("Expected 2 queued items, got %d", len(app.queue))
+	}
+
+	if screen = drawTUI(app, 100, 20); !strings.Contains(screen.Line(18), "2 queued") {
+		t.Errorf("Expected queue status, got %q", screen.Line(18))
+	}
+
+	if c := screen.Cell(itemsX, 2); c.Ch != '+' {
+		t.Errorf("Expected queued marker on line 2, got %q", c.Ch)
+	}
+
+	sendKeys(app, tuiKey{keyRune, 'p'})
+	backend.Last().Finish(nil)
+	waitForEvents(t, app, 1)
+	backend.Last().Finish(nil)
+	waitForEvents(t, app, 1)
+
+	var played []string
+	for _, p := range backend.Players() {
+		played = append(played, p.URL)
+	}
+
+	verifyStrings(t, "played", played, []string{expItems[0].URL, expItems[1].URL})
+
+	if app.playing != nil || len(app.queue) != 0 {
+		t.Errorf("Expected playback to finish")
+	}
+
+	// Newly played items are marked as played.
+
+	sendKeys(app, tuiKey{Code: keyHome}, tuiKey{keyRune, 'm'})
+	verifyUnplayedItemCount(t, db, first.ID, 1)
+
+	sendKeys(app, tuiKey{Code: keyEnter})
+
+	if screen = drawTUI(app, 100, 20); !strings.Contains(screen.Line(18), "Playing: "+prefix(expItems[0].Title, 20)) {
+		t.Errorf("Expected playing status, got %q", screen.Line(18))
+	}
+
+	if c := screen.Cell(itemsX, 2); c.Ch != '>' {
+		t.Errorf("Expected playing marker on line 2, got %q", c.Ch)
+	}
+
+	// Control the player.
+
+	sendKeys(app, tuiKey{keyRune, ' '}, tuiKey{keyRune, '.'}, tuiKey{keyRune, '.'}, tuiKey{keyRune, ','}, tuiKey{keyRune, ']'}, tuiKey{keyRune, ']'}, tuiKey{keyRune, '['})
+
+	fake := backend.Last()
+	verifyStrings(t, "commands", fake.Commands(), []string{"pause true", "seek 30s", "seek 1m0s", "seek 30s", "speed 1.25", "speed 1.5", "speed 1.25"})
+
+	if status := app.statusLine(); !strings.HasSuffix(status, " 1.25x (paused)") {
+		t.Errorf("Expected speed and paused in status, got %q", status)
+	}
+
+	sendKeys(app, tuiKey{keyRune, 'x'})
+	waitForEvents(t, app, 1)
+
+	if pos, _ := loadItemPosition(db, itemIDByURL(t, db, expItems[0].URL)); pos != 30 {
+		t.Errorf("Expected saved position 30, got %d", pos)
+	}
+
+	if !strings.HasPrefix(app.status, "Stopped") {
+		t.Errorf("Expected stopped status, got %q", app.status)
+	}
+
+	verifyUnplayedItemCount(t, db, first.ID, 1)
+
+	// Sync in the background.
+
+	sendKeys(app, tuiKey{keyRune, 's'})
+
+	if screen = drawTUI(app, 100, 20); !strings.HasSuffix(screen.Line(0), "Syncing...") {
+		t.Errorf("Expected sync indicator, got %q", screen.Line(0))
+	}
+
+	waitForEvents(t, app, 1)
+
+	if app.syncing || app.status != "Synced: 0 new items" {
+		t.Errorf("Expected sync to finish, got status %q", app.status)
+	}
+
+	sendKeys(app, tuiKey{keyRune, 'q'})
+
+	if !app.quit {
+		t.Errorf("Expected q to quit")
+	}
+}
+
+func TestTUINoPlayer(t *testing.T) {
+	testWithInitDB(t, testTUINoPlayer)
+}
+
+func testTUINoPlayer(t *testing.T, db *sql.DB) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	if _, err := addFeed(db, nil, serverURL(ts, allTestCases["Serial"].Filename)); err != nil {
+		t.Fatalf("addFeed returned error %q", err)
+	}
+
+	app := newTUIApp(db, nil, nil)
+	if err := app.reload(); err != nil {
+		t.Fatalf("reload returned error %q", err)
+	}
+
+	sendKeys(app, tuiKey{Code: keyTab}, tuiKey{keyRune, 'p'})
+
+	if app.playing != nil || !strings.HasPrefix(app.status, "No player") {
+		t.Errorf("Expected no player status, got %q", app.status)
+	}
+
+	if screen := drawTUI(app, 20, 5); screen.Line(0) != "Terminal too small" {
+		t.Errorf("Expected small terminal warning, got %q", screen.Line(0))
+	}
+}
+
+type fakeTerminal struct {
+	Width  int
+	Height int
+	Frames []*tuiBuffer
+}
+
+func (t *fakeTerminal) Size() (int, int, error) {
+	return t.Width, t.Height, nil
+}
+
+func (t *fakeTerminal) Draw(buf *tuiBuffer) error {
+	t.Frames = append(t.Frames, buf)
+	return nil
+}
+
+func TestTUIRun(t *testing.T) {
+	testWithInitDB(t, testTUIRun)
+}
+
+func testTUIRun(t *testing.T, db *sql.DB) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	res, err := addFeed(db, nil, serverURL(ts, allTestCases["Serial"].Filename))
+	if err != nil {
+		t.Fatalf("addFeed returned error %q", err)
+	}
+
+	term := &fakeTerminal{Width: 80, Height: 10}
+	keys := readKeys(strings.NewReader("\x1b[B\tm"))
+
+	if err := newTUIApp(db, nil, nil).Run(term, keys); err != nil {
+		t.Fatalf("Run returned error %q", err)
+	}
+
+	if len(term.Frames) != 4 {
+		t.Fatalf("Expected 4 frames, got %d", len(term.Frames))
+	}
+
+	verifyUnplayedItemCount(t, db, res.ID, 1)
+
+	last := term.Frames[len(term.Frames)-1]
+	if !strings.HasPrefix(last.Line(3), res.Title) {
+		t.Errorf("Expected feed %q on line 3, got %q", res.Title, last.Line(3))
+	}
+}
+
+func drawTUI(app *tuiApp, width, height int) *tuiBuffer {
+	buf := newTUIBuffer(width, height)
+	app.draw(buf)
+	return buf
+}
+
+// region returns the text in row y between x and x+width,
+// minus any trailing spaces.
+func region(buf *tuiBuffer, x, y, width int) string {
+	return strings.TrimRight(string([]rune(buf.Line(y) + strings.Repeat(" ", buf.Width))[x:x+width]), " ")
+}
+
+func prefix(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
+
+func sendKeys(app *tuiApp, keys ...tuiKey) {
+	for _, k := range keys {
+		app.handleKey(k)
+	}
+}
+
+// waitForEvents runs the next n background events.
+func waitForEvents(t *testing.T, app *tuiApp, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case fn := <-app.events:
+			fn()
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for event %d of %d", i+1, n)
+		}
+	}
+}
+
+func verifyStrings(t *testing.T, name string, got, exp []string) {
+
+	if len(got) != len(exp) {
+		t.Errorf("Expected %d %s, got %d: %v", len(exp), name, len(got), got)
+		return
+	}
+
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Errorf("Expected %s %d to be %q, got %q", name, i, exp[i], got[i])
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// validation is the result of checking a feed for problems.
+type validation struct {
+	URL      string
+	Title    string
+	Items    int
+	Problems []string
+}
+
+// validateFeed fetches and parses the feed at feedURL and
+// checks it for problems that stop items from being added,
+// or that cause items to be added with missing information.
+// An error is only returned if the feed can't be fetched or
+// parsed at all.
+func validateFeed(feedURL string) (*validation, error) {
+
+	f, finalURL, err := fetchGoFeed(feedURL)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &validation{
+		URL:   feedURL,
+		Title: f.Title,
+		Items: len(f.Items),
+	}
+
+	var problems feedWarnings
+
+	if finalURL != feedURL {
+		problems = append(problems, "feed URL redirects to "+finalURL)
+	}
+
+	if f.ITunesExt != nil {
+		if u := f.ITunesExt.NewFeedURL; u != "" && u != feedURL && u != finalURL {
+			problems = append(problems, "feed has moved to "+u+" (itunes:new-feed-url)")
+		}
+	}
+
+	if f.Title == "" {
+		problems = append(problems, "feed has no title")
+	}
+
+	if len(f.Items) == 0 {
+		problems = append(problems, "feed has no items")
+	}
+
+	guids := map[string]int{}
+	for _, item := range f.Items {
+		if item.GUID != "" {
+			guids[item.GUID]++
+		}
+	}
+
+	for _, item := range f.Items {
+
+		// Start with the problems that feed translation
+		// reports, i.e. the ones users see as warnings.
+		translateItem(item, &problems)
+
+		if n := guids[item.GUID]; n > 1 {
+			problems.add(item, "GUID %q is used by %d items", item.GUID, n)
+			// Only report each duplicate once.
+			delete(guids, item.GUID)
+		}
+
+		validateItem(item, &problems)
+	}
+
+	v.Problems = problems
+
+	return v, nil
+}
+
+// validateItem adds the problems with an item that feed
+// translation doesn't catch (because they don't affect the
+// item that gets added).
+func validateItem(item *gofeed.Item, problems *feedWarnings) {
+
+	if item.GUID == "" {
+		problems.add(item, "no GUID")
+	}
+
+	// Kibner can read some dates that other apps can't.
+	if item.PublishedParsed == nil && item.Published != "" {
+		if _, err := parsePubdate(item.Published); err == nil {
+			problems.add(item, "non-standard release date %q", item.Published)
+		}
+	}
+
+	if len(item.Enclosures) == 0 {
+		return
+	}
+
+	enc := item.Enclosures[0]
+
+	if n, err := strconv.ParseInt(enc.Length, 10, 64); enc.Length == "" || (err == nil && n <= 0) {
+		problems.add(item, "no file size (enclosure length is %q)", enc.Length)
+	}
+
+	if strings.HasPrefix(strings.ToLower(enc.URL), "http://") {
+		problems.add(item, "download URL uses HTTP rather than HTTPS")
+	}
+}
+
+func printValidation(w io.Writer, v *validation) {
+
+	fmt.Fprintf(w, "%s (%s)\n", v.Title, v.URL)
+
+	for _, problem := range v.Problems {
+		fmt.Fprintln(w, "  "+problem)
+	}
+
+	fmt.Fprintf(w, "%d items, ", v.Items)
+
+	switch n := len(v.Problems); n {
+	case 0:
+		fmt.Fprintln(w, "no problems found")
+	case 1:
+		fmt.Fprintln(w, "1 problem found")
+	default:
+		fmt.Fprintf(w, "%d problems found\n", n)
+	}
+}
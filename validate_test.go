@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestValidateFeed(t *testing.T) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	tests := []struct {
+		Filename string
+		Title    string
+		Items    int
+		Problems []string
+	}{
+		{
+			Filename: allTestCases["Columbo"].Filename,
+			Title:    "Columbo",
+			Items:    10,
+			Problems: []string{
+				`"Lady in Waiting": no GUID`,
+				`"Suitable for Framing": non-standard release date "17th Nov 1971 20:30:00 -0500"`,
+				`"Dead Weight": no release date`,
+				`"Death Lends a Hand": invalid file size "xxx"`,
+				`"Murder by the Book": no file size (enclosure length is "")`,
+				`"Ransom for a Dead Man": invalid duration "xxx"`,
+			},
+		},
+		{
+			Filename: allTestCases["Why We Eat"].Filename,
+			Title:    "Why We Eat What We Eat",
+			Items:    2,
+			Problems: []string{
+				`"The Search for Big Kale": skipped (no download URL)`,
+				`"Introducing: Why We Eat What We Eat": skipped (no download URL)`,
+			},
+		},
+		{
+			Filename: allTestCases["Minimal Feed"].Filename,
+			Title:    "Minimal Feed",
+			Items:    2,
+			Problems: []string{
+				`"http://deepilla.com/assets/mp3/minimal-2.mp3": no GUID`,
+				`"http://deepilla.com/assets/mp3/minimal-2.mp3": no file size (enclosure length is "0")`,
+				`"http://deepilla.com/assets/mp3/minimal-2.mp3": download URL uses HTTP rather than HTTPS`,
+				`"http://deepilla.com/assets/mp3/minimal-1.mp3": no release date`,
+				`"http://deepilla.com/assets/mp3/minimal-1.mp3": no GUID`,
+				`"http://deepilla.com/assets/mp3/minimal-1.mp3": no file size (enclosure length is "0")`,
+				`"http://deepilla.com/assets/mp3/minimal-1.mp3": download URL uses HTTP rather than HTTPS`,
+			},
+		},
+		{
+			Filename: "errors/duplicate-guid.xml",
+			Title:    "Rework",
+			Items:    5,
+			Problems: []string{
+				`"03 - Pick A Fight (on Twitter)": download URL uses HTTP rather than HTTPS`,
+				`"02 - Workaholics Aren't Heroes": download URL uses HTTP rather than HTTPS`,
+				`"01 - Sell Your By-products": download URL uses HTTP rather than HTTPS`,
+				`"Rework Teaser": GUID "gid://art19-episode-locator/V0/FP72lI08fQa5uymp3rxmu_gTBY3uDNX2zCjMFebpzZc" is used by 2 items`,
+				`"Rework Teaser": download URL uses HTTP rather than HTTPS`,
+				`"Rework Teaser": download URL uses HTTP rather than HTTPS`,
+			},
+		},
+		{
+			Filename: allTestCases["Empty Feed"].Filename,
+			Title:    "Empty Feed",
+			Problems: []string{"feed has no items"},
+		},
+		{
+			Filename: allTestCases["Uncivil"].Filename,
+			Title:    "Uncivil",
+			Items:    3,
+		},
+	}
+
+	for _, test := range tests {
+
+		url := serverURL(ts, test.Filename)
+
+		v, err := validateFeed(url)
+		if err != nil {
+			t.Fatalf("%s: validateFeed returned error %q", test.Filename, err)
+		}
+
+		exp := &validation{
+			URL:      url,
+			Title:    test.Title,
+			Items:    test.Items,
+			Problems: test.Problems,
+		}
+
+		if !reflect.DeepEqual(v, exp) {
+			t.Errorf("%s: expected validateFeed to return %#v, got %#v", test.Filename, exp, v)
+		}
+	}
+}
+
+func TestValidateFeedRedirect(t *testing.T) {
+
+	ts := newFileServer()
+	defer ts.Close()
+
+	target := serverURL(ts, allTestCases["Uncivil"].Filename)
+
+	redirect := httptest.NewServer(http.RedirectHandler(target, http.StatusMovedPermanently))
+	defer redirect.Close()
+
+	v, err := validateFeed(redirect.URL)
+	if err != nil {
+		t.Fatalf("validateFeed returned error %q", err)
+	}
+
+	exp := []string{"feed URL redirects to " + target}
+
+	if !reflect.DeepEqual(v.Problems, exp) {
+		t.Errorf("expected validateFeed to return problems %q, got %q", exp, v.Problems)
+	}
+
+	var buf bytes.Buffer
+	printValidation(&buf, v)
+
+	expOutput := "Uncivil (" + redirect.URL + ")\n  feed URL redirects to " + target + "\n3 items, 1 problem found\n"
+
+	if got := buf.String(); got != expOutput {
+		t.Errorf("expected printValidation to output %q, got %q", expOutput, got)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vlcBackend plays URLs with VLC, which is controlled over its
+// remote control (RC) interface on a Unix socket.
+func vlcBackend(program string, env *Env) playerBackend {
+	return func(item *commandData) (player, error) {
+
+		dir, err := ioutil.TempDir("", "kibner-vlc")
+		if err != nil {
+			return nil, err
+		}
+
+		sock := filepath.Join(dir, "vlc.sock")
+
+		args := []string{"--extraintf=oldrc", "--rc-unix=" + sock, "--play-and-exit"}
+		if item.Position > 0 {
+			args = append(args, fmt.Sprintf("--start-time=%d", item.Position))
+		}
+		if env == nil {
+			args = append(args, "--intf=dummy")
+		}
+		args = append(args, item.URL)
+
+		cmd, err := parseCommand(program, item, args...)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+
+		proc, err := startProcess(cmd, env, func() {
+			os.RemoveAll(dir)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := dialPlayer("unix", sock, proc.Done())
+		if err != nil {
+			proc.Kill()
+			<-proc.Done()
+			return nil, errors.New("Could not connect to VLC: " + err.Error())
+		}
+
+		return &vlcPlayer{
+			process: proc,
+			client:  newVLCClient(conn),
+		}, nil
+	}
+}
+
+type vlcPlayer struct {
+	*process
+	client *vlcClient
+}
+
+// Pause pauses or resumes playback. VLC's pause command is a
+// toggle so we have to check the current state first.
+func (p *vlcPlayer) Pause(paused bool) error {
+
+	playing, err := p.client.Int("is_playing")
+	if err != nil {
+		return err
+	}
+
+	if (playing == 1) != paused {
+		return nil
+	}
+
+	return p.client.Send("pause")
+}
+
+func (p *vlcPlayer) Seek(pos time.Duration) error {
+	return p.client.Send(fmt.Sprintf("seek %d", pos/time.Second))
+}
+
+func (p *vlcPlayer) SetSpeed(speed float64) error {
+	return p.client.Send("rate " + strconv.FormatFloat(speed, 'f', -1, 64))
+}
+
+func (p *vlcPlayer) Position() (time.Duration, error) {
+	return p.client.Seconds("get_time")
+}
+
+func (p *vlcPlayer) Duration() (time.Duration, error) {
+	return p.client.Seconds("get_length")
+}
+
+func (p *vlcPlayer) Stop() error {
+
+	if err := p.client.Send("shutdown"); err != nil {
+		return p.Kill()
+	}
+
+	return nil
+}
+
+// vlcClient sends commands to VLC's RC interface. Commands are
+// plain text, one per line. Responses are free-form and not
+// every command has one, so output from earlier commands can
+// still be waiting when a query is sent. Queries are wrapped in
+// markers to pick out their own response. It's safe for
+// concurrent use.
+type vlcClient struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	seq  int
+}
+
+func newVLCClient(conn net.Conn) *vlcClient {
+	return &vlcClient{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+}
+
+func (c *vlcClient) Send(command string) error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.send(command)
+}
+
+func (c *vlcClient) send(command string) error {
+
+	c.conn.SetWriteDeadline(time.Now().Add(defaults.Timeout))
+
+	if _, err := c.conn.Write([]byte(command + "\n")); err != nil {
+		return errors.New("vlc: " + err.Error())
+	}
+
+	return nil
+}
+
+// Int runs a command that returns an integer. The command is
+// sent between two made-up commands, which VLC answers with an
+// "Unknown command" error that includes the name. Anything read
+// before the first marker is left over from earlier commands
+// (or queries that timed out) and is discarded. The response is
+// the last number before the second marker.
+func (c *vlcClient) Int(command string) (int64, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	begin := "kibner-" + strconv.Itoa(c.seq) + "-begin"
+	end := "kibner-" + strconv.Itoa(c.seq) + "-end"
+
+	if err := c.send(begin + "\n" + command + "\n" + end); err != nil {
+		return 0, err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(defaults.Timeout))
+
+	var n int64
+	var started, found bool
+
+	for {
+
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return 0, errors.New("vlc: " + err.Error())
+		}
+
+		switch {
+		case strings.Contains(line, "`"+begin+"'"):
+			started = true
+		case strings.Contains(line, "`"+end+"'"):
+			if !found {
+				return 0, errors.New("vlc: no response to " + command)
+			}
+			return n, nil
+		case started:
+			// Strip any prompts.
+			line = strings.TrimSpace(strings.TrimLeft(line, "> "))
+			if i, err := strconv.ParseInt(line, 10, 64); err == nil {
+				n, found = i, true
+			}
+		}
+	}
+}
+
+// Seconds runs a command that returns a number of seconds.
+func (c *vlcClient) Seconds(command string) (time.Duration, error) {
+
+	secs, err := c.Int(command)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(secs) * time.Second, nil
+}